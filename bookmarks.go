@@ -0,0 +1,60 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains support for bookmarks stored in PEP, XEP-0402.
+
+import (
+	"encoding/xml"
+)
+
+const NsBookmarks = "urn:xmpp:bookmarks:1"
+
+// A chat room the user wants to remember. Each bookmark is a separate
+// item of the user's bookmarks node, whose id is the room's JID.
+type Bookmark struct {
+	XMLName xml.Name `xml:"urn:xmpp:bookmarks:1 conference"`
+	// The room's JID.
+	Jid      string `xml:"-"`
+	Name     string `xml:"name,attr,omitempty"`
+	Autojoin bool   `xml:"autojoin,attr,omitempty"`
+	Nick     string `xml:"nick,omitempty"`
+	Password string `xml:"password,omitempty"`
+}
+
+// GetBookmarks fetches the user's bookmarks.
+func (cl *Client) GetBookmarks() ([]Bookmark, error) {
+	items, err := cl.PubsubItems("", NsBookmarks)
+	if err != nil {
+		return nil, err
+	}
+	var bms []Bookmark
+	for _, it := range items {
+		var bm Bookmark
+		if err := it.Unmarshal(&bm); err != nil {
+			Warn.Logf("bookmark %s: %s", it.Id, err)
+			continue
+		}
+		bm.Jid = it.Id
+		bms = append(bms, bm)
+	}
+	return bms, nil
+}
+
+// AddBookmark adds b to the user's bookmarks, replacing any bookmark
+// for the same room. The others are left alone.
+func (cl *Client) AddBookmark(b Bookmark) error {
+	// The bookmarks are private, and there may be any number of
+	// them.
+	options := &Form{Type: FormSubmit}
+	options.Set("FORM_TYPE", NsPubsub+"#publish-options")
+	options.Field("FORM_TYPE").Type = FieldHidden
+	options.Set("pubsub#persist_items", "true")
+	options.Set("pubsub#max_items", "max")
+	options.Set("pubsub#send_last_published_item", "never")
+	options.Set("pubsub#access_model", "whitelist")
+	_, err := cl.pubsubPublish("", NsBookmarks, b.Jid, &b, options)
+	return err
+}
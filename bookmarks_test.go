@@ -0,0 +1,114 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestBookmarkMarshal(t *testing.T) {
+	bm := &Bookmark{Jid: "theplay@conference.shakespeare.lit",
+		Name: "The Play's the Thing", Autojoin: true, Nick: "JC"}
+	exp := `<conference xmlns="` + NsBookmarks + `" name="The Play&#39;s ` +
+		`the Thing" autojoin="true"><nick>JC</nick></conference>`
+	assertMarshal(t, exp, bm)
+
+	var back Bookmark
+	if err := xml.Unmarshal([]byte(exp), &back); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	assertEquals(t, "The Play's the Thing", back.Name)
+	assertEquals(t, "JC", back.Nick)
+	if !back.Autojoin {
+		t.Error("not autojoin")
+	}
+	// The JID is the item id, not part of the payload.
+	assertEquals(t, "", back.Jid)
+}
+
+// Answer a request for the bookmarks with the given items.
+func sendBookmarks(srv *fakeServer, items []string) {
+	iq := srv.expect("iq")
+	if !strings.Contains(iq.Innerxml, `<items node="`+NsBookmarks+`">`) {
+		srv.t.Fatalf("not a bookmarks request: %s", iq.Innerxml)
+	}
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `">` +
+		`<pubsub xmlns="` + NsPubsub + `"><items node="` + NsBookmarks +
+		`">` + strings.Join(items, "") + `</items></pubsub></iq>`)
+}
+
+func TestAddBookmark(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	type result struct {
+		bms []Bookmark
+		err error
+	}
+	results := make(chan result)
+	getBookmarks := func() {
+		bms, err := cl.GetBookmarks()
+		results <- result{bms, err}
+	}
+	items := []string{`<item id="theplay@conference.shakespeare.lit">` +
+		`<conference xmlns="` + NsBookmarks + `" name="The Play" ` +
+		`autojoin="true"><nick>JC</nick></conference></item>`}
+
+	go getBookmarks()
+	sendBookmarks(srv, items)
+	r := <-results
+	if r.err != nil || len(r.bms) != 1 {
+		t.Fatalf("GetBookmarks: %v %v", r.bms, r.err)
+	}
+	assertEquals(t, "theplay@conference.shakespeare.lit", r.bms[0].Jid)
+
+	errs := make(chan error)
+	go func() {
+		errs <- cl.AddBookmark(Bookmark{Jid: "orchard@conference.shakespeare.lit",
+			Name: "The Orchard", Nick: "Romeo"})
+	}()
+	iq := srv.expect("iq")
+	assertEquals(t, "set", iq.attr("type"))
+	var ps pubsub
+	if err := xml.Unmarshal([]byte(iq.Innerxml), &ps); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	// Only the new bookmark is published, as its own item.
+	if ps.Publish == nil || len(ps.Publish.Item) != 1 {
+		t.Fatalf("publish: %s", iq.Innerxml)
+	}
+	assertEquals(t, NsBookmarks, ps.Publish.Node)
+	assertEquals(t, "orchard@conference.shakespeare.lit", ps.Publish.Item[0].Id)
+	if ps.PublishOptions == nil || ps.PublishOptions.Form == nil {
+		t.Fatalf("no publish options: %s", iq.Innerxml)
+	}
+	assertEquals(t, "whitelist", strings.Join(ps.PublishOptions.Form.Field(
+		"pubsub#access_model").Values, ""))
+	// The server stores it alongside the existing one.
+	buf, err := xml.Marshal(ps.Publish.Item[0].Payload)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	items = append(items, `<item id="orchard@conference.shakespeare.lit">`+
+		string(buf)+`</item>`)
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `"/>`)
+	if err := <-errs; err != nil {
+		t.Fatalf("AddBookmark: %v", err)
+	}
+
+	go getBookmarks()
+	sendBookmarks(srv, items)
+	r = <-results
+	if r.err != nil || len(r.bms) != 2 {
+		t.Fatalf("GetBookmarks: %v %v", r.bms, r.err)
+	}
+	assertEquals(t, "theplay@conference.shakespeare.lit", r.bms[0].Jid)
+	assertEquals(t, "orchard@conference.shakespeare.lit", r.bms[1].Jid)
+	assertEquals(t, "Romeo", r.bms[1].Nick)
+}
@@ -0,0 +1,60 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains support for advertising entity capabilities,
+// XEP-0115.
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"sort"
+	"strings"
+)
+
+const NsCaps = "http://jabber.org/protocol/caps"
+
+// Tells contacts, in our presence, which features we support, as a
+// hash of our disco#info, so they needn't ask.
+type Caps struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/caps c"`
+	Hash    string   `xml:"hash,attr"`
+	// Identifies the app, usually by its home page.
+	Node string `xml:"node,attr"`
+	Ver  string `xml:"ver,attr"`
+}
+
+// The caps that DefaultPresence() puts in the presence it makes, if
+// not nil. See NewCaps().
+var DefaultCaps *Caps
+
+// NewCaps returns the caps for an app identified by node which
+// answers disco#info requests with info.
+func NewCaps(node string, info *DiscoInfo) *Caps {
+	return &Caps{Hash: "sha-1", Node: node, Ver: capsVer(info)}
+}
+
+// The verification string, XEP-0115 section 5.1, which is what the
+// caps hash. It doesn't cover extended info forms.
+func capsVer(info *DiscoInfo) string {
+	var ids []string
+	for _, id := range info.Identity {
+		ids = append(ids, id.Category+"/"+id.Type+"//"+id.Name)
+	}
+	sort.Strings(ids)
+	var features []string
+	for _, f := range info.Feature {
+		features = append(features, f.Var)
+	}
+	sort.Strings(features)
+	var s strings.Builder
+	for _, str := range append(ids, features...) {
+		s.WriteString(str)
+		s.WriteByte('<')
+	}
+	sum := sha1.Sum([]byte(s.String()))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,55 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCapsVer(t *testing.T) {
+	// The simple example from XEP-0115, section 5.2.
+	info := &DiscoInfo{
+		Identity: []DiscoIdentity{{Category: "client", Type: "pc",
+			Name: "Exodus 0.9.1"}},
+		Feature: []DiscoFeature{{NsDiscoInfo}, {NsDiscoItems},
+			{"http://jabber.org/protocol/muc"}, {NsCaps}}}
+	caps := NewCaps("http://code.google.com/p/exodus", info)
+	assertEquals(t, "QgayPKawpkPSDYmwT/WM94uAlu0=", caps.Ver)
+	assertMarshal(t, `<c xmlns="`+NsCaps+`" hash="sha-1" `+
+		`node="http://code.google.com/p/exodus" `+
+		`ver="QgayPKawpkPSDYmwT/WM94uAlu0="></c>`, caps)
+}
+
+func TestDefaultPresence(t *testing.T) {
+	DefaultCaps = &Caps{Hash: "sha-1", Node: "http://example.com/app",
+		Ver: "QgayPKawpkPSDYmwT/WM94uAlu0="}
+	defer func() { DefaultCaps = nil }()
+
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(sessionFeatures)
+	srv.bind()
+
+	errs := make(chan error)
+	go func() {
+		errs <- cl.StartSession(false, DefaultPresence("away",
+			"Gone fishing", 5))
+	}()
+	// Nothing's said before the session starts.
+	srv.session()
+	pr := srv.expect("presence")
+	if err := <-errs; err != nil {
+		t.Fatalf("StartSession: %v", err)
+	}
+	for _, exp := range []string{`>away</show>`,
+		`>Gone fishing</status>`, `>5</priority>`,
+		`<c xmlns="` + NsCaps + `" hash="sha-1" ` +
+			`node="http://example.com/app"`} {
+		if !strings.Contains(pr.Innerxml, exp) {
+			t.Errorf("no %s in %s", exp, pr.Innerxml)
+		}
+	}
+}
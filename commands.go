@@ -0,0 +1,155 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains a client for ad-hoc commands, XEP-0050.
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+const NsCommands = "http://jabber.org/protocol/commands"
+
+var commandsExt Extension = Extension{StanzaHandlers: map[string]func(*xml.Name) interface{}{NsCommands: newCommand},
+	Start: func(cl *Client) {}}
+
+// Command actions.
+const (
+	CommandExecute  = "execute"
+	CommandNext     = "next"
+	CommandPrev     = "prev"
+	CommandComplete = "complete"
+	CommandCancel   = "cancel"
+)
+
+// Command statuses.
+const (
+	CommandExecuting = "executing"
+	CommandCompleted = "completed"
+	CommandCanceled  = "canceled"
+)
+
+type command struct {
+	XMLName   xml.Name        `xml:"http://jabber.org/protocol/commands command"`
+	Node      string          `xml:"node,attr"`
+	SessionId string          `xml:"sessionid,attr,omitempty"`
+	Action    string          `xml:"action,attr,omitempty"`
+	Status    string          `xml:"status,attr,omitempty"`
+	Actions   *commandActions `xml:"actions"`
+	Note      []CommandNote   `xml:"note"`
+	Form      *Form
+}
+
+type commandActions struct {
+	Execute  string    `xml:"execute,attr,omitempty"`
+	Prev     *struct{} `xml:"prev"`
+	Next     *struct{} `xml:"next"`
+	Complete *struct{} `xml:"complete"`
+}
+
+// A message from the responder about the command's progress.
+type CommandNote struct {
+	// info, warn, or error.
+	Type string `xml:"type,attr,omitempty"`
+	Text string `xml:",chardata"`
+}
+
+// The outcome of one stage of an ad-hoc command.
+type CommandResult struct {
+	Node      string
+	SessionId string
+	// CommandExecuting if the responder expects another stage.
+	Status string
+	// The form to fill in for the next stage, or the command's
+	// results.
+	Form  *Form
+	Notes []CommandNote
+	// The actions the responder allows next, and the one to use if
+	// the user didn't pick one.
+	Actions       []string
+	DefaultAction string
+
+	cl *Client
+	to string
+}
+
+func newCommand(name *xml.Name) interface{} {
+	return &command{}
+}
+
+// ListCommands asks the entity at to which commands it offers.
+func (cl *Client) ListCommands(to string) ([]DiscoItem, error) {
+	return cl.DiscoItems(to, NsCommands)
+}
+
+// ExecuteCommand starts the command with the given node at to. form
+// is submitted with the request if it isn't nil. If the result's
+// Status is CommandExecuting, continue with one of its Actions.
+func (cl *Client) ExecuteCommand(to, node string, form *Form) (*CommandResult, error) {
+	return cl.command(to, &command{Node: node, Action: CommandExecute},
+		form)
+}
+
+// Next submits form and moves on to the command's next stage.
+func (r *CommandResult) Next(form *Form) (*CommandResult, error) {
+	return r.act(CommandNext, form)
+}
+
+// Prev goes back to the command's previous stage.
+func (r *CommandResult) Prev() (*CommandResult, error) {
+	return r.act(CommandPrev, nil)
+}
+
+// Complete submits form and finishes the command.
+func (r *CommandResult) Complete(form *Form) (*CommandResult, error) {
+	return r.act(CommandComplete, form)
+}
+
+// Cancel abandons the command.
+func (r *CommandResult) Cancel() error {
+	_, err := r.act(CommandCancel, nil)
+	return err
+}
+
+func (r *CommandResult) act(action string, form *Form) (*CommandResult, error) {
+	return r.cl.command(r.to, &command{Node: r.Node,
+		SessionId: r.SessionId, Action: action}, form)
+}
+
+func (cl *Client) command(to string, cmd *command, form *Form) (*CommandResult, error) {
+	if form != nil {
+		cmd.Form = form.submitted()
+	}
+	iq := &Iq{Header: Header{To: to, Type: "set", Id: cl.NextId(),
+		Nested: []interface{}{cmd}}}
+	reply, err := cl.sendIq(iq)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range reply.Nested {
+		c, ok := n.(*command)
+		if !ok {
+			continue
+		}
+		res := &CommandResult{Node: c.Node, SessionId: c.SessionId,
+			Status: c.Status, Form: c.Form, Notes: c.Note,
+			cl: cl, to: to}
+		if a := c.Actions; a != nil {
+			if a.Prev != nil {
+				res.Actions = append(res.Actions, CommandPrev)
+			}
+			if a.Next != nil {
+				res.Actions = append(res.Actions, CommandNext)
+			}
+			if a.Complete != nil {
+				res.Actions = append(res.Actions, CommandComplete)
+			}
+			res.DefaultAction = a.Execute
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("command reply has no command: %v", reply)
+}
@@ -0,0 +1,180 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+const configNode = "http://jabber.org/protocol/admin#config"
+
+func TestListCommands(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	type result struct {
+		items []DiscoItem
+		err   error
+	}
+	results := make(chan result)
+	go func() {
+		items, err := cl.ListCommands("responder@example.com")
+		results <- result{items, err}
+	}()
+	iq := srv.expect("iq")
+	assertEquals(t, "get", iq.attr("type"))
+	assertEquals(t, `<query xmlns="`+NsDiscoItems+`" node="`+
+		NsCommands+`"></query>`, iq.Innerxml)
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `">` +
+		`<query xmlns="` + NsDiscoItems + `" node="` + NsCommands + `">` +
+		`<item jid="responder@example.com" node="` + configNode +
+		`" name="Configure Service"/></query></iq>`)
+	r := <-results
+	if r.err != nil {
+		t.Fatalf("ListCommands: %v", r.err)
+	}
+	if len(r.items) != 1 {
+		t.Fatalf("items: %v", r.items)
+	}
+	assertEquals(t, configNode, r.items[0].Node)
+	assertEquals(t, "Configure Service", r.items[0].Name)
+}
+
+// Read the command the client sent.
+func expectCommand(t *testing.T, srv *fakeServer) (*fakeElement, *command) {
+	iq := srv.expect("iq")
+	assertEquals(t, "set", iq.attr("type"))
+	cmd := &command{}
+	if err := xml.Unmarshal([]byte(iq.Innerxml), cmd); err != nil {
+		t.Fatalf("command: %v", err)
+	}
+	return iq, cmd
+}
+
+func TestExecuteCommand(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	type result struct {
+		res *CommandResult
+		err error
+	}
+	results := make(chan result)
+	go func() {
+		res, err := cl.ExecuteCommand("responder@example.com",
+			configNode, nil)
+		results <- result{res, err}
+	}()
+
+	// Stage 1: the responder asks for a service.
+	iq, cmd := expectCommand(t, srv)
+	assertEquals(t, configNode, cmd.Node)
+	assertEquals(t, CommandExecute, cmd.Action)
+	if cmd.Form != nil {
+		t.Errorf("form: %v", cmd.Form)
+	}
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `">` +
+		`<command xmlns="` + NsCommands + `" node="` + configNode +
+		`" sessionid="config:20020923T213616Z-700" status="executing">` +
+		`<actions execute="next"><next/></actions>` +
+		`<x xmlns="` + NsData + `" type="form">` +
+		`<field var="service" type="list-single">` +
+		`<option><value>httpd</value></option>` +
+		`<option><value>jabberd</value></option></field></x>` +
+		`</command></iq>`)
+	r := <-results
+	if r.err != nil {
+		t.Fatalf("ExecuteCommand: %v", r.err)
+	}
+	res := r.res
+	assertEquals(t, CommandExecuting, res.Status)
+	assertEquals(t, "config:20020923T213616Z-700", res.SessionId)
+	assertEquals(t, CommandNext, strings.Join(res.Actions, ","))
+	assertEquals(t, CommandNext, res.DefaultAction)
+	if res.Form == nil || res.Form.Field("service") == nil {
+		t.Fatalf("form: %v", res.Form)
+	}
+
+	// Stage 2: we pick one, and the responder asks for its state.
+	res.Form.Set("service", "httpd")
+	go func() {
+		res, err := res.Next(res.Form)
+		results <- result{res, err}
+	}()
+	iq, cmd = expectCommand(t, srv)
+	assertEquals(t, CommandNext, cmd.Action)
+	assertEquals(t, "config:20020923T213616Z-700", cmd.SessionId)
+	if cmd.Form == nil || cmd.Form.Type != FormSubmit {
+		t.Fatalf("form: %v", cmd.Form)
+	}
+	assertEquals(t, "httpd", strings.Join(cmd.Form.Field("service").Values, ","))
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `">` +
+		`<command xmlns="` + NsCommands + `" node="` + configNode +
+		`" sessionid="config:20020923T213616Z-700" status="executing">` +
+		`<actions execute="complete"><prev/><complete/></actions>` +
+		`<x xmlns="` + NsData + `" type="form">` +
+		`<field var="state" type="list-single" label="Run State">` +
+		`<value>off</value><option><value>off</value></option>` +
+		`<option><value>on</value></option></field></x>` +
+		`</command></iq>`)
+	r = <-results
+	if r.err != nil {
+		t.Fatalf("Next: %v", r.err)
+	}
+	res = r.res
+	assertEquals(t, "prev,complete", strings.Join(res.Actions, ","))
+	assertEquals(t, CommandComplete, res.DefaultAction)
+
+	// And we finish.
+	res.Form.Set("state", "on")
+	go func() {
+		res, err := res.Complete(res.Form)
+		results <- result{res, err}
+	}()
+	iq, cmd = expectCommand(t, srv)
+	assertEquals(t, CommandComplete, cmd.Action)
+	assertEquals(t, "on", strings.Join(cmd.Form.Field("state").Values, ","))
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `">` +
+		`<command xmlns="` + NsCommands + `" node="` + configNode +
+		`" sessionid="config:20020923T213616Z-700" status="completed">` +
+		`<note type="info">Service 'httpd' has been configured.</note>` +
+		`</command></iq>`)
+	r = <-results
+	if r.err != nil {
+		t.Fatalf("Complete: %v", r.err)
+	}
+	res = r.res
+	assertEquals(t, CommandCompleted, res.Status)
+	if len(res.Notes) != 1 || len(res.Actions) != 0 {
+		t.Fatalf("result: %+v", res)
+	}
+	assertEquals(t, "Service 'httpd' has been configured.", res.Notes[0].Text)
+}
+
+func TestExecuteCommandError(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	errs := make(chan error)
+	go func() {
+		_, err := cl.ExecuteCommand("responder@example.com", "nope", nil)
+		errs <- err
+	}()
+	iq := srv.expect("iq")
+	srv.send(`<iq type="error" id="` + iq.attr("id") + `">` +
+		`<error type="cancel"><item-not-found ` +
+		`xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error></iq>`)
+	if err := <-errs; err == nil {
+		t.Error("no error")
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains support for external components, XEP-0114.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+const NsComponentAccept = "jabber:component:accept"
+
+// <handshake/>
+type handshake struct {
+	XMLName xml.Name `xml:"handshake"`
+	Digest  string   `xml:",chardata"`
+}
+
+// NewComponent connects to the server at server:port as the external
+// component jid, and authenticates with the secret the two share.
+// There's no TLS, SASL, resource binding or session: once the server
+// accepts the handshake, Client.In and Client.Out work as they do for
+// a client, except that the app must set the from of the stanzas it
+// sends. Don't call StartSession().
+func NewComponent(jid *JID, secret, server string, port int) (*Client, error) {
+	addrStr := net.JoinHostPort(server, fmt.Sprint(port))
+	dial := func() (net.Conn, error) {
+		return dialTcp(context.Background(), addrStr)
+	}
+	tcp, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	return newClientNs(tcp, dial, jid, secret, nil, NsComponentAccept)
+}
+
+// The handshake proves we know the secret without sending it.
+func handshakeDigest(streamId, secret string) string {
+	sum := sha1.Sum([]byte(streamId + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Answers the server's stream header with our credentials.
+func (cl *Client) componentHandshake(st *stream) {
+	if st.Id == "" {
+		cl.abortStream(StreamInvalidId,
+			&AuthError{Text: "server sent no stream id"})
+		return
+	}
+	cl.xmlOut <- &handshake{Digest: handshakeDigest(st.Id, cl.password)}
+}
+
+// The server accepted our handshake, so we're ready to go. A server
+// that doesn't sends a stream error instead.
+func (cl *Client) handleHandshake() {
+	if cl.ns != NsComponentAccept {
+		Warn.Log("Ignoring handshake on a client stream")
+		return
+	}
+	Info.Log("Component handshake succeeded")
+	cl.enterPhase(Authenticated)
+	cl.setJid(cl.jid())
+	cl.enterPhase(Bound)
+	cl.bindDone()
+}
+
+// Reads from r, rewriting namespace declarations of from as to.
+// Components and servers use their own namespaces for stanzas; this
+// lets the stanza types, whose elements are in jabber:client, read
+// them. It follows the markup well enough to only touch the values of
+// xmlns attributes, leaving text, comments and CDATA sections alone.
+type nsReader struct {
+	r        io.Reader
+	from, to []byte
+	// Where we are in the markup.
+	state int
+	// The name of the tag's current attribute, whether we're still
+	// reading it, and whether its = has been seen.
+	attr       []byte
+	inAttr, eq bool
+	quote      byte
+	// The attribute value so far, held back while it could still
+	// be from.
+	value   []byte
+	holding bool
+	// The bytes since "<!", to tell a comment from CDATA, and the
+	// last few bytes, to spot where one ends.
+	bang, recent []byte
+	// Rewritten and ready to be read.
+	ready []byte
+	buf   []byte
+	err   error
+}
+
+// What nsReader is in the middle of.
+const (
+	nsText = iota
+	// Just after a <.
+	nsOpen
+	// Just after <!, before we know what it starts.
+	nsBang
+	nsTag
+	nsValue
+	nsComment
+	nsCData
+	nsPI
+)
+
+const nsCDataStart = "[CDATA["
+
+func newNsReader(r io.Reader, from, to string) *nsReader {
+	return &nsReader{r: r, from: []byte(from), to: []byte(to),
+		buf: make([]byte, 4096)}
+}
+
+func (nr *nsReader) Read(p []byte) (int, error) {
+	for len(nr.ready) == 0 {
+		if nr.err != nil {
+			if !nr.holding || len(nr.value) == 0 {
+				return 0, nr.err
+			}
+			nr.ready, nr.value = nr.value, nil
+			break
+		}
+		n, err := nr.r.Read(nr.buf)
+		nr.err = err
+		nr.ready = nr.ready[:0]
+		for _, c := range nr.buf[:n] {
+			nr.scan(c)
+		}
+	}
+	n := copy(p, nr.ready)
+	nr.ready = nr.ready[n:]
+	return n, nil
+}
+
+// Takes the next byte of input, adding what's ready to nr.ready.
+func (nr *nsReader) scan(c byte) {
+	if nr.state == nsValue && nr.holding {
+		if c == nr.quote {
+			if bytes.Equal(nr.value, nr.from) {
+				nr.ready = append(nr.ready, nr.to...)
+			} else {
+				nr.ready = append(nr.ready, nr.value...)
+			}
+			nr.value = nr.value[:0]
+			nr.holding = false
+			nr.ready = append(nr.ready, c)
+			nr.state = nsTag
+			return
+		}
+		nr.value = append(nr.value, c)
+		if !bytes.HasPrefix(nr.from, nr.value) {
+			nr.ready = append(nr.ready, nr.value...)
+			nr.value = nr.value[:0]
+			nr.holding = false
+		}
+		return
+	}
+	nr.ready = append(nr.ready, c)
+	nr.recent = append(nr.recent, c)
+	if len(nr.recent) > 3 {
+		nr.recent = nr.recent[1:]
+	}
+	switch nr.state {
+	case nsText:
+		if c == '<' {
+			nr.state = nsOpen
+		}
+	case nsOpen:
+		switch c {
+		case '!':
+			nr.state = nsBang
+			nr.bang = nr.bang[:0]
+		case '?':
+			nr.state = nsPI
+		default:
+			nr.state = nsTag
+			nr.attr = nr.attr[:0]
+			nr.inAttr, nr.eq = false, false
+		}
+	case nsBang:
+		nr.bang = append(nr.bang, c)
+		switch {
+		case string(nr.bang) == "--":
+			nr.state = nsComment
+		case string(nr.bang) == nsCDataStart:
+			nr.state = nsCData
+		case !strings.HasPrefix("--", string(nr.bang)) &&
+			!strings.HasPrefix(nsCDataStart, string(nr.bang)):
+			// A declaration such as <!DOCTYPE>.
+			nr.state = nsTag
+		}
+	case nsTag:
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			nr.inAttr = false
+		case '=':
+			nr.inAttr, nr.eq = false, true
+		case '"', '\'':
+			nr.state = nsValue
+			nr.quote = c
+			nr.holding = nr.eq && (string(nr.attr) == "xmlns" ||
+				bytes.HasPrefix(nr.attr, []byte("xmlns:")))
+			nr.eq = false
+		case '>':
+			nr.state = nsText
+		default:
+			if !nr.inAttr {
+				nr.attr = nr.attr[:0]
+				nr.inAttr = true
+			}
+			nr.attr = append(nr.attr, c)
+		}
+	case nsValue:
+		if c == nr.quote {
+			nr.state = nsTag
+		}
+	case nsComment:
+		if bytes.HasSuffix(nr.recent, []byte("-->")) {
+			nr.state = nsText
+		}
+	case nsCData:
+		if bytes.HasSuffix(nr.recent, []byte("]]>")) {
+			nr.state = nsText
+		}
+	case nsPI:
+		if bytes.HasSuffix(nr.recent, []byte("?>")) {
+			nr.state = nsText
+		}
+	}
+}
+
+func (nr *nsReader) Close() error {
+	if c, ok := nr.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Writes to w, rewriting the namespace declaration from as to. Each
+// write is a whole element, which the encoder quotes with ".
+type nsWriter struct {
+	w        io.WriteCloser
+	from, to []byte
+}
+
+func newNsWriter(w io.WriteCloser, from, to string) *nsWriter {
+	return &nsWriter{w: w, from: []byte(`xmlns="` + from + `"`),
+		to: []byte(`xmlns="` + to + `"`)}
+}
+
+func (nw *nsWriter) Write(p []byte) (int, error) {
+	if _, err := nw.w.Write(bytes.Replace(p, nw.from, nw.to, -1)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (nw *nsWriter) Flush() error {
+	if fl, ok := nw.w.(flusher); ok {
+		return fl.Flush()
+	}
+	return nil
+}
+
+func (nw *nsWriter) Close() error {
+	return nw.w.Close()
+}
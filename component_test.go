@@ -0,0 +1,115 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestHandshakeDigest(t *testing.T) {
+	assertEquals(t, "b09ea9b3b7f586be8a08d0a3dd7466f110aeb136",
+		handshakeDigest("3BF96D32", "secret"))
+}
+
+func TestNsReader(t *testing.T) {
+	in := `<stream:stream xmlns="jabber:component:accept" id="a">` +
+		`<message xmlns='jabber:component:accept'>"jabber:component"</message>` +
+		// Only the declarations change, not text that quotes
+		// them, or other attributes.
+		`<message xmlns = "jabber:component:accept" id="jabber:component:accept">` +
+		`<body>The namespace is "jabber:component:accept", or ` +
+		`'jabber:component:accept'.</body>` +
+		`<!-- xmlns="jabber:component:accept" -->` +
+		`<![CDATA[<x xmlns="jabber:component:accept">]]>` +
+		`<x:y xmlns:x="jabber:component:accept"/></message>`
+	exp := `<stream:stream xmlns="jabber:client" id="a">` +
+		`<message xmlns='jabber:client'>"jabber:component"</message>` +
+		`<message xmlns = "jabber:client" id="jabber:component:accept">` +
+		`<body>The namespace is "jabber:component:accept", or ` +
+		`'jabber:component:accept'.</body>` +
+		`<!-- xmlns="jabber:component:accept" -->` +
+		`<![CDATA[<x xmlns="jabber:component:accept">]]>` +
+		`<x:y xmlns:x="jabber:client"/></message>`
+	// One byte at a time, so every declaration is split.
+	r := newNsReader(iotest.OneByteReader(strings.NewReader(in)),
+		NsComponentAccept, NsClient)
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	assertEquals(t, exp, string(out))
+}
+
+type closingBuffer struct {
+	bytes.Buffer
+}
+
+func (cb *closingBuffer) Close() error {
+	return nil
+}
+
+func TestNsWriter(t *testing.T) {
+	msg := &Message{XMLName: xml.Name{Space: NsClient, Local: "message"},
+		Header: Header{To: "juliet@example.com", Id: "m1"}}
+	msg.AddBody("", "Hello")
+	buf, err := xml.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	out := &closingBuffer{}
+	w := newNsWriter(out, NsClient, NsComponentAccept)
+	if _, err := w.Write(buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	assertEquals(t, `<message xmlns="`+NsComponentAccept+`" `+
+		`to="juliet@example.com" id="m1"><body xmlns="`+
+		NsComponentAccept+`">Hello</body></message>`, out.String())
+}
+
+func TestComponent(t *testing.T) {
+	jid := &JID{Domain: "tester.example.com"}
+	c, s := net.Pipe()
+	srv := newFakeServer(t, s)
+	cl, err := newClientNs(c, nil, jid, "secret", nil, NsComponentAccept)
+	if err != nil {
+		t.Fatalf("newClientNs: %v", err)
+	}
+	defer cl.Close()
+
+	st := srv.expect("stream")
+	assertEquals(t, NsComponentAccept, st.attr("xmlns"))
+	assertEquals(t, "tester.example.com", st.attr("to"))
+	srv.send(`<stream:stream xmlns="` + NsComponentAccept +
+		`" xmlns:stream="` + NsStream + `" from="tester.example.com" ` +
+		`id="3BF96D32">`)
+	hs := srv.expect("handshake")
+	assertEquals(t, NsComponentAccept, hs.XMLName.Space)
+	assertEquals(t, handshakeDigest("3BF96D32", "secret"), hs.Innerxml)
+	srv.send(`<handshake/>`)
+
+	// Stanzas flow both ways, in the component namespace.
+	msg := &Message{Header: Header{From: "bot@tester.example.com",
+		To: "juliet@example.com", Id: "m1"}}
+	msg.AddBody("", "Hello")
+	if err := cl.Send(msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	out := srv.expect("message")
+	assertEquals(t, NsComponentAccept, out.XMLName.Space)
+	if strings.Contains(out.Innerxml, NsClient) {
+		t.Errorf("client namespace: %s", out.Innerxml)
+	}
+
+	srv.send(`<message from="juliet@example.com" ` +
+		`to="bot@tester.example.com" id="m2"><body>Hi</body></message>`)
+	in := expectMessage(t, cl, "m2")
+	assertEquals(t, "Hi", in.GetBody())
+}
@@ -0,0 +1,50 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains support for last message correction, XEP-0308.
+
+import (
+	"encoding/xml"
+)
+
+const NsCorrect = "urn:xmpp:message-correct:0"
+
+var correctExt Extension = Extension{StanzaHandlers: map[string]func(*xml.Name) interface{}{NsCorrect: newReplace},
+	Start: func(cl *Client) {}}
+
+// Marks a message as a correction of an earlier one.
+type Replace struct {
+	XMLName xml.Name `xml:"urn:xmpp:message-correct:0 replace"`
+	// The id of the message being corrected.
+	Id string `xml:"id,attr"`
+}
+
+func newReplace(name *xml.Name) interface{} {
+	return &Replace{}
+}
+
+// CorrectMessage sends a new body for the message we sent to the
+// given JID with id originalId. msgType is the original's type, such
+// as MessageChat, or MessageGroupchat to correct what we said in a
+// room. The recipient's client may show the new body in place of the
+// old one.
+func (cl *Client) CorrectMessage(to, msgType, originalId, newBody string) error {
+	msg := &Message{Header: Header{To: to, Id: cl.NextId(), Type: msgType,
+		Nested: []interface{}{&Replace{Id: originalId}}}}
+	msg.AddBody("", newBody)
+	return cl.Send(msg)
+}
+
+// Corrects returns the id of the message this one corrects, if it's
+// a correction.
+func (m *Message) Corrects() (string, bool) {
+	for _, n := range m.Nested {
+		if r, ok := n.(*Replace); ok {
+			return r.Id, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,66 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestReplaceMarshal(t *testing.T) {
+	msg := &Message{Header: Header{To: "a@b.c", Id: "2", Type: "chat",
+		Nested: []interface{}{&Replace{Id: "1"}}},
+		Body: []*Generic{{XMLName: xml.Name{Space: NsClient,
+			Local: "body"}, Chardata: "fixed"}}}
+	exp := `<message xmlns="` + NsClient + `" to="a@b.c" id="2" ` +
+		`type="chat"><replace xmlns="` + NsCorrect + `" id="1">` +
+		`</replace><body xmlns="` + NsClient + `">fixed</body></message>`
+	assertMarshal(t, exp, msg)
+}
+
+func TestReplaceUnmarshal(t *testing.T) {
+	str := `<message xmlns="` + NsClient + `" to="a@b.c" id="2">` +
+		`<body>fixed</body>` +
+		`<replace xmlns="` + NsCorrect + `" id="1"/></message>`
+	msg := &Message{}
+	if err := xml.Unmarshal([]byte(str), msg); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	m := map[string][]func(*xml.Name) interface{}{
+		NsCorrect: {newReplace}}
+	if err := parseExtended(&msg.Header, m); err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	id, ok := msg.Corrects()
+	if !ok {
+		t.Fatalf("not a correction: %v", msg.Nested)
+	}
+	assertEquals(t, "1", id)
+
+	msg = &Message{}
+	if _, ok := msg.Corrects(); ok {
+		t.Errorf("plain message is a correction")
+	}
+}
+
+func TestCorrectMessage(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	err := cl.CorrectMessage("coven@chat.shakespeare.lit",
+		MessageGroupchat, "m1", "Double, double")
+	if err != nil {
+		t.Fatalf("CorrectMessage: %v", err)
+	}
+	msg := srv.expect("message")
+	assertEquals(t, "coven@chat.shakespeare.lit", msg.attr("to"))
+	assertEquals(t, MessageGroupchat, msg.attr("type"))
+	if !strings.Contains(msg.Innerxml, `id="m1"`) {
+		t.Errorf("no replace: %s", msg.Innerxml)
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains support for delayed delivery, XEP-0203.
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+const NsDelay = "urn:xmpp:delay"
+
+var delayExt Extension = Extension{StanzaHandlers: map[string]func(*xml.Name) interface{}{NsDelay: newDelay},
+	Start: func(cl *Client) {}}
+
+// Says when a stanza was originally sent, for stanzas which were
+// stored and delivered later, such as offline or archived messages.
+type Delay struct {
+	XMLName xml.Name  `xml:"urn:xmpp:delay delay"`
+	From    string    `xml:"from,attr,omitempty"`
+	Stamp   time.Time `xml:"stamp,attr"`
+	Reason  string    `xml:",chardata"`
+}
+
+func newDelay(name *xml.Name) interface{} {
+	return &Delay{}
+}
+
+// Delay returns the stanza's delayed delivery information, or nil if
+// it wasn't delayed.
+func (h *Header) Delay() *Delay {
+	for _, n := range h.Nested {
+		if d, ok := n.(*Delay); ok {
+			return d
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains the code that connects to a server's host,
+// trying its IPv6 and IPv4 addresses side by side as RFC 8305
+// describes, so an unreachable address doesn't hold us up.
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// How long to wait for one address to answer before also trying the
+// next. RFC 8305 recommends 250ms.
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// Looks up a host's addresses. Tests replace it.
+var lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return net.DefaultResolver.LookupIPAddr(ctx, host)
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// Connects to addrStr, a host and port, within DialTimeout.
+func dialTcp(ctx context.Context, addrStr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addrStr)
+	if err != nil {
+		return nil, transportError("dial "+addrStr, err)
+	}
+	if DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DialTimeout)
+		defer cancel()
+	}
+	var addrs []net.IPAddr
+	if ip := net.ParseIP(host); ip != nil {
+		addrs = []net.IPAddr{{IP: ip}}
+	} else {
+		addrs, err = lookupIP(ctx, host)
+		if err != nil {
+			return nil, transportError("lookup "+host, err)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, &TransportError{Op: "lookup " + host,
+			Err: errors.New("no addresses")}
+	}
+	tcp, err := dialParallel(ctx, interleave(addrs), port)
+	if err != nil {
+		return nil, transportError("dial "+addrStr, err)
+	}
+	return tcp, nil
+}
+
+// Orders addresses for dialing: IPv6 first, then alternating
+// between the families.
+func interleave(addrs []net.IPAddr) []net.IPAddr {
+	var v6, v4 []net.IPAddr
+	for _, a := range addrs {
+		if a.IP.To4() == nil {
+			v6 = append(v6, a)
+		} else {
+			v4 = append(v4, a)
+		}
+	}
+	out := make([]net.IPAddr, 0, len(addrs))
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			out = append(out, v6[0])
+			v6 = v6[1:]
+		}
+		if len(v4) > 0 {
+			out = append(out, v4[0])
+			v4 = v4[1:]
+		}
+	}
+	return out
+}
+
+// Dials addrs in order, starting each attempt when the one before it
+// fails or has had connectionAttemptDelay to answer. The first
+// connection wins; the rest are abandoned.
+func dialParallel(ctx context.Context, addrs []net.IPAddr, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(addrs))
+	var d net.Dialer
+	dial := func(a net.IPAddr) {
+		addr := net.JoinHostPort(a.String(), port)
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		results <- dialResult{conn, err}
+	}
+
+	next := time.NewTimer(0)
+	defer next.Stop()
+	var started, pending int
+	var err error
+	for started < len(addrs) || pending > 0 {
+		var nextC <-chan time.Time
+		if started < len(addrs) {
+			nextC = next.C
+		}
+		select {
+		case <-nextC:
+			go dial(addrs[started])
+			started++
+			pending++
+			next.Reset(connectionAttemptDelay)
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close any losers that connected too.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			err = r.err
+			// Don't wait to try the next one.
+			if started < len(addrs) {
+				next.Reset(0)
+			}
+		}
+	}
+	return nil, err
+}
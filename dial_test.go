@@ -0,0 +1,134 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestInterleave(t *testing.T) {
+	var addrs []net.IPAddr
+	for _, s := range []string{"192.0.2.1", "192.0.2.2", "2001:db8::1",
+		"192.0.2.3", "2001:db8::2"} {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(s)})
+	}
+	var got []string
+	for _, a := range interleave(addrs) {
+		got = append(got, a.String())
+	}
+	assertEquals(t, "[2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2 192.0.2.3]",
+		fmt.Sprint(got))
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	// The first two addresses are unreachable.
+	defer func(f func(context.Context, string) ([]net.IPAddr, error)) {
+		lookupIP = f
+	}(lookupIP)
+	lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if host != "xmpp.example.com" {
+			t.Errorf("looked up %s", host)
+		}
+		return []net.IPAddr{{IP: net.ParseIP("2001:db8::1")},
+			{IP: net.ParseIP("192.0.2.1")},
+			{IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	start := time.Now()
+	conn, err := dialTcp(context.Background(),
+		"xmpp.example.com:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatalf("dialTcp: %v", err)
+	}
+	defer conn.Close()
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("took %s", d)
+	}
+	assertEquals(t, l.Addr().String(), conn.RemoteAddr().String())
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener didn't get the connection")
+	}
+}
+
+func TestDial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	jid := &JID{Node: "user", Domain: "example.com", Resource: "res"}
+	conn, err := Dial(context.Background(), jid,
+		&DialOptions{Host: "127.0.0.1", Port: port})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	// The app can get at the socket before the stream starts.
+	if _, ok := conn.(*net.TCPConn); !ok {
+		t.Fatalf("not a TCP connection: %T", conn)
+	}
+	var s net.Conn
+	select {
+	case s = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener didn't get the connection")
+	}
+	srv := newFakeServer(t, s)
+	defer s.Close()
+
+	cl, err := NewClientConn(conn, jid, "secret", nil)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+	select {
+	case <-cl.Bound():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not bound")
+	}
+}
+
+func TestDialCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	jid := &JID{Node: "user", Domain: "example.com"}
+	// From TEST-NET-1, so nothing would answer anyway.
+	_, err := Dial(ctx, jid, &DialOptions{Host: "192.0.2.1"})
+	if err == nil {
+		t.Fatal("dialed with a canceled context")
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains experimental support for server-to-server
+// streams authenticated with dialback, XEP-0220. Only the outbound
+// side is here: the receiving server verifies our key by asking the
+// authoritative server for our domain, which is up to the app.
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"net"
+)
+
+const (
+	NsServer   = "jabber:server"
+	NsDialback = "jabber:server:dialback"
+)
+
+// The secret dialback keys are made from, as XEP-0185 describes. The
+// authoritative server for our domain needs it to verify them, so
+// there's no default: dialback fails until it's set. It takes effect
+// for Clients created after it's changed.
+var DialbackSecret string
+
+// <db:result/> and <db:verify/>
+type dialback struct {
+	XMLName xml.Name
+	From    string `xml:"from,attr,omitempty"`
+	To      string `xml:"to,attr,omitempty"`
+	Id      string `xml:"id,attr,omitempty"`
+	Type    string `xml:"type,attr,omitempty"`
+	Key     string `xml:",chardata"`
+}
+
+// NewServerDialer opens a server-to-server stream from fromDomain to
+// toDomain, and asks toDomain to accept it with dialback. This is
+// experimental. The stream can only carry stanzas from fromDomain to
+// toDomain; once toDomain has accepted it, use Client.Out as usual,
+// setting each stanza's from. If toDomain refuses, or DialbackSecret
+// isn't set, the client reports an *AuthError on Errors() and shuts
+// down.
+func NewServerDialer(fromDomain, toDomain string) (*Client, error) {
+	dial := func() (net.Conn, error) {
+		return dialSrv(context.Background(), serverSrv, toDomain)
+	}
+	tcp, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	return newServerDialer(tcp, dial, fromDomain, toDomain)
+}
+
+func newServerDialer(tcp net.Conn, dial func() (net.Conn, error), fromDomain, toDomain string) (*Client, error) {
+	return newClientPeer(tcp, dial, &JID{Domain: fromDomain}, "", nil,
+		NsServer, toDomain)
+}
+
+// The key proving we're fromDomain, for the stream with id that the
+// receiving server toDomain opened. See XEP-0185.
+func dialbackKey(secret, toDomain, fromDomain, id string) string {
+	sum := sha256.Sum256([]byte(secret))
+	mac := hmac.New(sha256.New, []byte(hex.EncodeToString(sum[:])))
+	mac.Write([]byte(toDomain + " " + fromDomain + " " + id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Answers the receiving server's stream header with our key.
+func (cl *Client) startDialback(st *stream) {
+	if st.Id == "" {
+		cl.abortStream(StreamInvalidId,
+			&AuthError{Text: "server sent no stream id"})
+		return
+	}
+	if cl.dialbackSecret == "" {
+		cl.abortStream(StreamUndefinedCondition,
+			&AuthError{Text: "DialbackSecret isn't set"})
+		return
+	}
+	from := cl.jid().Domain
+	cl.xmlOut <- &dialback{
+		XMLName: xml.Name{Space: NsDialback, Local: "result"},
+		From:    from, To: cl.peer,
+		Key: dialbackKey(cl.dialbackSecret, cl.peer, from, st.Id)}
+}
+
+// The receiving server's verdict on our key.
+func (cl *Client) handleDialback(db *dialback) {
+	if cl.ns != NsServer || db.XMLName.Local != "result" {
+		Warn.Logf("Ignoring dialback %s", db.XMLName.Local)
+		return
+	}
+	if db.From != cl.peer || db.To != cl.jid().Domain {
+		Warn.Logf("Ignoring dialback result from %s to %s",
+			db.From, db.To)
+		return
+	}
+	if db.Type != "valid" {
+		Info.Logf("Dialback to %s failed: %s", cl.peer, db.Type)
+		cl.failAuth(&AuthError{Condition: db.Type,
+			Text: "dialback refused by " + cl.peer})
+		return
+	}
+	Info.Logf("Dialback to %s succeeded", cl.peer)
+	cl.setJid(cl.jid())
+	cl.bindDone()
+}
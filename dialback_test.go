@@ -0,0 +1,114 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// The inputs from XEP-0185's example.
+func TestDialbackKey(t *testing.T) {
+	assertEquals(t, "008c689ff366b50c63d69a3e2d2c0e0e1f8404b0118eb688a0102c87cb691bdc",
+		dialbackKey("s3cr3tf0rd14lb4ck", "example.net", "example.com",
+			"D60000229F"))
+}
+
+// Open a dialback stream from example.com to a fake example.net, and
+// check the key.
+func newTestDialer(t *testing.T) (*Client, *fakeServer) {
+	c, s := net.Pipe()
+	srv := newFakeServer(t, s)
+	cl, err := newServerDialer(c, nil, "example.com", "example.net")
+	if err != nil {
+		t.Fatalf("newServerDialer: %v", err)
+	}
+
+	st := srv.expect("stream")
+	assertEquals(t, NsServer, st.attr("xmlns"))
+	assertEquals(t, "example.net", st.attr("to"))
+	assertEquals(t, "example.com", st.attr("from"))
+	assertEquals(t, NsDialback, st.attr("db"))
+	srv.send(`<stream:stream xmlns="` + NsServer + `" xmlns:stream="` +
+		NsStream + `" xmlns:db="` + NsDialback + `" id="D60000229F">`)
+	res := srv.expect("result")
+	assertEquals(t, NsDialback, res.XMLName.Space)
+	assertEquals(t, "example.com", res.attr("from"))
+	assertEquals(t, "example.net", res.attr("to"))
+	assertEquals(t, dialbackKey("s3cr3tf0rd14lb4ck", "example.net",
+		"example.com", "D60000229F"), res.Innerxml)
+	return cl, srv
+}
+
+func TestServerDialer(t *testing.T) {
+	DialbackSecret = "s3cr3tf0rd14lb4ck"
+	defer func() { DialbackSecret = "" }()
+	cl, srv := newTestDialer(t)
+	defer cl.Close()
+	srv.send(`<db:result from="example.net" to="example.com" type="valid"/>`)
+
+	msg := &Message{Header: Header{From: "romeo@example.com",
+		To: "juliet@example.net", Id: "m1"}}
+	if err := cl.Send(msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	out := srv.expect("message")
+	assertEquals(t, NsServer, out.XMLName.Space)
+	assertEquals(t, "m1", out.attr("id"))
+}
+
+func TestServerDialerRefused(t *testing.T) {
+	DialbackSecret = "s3cr3tf0rd14lb4ck"
+	defer func() { DialbackSecret = "" }()
+	cl, srv := newTestDialer(t)
+	defer cl.Close()
+	srv.send(`<db:result from="example.net" to="example.com" type="invalid"/>`)
+
+	var ae *AuthError
+	if err := nextError(t, cl); !errors.As(err, &ae) {
+		t.Fatalf("not an auth error: %#v", err)
+	}
+	for _ = range cl.In {
+	}
+}
+
+func TestServerDialerNoSecret(t *testing.T) {
+	c, s := net.Pipe()
+	srv := newFakeServer(t, s)
+	cl, err := newServerDialer(c, nil, "example.com", "example.net")
+	if err != nil {
+		t.Fatalf("newServerDialer: %v", err)
+	}
+	defer cl.Close()
+	srv.expect("stream")
+	srv.send(`<stream:stream xmlns="` + NsServer + `" xmlns:stream="` +
+		NsStream + `" xmlns:db="` + NsDialback + `" id="D60000229F">`)
+
+	// No key goes out that nobody could verify.
+	var ae *AuthError
+	if err := nextError(t, cl); !errors.As(err, &ae) {
+		t.Fatalf("not an auth error: %#v", err)
+	}
+	if el := srv.expect("error"); el.XMLName.Space != NsStream {
+		t.Errorf("sent %v", el.XMLName)
+	}
+}
+
+func TestServerDialerWrongDomains(t *testing.T) {
+	DialbackSecret = "s3cr3tf0rd14lb4ck"
+	defer func() { DialbackSecret = "" }()
+	cl, srv := newTestDialer(t)
+	defer cl.Close()
+	srv.send(`<db:result from="example.org" to="example.com" type="valid"/>`)
+	srv.send(`<db:result from="example.net" to="example.org" type="valid"/>`)
+	srv.send(`<db:result from="example.net" to="example.com" type="invalid"/>`)
+
+	// Only the last one was about us.
+	var ae *AuthError
+	if err := nextError(t, cl); !errors.As(err, &ae) {
+		t.Fatalf("not an auth error: %#v", err)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains support for service discovery, XEP-0030.
+
+import (
+	"encoding/xml"
+	"sync"
+)
+
+const (
+	NsDiscoInfo  = "http://jabber.org/protocol/disco#info"
+	NsDiscoItems = "http://jabber.org/protocol/disco#items"
+)
+
+var discoExt Extension = Extension{StanzaHandlers: map[string]func(*xml.Name) interface{}{NsDiscoInfo: newDiscoInfo, NsDiscoItems: newDiscoItems},
+	Start: startDiscoFilter}
+
+// What an entity is, and which features it supports.
+type DiscoInfo struct {
+	XMLName  xml.Name        `xml:"http://jabber.org/protocol/disco#info query"`
+	Node     string          `xml:"node,attr,omitempty"`
+	Identity []DiscoIdentity `xml:"identity"`
+	Feature  []DiscoFeature  `xml:"feature"`
+}
+
+type DiscoIdentity struct {
+	Category string `xml:"category,attr"`
+	Type     string `xml:"type,attr"`
+	Name     string `xml:"name,attr,omitempty"`
+}
+
+type DiscoFeature struct {
+	Var string `xml:"var,attr"`
+}
+
+type discoItemsQuery struct {
+	XMLName xml.Name    `xml:"http://jabber.org/protocol/disco#items query"`
+	Node    string      `xml:"node,attr,omitempty"`
+	Item    []DiscoItem `xml:"item"`
+}
+
+// An entity or node that another entity points to.
+type DiscoItem struct {
+	Jid  string `xml:"jid,attr"`
+	Node string `xml:"node,attr,omitempty"`
+	Name string `xml:"name,attr,omitempty"`
+}
+
+// The nodes we answer disco queries about ourselves.
+type discoClient struct {
+	sync.Mutex
+	nodes map[string]DiscoInfo
+}
+
+func newDiscoInfo(name *xml.Name) interface{} {
+	return &DiscoInfo{}
+}
+
+func newDiscoItems(name *xml.Name) interface{} {
+	return &discoItemsQuery{}
+}
+
+// DiscoItems asks the entity at to for the items associated with it, or
+// with one of its nodes if node isn't empty.
+func (cl *Client) DiscoItems(to, node string) ([]DiscoItem, error) {
+	q := &discoItemsQuery{}
+	err := cl.Query(to, "get", &discoItemsQuery{Node: node}, q)
+	if err != nil {
+		return nil, err
+	}
+	return q.Item, nil
+}
+
+// DiscoInfo asks the entity at to what it is and what it supports,
+// or the same about one of its nodes if node isn't empty.
+func (cl *Client) DiscoInfo(to, node string) (*DiscoInfo, error) {
+	info := &DiscoInfo{}
+	err := cl.Query(to, "get", &DiscoInfo{Node: node}, info)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// HasFeature reports whether the entity supports the feature with the
+// given var.
+func (di *DiscoInfo) HasFeature(v string) bool {
+	for _, f := range di.Feature {
+		if f.Var == v {
+			return true
+		}
+	}
+	return false
+}
+
+// AddDiscoNode registers what we say about one of our nodes.
+// Incoming disco#info queries about it are answered with info, and
+// disco#items queries with no items, without reaching the app.
+// Queries about nodes that aren't registered are answered with
+// item-not-found; those without a node are still left to the app.
+// Apps that advertise entity capabilities should register their caps
+// node, node#ver.
+func (cl *Client) AddDiscoNode(node string, info DiscoInfo) {
+	info.Node = node
+	dc := &cl.disco
+	dc.Lock()
+	defer dc.Unlock()
+	if dc.nodes == nil {
+		dc.nodes = make(map[string]DiscoInfo)
+	}
+	dc.nodes[node] = info
+}
+
+// The disco filter answers queries about our registered nodes, and
+// lets everything else through.
+func startDiscoFilter(client *Client) {
+	client.AddFilterFunc(func(st Stanza) (Stanza, bool) {
+		if reply := client.disco.answer(st); reply != nil {
+			client.Send(reply)
+			return st, false
+		}
+		return st, true
+	})
+}
+
+// Returns the reply to st if it's a disco query about one of our
+// nodes, or nil if it's not.
+func (dc *discoClient) answer(st Stanza) *Iq {
+	iq, ok := st.(*Iq)
+	if !ok || iq.Type != "get" {
+		return nil
+	}
+	for _, n := range iq.Nested {
+		var node string
+		switch q := n.(type) {
+		case *DiscoInfo:
+			node = q.Node
+		case *discoItemsQuery:
+			node = q.Node
+		default:
+			continue
+		}
+		if node == "" {
+			return nil
+		}
+		reply := &Iq{Header: Header{To: iq.From, Id: iq.Id,
+			Type: "result"}}
+		dc.Lock()
+		info, ok := dc.nodes[node]
+		dc.Unlock()
+		if !ok {
+			reply.Type = "error"
+			reply.Error = &Error{Type: "cancel", Any: &Generic{
+				XMLName: xml.Name{Space: NsStanzas,
+					Local: "item-not-found"}}}
+		} else if _, isInfo := n.(*DiscoInfo); isInfo {
+			reply.Nested = []interface{}{&info}
+		} else {
+			reply.Nested = []interface{}{&discoItemsQuery{Node: node}}
+		}
+		return reply
+	}
+	return nil
+}
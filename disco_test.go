@@ -0,0 +1,71 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiscoNode(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	cl.AddDiscoNode("http://example.com/client#abc", DiscoInfo{
+		Identity: []DiscoIdentity{{Category: "client", Type: "pc"}},
+		Feature:  []DiscoFeature{{Var: NsDiscoInfo}}})
+
+	srv.send(`<iq type="get" id="d1" from="juliet@example.com/balcony">` +
+		`<query xmlns="` + NsDiscoInfo + `" ` +
+		`node="http://example.com/client#abc"/></iq>`)
+	iq := srv.expect("iq")
+	assertEquals(t, "result", iq.attr("type"))
+	assertEquals(t, "d1", iq.attr("id"))
+	assertEquals(t, "juliet@example.com/balcony", iq.attr("to"))
+	assertEquals(t, `<query xmlns="`+NsDiscoInfo+`" `+
+		`node="http://example.com/client#abc"><identity category="client" `+
+		`type="pc"></identity><feature var="`+NsDiscoInfo+`"></feature>`+
+		`</query>`, iq.Innerxml)
+
+	srv.send(`<iq type="get" id="d2" from="juliet@example.com/balcony">` +
+		`<query xmlns="` + NsDiscoItems + `" ` +
+		`node="http://example.com/client#abc"/></iq>`)
+	iq = srv.expect("iq")
+	assertEquals(t, "result", iq.attr("type"))
+	assertEquals(t, `<query xmlns="`+NsDiscoItems+`" `+
+		`node="http://example.com/client#abc"></query>`, iq.Innerxml)
+
+	// Queries about ourselves are still the app's to answer.
+	srv.send(`<iq type="get" id="d3" from="juliet@example.com/balcony">` +
+		`<query xmlns="` + NsDiscoInfo + `"/></iq>`)
+	srv.send(`<message id="m1"/>`)
+	st := <-cl.In
+	if iq, ok := st.(*Iq); !ok || iq.Id != "d3" {
+		t.Fatalf("expected iq d3, got %#v", st)
+	}
+	expectMessage(t, cl, "m1")
+}
+
+func TestDiscoUnknownNode(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	srv.send(`<iq type="get" id="d1" from="juliet@example.com/balcony">` +
+		`<query xmlns="` + NsDiscoInfo + `" node="nonesuch"/></iq>`)
+	srv.send(`<message id="m1"/>`)
+	iq := srv.expect("iq")
+	assertEquals(t, "error", iq.attr("type"))
+	assertEquals(t, "d1", iq.attr("id"))
+	if !strings.Contains(iq.Innerxml, `<item-not-found xmlns="`+
+		NsStanzas+`">`) {
+		t.Errorf("not item-not-found: %s", iq.Innerxml)
+	}
+	// The app never saw the query.
+	expectMessage(t, cl, "m1")
+}
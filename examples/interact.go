@@ -31,8 +31,6 @@ func init() {
 	// xmpp.Debug = logger
 	xmpp.Info = logger
 	xmpp.Warn = logger
-
-	xmpp.TlsConfig = tls.Config{InsecureSkipVerify: true}
 }
 
 // Demonstrate the API, and allow the user to interact with an XMPP
@@ -41,7 +39,12 @@ func main() {
 	var jid xmpp.JID
 	flag.Var(&jid, "jid", "JID to log in as")
 	var pw *string = flag.String("pw", "", "password")
+	insecure := flag.Bool("insecure", false,
+		"don't verify the server's certificate")
 	flag.Parse()
+	if *insecure {
+		xmpp.TlsConfig = tls.Config{InsecureSkipVerify: true}
+	}
 	if jid.Domain == "" || *pw == "" {
 		flag.Usage()
 		os.Exit(2)
@@ -51,12 +54,14 @@ func main() {
 	if err != nil {
 		log.Fatalf("NewClient(%v): %v", jid, err)
 	}
-	defer close(c.Out)
+	defer c.Close()
 
 	err = c.StartSession(true, &xmpp.Presence{})
 	if err != nil {
 		log.Fatalf("StartSession: %v", err)
 	}
+	bound, _ := c.BoundJID()
+	fmt.Printf("Bound as %s\n", &bound)
 	roster := xmpp.Roster(c)
 	fmt.Printf("%d roster entries:\n", len(roster))
 	for i, entry := range roster {
@@ -0,0 +1,168 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains support for data forms, XEP-0004.
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+const NsData = "jabber:x:data"
+
+// Form types.
+const (
+	FormForm   = "form"
+	FormSubmit = "submit"
+	FormCancel = "cancel"
+	FormResult = "result"
+)
+
+// Field types.
+const (
+	FieldBoolean     = "boolean"
+	FieldFixed       = "fixed"
+	FieldHidden      = "hidden"
+	FieldJidMulti    = "jid-multi"
+	FieldJidSingle   = "jid-single"
+	FieldListMulti   = "list-multi"
+	FieldListSingle  = "list-single"
+	FieldTextMulti   = "text-multi"
+	FieldTextPrivate = "text-private"
+	FieldTextSingle  = "text-single"
+)
+
+// A data form. See XEP-0004. Forms in incoming stanzas are left in
+// their UnknownElements(); use ParseForm to read them.
+type Form struct {
+	XMLName      xml.Name `xml:"jabber:x:data x"`
+	Type         string   `xml:"type,attr"`
+	Title        string   `xml:"title,omitempty"`
+	Instructions []string `xml:"instructions"`
+	Fields       []*Field `xml:"field"`
+}
+
+type Field struct {
+	Var      string
+	Type     string
+	Label    string
+	Desc     string
+	Required bool
+	Values   []string
+	Options  []FieldOption
+}
+
+// One of the choices for a list field.
+type FieldOption struct {
+	Label string `xml:"label,attr,omitempty"`
+	Value string `xml:"value"`
+}
+
+// How a Field looks on the wire.
+type fieldXml struct {
+	XMLName  xml.Name      `xml:"field"`
+	Var      string        `xml:"var,attr,omitempty"`
+	Type     string        `xml:"type,attr,omitempty"`
+	Label    string        `xml:"label,attr,omitempty"`
+	Desc     string        `xml:"desc,omitempty"`
+	Required *struct{}     `xml:"required"`
+	Values   []string      `xml:"value"`
+	Options  []FieldOption `xml:"option"`
+}
+
+func (f *Field) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	fx := fieldXml{Var: f.Var, Type: f.Type, Label: f.Label,
+		Desc: f.Desc, Values: f.Values, Options: f.Options}
+	if f.Required {
+		fx.Required = &struct{}{}
+	}
+	return e.EncodeElement(&fx, start)
+}
+
+func (f *Field) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var fx fieldXml
+	if err := d.DecodeElement(&fx, &start); err != nil {
+		return err
+	}
+	*f = Field{Var: fx.Var, Type: fx.Type, Label: fx.Label,
+		Desc: fx.Desc, Required: fx.Required != nil,
+		Values: fx.Values, Options: fx.Options}
+	return nil
+}
+
+// ParseForm reads a form held in a Generic, such as one of a stanza's
+// UnknownElements().
+func ParseForm(g *Generic) (*Form, error) {
+	if g.XMLName.Space != NsData || g.XMLName.Local != "x" {
+		return nil, fmt.Errorf("not a data form: <%s %s>",
+			g.XMLName.Space, g.XMLName.Local)
+	}
+	buf, err := xml.Marshal(g)
+	if err != nil {
+		return nil, err
+	}
+	f := &Form{}
+	if err := xml.Unmarshal(buf, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Field returns the field with the given var, or nil.
+func (f *Form) Field(name string) *Field {
+	for _, fl := range f.Fields {
+		if fl.Var == name {
+			return fl
+		}
+	}
+	return nil
+}
+
+// Set the values of the field with the given var, adding it if
+// necessary.
+func (f *Form) Set(name string, values ...string) {
+	fl := f.Field(name)
+	if fl == nil {
+		fl = &Field{Var: name}
+		f.Fields = append(f.Fields, fl)
+	}
+	fl.Values = values
+}
+
+// Submit returns the answer to this form: the type='submit' form
+// with the fields' current values.
+func (f *Form) Submit() *Generic {
+	g, err := marshalGeneric(f.submitted())
+	if err != nil {
+		Warn.Logf("form submit: %s", err)
+		return nil
+	}
+	return g
+}
+
+func (f *Form) submitted() *Form {
+	sub := &Form{Type: FormSubmit}
+	for _, fl := range f.Fields {
+		if fl.Var == "" || fl.Type == FieldFixed {
+			continue
+		}
+		// FORM_TYPE keeps its type so the receiver knows to
+		// ignore it.
+		var typ string
+		if fl.Type == FieldHidden {
+			typ = FieldHidden
+		}
+		sub.Fields = append(sub.Fields, &Field{Var: fl.Var,
+			Type: typ, Values: fl.Values})
+	}
+	return sub
+}
+
+// Bool returns the value of a boolean field.
+func (f *Field) Bool() bool {
+	return len(f.Values) > 0 && (f.Values[0] == "1" ||
+		f.Values[0] == "true")
+}
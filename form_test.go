@@ -0,0 +1,106 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestFormRoundTrip(t *testing.T) {
+	str := `<message xmlns="` + NsClient + `" id="1">` +
+		`<x xmlns="` + NsData + `" type="form">` +
+		`<title>Bot Configuration</title>` +
+		`<instructions>Fill out this form.</instructions>` +
+		`<field type="hidden" var="FORM_TYPE"><value>jabber:bot</value></field>` +
+		`<field type="fixed"><value>Section 1</value></field>` +
+		`<field type="text-single" var="botname" label="The name of your bot"/>` +
+		`<field type="boolean" var="public" label="Public bot?"><required/><value>0</value></field>` +
+		`<field type="list-single" var="maxsubs" label="Maximum subscribers">` +
+		`<value>20</value>` +
+		`<option label="10"><value>10</value></option>` +
+		`<option label="20"><value>20</value></option></field>` +
+		`<field type="jid-multi" var="invitelist" label="People to invite">` +
+		`<desc>Tell all your friends about your new bot!</desc></field>` +
+		`</x></message>`
+	msg := &Message{}
+	if err := xml.Unmarshal([]byte(str), msg); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if err := parseExtended(&msg.Header, nil); err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	unknown := msg.UnknownElements()
+	if len(unknown) != 1 {
+		t.Fatalf("unknown: %v", unknown)
+	}
+	f, err := ParseForm(unknown[0])
+	if err != nil {
+		t.Fatalf("ParseForm: %v", err)
+	}
+	assertEquals(t, FormForm, f.Type)
+	assertEquals(t, "Bot Configuration", f.Title)
+	assertEquals(t, "Fill out this form.", strings.Join(f.Instructions, ""))
+	if len(f.Fields) != 6 {
+		t.Fatalf("fields: %v", f.Fields)
+	}
+
+	name := f.Field("botname")
+	assertEquals(t, FieldTextSingle, name.Type)
+	assertEquals(t, "The name of your bot", name.Label)
+	pub := f.Field("public")
+	assertEquals(t, FieldBoolean, pub.Type)
+	if !pub.Required || pub.Bool() {
+		t.Errorf("public: %+v", pub)
+	}
+	subs := f.Field("maxsubs")
+	assertEquals(t, FieldListSingle, subs.Type)
+	assertEquals(t, "20", strings.Join(subs.Values, ","))
+	if len(subs.Options) != 2 {
+		t.Fatalf("options: %v", subs.Options)
+	}
+	assertEquals(t, "10", subs.Options[0].Label)
+	assertEquals(t, "10", subs.Options[0].Value)
+	inv := f.Field("invitelist")
+	assertEquals(t, FieldJidMulti, inv.Type)
+	assertEquals(t, "Tell all your friends about your new bot!", inv.Desc)
+
+	f.Set("botname", "The Jabber Google Bot")
+	f.Set("public", "1")
+	f.Set("maxsubs", "10")
+	f.Set("invitelist", "juliet@example.com", "romeo@example.com")
+	sub := f.Submit()
+	if sub == nil {
+		t.Fatal("Submit returned nil")
+	}
+	exp := `<x xmlns="` + NsData + `" type="submit">` +
+		`<field var="FORM_TYPE" type="hidden"><value>jabber:bot</value></field>` +
+		`<field var="botname"><value>The Jabber Google Bot</value></field>` +
+		`<field var="public"><value>1</value></field>` +
+		`<field var="maxsubs"><value>10</value></field>` +
+		`<field var="invitelist"><value>juliet@example.com</value>` +
+		`<value>romeo@example.com</value></field></x>`
+	assertMarshal(t, exp, sub)
+
+	// And the submitted form reads back the same.
+	back, err := ParseForm(sub)
+	if err != nil {
+		t.Fatalf("ParseForm(submit): %v", err)
+	}
+	assertEquals(t, FormSubmit, back.Type)
+	if !back.Field("public").Bool() {
+		t.Errorf("public: %+v", back.Field("public"))
+	}
+	assertEquals(t, "juliet@example.com,romeo@example.com",
+		strings.Join(back.Field("invitelist").Values, ","))
+}
+
+func TestParseFormWrongElement(t *testing.T) {
+	g := &Generic{XMLName: xml.Name{Space: NsRoster, Local: "query"}}
+	if _, err := ParseForm(g); err == nil {
+		t.Error("ParseForm accepted a roster query")
+	}
+}
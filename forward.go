@@ -0,0 +1,167 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains support for stanza forwarding, XEP-0297, which
+// carbons and archived messages are built on.
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const NsForward = "urn:xmpp:forward:0"
+
+// A stanza wrapped whole inside another, along with when it was
+// originally sent. Use Stanza() to get at it.
+type Forwarded struct {
+	XMLName  xml.Name `xml:"urn:xmpp:forward:0 forwarded"`
+	Delay    *Delay
+	Innerxml string `xml:",innerxml"`
+}
+
+// Stanza returns the forwarded stanza, and when it was originally
+// sent, or the zero time if that's not known.
+func (f *Forwarded) Stanza() (Stanza, time.Time, error) {
+	return parseForwarded(f.Innerxml)
+}
+
+// ParseForwarded returns the stanza inside a <forwarded/>, such as
+// one found among a message's UnknownElements(), and when it was
+// originally sent, or the zero time if that's not known. As with
+// ParseStanza(), the stanza's extensions aren't parsed.
+func ParseForwarded(g *Generic) (Stanza, time.Time, error) {
+	if g.XMLName.Space != NsForward || g.XMLName.Local != "forwarded" {
+		return nil, time.Time{}, fmt.Errorf("not forwarded: %s %s",
+			g.XMLName.Space, g.XMLName.Local)
+	}
+	return parseForwarded(g.Innerxml)
+}
+
+// Takes apart the children of a <forwarded/>.
+func parseForwarded(innerxml string) (Stanza, time.Time, error) {
+	var st Stanza
+	var stamp time.Time
+	p := xml.NewDecoder(strings.NewReader(innerxml))
+	for {
+		start := p.InputOffset()
+		t, err := p.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch {
+		case se.Name.Space == NsDelay && se.Name.Local == "delay":
+			var d Delay
+			if err := p.DecodeElement(&d, &se); err != nil {
+				return nil, time.Time{}, err
+			}
+			stamp = d.Stamp
+		case st == nil && newStanza(se.Name) != nil:
+			if err := p.Skip(); err != nil {
+				return nil, time.Time{}, err
+			}
+			st, err = ParseStanza([]byte(innerxml[start:p.InputOffset()]))
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+		default:
+			if err := p.Skip(); err != nil {
+				return nil, time.Time{}, err
+			}
+		}
+	}
+	if st == nil {
+		return nil, time.Time{}, fmt.Errorf("nothing forwarded")
+	}
+	return st, stamp, nil
+}
+
+// ParseStanza decodes an iq, message or presence from its XML. Its
+// extensions aren't parsed, since that depends on the Client; they're
+// all left in Innerxml, and Nested is empty.
+func ParseStanza(data []byte) (Stanza, error) {
+	p := xml.NewDecoder(strings.NewReader(string(data)))
+	for {
+		t, err := p.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no stanza")
+		}
+		if err != nil {
+			return nil, err
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		st := newStanza(se.Name)
+		if st == nil {
+			return nil, fmt.Errorf("not a stanza: %s %s",
+				se.Name.Space, se.Name.Local)
+		}
+		se.Name.Space = NsClient
+		fixLang(&se)
+		if err := p.DecodeElement(st, &se); err != nil {
+			return nil, err
+		}
+		return st, nil
+	}
+}
+
+// Returns a new, empty stanza of the kind name says, or nil if it
+// isn't one. The inner stanza of a forward may leave its namespace
+// to be inherited, in which case its raw XML doesn't say.
+func newStanza(name xml.Name) Stanza {
+	if name.Space != NsClient && name.Space != "" {
+		return nil
+	}
+	switch name.Local {
+	case "iq":
+		return &Iq{}
+	case "message":
+		return &Message{}
+	case "presence":
+		return &Presence{}
+	}
+	return nil
+}
+
+// Carbon returns the message a carbon copy carries, XEP-0280, and
+// whether it's one another of our resources sent rather than
+// received. It returns a nil message if m isn't a carbon. As with
+// ParseStanza(), the message's extensions aren't parsed.
+func (m *Message) Carbon() (*Message, bool, error) {
+	for _, g := range m.UnknownElements() {
+		if g.XMLName.Space != NsCarbons || g.Any == nil {
+			continue
+		}
+		sent := g.XMLName.Local == "sent"
+		if !sent && g.XMLName.Local != "received" {
+			continue
+		}
+		st, stamp, err := ParseForwarded(g.Any)
+		if err != nil {
+			return nil, false, err
+		}
+		msg, ok := st.(*Message)
+		if !ok {
+			return nil, false, fmt.Errorf("carbon of a %T", st)
+		}
+		if !stamp.IsZero() && msg.Delay() == nil {
+			msg.Nested = append(msg.Nested, &Delay{Stamp: stamp})
+		}
+		return msg, sent, nil
+	}
+	return nil, false, nil
+}
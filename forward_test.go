@@ -0,0 +1,71 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestParseForwarded(t *testing.T) {
+	str := `<forwarded xmlns="` + NsForward + `">` +
+		`<delay xmlns="` + NsDelay + `" stamp="2010-07-10T23:08:25Z"/>` +
+		`<message xmlns="` + NsClient + `" from="romeo@montague.lit/orchard" ` +
+		`to="juliet@capulet.lit/balcony" type="chat" id="0202197">` +
+		`<body>Yet I should kill thee with much cherishing.</body>` +
+		`</message></forwarded>`
+	var g Generic
+	if err := xml.Unmarshal([]byte(str), &g); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	st, stamp, err := ParseForwarded(&g)
+	if err != nil {
+		t.Fatalf("ParseForwarded: %v", err)
+	}
+	msg, ok := st.(*Message)
+	if !ok {
+		t.Fatalf("not a message: %v", st)
+	}
+	assertEquals(t, "romeo@montague.lit/orchard", msg.From)
+	assertEquals(t, "0202197", msg.Id)
+	assertEquals(t, "Yet I should kill thee with much cherishing.",
+		msg.GetBody())
+	exp := time.Date(2010, 7, 10, 23, 8, 25, 0, time.UTC)
+	if !stamp.Equal(exp) {
+		t.Errorf("stamp %v, expected %v", stamp, exp)
+	}
+
+	g.XMLName.Local = "message"
+	if _, _, err := ParseForwarded(&g); err == nil {
+		t.Error("parsed a message as forwarded")
+	}
+}
+
+func TestCarbon(t *testing.T) {
+	st, err := ParseStanza([]byte(carbon("user@example.com", "hi")))
+	if err != nil {
+		t.Fatalf("ParseStanza: %v", err)
+	}
+	outer := st.(*Message)
+	if err := parseExtended(&outer.Header, nil); err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	msg, sent, err := outer.Carbon()
+	if err != nil || msg == nil {
+		t.Fatalf("Carbon: %v %v", msg, err)
+	}
+	if sent {
+		t.Error("received carbon reported as sent")
+	}
+	assertEquals(t, "juliet@example.com/balcony", msg.From)
+	assertEquals(t, "hi", msg.GetBody())
+
+	// An ordinary message isn't one.
+	msg, _, err = msg.Carbon()
+	if msg != nil || err != nil {
+		t.Errorf("Carbon of a plain message: %v %v", msg, err)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains support for message processing hints, XEP-0334.
+
+import (
+	"encoding/xml"
+)
+
+const NsHints = "urn:xmpp:hints"
+
+// The hints a message can carry for the servers and clients that
+// handle it.
+const (
+	HintNoPermanentStore = "no-permanent-store"
+	HintNoStore          = "no-store"
+	HintNoCopy           = "no-copy"
+	HintStore            = "store"
+)
+
+var hintsExt Extension = Extension{StanzaHandlers: map[string]func(*xml.Name) interface{}{NsHints: newHint},
+	Start: func(cl *Client) {}}
+
+// One hint. The element's name says which.
+type hint struct {
+	XMLName xml.Name
+}
+
+func newHint(name *xml.Name) interface{} {
+	return &hint{}
+}
+
+// SetHint adds a hint, such as HintNoStore, to the message, unless
+// it already has it.
+func (m *Message) SetHint(h string) {
+	for _, have := range m.Hints() {
+		if have == h {
+			return
+		}
+	}
+	m.Nested = append(m.Nested, &hint{XMLName: xml.Name{Space: NsHints,
+		Local: h}})
+}
+
+// Hints returns the names of the hints the message carries, such as
+// HintNoStore.
+func (m *Message) Hints() []string {
+	var hints []string
+	for _, n := range m.Nested {
+		if h, ok := n.(*hint); ok {
+			hints = append(hints, h.XMLName.Local)
+		}
+	}
+	return hints
+}
@@ -0,0 +1,38 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestHints(t *testing.T) {
+	msg := &Message{Header: Header{To: "a@b.c", Id: "1", Type: "chat"}}
+	msg.SetHint(HintNoStore)
+	msg.SetHint(HintNoStore)
+	msg.AddBody("", "secret")
+	exp := `<message xmlns="` + NsClient + `" to="a@b.c" id="1" ` +
+		`type="chat"><no-store xmlns="` + NsHints + `"></no-store>` +
+		`<body xmlns="` + NsClient + `">secret</body></message>`
+	assertMarshal(t, exp, msg)
+
+	back := &Message{}
+	if err := xml.Unmarshal([]byte(exp), back); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	m := map[string][]func(*xml.Name) interface{}{NsHints: {newHint}}
+	if err := parseExtended(&back.Header, m); err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	assertEquals(t, HintNoStore, strings.Join(back.Hints(), " "))
+
+	back.SetHint(HintNoCopy)
+	assertEquals(t, "no-store no-copy", strings.Join(back.Hints(), " "))
+	if hints := (&Message{}).Hints(); hints != nil {
+		t.Errorf("plain message has hints: %v", hints)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains support for non-SASL authentication, XEP-0078,
+// for servers too old to offer SASL.
+
+import (
+	"encoding/xml"
+)
+
+const NsIqAuth = "jabber:iq:auth"
+
+var iqAuthExt Extension = Extension{StanzaHandlers: map[string]func(*xml.Name) interface{}{NsIqAuth: newIqAuth},
+	Start: func(cl *Client) {}}
+
+// Whether Clients log in to servers that predate XMPP 1.0 with the
+// obsolete jabber:iq:auth protocol. Without it, they give up on such
+// servers. Such servers don't offer STARTTLS, so the password is
+// protected only if the server accepts a digest of it, or the client
+// connected with DirectTLS; otherwise it's sent as is only if
+// AllowPlainWithoutTLS is also set. It takes effect for Clients
+// created after it's changed.
+var LegacyAuth bool
+
+// The query, both for the fields the server wants and for the
+// credentials. Fields the server wants come back empty.
+type iqAuth struct {
+	XMLName  xml.Name `xml:"jabber:iq:auth query"`
+	Username *string  `xml:"username"`
+	Password *string  `xml:"password"`
+	Digest   *string  `xml:"digest"`
+	Resource *string  `xml:"resource"`
+}
+
+func newIqAuth(name *xml.Name) interface{} {
+	return &iqAuth{}
+}
+
+// Asks the server how it would like us to authenticate.
+func (cl *Client) iqAuth() {
+	jid := cl.jid()
+	iq := &Iq{Header: Header{To: jid.Domain, Type: "get", Id: cl.NextId(),
+		Nested: []interface{}{&iqAuth{Username: &jid.Node}}}}
+	cl.HandleStanzaFrom(iq.Id, iq.To, func(st Stanza) bool {
+		cl.iqAuthFields(st)
+		return false
+	})
+	cl.xmlOut <- iq
+}
+
+// Sends our credentials in the form the server asked for.
+func (cl *Client) iqAuthFields(st Stanza) {
+	iq, ok := st.(*Iq)
+	if !ok || iq.Type != "result" {
+		cl.failIqAuth(st)
+		return
+	}
+	var fields *iqAuth
+	for _, n := range iq.Nested {
+		if q, ok := n.(*iqAuth); ok {
+			fields = q
+		}
+	}
+	if fields == nil {
+		cl.failIqAuth(st)
+		return
+	}
+
+	jid := cl.jid()
+	if jid.Resource == "" {
+		jid.Resource = generateResource()
+	}
+	creds := &iqAuth{Username: &jid.Node, Resource: &jid.Resource}
+	switch {
+	case fields.Digest != nil:
+		digest := handshakeDigest(cl.StreamID(), cl.password)
+		creds.Digest = &digest
+	case fields.Password != nil && (cl.allowPlain || cl.IsEncrypted()):
+		creds.Password = &cl.password
+	default:
+		Warn.Log("No acceptable non-SASL authentication method")
+		cl.failAuth(&AuthError{Text: "server wants the password " +
+			"sent in the clear"})
+		return
+	}
+	set := &Iq{Header: Header{To: jid.Domain, Type: "set", Id: cl.NextId(),
+		Nested: []interface{}{creds}}}
+	cl.HandleStanzaFrom(set.Id, set.To, func(st Stanza) bool {
+		if iq, ok := st.(*Iq); !ok || iq.Type != "result" {
+			cl.failIqAuth(st)
+			return false
+		}
+		Info.Log("Non-SASL authentication succeeded")
+		cl.enterPhase(Authenticated)
+		cl.setJid(jid)
+		cl.enterPhase(Bound)
+		cl.bindDone()
+		return false
+	})
+	cl.xmlOut <- set
+}
+
+func (cl *Client) failIqAuth(st Stanza) {
+	err := &AuthError{Text: "bad jabber:iq:auth reply"}
+	if h := st.GetHeader(); h.Error != nil {
+		err = &AuthError{Condition: h.Error.Condition(),
+			Text: h.Error.TextFor(cl.lang)}
+	}
+	Warn.Logf("Non-SASL authentication failed: %v", err)
+	cl.failAuth(err)
+}
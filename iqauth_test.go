@@ -0,0 +1,87 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIqAuthDigest(t *testing.T) {
+	// XEP-0078, Example 5.
+	assertEquals(t, "48fc78be9ec8f86d8ce1c39c320c97c21d62334d",
+		handshakeDigest("3EE948B0", "Calli0pe"))
+}
+
+// A client for bill@shakespeare.lit, talking to a server that
+// predates XMPP 1.0, and the id of its request for the fields the
+// server wants.
+func legacyClient(t *testing.T) (*Client, *fakeServer, string) {
+	LegacyAuth = true
+	defer func() { LegacyAuth = false }()
+	jid := &JID{Node: "bill", Domain: "shakespeare.lit", Resource: "globe"}
+	c, s := net.Pipe()
+	srv := newFakeServer(t, s)
+	cl, err := newClient(c, nil, jid, "Calli0pe", nil)
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	srv.expect("stream")
+	srv.send(`<stream:stream xmlns="` + NsClient + `" xmlns:stream="` +
+		NsStream + `" from="shakespeare.lit" id="3EE948B0">`)
+	iq := srv.expect("iq")
+	assertEquals(t, "get", iq.attr("type"))
+	assertEquals(t, `<query xmlns="`+NsIqAuth+`"><username>bill</username>`+
+		`</query>`, iq.Innerxml)
+	return cl, srv, iq.attr("id")
+}
+
+func TestIqAuth(t *testing.T) {
+	cl, srv, id := legacyClient(t)
+	defer cl.Close()
+	srv.send(`<iq type="result" id="` + id + `">` +
+		`<query xmlns="` + NsIqAuth + `"><username/><password/>` +
+		`<digest/><resource/></query></iq>`)
+
+	iq := srv.expect("iq")
+	assertEquals(t, "set", iq.attr("type"))
+	var q iqAuth
+	if err := xml.Unmarshal([]byte(iq.Innerxml), &q); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if q.Username == nil || q.Resource == nil || q.Digest == nil {
+		t.Fatalf("query: %s", iq.Innerxml)
+	}
+	if q.Password != nil {
+		t.Errorf("password sent: %s", iq.Innerxml)
+	}
+	assertEquals(t, "bill", *q.Username)
+	assertEquals(t, "globe", *q.Resource)
+	assertEquals(t, "48fc78be9ec8f86d8ce1c39c320c97c21d62334d", *q.Digest)
+
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `"/>`)
+	select {
+	case <-cl.Bound():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not bound")
+	}
+	jid, _ := cl.BoundJID()
+	assertEquals(t, "bill@shakespeare.lit/globe", jid.String())
+}
+
+func TestIqAuthPlainRefused(t *testing.T) {
+	cl, srv, id := legacyClient(t)
+	defer cl.Close()
+	srv.send(`<iq type="result" id="` + id + `">` +
+		`<query xmlns="` + NsIqAuth + `"><username/><password/>` +
+		`<resource/></query></iq>`)
+	var ae *AuthError
+	if err := nextError(t, cl); !errors.As(err, &ae) {
+		t.Fatalf("error: %v", err)
+	}
+}
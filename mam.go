@@ -0,0 +1,209 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains support for querying message archives, XEP-0313.
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	NsMAM = "urn:xmpp:mam:2"
+	NsSID = "urn:xmpp:sid:0"
+)
+
+var mamExt Extension = Extension{StanzaHandlers: map[string]func(*xml.Name) interface{}{NsMAM: newMam, NsSID: newStanzaId},
+	Start: startMamFilter}
+
+// The query we send to the archive.
+type mamQuery struct {
+	XMLName xml.Name `xml:"urn:xmpp:mam:2 query"`
+	QueryId string   `xml:"queryid,attr,omitempty"`
+	// The search terms.
+	Form *Form
+	Set  *RSMSet
+}
+
+// One archived message, which arrives wrapped in a <message/> from
+// the archive.
+type mamResult struct {
+	XMLName   xml.Name `xml:"urn:xmpp:mam:2 result"`
+	QueryId   string   `xml:"queryid,attr"`
+	Id        string   `xml:"id,attr"`
+	Forwarded Forwarded
+}
+
+// The end of the results, in the archive's reply to our query.
+type mamFin struct {
+	XMLName  xml.Name `xml:"urn:xmpp:mam:2 fin"`
+	Complete bool     `xml:"complete,attr"`
+	Set      *RSMSet
+}
+
+// Identifies a message in an archive. See XEP-0359.
+type StanzaId struct {
+	XMLName xml.Name `xml:"urn:xmpp:sid:0 stanza-id"`
+	Id      string   `xml:"id,attr"`
+	By      string   `xml:"by,attr"`
+}
+
+func newMam(name *xml.Name) interface{} {
+	switch name.Local {
+	case "result":
+		return &mamResult{}
+	case "fin":
+		return &mamFin{}
+	}
+	return &Generic{}
+}
+
+func newStanzaId(name *xml.Name) interface{} {
+	return &StanzaId{}
+}
+
+// Each Client keeps one of these, which tracks its queries in
+// progress.
+type mamClient struct {
+	sync.Mutex
+	// Keyed by queryid.
+	queries map[string]*mamPending
+}
+
+type mamPending struct {
+	iqId string
+	msgs []*Message
+	// Receives the archive's reply to the query, once all the
+	// results have been collected.
+	done chan *Iq
+}
+
+// The MAM filter takes the archived messages and the replies to our
+// queries out of the stream, and gives them to MAMQuery().
+func startMamFilter(client *Client) {
+	client.mam.queries = make(map[string]*mamPending)
+	client.AddFilterFunc(func(st Stanza) (Stanza, bool) {
+		return st, !client.mam.collect(client, st)
+	})
+}
+
+// Returns true if st belongs to one of our queries.
+func (mc *mamClient) collect(cl *Client, st Stanza) bool {
+	mc.Lock()
+	defer mc.Unlock()
+	switch st := st.(type) {
+	case *Message:
+		for _, n := range st.Nested {
+			res, ok := n.(*mamResult)
+			if !ok {
+				continue
+			}
+			q := mc.queries[res.QueryId]
+			if q == nil {
+				return false
+			}
+			fwd, _, err := res.Forwarded.Stanza()
+			msg, ok := fwd.(*Message)
+			if err != nil || !ok {
+				Warn.Logf("archived message: %v %v", fwd, err)
+				return false
+			}
+			if err := parseExtended(&msg.Header, cl.extStanza); err != nil {
+				Warn.Logf("archived message: %s", err)
+			}
+			msg.Nested = append(msg.Nested,
+				&StanzaId{Id: res.Id, By: st.From})
+			if res.Forwarded.Delay != nil && msg.Delay() == nil {
+				msg.Nested = append(msg.Nested,
+					res.Forwarded.Delay)
+			}
+			q.msgs = append(q.msgs, msg)
+			return true
+		}
+	case *Iq:
+		if st.Type != "result" && st.Type != "error" ||
+			!cl.replyFrom("", st.From) {
+			// Not the archive's reply, whatever its id.
+			return false
+		}
+		for id, q := range mc.queries {
+			if q.iqId == st.Id {
+				delete(mc.queries, id)
+				q.done <- st
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MAMQuery fetches messages from our archive, optionally only the
+// ones exchanged with the given JID, between start and end. Pass a
+// zero time to leave either end open. rsm, if not nil, selects a page
+// of the results. It returns the messages, oldest first, and the
+// archive's description of the page. Each message's ArchiveId() and
+// Delay() say where it is in the archive and when it was sent.
+func (cl *Client) MAMQuery(with string, start, end time.Time, rsm *RSMSet) ([]*Message, *RSMSet, error) {
+	form := &Form{Type: FormSubmit, Fields: []*Field{{Var: "FORM_TYPE",
+		Type: FieldHidden, Values: []string{NsMAM}}}}
+	if with != "" {
+		form.Set("with", with)
+	}
+	if !start.IsZero() {
+		form.Set("start", start.UTC().Format(time.RFC3339))
+	}
+	if !end.IsZero() {
+		form.Set("end", end.UTC().Format(time.RFC3339))
+	}
+	queryId := cl.NextId()
+	iq := &Iq{Header: Header{Type: "set", Id: cl.NextId(),
+		Nested: []interface{}{&mamQuery{QueryId: queryId,
+			Form: form, Set: rsm}}}}
+
+	q := &mamPending{iqId: iq.Id, done: make(chan *Iq, 1)}
+	cl.mam.Lock()
+	cl.mam.queries[queryId] = q
+	cl.mam.Unlock()
+	forget := func() {
+		cl.mam.Lock()
+		delete(cl.mam.queries, queryId)
+		cl.mam.Unlock()
+	}
+
+	if err := cl.Send(iq); err != nil {
+		forget()
+		return nil, nil, err
+	}
+	var reply *Iq
+	select {
+	case reply = <-q.done:
+	case <-cl.done:
+		forget()
+		return nil, nil, ErrClosed
+	}
+	if reply.Type == "error" {
+		return nil, nil, reply.Error.stanzaError(cl.lang)
+	}
+	for _, n := range reply.Nested {
+		if fin, ok := n.(*mamFin); ok {
+			return q.msgs, fin.Set, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("archive reply has no fin: %v", reply)
+}
+
+// ArchiveId returns the id of an archived message, as assigned by
+// the archive it came from, or "" if there isn't one.
+func (m *Message) ArchiveId() string {
+	for _, n := range m.Nested {
+		if sid, ok := n.(*StanzaId); ok {
+			return sid.Id
+		}
+	}
+	return ""
+}
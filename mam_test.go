@@ -0,0 +1,131 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMAMQuery(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	type result struct {
+		msgs []*Message
+		set  *RSMSet
+		err  error
+	}
+	results := make(chan result)
+	start := time.Date(2010, 6, 7, 0, 0, 0, 0, time.UTC)
+	go func() {
+		msgs, set, err := cl.MAMQuery("juliet@capulet.lit", start,
+			time.Time{}, RSMAfter(2, ""))
+		results <- result{msgs, set, err}
+	}()
+
+	iq := srv.expect("iq")
+	var q mamQuery
+	if err := xml.Unmarshal([]byte(iq.Innerxml), &q); err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if q.Form == nil || len(q.Form.Fields) != 3 {
+		t.Fatalf("form: %v", q.Form)
+	}
+	assertEquals(t, "juliet@capulet.lit", q.Form.Field("with").Values[0])
+	assertEquals(t, "2010-06-07T00:00:00Z", q.Form.Field("start").Values[0])
+	if q.Set == nil || q.Set.Max == nil || *q.Set.Max != 2 {
+		t.Errorf("set: %v", q.Set)
+	}
+
+	for i, body := range []string{"Hail to thee", "Art thou not Romeo"} {
+		srv.send(`<message id="r` + strconv.Itoa(i) + `">` +
+			`<result xmlns="` + NsMAM + `" queryid="` + q.QueryId +
+			`" id="arch` + strconv.Itoa(i) + `"><forwarded xmlns="` +
+			NsForward + `"><delay xmlns="` + NsDelay +
+			`" stamp="2010-07-10T23:0` + strconv.Itoa(i) + `:25Z"/>` +
+			`<message xmlns="` + NsClient + `" from="juliet@capulet.lit"` +
+			` type="chat"><body>` + body + `</body></message>` +
+			`</forwarded></result></message>`)
+	}
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `">` +
+		`<fin xmlns="` + NsMAM + `"><set xmlns="` + NsRSM + `">` +
+		`<first index="0">arch0</first><last>arch1</last>` +
+		`<count>16</count></set></fin></iq>`)
+
+	var res result
+	select {
+	case res = <-results:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no result")
+	}
+	if res.err != nil {
+		t.Fatalf("MAMQuery: %v", res.err)
+	}
+	if len(res.msgs) != 2 {
+		t.Fatalf("messages: %v", res.msgs)
+	}
+	assertEquals(t, "Art thou not Romeo", res.msgs[1].GetBody())
+	assertEquals(t, "juliet@capulet.lit", res.msgs[1].From)
+	assertEquals(t, "arch1", res.msgs[1].ArchiveId())
+	d := res.msgs[1].Delay()
+	if d == nil {
+		t.Fatalf("no delay")
+	}
+	assertEquals(t, "2010-07-10T23:01:25Z", d.Stamp.Format(time.RFC3339))
+	if res.set == nil || res.set.Count == nil || *res.set.Count != 16 {
+		t.Errorf("set: %v", res.set)
+	}
+
+	// None of it reached the app.
+	select {
+	case st := <-cl.In:
+		t.Errorf("archived message leaked: %v", st)
+	default:
+	}
+}
+
+// Only our own archive can end a query, whatever id someone else's
+// iq has.
+func TestMAMQueryForgedReply(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	errs := make(chan error)
+	go func() {
+		_, _, err := cl.MAMQuery("", time.Time{}, time.Time{}, nil)
+		errs <- err
+	}()
+	id := srv.expect("iq").attr("id")
+	srv.send(`<iq type="result" from="mallory@example.org" id="` + id +
+		`"/>`)
+	srv.send(`<iq type="set" id="` + id + `"><query xmlns="` +
+		NsMAM + `"/></iq>`)
+	for i := 0; i < 2; i++ {
+		select {
+		case st := <-cl.In:
+			assertEquals(t, id, st.GetHeader().Id)
+		case <-time.After(5 * time.Second):
+			t.Fatal("forged reply swallowed")
+		}
+	}
+
+	srv.send(`<iq type="result" id="` + id + `"><fin xmlns="` + NsMAM +
+		`"/></iq>`)
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("MAMQuery: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no result")
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains support for keeping track of the multi-user chat
+// rooms we're in, XEP-0045.
+
+import (
+	"encoding/xml"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NsMUC     = "http://jabber.org/protocol/muc"
+	NsMUCUser = "http://jabber.org/protocol/muc#user"
+)
+
+var mucExt Extension = Extension{StanzaHandlers: map[string]func(*xml.Name) interface{}{NsMUCUser: newMucUser},
+	Start: startMucFilter}
+
+// The status code a room puts on presence about ourselves.
+const mucStatusSelf = 110
+
+// How long we wait for a room we've asked to join to send our own
+// presence back before forgetting about it.
+const mucJoinTimeout = 2 * time.Minute
+
+// The element that asks to join a room, sent in directed presence to
+// room@service/nick. Rooms we're joining this way are tracked; see
+// Client.MUCRoom().
+type MUCJoin struct {
+	XMLName  xml.Name `xml:"http://jabber.org/protocol/muc x"`
+	Password string   `xml:"password,omitempty"`
+}
+
+// A multi-user chat room, as its presence and messages have described
+// it to us.
+type MUCRoom struct {
+	// The room's bare JID.
+	Jid string
+	// The current subject, and the nick of whoever set it, if the
+	// room said.
+	Subject   string
+	SubjectBy string
+	// Who's in the room, by nick.
+	Occupants map[string]MUCOccupant
+}
+
+// Someone in a multi-user chat room.
+type MUCOccupant struct {
+	Nick string
+	// Their real JID, if the room tells us.
+	Jid         string
+	Affiliation string
+	Role        string
+}
+
+type mucUser struct {
+	XMLName xml.Name    `xml:"http://jabber.org/protocol/muc#user x"`
+	Item    *mucItem    `xml:"item"`
+	Status  []mucStatus `xml:"status"`
+}
+
+type mucItem struct {
+	Affiliation string `xml:"affiliation,attr,omitempty"`
+	Role        string `xml:"role,attr,omitempty"`
+	Jid         string `xml:"jid,attr,omitempty"`
+	Nick        string `xml:"nick,attr,omitempty"`
+}
+
+type mucStatus struct {
+	Code int `xml:"code,attr"`
+}
+
+// The rooms we're in, and those we've asked to join, by bare JID.
+type mucClient struct {
+	sync.Mutex
+	rooms   map[string]*MUCRoom
+	joining map[string]*mucJoining
+}
+
+// A room we've asked to join, and when.
+type mucJoining struct {
+	room  *MUCRoom
+	since time.Time
+}
+
+func newMucUser(name *xml.Name) interface{} {
+	return &mucUser{}
+}
+
+// The MUC filter keeps track of the rooms we're in from their
+// presence, which it lets through, and their subject changes, which
+// it takes out of the stream.
+func startMucFilter(client *Client) {
+	client.AddFilterFunc(func(st Stanza) (Stanza, bool) {
+		switch st := st.(type) {
+		case *Presence:
+			client.muc.presence(st)
+		case *Message:
+			return st, !client.muc.subject(st)
+		}
+		return st, true
+	})
+}
+
+// Splits a room occupant's JID into the room and the nick.
+func splitOccupant(jid string) (string, string) {
+	if i := strings.Index(jid, "/"); i >= 0 {
+		return jid[:i], jid[i+1:]
+	}
+	return jid, ""
+}
+
+// Whether x asks to join a room.
+func isMucJoin(x interface{}) bool {
+	switch x := x.(type) {
+	case *MUCJoin:
+		return true
+	case *Generic:
+		return x.XMLName.Space == NsMUC && x.XMLName.Local == "x"
+	}
+	return false
+}
+
+// Notes the rooms pr, on its way to the server, asks to join.
+func (mc *mucClient) sent(pr *Presence) {
+	if pr.To == "" || pr.Type != "" {
+		return
+	}
+	join := false
+	for _, n := range pr.Nested {
+		if isMucJoin(n) {
+			join = true
+		}
+	}
+	room, nick := splitOccupant(pr.To)
+	if !join || nick == "" {
+		return
+	}
+	mc.Lock()
+	defer mc.Unlock()
+	if mc.rooms[room] != nil {
+		// Just a nick change.
+		return
+	}
+	mc.expire()
+	if j := mc.joining[room]; j != nil {
+		j.since = time.Now()
+		return
+	}
+	if mc.joining == nil {
+		mc.joining = make(map[string]*mucJoining)
+	}
+	mc.joining[room] = &mucJoining{since: time.Now(),
+		room: &MUCRoom{Jid: room,
+			Occupants: make(map[string]MUCOccupant)}}
+}
+
+// Forgets the rooms that never let us in. Call with mc locked.
+func (mc *mucClient) expire() {
+	for jid, j := range mc.joining {
+		if time.Since(j.since) > mucJoinTimeout {
+			Info.Logf("Gave up joining %s", jid)
+			delete(mc.joining, jid)
+		}
+	}
+}
+
+// Updates the occupants of the room pr is from, if it's room
+// presence.
+func (mc *mucClient) presence(pr *Presence) {
+	var x *mucUser
+	for _, n := range pr.Nested {
+		if u, ok := n.(*mucUser); ok {
+			x = u
+			break
+		}
+	}
+	room, nick := splitOccupant(pr.From)
+	if pr.Type == PresenceError {
+		// The room turned us away.
+		mc.Lock()
+		delete(mc.joining, room)
+		mc.Unlock()
+		return
+	}
+	if x == nil || nick == "" {
+		return
+	}
+	self := false
+	for _, s := range x.Status {
+		if s.Code == mucStatusSelf {
+			self = true
+		}
+	}
+	mc.Lock()
+	defer mc.Unlock()
+	mc.expire()
+	r := mc.rooms[room]
+	j := mc.joining[room]
+	if r == nil && j != nil {
+		r = j.room
+	}
+	if r == nil {
+		// Not a room we're in or asked to join.
+		return
+	}
+	switch pr.Type {
+	case "":
+		occ := MUCOccupant{Nick: nick}
+		if x.Item != nil {
+			occ.Jid = x.Item.Jid
+			occ.Affiliation = x.Item.Affiliation
+			occ.Role = x.Item.Role
+		}
+		r.Occupants[nick] = occ
+		if self && j != nil {
+			// Our own presence comes last, once we're in.
+			delete(mc.joining, room)
+			if mc.rooms == nil {
+				mc.rooms = make(map[string]*MUCRoom)
+			}
+			mc.rooms[room] = r
+		}
+	case PresenceUnavailable:
+		if self {
+			// We've left, or never got in, so we won't
+			// hear any more.
+			delete(mc.rooms, room)
+			delete(mc.joining, room)
+			return
+		}
+		delete(r.Occupants, nick)
+	}
+}
+
+// Updates the subject if msg changes that of a room we're in, and
+// returns true if it did. A message with a body that happens to have
+// a subject too is left alone.
+func (mc *mucClient) subject(msg *Message) bool {
+	if msg.Type != MessageGroupchat || len(msg.Subject) == 0 ||
+		len(msg.Body) > 0 {
+		return false
+	}
+	room, nick := splitOccupant(msg.From)
+	mc.Lock()
+	defer mc.Unlock()
+	r := mc.rooms[room]
+	if r == nil {
+		return false
+	}
+	r.Subject = msg.GetSubject()
+	r.SubjectBy = nick
+	return true
+}
+
+// MUCRoom returns what we know about the multi-user chat room with the
+// given bare JID, and false if we're not in it. Only rooms joined by
+// sending a MUCJoin in directed presence are tracked, and until our
+// own presence there arrives, we're not in them. The subject changes it reflects aren't
+// delivered on Client.In.
+func (cl *Client) MUCRoom(jid string) (*MUCRoom, bool) {
+	cl.muc.Lock()
+	defer cl.muc.Unlock()
+	r := cl.muc.rooms[jid]
+	if r == nil {
+		return nil, false
+	}
+	cp := *r
+	cp.Occupants = make(map[string]MUCOccupant, len(r.Occupants))
+	for k, v := range r.Occupants {
+		cp.Occupants[k] = v
+	}
+	return &cp, true
+}
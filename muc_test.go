@@ -0,0 +1,199 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+const testRoom = "coven@chat.shakespeare.lit"
+
+// Send presence from an occupant of testRoom, and wait for the client
+// to pass it on.
+func mucPresence(t *testing.T, cl *Client, srv *fakeServer, nick, typ, item, status string) {
+	attr := ""
+	if typ != "" {
+		attr = ` type="` + typ + `"`
+	}
+	srv.send(`<presence from="` + testRoom + `/` + nick + `"` + attr +
+		`><x xmlns="` + NsMUCUser + `">` + item + status + `</x></presence>`)
+	select {
+	case st := <-cl.In:
+		if pr, ok := st.(*Presence); !ok || pr.From != testRoom+"/"+nick {
+			t.Fatalf("not the presence: %#v", st)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no presence")
+	}
+}
+
+// Ask to join testRoom as nick.
+func mucJoin(t *testing.T, cl *Client, srv *fakeServer, nick string) {
+	cl.SendDirectedPresence(testRoom+"/"+nick,
+		&Presence{Header: Header{Nested: []interface{}{&MUCJoin{}}}})
+	pr := srv.expect("presence")
+	assertEquals(t, testRoom+"/"+nick, pr.attr("to"))
+}
+
+func TestMUCJoinMarshal(t *testing.T) {
+	assertMarshal(t, `<x xmlns="`+NsMUC+`"><password>cauldron`+
+		`</password></x>`, &MUCJoin{Password: "cauldron"})
+}
+
+func TestMUCOccupants(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	if _, ok := cl.MUCRoom(testRoom); ok {
+		t.Fatal("in the room already")
+	}
+	mucJoin(t, cl, srv, "thirdwitch")
+	mucPresence(t, cl, srv, "firstwitch", "", `<item affiliation="owner" `+
+		`role="moderator" jid="crone1@shakespeare.lit/desktop"/>`, "")
+	// We're not in until our own presence arrives.
+	if _, ok := cl.MUCRoom(testRoom); ok {
+		t.Fatal("in the room before joining")
+	}
+	mucPresence(t, cl, srv, "thirdwitch", "", `<item affiliation="admin" `+
+		`role="moderator"/>`, `<status code="110"/>`)
+	room, ok := cl.MUCRoom(testRoom)
+	if !ok || len(room.Occupants) != 2 {
+		t.Fatalf("room: %#v", room)
+	}
+	occ := room.Occupants["firstwitch"]
+	assertEquals(t, "crone1@shakespeare.lit/desktop", occ.Jid)
+	assertEquals(t, "owner", occ.Affiliation)
+	assertEquals(t, "moderator", occ.Role)
+
+	mucPresence(t, cl, srv, "firstwitch", "unavailable",
+		`<item affiliation="owner" role="none"/>`, "")
+	room, _ = cl.MUCRoom(testRoom)
+	if _, ok := room.Occupants["firstwitch"]; ok || len(room.Occupants) != 1 {
+		t.Errorf("occupants: %v", room.Occupants)
+	}
+
+	// Once we've left, the room is forgotten.
+	mucPresence(t, cl, srv, "thirdwitch", "unavailable",
+		`<item affiliation="admin" role="none"/>`, `<status code="110"/>`)
+	if _, ok := cl.MUCRoom(testRoom); ok {
+		t.Error("still in the room")
+	}
+}
+
+func TestMUCSubject(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	mucJoin(t, cl, srv, "thirdwitch")
+	mucPresence(t, cl, srv, "thirdwitch", "", `<item affiliation="none" `+
+		`role="participant"/>`, `<status code="110"/>`)
+	srv.send(`<message from="` + testRoom + `/secondwitch" ` +
+		`type="groupchat" id="s1"><subject>Fire Burn and Cauldron ` +
+		`Bubble!</subject></message>`)
+	// A message that also has a body isn't a subject change.
+	srv.send(`<message from="` + testRoom + `/secondwitch" ` +
+		`type="groupchat" id="m1"><subject>Toil</subject>` +
+		`<body>Double, double</body></message>`)
+	expectMessage(t, cl, "m1")
+	room, ok := cl.MUCRoom(testRoom)
+	if !ok {
+		t.Fatal("not in the room")
+	}
+	assertEquals(t, "Fire Burn and Cauldron Bubble!", room.Subject)
+	assertEquals(t, "secondwitch", room.SubjectBy)
+
+	// An empty subject clears it.
+	srv.send(`<message from="` + testRoom + `" type="groupchat" ` +
+		`id="s2"><subject/></message>`)
+	srv.send(`<message from="` + testRoom + `" type="groupchat" ` +
+		`id="m2"><body>hi</body></message>`)
+	expectMessage(t, cl, "m2")
+	room, _ = cl.MUCRoom(testRoom)
+	assertEquals(t, "", room.Subject)
+	assertEquals(t, "", room.SubjectBy)
+}
+
+func TestMUCSubjectNotJoined(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	// A room we never joined can't set a subject, so it's just a
+	// message.
+	srv.send(`<message from="` + testRoom + `/secondwitch" ` +
+		`type="groupchat" id="s1"><subject>Toil and trouble` +
+		`</subject></message>`)
+	expectMessage(t, cl, "s1")
+	if _, ok := cl.MUCRoom(testRoom); ok {
+		t.Error("in a room we never joined")
+	}
+}
+
+func TestMUCNotJoined(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	// Presence from rooms we never asked to join isn't tracked, so
+	// it can't crowd out the ones we do join.
+	for i := 0; i < 30; i++ {
+		mucPresence(t, cl, srv, "thirdwitch", "", `<item `+
+			`affiliation="none" role="participant"/>`,
+			`<status code="110"/>`)
+	}
+	if _, ok := cl.MUCRoom(testRoom); ok {
+		t.Fatal("in a room we never joined")
+	}
+
+	// A join written by hand counts too.
+	cl.SendDirectedPresence(testRoom+"/thirdwitch", &Presence{
+		Header: Header{Nested: []interface{}{&Generic{
+			XMLName: xml.Name{Space: NsMUC, Local: "x"}}}}})
+	srv.expect("presence")
+	mucPresence(t, cl, srv, "thirdwitch", "", `<item affiliation="none" `+
+		`role="participant"/>`, `<status code="110"/>`)
+	if _, ok := cl.MUCRoom(testRoom); !ok {
+		t.Fatal("not in the room")
+	}
+}
+
+func TestMUCJoinRefused(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	mucJoin(t, cl, srv, "thirdwitch")
+	srv.send(`<presence from="` + testRoom + `/thirdwitch" ` +
+		`type="error"><error type="auth"><not-authorized xmlns="` +
+		NsStanzas + `"/></error></presence>`)
+	<-cl.In
+	cl.muc.Lock()
+	defer cl.muc.Unlock()
+	if len(cl.muc.joining) != 0 {
+		t.Errorf("still joining %v", cl.muc.joining)
+	}
+}
+
+func TestMUCJoinExpires(t *testing.T) {
+	var mc mucClient
+	mc.sent(&Presence{Header: Header{To: testRoom + "/thirdwitch",
+		Nested: []interface{}{&MUCJoin{}}}})
+	mc.sent(&Presence{Header: Header{To: "hall@chat.shakespeare.lit/" +
+		"thirdwitch", Nested: []interface{}{&MUCJoin{}}}})
+	mc.joining[testRoom].since = time.Now().Add(-2 * mucJoinTimeout)
+	mc.expire()
+	if _, ok := mc.joining[testRoom]; ok || len(mc.joining) != 1 {
+		t.Errorf("joining %v", mc.joining)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains support for user nicknames, XEP-0172.
+
+import (
+	"encoding/xml"
+)
+
+const NsNick = "http://jabber.org/protocol/nick"
+
+var nickExt Extension = Extension{StanzaHandlers: map[string]func(*xml.Name) interface{}{NsNick: newNick},
+	Start: func(cl *Client) {}}
+
+// The nickname the sender would like to be known by.
+type nick struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/nick nick"`
+	Nick    string   `xml:",chardata"`
+}
+
+func newNick(name *xml.Name) interface{} {
+	return &nick{}
+}
+
+// Nick returns the nickname the sender gave, if any.
+func (h *Header) Nick() (string, bool) {
+	for _, n := range h.Nested {
+		if n, ok := n.(*nick); ok {
+			return n.Nick, true
+		}
+	}
+	return "", false
+}
+
+// SetNick attaches the nickname the recipient should know us by,
+// replacing any already attached.
+func (h *Header) SetNick(name string) {
+	for _, n := range h.Nested {
+		if n, ok := n.(*nick); ok {
+			n.Nick = name
+			return
+		}
+	}
+	h.Nested = append(h.Nested, &nick{Nick: name})
+}
+
+// Subscribe asks for a subscription to the given JID's presence. If
+// name isn't empty, it's sent as our nickname, for the contact to see
+// with the request.
+func (cl *Client) Subscribe(to, name string) error {
+	pr := &Presence{Header: Header{To: to, Type: PresenceSubscribe}}
+	if name != "" {
+		pr.SetNick(name)
+	}
+	return cl.Send(pr)
+}
@@ -0,0 +1,57 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestNickMarshal(t *testing.T) {
+	pr := &Presence{Header: Header{To: "juliet@example.com",
+		Type: "subscribe"}}
+	pr.SetNick("Romeo")
+	exp := `<presence to="juliet@example.com" ` +
+		`type="subscribe"><nick xmlns="` + NsNick + `">Romeo</nick>` +
+		`</presence>`
+	assertMarshal(t, exp, pr)
+	pr.SetNick("Montague")
+	if len(pr.Nested) != 1 {
+		t.Errorf("nested: %v", pr.Nested)
+	}
+
+	back := &Presence{}
+	if err := xml.Unmarshal([]byte(exp), back); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	m := map[string][]func(*xml.Name) interface{}{NsNick: {newNick}}
+	if err := parseExtended(&back.Header, m); err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	name, ok := back.Nick()
+	if !ok {
+		t.Fatalf("no nick: %v", back.Nested)
+	}
+	assertEquals(t, "Romeo", name)
+
+	if _, ok := (&Message{}).Nick(); ok {
+		t.Errorf("message without a nick has one")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	if err := cl.Subscribe("juliet@example.com", "Romeo"); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	pr := srv.expect("presence")
+	assertEquals(t, "subscribe", pr.attr("type"))
+	assertEquals(t, "juliet@example.com", pr.attr("to"))
+	assertEquals(t, `<nick xmlns="`+NsNick+`">Romeo</nick>`, pr.Innerxml)
+}
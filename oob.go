@@ -0,0 +1,46 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains support for out-of-band data, XEP-0066.
+
+import (
+	"encoding/xml"
+)
+
+const NsOOB = "jabber:x:oob"
+
+var oobExt Extension = Extension{StanzaHandlers: map[string]func(*xml.Name) interface{}{NsOOB: newOOB},
+	Start: func(cl *Client) {}}
+
+// A link attached to a message, typically to a file.
+type OOB struct {
+	XMLName xml.Name `xml:"jabber:x:oob x"`
+	URL     string   `xml:"url"`
+	Desc    string   `xml:"desc,omitempty"`
+}
+
+func newOOB(name *xml.Name) interface{} {
+	return &OOB{}
+}
+
+// NewOOBMessage returns a chat message carrying a link to url. The
+// body is the URL too, for clients that don't understand the link.
+func NewOOBMessage(to, url, desc string) *Message {
+	msg := &Message{Header: Header{To: to, Id: newId(), Type: "chat",
+		Nested: []interface{}{&OOB{URL: url, Desc: desc}}}}
+	msg.AddBody("", url)
+	return msg
+}
+
+// OOB returns the link attached to the message, if there is one.
+func (m *Message) OOB() (url, desc string, ok bool) {
+	for _, n := range m.Nested {
+		if o, ok := n.(*OOB); ok {
+			return o.URL, o.Desc, true
+		}
+	}
+	return "", "", false
+}
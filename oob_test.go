@@ -0,0 +1,47 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+const testOOBURL = "https://upload.example.com/a1/photo.jpg"
+
+func TestOOBMarshal(t *testing.T) {
+	msg := NewOOBMessage("a@b.c", testOOBURL, "A photo")
+	msg.Id = "1"
+	exp := `<message xmlns="` + NsClient + `" to="a@b.c" id="1" ` +
+		`type="chat"><x xmlns="` + NsOOB + `"><url>` + testOOBURL +
+		`</url><desc>A photo</desc></x><body xmlns="` + NsClient +
+		`">` + testOOBURL + `</body></message>`
+	assertMarshal(t, exp, msg)
+}
+
+func TestOOBUnmarshal(t *testing.T) {
+	str := `<message xmlns="` + NsClient + `" to="a@b.c" id="1">` +
+		`<body>` + testOOBURL + `</body><x xmlns="` + NsOOB + `">` +
+		`<url>` + testOOBURL + `</url></x></message>`
+	msg := &Message{}
+	if err := xml.Unmarshal([]byte(str), msg); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	m := map[string][]func(*xml.Name) interface{}{NsOOB: {newOOB}}
+	if err := parseExtended(&msg.Header, m); err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	url, desc, ok := msg.OOB()
+	if !ok {
+		t.Fatalf("no link: %v", msg.Nested)
+	}
+	assertEquals(t, testOOBURL, url)
+	assertEquals(t, "", desc)
+
+	msg = &Message{}
+	if _, _, ok := msg.OOB(); ok {
+		t.Errorf("plain message has a link")
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains basic support for publish-subscribe, XEP-0060.
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+const (
+	NsPubsub      = "http://jabber.org/protocol/pubsub"
+	NsPubsubEvent = "http://jabber.org/protocol/pubsub#event"
+)
+
+var pubsubExt Extension = Extension{StanzaHandlers: map[string]func(*xml.Name) interface{}{NsPubsub: newPubsub, NsPubsubEvent: newPubsubEvent},
+	Start: startPubsubFilter}
+
+// How many notifications PubsubEvents() will hold for an app that
+// isn't reading them.
+const pubsubEventsBuffer = 100
+
+type pubsub struct {
+	XMLName        xml.Name            `xml:"http://jabber.org/protocol/pubsub pubsub"`
+	Subscribe      *pubsubSubscribe    `xml:"subscribe"`
+	Subscription   *pubsubSubscription `xml:"subscription"`
+	Publish        *pubsubItems        `xml:"publish"`
+	PublishOptions *pubsubOptions      `xml:"publish-options"`
+	Items          *pubsubItems        `xml:"items"`
+}
+
+// The node configuration a publish requires, as a publish-options
+// form.
+type pubsubOptions struct {
+	Form *Form
+}
+
+type pubsubSubscribe struct {
+	Node string `xml:"node,attr"`
+	Jid  string `xml:"jid,attr"`
+}
+
+type pubsubSubscription struct {
+	Node         string `xml:"node,attr,omitempty"`
+	Jid          string `xml:"jid,attr"`
+	SubId        string `xml:"subid,attr,omitempty"`
+	Subscription string `xml:"subscription,attr,omitempty"`
+}
+
+type pubsubItems struct {
+	Node string       `xml:"node,attr"`
+	Item []pubsubItem `xml:"item"`
+}
+
+type pubsubItem struct {
+	Id      string   `xml:"id,attr,omitempty"`
+	Payload *Generic `xml:",any"`
+}
+
+type pubsubEvent struct {
+	XMLName xml.Name     `xml:"http://jabber.org/protocol/pubsub#event event"`
+	Items   *pubsubItems `xml:"items"`
+}
+
+// An item published to a pubsub node.
+type PubsubItem struct {
+	// The pubsub service and the node it was published to.
+	Service string
+	Node    string
+	Id      string
+	// The item's content. Use Unmarshal to read it into a more
+	// specific type.
+	Payload *Generic
+}
+
+type pubsubClient struct {
+	events chan PubsubItem
+}
+
+func newPubsub(name *xml.Name) interface{} {
+	return &pubsub{}
+}
+
+func newPubsubEvent(name *xml.Name) interface{} {
+	return &pubsubEvent{}
+}
+
+// The pubsub filter copies incoming notifications to PubsubEvents(),
+// and lets the messages through.
+func startPubsubFilter(client *Client) {
+	client.pubsub.events = make(chan PubsubItem, pubsubEventsBuffer)
+	client.AddFilterFunc(func(st Stanza) (Stanza, bool) {
+		if msg, ok := st.(*Message); ok {
+			client.pubsub.notify(msg)
+		}
+		return st, true
+	})
+}
+
+func (pc *pubsubClient) notify(msg *Message) {
+	for _, n := range msg.Nested {
+		ev, ok := n.(*pubsubEvent)
+		if !ok || ev.Items == nil {
+			continue
+		}
+		for _, it := range ev.Items.Item {
+			item := PubsubItem{Service: msg.From,
+				Node: ev.Items.Node, Id: it.Id,
+				Payload: it.Payload}
+			select {
+			case pc.events <- item:
+			default:
+				Warn.Logf("Pubsub event dropped: %v", item)
+			}
+		}
+	}
+}
+
+// PubsubEvents returns a channel carrying the items in notifications
+// from the nodes we're subscribed to. The messages carrying them are
+// still delivered on Client.In. The channel is buffered; if the app
+// doesn't keep up, events are dropped rather than holding up the
+// client.
+func (cl *Client) PubsubEvents() <-chan PubsubItem {
+	return cl.pubsub.events
+}
+
+// PubsubSubscribe subscribes our bare JID to a node on the given
+// pubsub service.
+func (cl *Client) PubsubSubscribe(service, node string) error {
+	jid := cl.jid()
+	iq := &Iq{Header: Header{To: service, Type: "set", Id: cl.NextId(),
+		Nested: []interface{}{&pubsub{Subscribe: &pubsubSubscribe{
+			Node: node, Jid: jid.bare()}}}}}
+	reply, err := cl.sendIq(iq)
+	if err != nil {
+		return err
+	}
+	for _, n := range reply.Nested {
+		ps, ok := n.(*pubsub)
+		if !ok || ps.Subscription == nil {
+			continue
+		}
+		switch ps.Subscription.Subscription {
+		case "", "subscribed":
+			return nil
+		default:
+			return fmt.Errorf("subscription to %s is %s", node,
+				ps.Subscription.Subscription)
+		}
+	}
+	return nil
+}
+
+// PubsubPublish publishes payload, which may be anything that
+// marshals to a single XML element, to a node on the given pubsub
+// service. If itemId is empty the service picks one. It returns the
+// id of the published item.
+func (cl *Client) PubsubPublish(service, node, itemId string, payload interface{}) (string, error) {
+	return cl.pubsubPublish(service, node, itemId, payload, nil)
+}
+
+// Like PubsubPublish, but the publish only succeeds if the node's
+// configuration matches options, which should be a submitted
+// publish-options form.
+func (cl *Client) pubsubPublish(service, node, itemId string, payload interface{}, options *Form) (string, error) {
+	g, err := marshalGeneric(payload)
+	if err != nil {
+		return "", err
+	}
+	ps := &pubsub{Publish: &pubsubItems{Node: node,
+		Item: []pubsubItem{{Id: itemId, Payload: g}}}}
+	if options != nil {
+		ps.PublishOptions = &pubsubOptions{Form: options}
+	}
+	iq := &Iq{Header: Header{To: service, Type: "set", Id: cl.NextId(),
+		Nested: []interface{}{ps}}}
+	reply, err := cl.sendIq(iq)
+	if err != nil {
+		return "", err
+	}
+	for _, n := range reply.Nested {
+		ps, ok := n.(*pubsub)
+		if ok && ps.Publish != nil && len(ps.Publish.Item) > 0 {
+			return ps.Publish.Item[0].Id, nil
+		}
+	}
+	// The service needn't say, if it used our id.
+	return itemId, nil
+}
+
+// PubsubItems fetches the items currently published to a node on
+// the given pubsub service.
+func (cl *Client) PubsubItems(service, node string) ([]PubsubItem, error) {
+	iq := &Iq{Header: Header{To: service, Type: "get", Id: cl.NextId(),
+		Nested: []interface{}{&pubsub{Items: &pubsubItems{
+			Node: node}}}}}
+	reply, err := cl.sendIq(iq)
+	if err != nil {
+		return nil, err
+	}
+	var items []PubsubItem
+	for _, n := range reply.Nested {
+		ps, ok := n.(*pubsub)
+		if !ok || ps.Items == nil {
+			continue
+		}
+		for _, it := range ps.Items.Item {
+			items = append(items, PubsubItem{Service: reply.From,
+				Node: node, Id: it.Id, Payload: it.Payload})
+		}
+	}
+	return items, nil
+}
+
+// Unmarshal decodes the item's payload into v, as xml.Unmarshal
+// would.
+func (it *PubsubItem) Unmarshal(v interface{}) error {
+	if it.Payload == nil {
+		return fmt.Errorf("pubsub item %s has no payload", it.Id)
+	}
+	buf, err := xml.Marshal(it.Payload)
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(buf, v)
+}
+
+// Converts v to a Generic with the same XML.
+func marshalGeneric(v interface{}) (*Generic, error) {
+	if g, ok := v.(*Generic); ok {
+		return g, nil
+	}
+	buf, err := xml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	g := &Generic{}
+	if err := xml.Unmarshal(buf, g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"testing"
+	"time"
+)
+
+type testTune struct {
+	XMLName struct{} `xml:"http://jabber.org/protocol/tune tune"`
+	Artist  string   `xml:"artist"`
+	Title   string   `xml:"title"`
+}
+
+func TestPubsubPublish(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	type result struct {
+		id  string
+		err error
+	}
+	results := make(chan result)
+	go func() {
+		id, err := cl.PubsubPublish("pubsub.example.com", "tunes", "",
+			&testTune{Artist: "Yes", Title: "Heart of the Sunrise"})
+		results <- result{id, err}
+	}()
+	iq := srv.expect("iq")
+	assertEquals(t, "set", iq.attr("type"))
+	assertEquals(t, "pubsub.example.com", iq.attr("to"))
+	assertEquals(t, `<pubsub xmlns="`+NsPubsub+`"><publish node="tunes">`+
+		`<item><tune xmlns="http://jabber.org/protocol/tune">`+
+		`<artist>Yes</artist><title>Heart of the Sunrise</title>`+
+		`</tune></item></publish></pubsub>`, iq.Innerxml)
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `">` +
+		`<pubsub xmlns="` + NsPubsub + `"><publish node="tunes">` +
+		`<item id="ae890ac52d0df67ed7cfdf51b644e901"/>` +
+		`</publish></pubsub></iq>`)
+	r := <-results
+	if r.err != nil {
+		t.Fatalf("PubsubPublish: %v", r.err)
+	}
+	assertEquals(t, "ae890ac52d0df67ed7cfdf51b644e901", r.id)
+}
+
+func TestPubsubSubscribe(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	errs := make(chan error)
+	go func() {
+		errs <- cl.PubsubSubscribe("pubsub.example.com", "tunes")
+	}()
+	iq := srv.expect("iq")
+	assertEquals(t, `<pubsub xmlns="`+NsPubsub+`"><subscribe node="tunes" `+
+		`jid="user@example.com"></subscribe></pubsub>`, iq.Innerxml)
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `">` +
+		`<pubsub xmlns="` + NsPubsub + `"><subscription node="tunes" ` +
+		`jid="user@example.com" subscription="pending"/>` +
+		`</pubsub></iq>`)
+	if err := <-errs; err == nil {
+		t.Error("pending subscription wasn't an error")
+	}
+}
+
+func TestPubsubEvent(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	srv.send(`<message from="pubsub.example.com" to="user@example.com">` +
+		`<event xmlns="` + NsPubsubEvent + `"><items node="tunes">` +
+		`<item id="ae890ac52d0df67ed7cfdf51b644e901">` +
+		`<tune xmlns="http://jabber.org/protocol/tune">` +
+		`<artist>Yes</artist><title>Heart of the Sunrise</title>` +
+		`</tune></item></items></event></message>`)
+
+	var item PubsubItem
+	select {
+	case item = <-cl.PubsubEvents():
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	assertEquals(t, "pubsub.example.com", item.Service)
+	assertEquals(t, "tunes", item.Node)
+	assertEquals(t, "ae890ac52d0df67ed7cfdf51b644e901", item.Id)
+	var tune testTune
+	if err := item.Unmarshal(&tune); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	assertEquals(t, "Yes", tune.Artist)
+	assertEquals(t, "Heart of the Sunrise", tune.Title)
+
+	// The message itself still arrives.
+	st := <-cl.In
+	if _, ok := st.(*Message); !ok {
+		t.Errorf("not a message: %v", st)
+	}
+}
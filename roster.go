@@ -7,35 +7,103 @@ package xmpp
 import (
 	"encoding/xml"
 	"fmt"
+	"strings"
+	"sync"
 )
 
 // This file contains support for roster management, RFC 3921, Section 7.
 
 var rosterExt Extension = Extension{StanzaHandlers: map[string]func(*xml.Name) interface{}{NsRoster: newRosterQuery}, Start: startRosterFilter}
 
-// Roster query/result
+// Roster query/result. Ver is the roster version, if the server
+// supports versioning. RFC 6121, Section 2.6.
 type RosterQuery struct {
 	XMLName xml.Name     `xml:"jabber:iq:roster query"`
+	Ver     *string      `xml:"ver,attr,omitempty"`
 	Item    []RosterItem `xml:"item"`
 }
 
-// See RFC 3921, Section 7.1.
+// Keeps a copy of the roster between sessions, so a server that
+// supports roster versioning only has to send what's changed. See
+// SetRosterStore().
+type RosterStore interface {
+	// Load returns the roster saved last, and its version. The
+	// version is "" if nothing's been saved.
+	Load() (ver string, items []RosterItem, err error)
+	// Save is called with the whole roster and its new version
+	// each time the server sends a new version.
+	Save(ver string, items []RosterItem) error
+}
+
+// See RFC 3921, Section 7.1. Ask is "subscribe" while our
+// subscription request is pending, and Approved is set if we've
+// pre-approved the contact's subscription request (RFC 6121, Section
+// 3.4).
 type RosterItem struct {
 	XMLName      xml.Name `xml:"jabber:iq:roster item"`
 	Jid          string   `xml:"jid,attr"`
 	Subscription string   `xml:"subscription,attr"`
 	Name         string   `xml:"name,attr"`
-	Group        []string
+	Ask          string   `xml:"ask,attr,omitempty"`
+	Approved     bool     `xml:"approved,attr,omitempty"`
+	Group        []string `xml:"group"`
+}
+
+// A contact asking to subscribe to our presence, or changing the
+// state of a subscription. Type is the presence type: "subscribe",
+// "subscribed", "unsubscribe" or "unsubscribed".
+type SubscriptionEvent struct {
+	From     string
+	Type     string
+	Presence *Presence
 }
 
+// Each Client keeps one of these, which connects it to its roster
+// feeder.
 type rosterClient struct {
-	rosterChan   <-chan []RosterItem
-	rosterUpdate chan<- RosterItem
+	// Where Roster() asks for a snapshot, and says where to send
+	// it.
+	rosterChan    chan<- chan<- []RosterItem
+	rosterUpdate  chan<- RosterItem
+	rosterQueries chan<- rosterQuery
+	events        chan RosterItem
+	subscriptions chan SubscriptionEvent
+	// Snapshots of SubscriptionsOnIn and RosterPushesOnIn.
+	subscriptionsOnIn bool
+	pushesOnIn        bool
+	// See SetRosterStore().
+	store   RosterStore
+	storeMu sync.Mutex
 }
 
-var (
-	rosterClients = make(map[string]rosterClient)
-)
+// A question for the roster feeder about one item, which it answers
+// without making a snapshot.
+type rosterQuery struct {
+	jid   string
+	reply chan<- rosterAnswer
+}
+
+type rosterAnswer struct {
+	item  RosterItem
+	found bool
+	// How many items the roster has.
+	len int
+}
+
+// How many roster pushes RosterEvents() and subscription changes
+// SubscriptionRequests() will hold for an app that isn't reading
+// them.
+const rosterEventsBuffer = 100
+
+// Whether the presence stanzas behind SubscriptionRequests() are also
+// delivered on Client.In. It takes effect for Clients created after
+// it's changed.
+var SubscriptionsOnIn = true
+
+// Whether the roster pushes behind RosterEvents() are also delivered
+// on Client.In. They've already been answered. It takes effect for
+// Clients created after it's changed.
+var RosterPushesOnIn = true
 
 // Implicitly becomes part of NewClient's extStanza arg.
 func newRosterQuery(name *xml.Name) interface{} {
@@ -46,76 +114,234 @@ func newRosterQuery(name *xml.Name) interface{} {
 // that information. This is called once from a fairly deep call stack
 // as part of XMPP negotiation.
 func fetchRoster(client *Client) error {
-	rosterUpdate := rosterClients[client.Uid].rosterUpdate
+	id, items, errs := client.fetchRosterAsync()
+	expired, stop := client.sessionTimer()
+	defer stop()
+	select {
+	case <-items:
+		return nil
+	case err := <-errs:
+		return err
+	case <-expired:
+		client.CancelStanza(id)
+		return &TimeoutError{Op: "roster fetch"}
+	case <-client.done:
+		return ErrClosed
+	}
+}
+
+// FetchRosterAsync asks the server for this client's roster without
+// waiting for the answer. When the answer arrives, the cached roster
+// returned by Roster() is updated and the items are delivered on the
+// first channel. If the server returns an error instead, or the
+// request can't be sent, the error is delivered on the second
+// channel. Only one of the channels will receive anything.
+func (cl *Client) FetchRosterAsync() (<-chan []RosterItem, <-chan error) {
+	_, items, errs := cl.fetchRosterAsync()
+	return items, errs
+}
+
+// Like FetchRosterAsync(), but also returns the request's id.
+func (cl *Client) fetchRosterAsync() (string, <-chan []RosterItem, <-chan error) {
+	itemCh := make(chan []RosterItem, 1)
+	errCh := make(chan error, 1)
 
-	iq := &Iq{Header: Header{From: client.Jid.String(), Type: "get",
-		Id: <-Id, Nested: []interface{}{RosterQuery{}}}}
-	ch := make(chan error)
+	// The roster we already have, if the server can tell us it's
+	// still current. Set before the request is sent, but the reply
+	// is handled on another goroutine, so they're guarded by mu.
+	var mu sync.Mutex
+	var versioned bool
+	var cached []RosterItem
+	iq := &Iq{Header: Header{Type: "get", Id: cl.NextId()}}
 	f := func(v Stanza) bool {
-		defer close(ch)
-		iq, ok := v.(*Iq)
+		if _, ok := v.(*CanceledStanza); ok {
+			errCh <- ErrCanceled
+			return false
+		}
+		reply, ok := v.(*Iq)
 		if !ok {
-			ch <- fmt.Errorf("response to iq wasn't iq: %s", v)
+			errCh <- fmt.Errorf("response to iq wasn't iq: %s", v)
 			return false
 		}
-		if iq.Type == "error" {
-			ch <- iq.Error
+		if reply.Type == "error" {
+			errCh <- reply.Error.stanzaError(cl.lang)
 			return false
 		}
 		var rq *RosterQuery
-		for _, ele := range iq.Nested {
+		for _, ele := range reply.Nested {
 			if q, ok := ele.(*RosterQuery); ok {
 				rq = q
 				break
 			}
 		}
+		mu.Lock()
+		versioned, cached := versioned, cached
+		mu.Unlock()
+		if rq == nil && versioned {
+			// What we have is current.
+			for _, item := range cached {
+				cl.updateRoster(item)
+			}
+			itemCh <- cached
+			return false
+		}
 		if rq == nil {
-			ch <- fmt.Errorf(
+			errCh <- fmt.Errorf(
 				"Roster query result not query: %v", v)
 			return false
 		}
 		for _, item := range rq.Item {
-			rosterUpdate <- item
+			cl.updateRoster(item)
 		}
-		ch <- nil
+		if versioned && rq.Ver != nil {
+			cl.saveRoster(*rq.Ver)
+		}
+		itemCh <- rq.Item
 		return false
 	}
-	client.HandleStanza(iq.Id, f)
-	client.Out <- iq
-	// Wait for f to complete.
-	return <-ch
+	cl.HandleStanzaFrom(iq.Id, iq.To, f)
+	go func() {
+		// Whether we can use versioning depends on the
+		// features the server offers with resource binding.
+		select {
+		case <-cl.Bound():
+		case <-cl.done:
+			errCh <- ErrClosed
+			return
+		}
+		jid := cl.jid()
+		iq.From = jid.String()
+		q := RosterQuery{}
+		ver, c, v := cl.loadRoster()
+		mu.Lock()
+		cached, versioned = c, v
+		mu.Unlock()
+		if v {
+			q.Ver = &ver
+		}
+		iq.Nested = []interface{}{q}
+		// Sending blocks until resource binding is done.
+		if err := cl.Send(iq); err != nil {
+			errCh <- err
+		}
+	}()
+	return iq.Id, itemCh, errCh
+}
+
+// SetRosterStore gives the client somewhere to keep the roster
+// between sessions. If the server supports roster versioning, the
+// roster is fetched from the store, and the server only sends what's
+// changed since it was saved. Set it before fetching the roster.
+func (cl *Client) SetRosterStore(store RosterStore) {
+	cl.roster.storeMu.Lock()
+	defer cl.roster.storeMu.Unlock()
+	cl.roster.store = store
+}
+
+func (cl *Client) rosterStore() RosterStore {
+	cl.roster.storeMu.Lock()
+	defer cl.roster.storeMu.Unlock()
+	return cl.roster.store
+}
+
+// Returns the stored roster version and items, and whether the
+// server will accept the version.
+func (cl *Client) loadRoster() (string, []RosterItem, bool) {
+	store := cl.rosterStore()
+	fe := cl.CurrentFeatures()
+	if store == nil || fe == nil || fe.RosterVer == nil {
+		return "", nil, false
+	}
+	ver, items, err := store.Load()
+	if err != nil {
+		Warn.Logf("Loading roster: %s", err)
+		return "", nil, true
+	}
+	if ver == "" {
+		items = nil
+	}
+	return ver, items, true
+}
+
+// Saves the current roster with the given version, if there's a
+// store.
+func (cl *Client) saveRoster(ver string) {
+	store := cl.rosterStore()
+	if store == nil {
+		return
+	}
+	if err := store.Save(ver, Roster(cl)); err != nil {
+		Warn.Logf("Saving roster: %s", err)
+	}
 }
 
 // The roster filter updates the Client's representation of the
-// roster, but it lets the relevant stanzas through. This also starts
+// roster, and lets the relevant stanzas through unless the app asked
+// not to see them. This also starts
 // the roster feeder, which is the goroutine that provides data on
 // client.Roster.
 func startRosterFilter(client *Client) {
-	out := make(chan Stanza)
-	in := client.AddFilter(out)
-	go func(in <-chan Stanza, out chan<- Stanza) {
-		defer close(out)
-		for st := range in {
-			maybeUpdateRoster(client, st)
-			out <- st
+	rosterCh := make(chan chan<- []RosterItem)
+	rosterUpdate := make(chan RosterItem)
+	rosterQueries := make(chan rosterQuery)
+	client.roster = rosterClient{rosterChan: rosterCh,
+		rosterUpdate:      rosterUpdate,
+		rosterQueries:     rosterQueries,
+		events:            make(chan RosterItem, rosterEventsBuffer),
+		subscriptions:     make(chan SubscriptionEvent, rosterEventsBuffer),
+		subscriptionsOnIn: SubscriptionsOnIn,
+		pushesOnIn:        RosterPushesOnIn}
+	go feedRoster(rosterCh, rosterUpdate, rosterQueries, client.done)
+
+	client.AddFilterFunc(func(st Stanza) (Stanza, bool) {
+		if maybeUpdateRoster(client, st) {
+			return st, client.roster.pushesOnIn
+		}
+		if client.roster.subscription(st) {
+			return st, client.roster.subscriptionsOnIn
 		}
-	}(in, out)
+		return st, true
+	})
+}
 
-	rosterCh := make(chan []RosterItem)
-	rosterUpdate := make(chan RosterItem)
-	rosterClients[client.Uid] = rosterClient{rosterChan: rosterCh,
-		rosterUpdate: rosterUpdate}
-	go feedRoster(rosterCh, rosterUpdate)
+// Passes a subscription change on to SubscriptionRequests(). Returns
+// true if st was one.
+func (rc *rosterClient) subscription(st Stanza) bool {
+	pr, ok := st.(*Presence)
+	if !ok {
+		return false
+	}
+	switch pr.Type {
+	case PresenceSubscribe, PresenceSubscribed, PresenceUnsubscribe,
+		PresenceUnsubscribed:
+	default:
+		return false
+	}
+	ev := SubscriptionEvent{From: pr.From, Type: pr.Type, Presence: pr}
+	select {
+	case rc.subscriptions <- ev:
+	default:
+		Warn.Logf("Subscription event dropped: %v", ev)
+	}
+	return true
 }
 
-func maybeUpdateRoster(client *Client, st interface{}) {
+// Hands item to the roster feeder, unless the client has shut down.
+func (cl *Client) updateRoster(item RosterItem) {
+	select {
+	case cl.roster.rosterUpdate <- item:
+	case <-cl.done:
+	}
+}
+
+// Applies st if it's a roster push, and answers it. Returns true if
+// it was one.
+func maybeUpdateRoster(client *Client, st interface{}) bool {
 	iq, ok := st.(*Iq)
 	if !ok {
-		return
+		return false
 	}
 
-	rosterUpdate := rosterClients[client.Uid].rosterUpdate
-
 	var rq *RosterQuery
 	for _, ele := range iq.Nested {
 		if q, ok := ele.(*RosterQuery); ok {
@@ -123,39 +349,140 @@ func maybeUpdateRoster(client *Client, st interface{}) {
 			break
 		}
 	}
-	if iq.Type == "set" && rq != nil {
-		for _, item := range rq.Item {
-			rosterUpdate <- item
+	if iq.Type != "set" || rq == nil {
+		return false
+	}
+	for _, item := range rq.Item {
+		client.updateRoster(item)
+		select {
+		case client.roster.events <- item:
+		default:
+			Warn.Logf("Roster event dropped: %v", item)
 		}
-		// Send a reply.
-		reply := &Iq{Header: Header{To: iq.From, Id: iq.Id,
-			Type: "result"}}
-		client.Out <- reply
 	}
+	if rq.Ver != nil {
+		client.saveRoster(*rq.Ver)
+	}
+	// Send a reply.
+	reply := &Iq{Header: Header{To: iq.From, Id: iq.Id,
+		Type: "result"}}
+	client.Send(reply)
+	return true
 }
 
-func feedRoster(rosterCh chan<- []RosterItem, rosterUpdate <-chan RosterItem) {
+// The roster feeder owns the roster. Updates only touch the map; the
+// snapshot Roster() copies is made when it's asked for, and kept
+// until the next update, so loading a large roster doesn't copy it
+// once per item.
+func feedRoster(rosterCh <-chan chan<- []RosterItem, rosterUpdate <-chan RosterItem, queries <-chan rosterQuery, done <-chan struct{}) {
 	roster := make(map[string]RosterItem)
-	snapshot := []RosterItem{}
+	// Nil when it's out of date.
+	var snapshot []RosterItem
 	for {
 		select {
+		case q := <-queries:
+			it, ok := roster[q.jid]
+			q.reply <- rosterAnswer{item: it, found: ok,
+				len: len(roster)}
 		case newIt := <-rosterUpdate:
 			if newIt.Subscription == "remove" {
 				delete(roster, newIt.Jid)
 			} else {
 				roster[newIt.Jid] = newIt
 			}
-		case rosterCh <- snapshot:
-		}
-		snapshot = make([]RosterItem, 0, len(roster))
-		for _, v := range roster {
-			snapshot = append(snapshot, v)
+			snapshot = nil
+		case reply := <-rosterCh:
+			if snapshot == nil {
+				snapshot = make([]RosterItem, 0, len(roster))
+				for _, v := range roster {
+					snapshot = append(snapshot, v)
+				}
+			}
+			// Each caller gets its own copy, to sort or
+			// change as it likes.
+			reply <- append(make([]RosterItem, 0, len(snapshot)),
+				snapshot...)
+		case <-done:
+			return
 		}
 	}
 }
 
-// Retrieve a snapshot of the roster for the given Client.
+// RosterEvents returns a channel carrying each roster item the server
+// pushes to this client, once it's been applied to the roster
+// returned by Roster(). Removals arrive as items with a Subscription
+// of "remove". The channel is buffered; if the app doesn't keep up,
+// events are dropped rather than holding up the client.
+func (cl *Client) RosterEvents() <-chan RosterItem {
+	return cl.roster.events
+}
+
+// SubscriptionRequests returns a channel carrying the subscription
+// requests and changes contacts send us. Unless SubscriptionsOnIn
+// was false when the client was created, the presence stanzas are
+// still delivered on Client.In too. The channel is buffered; if the
+// app doesn't keep up, events are dropped rather than holding up the
+// client.
+func (cl *Client) SubscriptionRequests() <-chan SubscriptionEvent {
+	return cl.roster.subscriptions
+}
+
+// ProbePresence asks for the current presence of the contact with the
+// given JID, which the contact's server answers for them. Servers
+// probe contacts themselves when we come online, so apps rarely need
+// this. Only contacts whose presence we're subscribed to will answer,
+// so it warns about any other.
+func (cl *Client) ProbePresence(jid string) {
+	if i := strings.Index(jid, "/"); i >= 0 {
+		jid = jid[:i]
+	}
+	it, _ := cl.RosterItem(jid)
+	if it.Subscription != "to" && it.Subscription != "both" {
+		Warn.Logf("Probing %s, whose presence we're not subscribed to",
+			jid)
+	}
+	pr := &Presence{Header: Header{To: jid, Type: PresenceProbe}}
+	if err := cl.Send(pr); err != nil {
+		Warn.Logf("presence probe to %s: %s", jid, err)
+	}
+}
+
+// RosterLen returns how many items are in the roster, without copying
+// it as Roster() does.
+func (cl *Client) RosterLen() int {
+	a, _ := cl.roster.query("", cl.done)
+	return a.len
+}
+
+// RosterItem looks up the roster item for jid, without copying the
+// whole roster as Roster() does. It returns false if there isn't one.
+func (cl *Client) RosterItem(jid string) (RosterItem, bool) {
+	a, _ := cl.roster.query(jid, cl.done)
+	return a.item, a.found
+}
+
+// Asks the roster feeder about jid. Returns false if the client has
+// shut down.
+func (rc *rosterClient) query(jid string, done <-chan struct{}) (rosterAnswer, bool) {
+	reply := make(chan rosterAnswer, 1)
+	select {
+	case rc.rosterQueries <- rosterQuery{jid: jid, reply: reply}:
+		return <-reply, true
+	case <-done:
+		return rosterAnswer{}, false
+	}
+}
+
+// Retrieve a snapshot of the roster for the given Client. The roster
+// is empty until it's been fetched from the server, either by
+// StartSession() or FetchRosterAsync(), and once the client has shut
+// down.
 func Roster(client *Client) []RosterItem {
-	rosterChan := rosterClients[client.Uid].rosterChan
-	return <-rosterChan
+	reply := make(chan []RosterItem, 1)
+	select {
+	case client.roster.rosterChan <- reply:
+		return <-reply
+	case <-client.done:
+		return nil
+	}
 }
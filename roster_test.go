@@ -6,8 +6,12 @@ package xmpp
 
 import (
 	"encoding/xml"
+	"errors"
+	"fmt"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 // This is mostly just tests of the roster data structures.
@@ -25,7 +29,8 @@ func TestRosterIqUnmarshal(t *testing.T) {
 		NsRoster + `"><item jid="a@b.c"/></query></iq>`
 	iq := Iq{}
 	xml.Unmarshal([]byte(str), &iq)
-	m := map[string]func(*xml.Name) interface{}{NsRoster: newRosterQuery}
+	m := map[string][]func(*xml.Name) interface{}{
+		NsRoster: {newRosterQuery}}
 	err := parseExtended(&iq.Header, m)
 	if err != nil {
 		t.Fatalf("parseExtended: %v", err)
@@ -53,3 +58,433 @@ func TestRosterIqUnmarshal(t *testing.T) {
 	item := rq.Item[0]
 	assertEquals(t, "a@b.c", item.Jid)
 }
+
+func TestRosterPerClient(t *testing.T) {
+	cl1, srv1 := newTestClient(t)
+	defer cl1.Close()
+	cl2, srv2 := newTestClient(t)
+	defer cl2.Close()
+	for _, srv := range []*fakeServer{srv1, srv2} {
+		srv.open(`<bind xmlns="` + NsBind + `"/>`)
+		srv.bind()
+	}
+
+	rosterPush(t, cl1, srv1, `<item jid="a@b.c" subscription="both"/>`)
+	rosterPush(t, cl2, srv2, `<item jid="d@e.f" subscription="to"/>`)
+
+	r1 := Roster(cl1)
+	if len(r1) != 1 || r1[0].Jid != "a@b.c" {
+		t.Errorf("roster 1: %v", r1)
+	}
+	r2 := Roster(cl2)
+	if len(r2) != 1 || r2[0].Jid != "d@e.f" {
+		t.Errorf("roster 2: %v", r2)
+	}
+}
+
+// Push a roster update to the client, and check that it replies.
+func rosterPush(t *testing.T, cl *Client, srv *fakeServer, items string) {
+	srv.send(`<iq type="set" id="push1"><query xmlns="` + NsRoster + `">` +
+		items + `</query></iq>`)
+	reply := srv.expect("iq")
+	assertEquals(t, "push1", reply.attr("id"))
+	assertEquals(t, "result", reply.attr("type"))
+	<-cl.In
+}
+
+func TestRosterEvents(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<bind xmlns="` + NsBind + `"/>`)
+	srv.bind()
+
+	rosterPush(t, cl, srv, `<item jid="a@b.c" subscription="both"/>`)
+	rosterPush(t, cl, srv, `<item jid="a@b.c" subscription="remove"/>`)
+
+	ev := <-cl.RosterEvents()
+	assertEquals(t, "a@b.c", ev.Jid)
+	assertEquals(t, "both", ev.Subscription)
+	ev = <-cl.RosterEvents()
+	assertEquals(t, "remove", ev.Subscription)
+	if r := Roster(cl); len(r) != 0 {
+		t.Errorf("roster not empty: %v", r)
+	}
+}
+
+func TestRosterItem(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<bind xmlns="` + NsBind + `"/>`)
+	srv.bind()
+
+	assertEquals(t, "0", fmt.Sprint(cl.RosterLen()))
+	rosterPush(t, cl, srv, `<item jid="a@b.c" name="Alice" `+
+		`subscription="both"/><item jid="d@e.f" subscription="to"/>`)
+	// The push is applied before it's delivered.
+	it, ok := cl.RosterItem("a@b.c")
+	if !ok {
+		t.Fatal("a@b.c not found")
+	}
+	assertEquals(t, "Alice", it.Name)
+	assertEquals(t, "both", it.Subscription)
+	if _, ok := cl.RosterItem("x@y.z"); ok {
+		t.Error("found x@y.z")
+	}
+	assertEquals(t, fmt.Sprint(len(Roster(cl))), fmt.Sprint(cl.RosterLen()))
+	assertEquals(t, "2", fmt.Sprint(cl.RosterLen()))
+}
+
+func TestRosterItemUnmarshal(t *testing.T) {
+	str := `<item xmlns="` + NsRoster + `" jid="a@b.c" name="A"` +
+		` subscription="none" ask="subscribe" approved="true">` +
+		`<group>Friends</group><group>Work</group></item>`
+	var item RosterItem
+	if err := xml.Unmarshal([]byte(str), &item); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	assertEquals(t, "a@b.c", item.Jid)
+	assertEquals(t, "A", item.Name)
+	assertEquals(t, "none", item.Subscription)
+	assertEquals(t, "subscribe", item.Ask)
+	if !item.Approved {
+		t.Errorf("not approved")
+	}
+	if !reflect.DeepEqual(item.Group, []string{"Friends", "Work"}) {
+		t.Errorf("groups: %v", item.Group)
+	}
+}
+
+func TestRosterItemMarshal(t *testing.T) {
+	item := RosterItem{Jid: "a@b.c", Name: "A", Group: []string{"Friends"}}
+	exp := `<item xmlns="` + NsRoster + `" jid="a@b.c" subscription=""` +
+		` name="A"><group>Friends</group></item>`
+	assertMarshal(t, exp, item)
+
+	item.Ask = "subscribe"
+	item.Approved = true
+	exp = `<item xmlns="` + NsRoster + `" jid="a@b.c" subscription=""` +
+		` name="A" ask="subscribe" approved="true"><group>Friends</group></item>`
+	assertMarshal(t, exp, item)
+}
+
+func TestRosterRoundTrip(t *testing.T) {
+	items := []RosterItem{
+		{Jid: "a@b.c", Subscription: "both", Name: "A",
+			Group: []string{"Friends"}},
+		{Jid: "d@e.f", Subscription: "none", Ask: "subscribe"},
+	}
+	iq := &Iq{Header: Header{Type: "result", Id: "r1",
+		Nested: []interface{}{RosterQuery{Item: items}}}}
+	buf, err := xml.Marshal(iq)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	obs := Iq{}
+	if err := xml.Unmarshal(buf, &obs); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	m := map[string][]func(*xml.Name) interface{}{
+		NsRoster: {newRosterQuery}}
+	if err := parseExtended(&obs.Header, m); err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	if len(obs.Nested) != 1 {
+		t.Fatalf("nested: %v", obs.Nested)
+	}
+	rq := obs.Nested[0].(*RosterQuery)
+	if len(rq.Item) != len(items) {
+		t.Fatalf("items: %v", rq.Item)
+	}
+	for i, item := range rq.Item {
+		item.XMLName = xml.Name{}
+		if !reflect.DeepEqual(items[i], item) {
+			t.Errorf("item %d\ngot:  %#v\nwant: %#v", i, item, items[i])
+		}
+	}
+}
+
+func TestFetchRosterAsync(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<bind xmlns="` + NsBind + `"/>`)
+	srv.bind()
+
+	items, errs := cl.FetchRosterAsync()
+	iq := srv.expect("iq")
+	assertEquals(t, "get", iq.attr("type"))
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `"><query xmlns="` +
+		NsRoster + `"><item jid="a@b.c" subscription="both"/></query></iq>`)
+	select {
+	case r := <-items:
+		if len(r) != 1 || r[0].Jid != "a@b.c" {
+			t.Errorf("items: %v", r)
+		}
+	case err := <-errs:
+		t.Fatalf("FetchRosterAsync: %v", err)
+	}
+	if r := Roster(cl); len(r) != 1 {
+		t.Errorf("roster: %v", r)
+	}
+
+	items, errs = cl.FetchRosterAsync()
+	iq = srv.expect("iq")
+	srv.send(`<iq type="error" id="` + iq.attr("id") + `"><error type="cancel">` +
+		`<service-unavailable xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/>` +
+		`</error></iq>`)
+	select {
+	case r := <-items:
+		t.Fatalf("expected error, got %v", r)
+	case err := <-errs:
+		var xerr *Error
+		if !errors.As(err, &xerr) {
+			t.Fatalf("not *Error: %T %v", err, err)
+		}
+		assertEquals(t, "cancel", xerr.Type)
+	}
+}
+
+func TestSubscriptionRequests(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	srv.send(`<presence from="juliet@example.com" type="subscribe" ` +
+		`id="sub1"><status>Wherefore art thou?</status></presence>`)
+	var ev SubscriptionEvent
+	select {
+	case ev = <-cl.SubscriptionRequests():
+	case <-time.After(5 * time.Second):
+		t.Fatal("no subscription event")
+	}
+	assertEquals(t, "juliet@example.com", ev.From)
+	assertEquals(t, "subscribe", ev.Type)
+	assertEquals(t, "sub1", ev.Presence.Id)
+
+	// The presence itself still arrives.
+	select {
+	case st := <-cl.In:
+		if pr, ok := st.(*Presence); !ok || pr.Id != "sub1" {
+			t.Errorf("not the presence: %#v", st)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no presence")
+	}
+}
+
+func TestSubscriptionsNotOnIn(t *testing.T) {
+	SubscriptionsOnIn = false
+	defer func() { SubscriptionsOnIn = true }()
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	srv.send(`<presence from="juliet@example.com" type="unsubscribed"/>`)
+	srv.send(`<message from="juliet@example.com" id="m1"/>`)
+	expectMessage(t, cl, "m1")
+	ev := <-cl.SubscriptionRequests()
+	assertEquals(t, "unsubscribed", ev.Type)
+}
+
+func TestRosterPushesNotOnIn(t *testing.T) {
+	RosterPushesOnIn = false
+	defer func() { RosterPushesOnIn = true }()
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	srv.send(`<iq type="set" id="push1"><query xmlns="` + NsRoster + `">` +
+		`<item jid="a@b.c" subscription="both"/></query></iq>`)
+	reply := srv.expect("iq")
+	assertEquals(t, "push1", reply.attr("id"))
+	srv.send(`<message from="juliet@example.com" id="m1"/>`)
+	expectMessage(t, cl, "m1")
+	ev := <-cl.RosterEvents()
+	assertEquals(t, "a@b.c", ev.Jid)
+}
+
+func TestProbePresence(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	rosterPush(t, cl, srv, `<item jid="juliet@example.com" subscription="to"/>`)
+	cl.ProbePresence("juliet@example.com/balcony")
+	pr := srv.expect("presence")
+	assertEquals(t, "probe", pr.attr("type"))
+	// Probes go to the account, not one resource.
+	assertEquals(t, "juliet@example.com", pr.attr("to"))
+
+	// Not subscribed, but sent anyway.
+	cl.ProbePresence("mercutio@example.com")
+	pr = srv.expect("presence")
+	assertEquals(t, "probe", pr.attr("type"))
+	assertEquals(t, "mercutio@example.com", pr.attr("to"))
+}
+
+// A RosterStore in memory.
+type testRosterStore struct {
+	sync.Mutex
+	ver   string
+	items []RosterItem
+	saved chan string
+}
+
+func (s *testRosterStore) Load() (string, []RosterItem, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.ver, s.items, nil
+}
+
+func (s *testRosterStore) Save(ver string, items []RosterItem) error {
+	s.Lock()
+	s.ver, s.items = ver, items
+	s.Unlock()
+	s.saved <- ver
+	return nil
+}
+
+const rosterVerFeatures = bindFeatures +
+	`<ver xmlns="urn:xmpp:features:rosterver"/>`
+
+func TestRosterVersioning(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	store := &testRosterStore{ver: "v1", saved: make(chan string, 10),
+		items: []RosterItem{{Jid: "juliet@example.com",
+			Subscription: "both"}}}
+	cl.SetRosterStore(store)
+	srv.open(rosterVerFeatures)
+	srv.bind()
+
+	// Nothing's changed, so the server sends an empty result.
+	items, errs := cl.FetchRosterAsync()
+	iq := srv.expect("iq")
+	assertEquals(t, `<query xmlns="`+NsRoster+`" ver="v1"></query>`,
+		iq.Innerxml)
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `"/>`)
+	select {
+	case r := <-items:
+		if len(r) != 1 || r[0].Jid != "juliet@example.com" {
+			t.Errorf("items: %v", r)
+		}
+	case err := <-errs:
+		t.Fatalf("FetchRosterAsync: %v", err)
+	}
+	if r := Roster(cl); len(r) != 1 {
+		t.Errorf("roster: %v", r)
+	}
+
+	// A push brings a new version.
+	srv.send(`<iq type="set" id="push1"><query xmlns="` + NsRoster +
+		`" ver="v2"><item jid="nurse@example.com" subscription="none"/>` +
+		`</query></iq>`)
+	select {
+	case ver := <-store.saved:
+		assertEquals(t, "v2", ver)
+	case <-time.After(5 * time.Second):
+		t.Fatal("roster not saved")
+	}
+	_, saved, _ := store.Load()
+	if len(saved) != 2 {
+		t.Errorf("saved: %v", saved)
+	}
+	srv.expect("iq")
+}
+
+func TestRosterVersioningUnsupported(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	cl.SetRosterStore(&testRosterStore{ver: "v1"})
+	srv.open(bindFeatures)
+	srv.bind()
+
+	cl.FetchRosterAsync()
+	iq := srv.expect("iq")
+	assertEquals(t, `<query xmlns="`+NsRoster+`"></query>`, iq.Innerxml)
+}
+
+// A Client with nothing but a roster feeder, which runs until done is
+// closed.
+func newTestFeeder() *Client {
+	rosterCh := make(chan chan<- []RosterItem)
+	rosterUpdate := make(chan RosterItem)
+	rosterQueries := make(chan rosterQuery)
+	cl := &Client{done: make(chan struct{})}
+	cl.roster = rosterClient{rosterChan: rosterCh,
+		rosterUpdate: rosterUpdate, rosterQueries: rosterQueries}
+	go feedRoster(rosterCh, rosterUpdate, rosterQueries, cl.done)
+	return cl
+}
+
+func TestRosterSnapshot(t *testing.T) {
+	cl := newTestFeeder()
+	defer close(cl.done)
+
+	if r := Roster(cl); r == nil || len(r) != 0 {
+		t.Fatalf("empty roster: %#v", r)
+	}
+	for i := 0; i < 3; i++ {
+		cl.updateRoster(RosterItem{Jid: fmt.Sprintf("%d@b.c", i)})
+	}
+	first := Roster(cl)
+	if len(first) != 3 {
+		t.Fatalf("roster: %v", first)
+	}
+	cl.updateRoster(RosterItem{Jid: "1@b.c", Subscription: "remove"})
+	cl.updateRoster(RosterItem{Jid: "2@b.c", Name: "Two"})
+	r := Roster(cl)
+	if len(r) != 2 {
+		t.Fatalf("roster: %v", r)
+	}
+	for _, it := range r {
+		switch it.Jid {
+		case "0@b.c":
+		case "2@b.c":
+			assertEquals(t, "Two", it.Name)
+		default:
+			t.Errorf("unexpected item %v", it)
+		}
+	}
+	// An earlier snapshot isn't changed under the app.
+	if len(first) != 3 {
+		t.Errorf("earlier snapshot changed: %v", first)
+	}
+}
+
+func TestRosterSnapshotCopies(t *testing.T) {
+	cl := newTestFeeder()
+	defer close(cl.done)
+
+	cl.updateRoster(RosterItem{Jid: "a@b.c", Name: "A"})
+	r1 := Roster(cl)
+	r2 := Roster(cl)
+	r1[0].Name = "changed"
+	assertEquals(t, "A", r2[0].Name)
+	assertEquals(t, "A", Roster(cl)[0].Name)
+}
+
+// Load a large roster an item at a time, as the initial fetch does,
+// then take a snapshot.
+func BenchmarkRosterLoad(b *testing.B) {
+	items := make([]RosterItem, 5000)
+	for i := range items {
+		items[i] = RosterItem{Jid: fmt.Sprintf("contact%d@example.com", i),
+			Subscription: "both"}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cl := newTestFeeder()
+		for _, it := range items {
+			cl.updateRoster(it)
+		}
+		if len(Roster(cl)) != len(items) {
+			b.Fatal("short roster")
+		}
+		close(cl.done)
+	}
+}
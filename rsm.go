@@ -0,0 +1,121 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains support for result set management, XEP-0059.
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+)
+
+const NsRSM = "http://jabber.org/protocol/rsm"
+
+var rsmExt Extension = Extension{StanzaHandlers: map[string]func(*xml.Name) interface{}{NsRSM: newRSMSet},
+	Start: func(cl *Client) {}}
+
+// Describes a page of results, either the one we'd like (Max, After,
+// Before, Index) or the one the server returned (First, Last,
+// Count). A request for the last page has an empty, non-nil Before.
+type RSMSet struct {
+	XMLName xml.Name  `xml:"http://jabber.org/protocol/rsm set"`
+	Max     *int      `xml:"max,omitempty"`
+	After   string    `xml:"after,omitempty"`
+	Before  *string   `xml:"before,omitempty"`
+	Index   *int      `xml:"index,omitempty"`
+	First   *RSMFirst `xml:"first,omitempty"`
+	Last    string    `xml:"last,omitempty"`
+	Count   *int      `xml:"count,omitempty"`
+}
+
+// The id of the first item in a page, and that item's position in
+// the full result set.
+type RSMFirst struct {
+	Index *int   `xml:"index,attr,omitempty"`
+	Id    string `xml:",chardata"`
+}
+
+func newRSMSet(name *xml.Name) interface{} {
+	return &RSMSet{}
+}
+
+// Ask for up to max items following the item with id after, or the
+// first page if after is empty.
+func RSMAfter(max int, after string) *RSMSet {
+	return &RSMSet{Max: &max, After: after}
+}
+
+// Ask for up to max items preceding the item with id before, or the
+// last page if before is empty.
+func RSMBefore(max int, before string) *RSMSet {
+	return &RSMSet{Max: &max, Before: &before}
+}
+
+// RSM returns the result set description in a stanza, such as the
+// reply to a paged query, or nil if there isn't one.
+func (h *Header) RSM() *RSMSet {
+	for _, n := range h.Nested {
+		if set, ok := n.(*RSMSet); ok {
+			return set
+		}
+	}
+	return nil
+}
+
+// WithRSM returns a value that marshals as query, with set added as
+// its last child. Use it in Nested to page through the results of a
+// query type that doesn't have a field for the set.
+func WithRSM(query interface{}, set *RSMSet) interface{} {
+	return &rsmQuery{query, set}
+}
+
+type rsmQuery struct {
+	query interface{}
+	set   *RSMSet
+}
+
+func (q *rsmQuery) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	buf, err := xml.Marshal(q.query)
+	if err != nil {
+		return err
+	}
+	// Copy the query's tokens, slipping the set in before the
+	// final end tag.
+	d := xml.NewDecoder(bytes.NewReader(buf))
+	depth := 0
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch tt := t.(type) {
+		case xml.StartElement:
+			depth++
+			// The encoder declares the namespaces itself.
+			var attrs []xml.Attr
+			for _, a := range tt.Attr {
+				if a.Name.Space != "xmlns" && a.Name.Local != "xmlns" {
+					attrs = append(attrs, a)
+				}
+			}
+			tt.Attr = attrs
+			t = tt
+		case xml.EndElement:
+			depth--
+			if depth == 0 && q.set != nil {
+				if err := e.Encode(q.set); err != nil {
+					return err
+				}
+			}
+		}
+		if err := e.EncodeToken(xml.CopyToken(t)); err != nil {
+			return err
+		}
+	}
+}
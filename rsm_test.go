@@ -0,0 +1,61 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"strconv"
+	"testing"
+)
+
+func TestRSMMarshal(t *testing.T) {
+	exp := `<set xmlns="` + NsRSM + `"><max>10</max>` +
+		`<after>item9</after></set>`
+	assertMarshal(t, exp, RSMAfter(10, "item9"))
+
+	exp = `<set xmlns="` + NsRSM + `"><max>10</max><before></before></set>`
+	assertMarshal(t, exp, RSMBefore(10, ""))
+
+	// Forward paging through a query that doesn't know about
+	// result sets.
+	iq := &Iq{Header: Header{Type: "get", Id: "1",
+		Nested: []interface{}{WithRSM(RosterQuery{}, RSMAfter(10, ""))}}}
+	exp = `<iq id="1" type="get"><query xmlns="` + NsRoster + `">` +
+		`<set xmlns="` + NsRSM + `"><max>10</max></set></query></iq>`
+	assertMarshal(t, exp, iq)
+}
+
+func TestRSMUnmarshal(t *testing.T) {
+	str := `<iq xmlns="` + NsClient + `" type="result" id="1">` +
+		`<query xmlns="http://jabber.org/protocol/disco#items">` +
+		`<item jid="a.example.com"/>` +
+		`<set xmlns="` + NsRSM + `"><first index="20">a1</first>` +
+		`<last>a9</last><count>800</count></set></query></iq>`
+	iq := &Iq{}
+	if err := xml.Unmarshal([]byte(str), iq); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	m := map[string][]func(*xml.Name) interface{}{NsRSM: {newRSMSet}}
+	if err := parseExtended(&iq.Header, m); err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	set := iq.RSM()
+	if set == nil {
+		t.Fatalf("no set: %v", iq.Nested)
+	}
+	if set.First == nil || set.First.Index == nil {
+		t.Fatalf("first: %v", set.First)
+	}
+	assertEquals(t, "a1", set.First.Id)
+	assertEquals(t, "20", strconv.Itoa(*set.First.Index))
+	assertEquals(t, "a9", set.Last)
+	if set.Count == nil || *set.Count != 800 {
+		t.Errorf("count: %v", set.Count)
+	}
+	// The query itself is still there for the app.
+	if len(iq.UnknownElements()) != 1 {
+		t.Errorf("unknown: %v", iq.UnknownElements())
+	}
+}
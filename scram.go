@@ -0,0 +1,210 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains support for SCRAM-SHA-1 authentication, RFC
+// 5802, including the SCRAM-SHA-1-PLUS variant which binds the
+// authentication to the TLS channel using tls-unique.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The state of a SCRAM exchange with the server.
+type scram struct {
+	password string
+	// The GS2 header and the channel binding data to send with
+	// it, if any.
+	gs2Header string
+	cbind     []byte
+	nonce     string
+	// client-first-message-bare, which is part of the
+	// AuthMessage.
+	clientFirstBare string
+	// What we expect the server to prove it knows. Nil until
+	// we've sent our proof.
+	serverSignature []byte
+	// Whether the server has proved it.
+	verified bool
+}
+
+// Start a SCRAM exchange. If cbind is non-nil, the client supports
+// tls-unique channel binding and cbind is the binding data; plus
+// indicates whether we're using it (SCRAM-SHA-1-PLUS) or merely
+// telling the server we could have (SCRAM-SHA-1). A non-empty authzid
+// asks to be authorized as someone other than username.
+func newScram(username, authzid, password, nonce string, cbind []byte, plus bool) *scram {
+	s := &scram{password: password, nonce: nonce}
+	switch {
+	case cbind != nil && plus:
+		s.gs2Header = "p=tls-unique,"
+		s.cbind = cbind
+	case cbind != nil:
+		s.gs2Header = "y,"
+	default:
+		s.gs2Header = "n,"
+	}
+	if authzid != "" {
+		s.gs2Header += "a=" + scramName(authzid)
+	}
+	s.gs2Header += ","
+	s.clientFirstBare = "n=" + scramName(username) + ",r=" + nonce
+	return s
+}
+
+// Generate a random client nonce.
+func scramNonce() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// Escape a username as a SCRAM saslname.
+func scramName(name string) string {
+	name = strings.Replace(name, "=", "=3D", -1)
+	return strings.Replace(name, ",", "=2C", -1)
+}
+
+func (s *scram) clientFirst() string {
+	return s.gs2Header + s.clientFirstBare
+}
+
+// Compute client-final-message from server-first-message.
+func (s *scram) clientFinal(serverFirst string) (string, error) {
+	attrs := scramAttrs(serverFirst)
+	if _, ok := attrs["m"]; ok {
+		return "", errors.New("SCRAM: unsupported extension")
+	}
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, s.nonce) || len(nonce) == len(s.nonce) {
+		return "", errors.New("SCRAM: bad server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return "", fmt.Errorf("SCRAM: bad salt: %s", err)
+	}
+	iter, err := strconv.Atoi(attrs["i"])
+	if err != nil || iter < 1 {
+		return "", fmt.Errorf("SCRAM: bad iteration count %q",
+			attrs["i"])
+	}
+
+	cbind := append([]byte(s.gs2Header), s.cbind...)
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString(cbind) +
+		",r=" + nonce
+	authMessage := []byte(s.clientFirstBare + "," + serverFirst + "," +
+		withoutProof)
+
+	salted := scramHi([]byte(s.password), salt, iter)
+	clientKey := scramHmac(salted, []byte("Client Key"))
+	storedKey := sha1.Sum(clientKey)
+	clientSig := scramHmac(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSig[i]
+	}
+	serverKey := scramHmac(salted, []byte("Server Key"))
+	s.serverSignature = scramHmac(serverKey, authMessage)
+
+	return withoutProof + ",p=" +
+		base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// Check the server's server-final-message.
+func (s *scram) verify(serverFinal string) error {
+	attrs := scramAttrs(serverFinal)
+	if e, ok := attrs["e"]; ok {
+		return errors.New("SCRAM: server error: " + e)
+	}
+	sig, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || s.serverSignature == nil ||
+		!hmac.Equal(sig, s.serverSignature) {
+		return errors.New("SCRAM: server signature mismatch")
+	}
+	s.verified = true
+	return nil
+}
+
+// Split a SCRAM message into its attributes.
+func scramAttrs(msg string) map[string]string {
+	m := make(map[string]string)
+	for _, field := range strings.Split(msg, ",") {
+		if i := strings.Index(field, "="); i > 0 {
+			m[field[:i]] = field[i+1:]
+		}
+	}
+	return m
+}
+
+func scramHmac(key, data []byte) []byte {
+	h := hmac.New(sha1.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// The Hi() function from RFC 5802, which is PBKDF2 with HMAC-SHA-1.
+func scramHi(password, salt []byte, iter int) []byte {
+	u := scramHmac(password, append(salt, 0, 0, 0, 1))
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iter; i++ {
+		u = scramHmac(password, u)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+// Begin SCRAM authentication with the given mechanism.
+func (cl *Client) startScram(mechanism string) {
+	nonce, err := scramNonce()
+	if err != nil {
+		Warn.Logf("SCRAM rand: %s", err)
+		return
+	}
+	cl.scram = newScram(cl.saslUsername(), cl.authzid, cl.password, nonce,
+		cl.tlsUnique, strings.HasSuffix(mechanism, "-PLUS"))
+	b64 := base64.StdEncoding
+	auth := &auth{XMLName: xml.Name{Space: NsSASL, Local: "auth"},
+		Mechanism: mechanism,
+		Chardata:  b64.EncodeToString([]byte(cl.scram.clientFirst()))}
+	cl.xmlOut <- auth
+}
+
+// Answer a SCRAM challenge from the server. The first is
+// server-first-message; the server may also send
+// server-final-message as a challenge rather than with <success/>.
+func (cl *Client) scramChallenge(challenge string) {
+	b64 := base64.StdEncoding
+	var resp string
+	if cl.scram.serverSignature == nil {
+		var err error
+		resp, err = cl.scram.clientFinal(challenge)
+		if err != nil {
+			Warn.Log(err)
+			cl.saslAbort()
+			return
+		}
+		resp = b64.EncodeToString([]byte(resp))
+	} else if err := cl.scram.verify(challenge); err != nil {
+		Warn.Log(err)
+		cl.saslAbort()
+		return
+	}
+	clObj := &auth{XMLName: xml.Name{Space: NsSASL, Local: "response"},
+		Chardata: resp}
+	cl.xmlOut <- clObj
+}
@@ -0,0 +1,265 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The example exchange from RFC 5802, Section 5.
+const (
+	scramTestNonce       = "fyko+d2lbbFgONRv9qkxdawL"
+	scramTestServerFirst = "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j," +
+		"s=QSXCR+Q6sek8bf92,i=4096"
+)
+
+func TestScram(t *testing.T) {
+	s := newScram("user", "", "pencil", scramTestNonce, nil, false)
+	assertEquals(t, "n,,n=user,r="+scramTestNonce, s.clientFirst())
+	final, err := s.clientFinal(scramTestServerFirst)
+	if err != nil {
+		t.Fatalf("clientFinal: %v", err)
+	}
+	assertEquals(t, "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,"+
+		"p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=", final)
+	if err := s.verify("v=rmF9pqV8S7suAoZWja4dJRkFsKQ="); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+	if err := s.verify("v=AAAAAAAAAAAAAAAAAAAAAAAAAAA="); err == nil {
+		t.Errorf("bad server signature accepted")
+	}
+}
+
+func TestScramPlus(t *testing.T) {
+	cbind := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+	s := newScram("user", "", "pencil", scramTestNonce, cbind, true)
+	assertEquals(t, "p=tls-unique,,n=user,r="+scramTestNonce,
+		s.clientFirst())
+	final, err := s.clientFinal(scramTestServerFirst)
+	if err != nil {
+		t.Fatalf("clientFinal: %v", err)
+	}
+	assertEquals(t, "c=cD10bHMtdW5pcXVlLCwAAQIDBAUGBwgJCgs=,"+
+		"r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,"+
+		"p=ResgVA2w6fEFiwzXkrPSGTt/RSg=", final)
+	if err := s.verify("v=HKBeWjn99U5AvtgAjz6m1d81mhk="); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+
+	// A client that could do channel binding but wasn't offered
+	// it says so.
+	s = newScram("user", "", "pencil", scramTestNonce, cbind, false)
+	assertEquals(t, "y,,n=user,r="+scramTestNonce, s.clientFirst())
+}
+
+func TestScramAuthzid(t *testing.T) {
+	s := newScram("user", "admin@example.com", "pencil", scramTestNonce,
+		nil, false)
+	assertEquals(t, "n,a=admin@example.com,n=user,r="+scramTestNonce,
+		s.clientFirst())
+	s = newScram("user", "a=b,c", "pencil", scramTestNonce, nil, false)
+	assertEquals(t, "n,a=a=3Db=2Cc,n=user,r="+scramTestNonce,
+		s.clientFirst())
+}
+
+func TestPlainAuthzid(t *testing.T) {
+	assertEquals(t, "\x00user\x00pencil", plainPayload("", "user", "pencil"))
+
+	cert := testCertificate(t)
+	TlsConfig.InsecureSkipVerify = true
+	defer func() { TlsConfig.InsecureSkipVerify = false }()
+	AuthzID = "admin@example.com"
+	defer func() { AuthzID = "" }()
+
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<starttls xmlns="` + NsTLS + `"/>`)
+	srv.expect("starttls")
+	srv = srv.startTls(cert)
+	srv.open(`<mechanisms xmlns="` + NsSASL + `">` +
+		`<mechanism>PLAIN</mechanism></mechanisms>`)
+	auth := srv.expect("auth")
+	assertEquals(t, "PLAIN", auth.attr("mechanism"))
+	payload, _ := base64.StdEncoding.DecodeString(auth.Innerxml)
+	assertEquals(t, "admin@example.com\x00user\x00secret", string(payload))
+}
+
+func TestPlainWithoutTls(t *testing.T) {
+	AllowPlainWithoutTLS = true
+	defer func() { AllowPlainWithoutTLS = false }()
+
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<mechanisms xmlns="` + NsSASL + `">` +
+		`<mechanism>PLAIN</mechanism></mechanisms>`)
+	auth := srv.expect("auth")
+	assertEquals(t, "PLAIN", auth.attr("mechanism"))
+	srv.send(`<failure xmlns="` + NsSASL + `"><not-authorized/></failure>`)
+}
+
+func TestPlainRefusedWithoutTls(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<mechanisms xmlns="` + NsSASL + `">` +
+		`<mechanism>PLAIN</mechanism></mechanisms>`)
+
+	errs := make(chan error)
+	go func() {
+		errs <- cl.StartSession(false, nil)
+	}()
+	// The password never goes out, and we don't wait for the
+	// handshake to time out.
+	var ae *AuthError
+	select {
+	case err := <-errs:
+		if !errors.As(err, &ae) {
+			t.Fatalf("StartSession: %#v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartSession didn't fail")
+	}
+	select {
+	case el, ok := <-srv.in:
+		if ok && el.XMLName.Local == "auth" {
+			t.Errorf("sent <auth/>: %s", el.Innerxml)
+		}
+	case <-time.After(time.Second):
+	}
+}
+
+func TestScramBadServer(t *testing.T) {
+	s := newScram("user", "", "pencil", scramTestNonce, nil, false)
+	if _, err := s.clientFinal("r=someoneelse,s=QSXCR+Q6sek8bf92,i=4096"); err == nil {
+		t.Errorf("foreign nonce accepted")
+	}
+	if _, err := s.clientFinal("r=" + scramTestNonce + "x,s=QSXCR+Q6sek8bf92,i=0"); err == nil {
+		t.Errorf("zero iterations accepted")
+	}
+	if err := s.verify("v=rmF9pqV8S7suAoZWja4dJRkFsKQ="); err == nil {
+		t.Errorf("server signature accepted before the proof was sent")
+	}
+}
+
+func TestScramName(t *testing.T) {
+	assertEquals(t, "a=2Cb=3Dc", scramName("a,b=c"))
+}
+
+// Authenticate a Client with SCRAM-SHA-1 against the fake server.
+func TestScramAuth(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<mechanisms xmlns="` + NsSASL + `">` +
+		`<mechanism>DIGEST-MD5</mechanism>` +
+		`<mechanism>SCRAM-SHA-1</mechanism></mechanisms>`)
+
+	b64 := base64.StdEncoding
+	auth := srv.expect("auth")
+	assertEquals(t, "SCRAM-SHA-1", auth.attr("mechanism"))
+	first, err := b64.DecodeString(auth.Innerxml)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !strings.HasPrefix(string(first), "n,,n=user,r=") {
+		t.Fatalf("client-first: %s", first)
+	}
+	nonce := strings.TrimPrefix(string(first), "n,,n=user,r=")
+
+	// Play the server's part using the client's own code.
+	serverFirst := "r=" + nonce + "srv,s=QSXCR+Q6sek8bf92,i=16"
+	expect := newScram("user", "", "secret", nonce, nil, false)
+	final, _ := expect.clientFinal(serverFirst)
+	srv.send(`<challenge xmlns="` + NsSASL + `">` +
+		b64.EncodeToString([]byte(serverFirst)) + `</challenge>`)
+	resp := srv.expect("response")
+	got, _ := b64.DecodeString(resp.Innerxml)
+	assertEquals(t, final, string(got))
+
+	v := "v=" + b64.EncodeToString(expect.serverSignature)
+	srv.send(`<success xmlns="` + NsSASL + `">` +
+		b64.EncodeToString([]byte(v)) + `</success>`)
+	srv.expect("stream")
+}
+
+func TestScramPlusOverTls(t *testing.T) {
+	cert := testCertificate(t)
+	TlsConfig.InsecureSkipVerify = true
+	defer func() { TlsConfig.InsecureSkipVerify = false }()
+
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<starttls xmlns="` + NsTLS + `"/>`)
+	srv.expect("starttls")
+	srv = srv.startTls(cert)
+	srv.open(`<mechanisms xmlns="` + NsSASL + `">` +
+		`<mechanism>SCRAM-SHA-1</mechanism>` +
+		`<mechanism>SCRAM-SHA-1-PLUS</mechanism></mechanisms>`)
+	auth := srv.expect("auth")
+	assertEquals(t, "SCRAM-SHA-1-PLUS", auth.attr("mechanism"))
+	first, _ := base64.StdEncoding.DecodeString(auth.Innerxml)
+	if !strings.HasPrefix(string(first), "p=tls-unique,,n=user,r=") {
+		t.Errorf("client-first: %s", first)
+	}
+}
+
+func TestAuthFailure(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<mechanisms xmlns="` + NsSASL + `">` +
+		`<mechanism>SCRAM-SHA-1</mechanism></mechanisms>`)
+	srv.expect("auth")
+
+	errs := make(chan error)
+	go func() {
+		errs <- cl.StartSession(false, nil)
+	}()
+	srv.send(`<failure xmlns="` + NsSASL + `"><not-authorized/>` +
+		`<text>Wrong password</text></failure>`)
+	var ae *AuthError
+	if err := <-errs; !errors.As(err, &ae) {
+		t.Fatalf("StartSession: %#v", err)
+	}
+	assertEquals(t, "not-authorized", ae.Condition)
+	assertEquals(t, "Wrong password", ae.Text)
+	if err := nextError(t, cl); err != error(ae) {
+		t.Errorf("reported %v", err)
+	}
+}
+
+// A server that skips server-final hasn't proved it knows our
+// password.
+func TestScramSuccessUnverified(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<mechanisms xmlns="` + NsSASL + `">` +
+		`<mechanism>SCRAM-SHA-1</mechanism></mechanisms>`)
+
+	b64 := base64.StdEncoding
+	auth := srv.expect("auth")
+	first, _ := b64.DecodeString(auth.Innerxml)
+	nonce := strings.TrimPrefix(string(first), "n,,n=user,r=")
+	serverFirst := "r=" + nonce + "srv,s=QSXCR+Q6sek8bf92,i=16"
+	srv.send(`<challenge xmlns="` + NsSASL + `">` +
+		b64.EncodeToString([]byte(serverFirst)) + `</challenge>`)
+	srv.expect("response")
+
+	errs := make(chan error)
+	go func() {
+		errs <- cl.StartSession(false, nil)
+	}()
+	srv.send(`<success xmlns="` + NsSASL + `"/>`)
+	var ae *AuthError
+	select {
+	case err := <-errs:
+		if !errors.As(err, &ae) {
+			t.Fatalf("StartSession: %#v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartSession didn't fail")
+	}
+}
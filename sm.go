@@ -0,0 +1,418 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains support for stream management, XEP-0198.
+
+import (
+	"encoding/xml"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// How often we ask the server to acknowledge the stanzas
+	// we've sent it, if there are any it hasn't acknowledged yet.
+	smAckInterval = 30 * time.Second
+
+	// How many unacknowledged stanzas we keep for resending, by
+	// default.
+	defaultSmQueueMax = 1000
+)
+
+// Returned by RequestAck() if the server hasn't enabled stream
+// management.
+var ErrSmNotEnabled = errors.New("stream management isn't enabled")
+
+// Used for all the stream management elements: enable, enabled,
+// resume, resumed, failed, r, and a.
+type smElement struct {
+	XMLName  xml.Name
+	Id       string  `xml:"id,attr,omitempty"`
+	Previd   string  `xml:"previd,attr,omitempty"`
+	Resume   string  `xml:"resume,attr,omitempty"`
+	Location string  `xml:"location,attr,omitempty"`
+	H        *uint32 `xml:"h,attr,omitempty"`
+	Any      *Generic
+}
+
+// Stream management state. This is shared between readStream(),
+// which counts the stanzas we've received, and writeStream(), which
+// counts the ones we've sent.
+type smState struct {
+	sync.Mutex
+	// True once the server has accepted our <enable/> or
+	// <resume/>.
+	enabled bool
+	// True while we're waiting for the answer to <resume/>.
+	resuming bool
+	// The stream id, if the server will let us resume this
+	// stream after losing the connection.
+	id string
+	// Where the server would like us to reconnect to, if
+	// anywhere in particular.
+	location string
+	// How many stanzas the server has acknowledged, and how many
+	// we've received from it.
+	acked   uint32
+	handled uint32
+	// Stanzas we've sent which the server hasn't acknowledged,
+	// oldest first, and the number of stanzas sent before the
+	// first one in the queue.
+	queue []Stanza
+	base  uint32
+	// The most stanzas we'll keep in the queue. If it overflows,
+	// the oldest stanza is dropped and sent on the dropped
+	// channel.
+	queueMax int
+	dropped  chan Stanza
+}
+
+// AckCount returns the number of stanzas which the server has
+// confirmed it received. It's always 0 if the server doesn't support
+// stream management.
+func (cl *Client) AckCount() uint32 {
+	cl.sm.Lock()
+	defer cl.sm.Unlock()
+	return cl.sm.acked
+}
+
+// RequestAck asks the server to say how many of our stanzas it has
+// handled, without waiting for the client to ask on its own. The
+// request follows whatever has already been sent on Client.Out, and
+// AckCount() goes up once the server answers.
+func (cl *Client) RequestAck() error {
+	cl.sm.Lock()
+	enabled := cl.sm.enabled
+	cl.sm.Unlock()
+	if !enabled {
+		return ErrSmNotEnabled
+	}
+	select {
+	case cl.ackRequests <- struct{}{}:
+		return nil
+	case <-cl.done:
+		return ErrClosed
+	}
+}
+
+// SetSmQueueMax sets the most stanzas the client will hold on to
+// while waiting for the server to acknowledge them. Those stanzas are
+// sent again if the connection drops and the stream is resumed. Zero
+// means no limit.
+func (cl *Client) SetSmQueueMax(n int) {
+	cl.sm.Lock()
+	defer cl.sm.Unlock()
+	cl.sm.queueMax = n
+	cl.sm.trim()
+}
+
+// SmDropped returns a channel on which the client reports stanzas it
+// has given up on: either they overflowed the resend queue before the
+// server acknowledged them, or the server refused to resume the stream
+// after they were sent. In either case the server may or may not have
+// received them. If the app doesn't read from this channel, some of
+// these reports will be lost.
+func (cl *Client) SmDropped() <-chan Stanza {
+	return cl.sm.dropped
+}
+
+func (sm *smState) stanzaSent(st Stanza) {
+	sm.Lock()
+	defer sm.Unlock()
+	if sm.enabled {
+		sm.queue = append(sm.queue, st)
+		sm.trim()
+	}
+}
+
+func (sm *smState) stanzaHandled() {
+	sm.Lock()
+	defer sm.Unlock()
+	if sm.enabled {
+		sm.handled++
+	}
+}
+
+// Returns true if we've sent stanzas the server hasn't acknowledged.
+func (sm *smState) unacked() bool {
+	sm.Lock()
+	defer sm.Unlock()
+	return sm.enabled && sm.sent() != sm.acked
+}
+
+// The number of stanzas sent since stream management was enabled.
+// Called with the lock held.
+func (sm *smState) sent() uint32 {
+	return sm.base + uint32(len(sm.queue))
+}
+
+// Forget the stanzas the server has acknowledged. Called with the
+// lock held.
+func (sm *smState) ack(h uint32) {
+	sm.acked = h
+	for len(sm.queue) > 0 && int32(h-sm.base) > 0 {
+		sm.queue[0] = nil
+		sm.queue = sm.queue[1:]
+		sm.base++
+	}
+	if int32(h-sm.base) > 0 {
+		Warn.Logf("Server acknowledged %d stanzas, but we sent %d",
+			h, sm.base)
+		sm.base = h
+	}
+}
+
+// Enforce queueMax. Called with the lock held.
+func (sm *smState) trim() {
+	for sm.queueMax > 0 && len(sm.queue) > sm.queueMax {
+		sm.drop(sm.queue[0])
+		sm.queue[0] = nil
+		sm.queue = sm.queue[1:]
+		sm.base++
+	}
+}
+
+// Report a stanza we're no longer able to resend. Called with the
+// lock held.
+func (sm *smState) drop(st Stanza) {
+	select {
+	case sm.dropped <- st:
+	default:
+		Warn.Logf("Dropped unacknowledged stanza: %v", st)
+	}
+}
+
+// Give up on the stream, and report the stanzas we can no longer
+// resend. Called with the lock held.
+func (sm *smState) reset() {
+	sm.enabled = false
+	sm.resuming = false
+	sm.id = ""
+	sm.location = ""
+	for _, st := range sm.queue {
+		sm.drop(st)
+	}
+	sm.queue = nil
+}
+
+// Returns true if we can try to resume this stream on a new
+// connection.
+func (sm *smState) resumable() bool {
+	sm.Lock()
+	defer sm.Unlock()
+	return sm.id != ""
+}
+
+// Where the server would like us to reconnect to resume the stream,
+// or "" if it doesn't mind or we can't resume.
+func (sm *smState) resumeLocation() string {
+	sm.Lock()
+	defer sm.Unlock()
+	if sm.id == "" {
+		return ""
+	}
+	return sm.location
+}
+
+// Ask the server to enable stream management. This happens after
+// resource binding.
+func (cl *Client) enableSm() {
+	en := &smElement{XMLName: xml.Name{Space: NsSM, Local: "enable"},
+		Resume: "true"}
+	cl.xmlOut <- en
+}
+
+// Ask the server to resume the stream we lost. This happens instead
+// of resource binding.
+func (cl *Client) resumeSm() {
+	cl.sm.Lock()
+	h := cl.sm.handled
+	res := &smElement{XMLName: xml.Name{Space: NsSM, Local: "resume"},
+		Previd: cl.sm.id, H: &h}
+	cl.sm.enabled = false
+	cl.sm.resuming = true
+	cl.sm.Unlock()
+	cl.xmlOut <- res
+}
+
+func (cl *Client) handleSm(se *smElement) {
+	cl.sm.Lock()
+	switch se.XMLName.Local {
+	case "enabled":
+		cl.sm.enabled = true
+		cl.sm.acked = 0
+		cl.sm.handled = 0
+		cl.sm.base = 0
+		cl.sm.queue = nil
+		if se.Resume == "true" || se.Resume == "1" {
+			cl.sm.id = se.Id
+			cl.sm.location = se.Location
+		}
+		cl.sm.Unlock()
+		Info.Log("Stream management enabled")
+		cl.bindDone()
+	case "resumed":
+		cl.sm.enabled = true
+		cl.sm.resuming = false
+		if se.H != nil {
+			cl.sm.ack(*se.H)
+			// Anything that fell out of the queue is gone
+			// for good; the stanzas we still have are
+			// numbered from what the server last saw.
+			cl.sm.base = *se.H
+		}
+		resend := make([]Stanza, len(cl.sm.queue))
+		copy(resend, cl.sm.queue)
+		cl.sm.Unlock()
+		Info.Logf("Stream resumed; resending %d stanzas", len(resend))
+		cl.enterPhase(Bound)
+		for _, st := range resend {
+			cl.xmlOut <- st
+		}
+		cl.bindDone()
+	case "failed":
+		resuming := cl.sm.resuming
+		cl.sm.reset()
+		cl.sm.Unlock()
+		if resuming {
+			// Start over with a new session.
+			Info.Log("Stream resumption failed")
+			cl.bind(cl.Features.Bind)
+			return
+		}
+		Warn.Logf("Can't enable stream management: %v", se.Any)
+		cl.bindDone()
+	case "r":
+		h := cl.sm.handled
+		cl.sm.Unlock()
+		a := &smElement{XMLName: xml.Name{Space: NsSM, Local: "a"},
+			H: &h}
+		cl.xmlOut <- a
+	case "a":
+		if se.H != nil {
+			cl.sm.ack(*se.H)
+		}
+		cl.sm.Unlock()
+		cl.stats.ponged()
+	default:
+		cl.sm.Unlock()
+		Warn.Logf("Unknown stream management element: %s",
+			se.XMLName.Local)
+	}
+}
+
+// Called from readStream() when the connection to the server is
+// lost. If the server agreed to let us resume the stream, or the app
+// asked for EnableAutoReconnect(), we dial again and start a new
+// negotiation, which will end in <resume/> or resource binding.
+// Returns the new source of XML from the server, or nil if the
+// client should shut down.
+func (cl *Client) reconnect() <-chan interface{} {
+	select {
+	case <-cl.done:
+		return nil
+	case <-cl.writeClosed:
+		// The server closed its side after we closed ours.
+		return nil
+	default:
+	}
+	resume := cl.sm.resumable()
+	if cl.dial == nil || !resume && !cl.autoReconnecting() {
+		return nil
+	}
+	if resume {
+		Info.Log("Connection lost; trying to resume the stream")
+	} else {
+		Info.Log("Connection lost; reconnecting")
+		cl.sm.Lock()
+		cl.sm.reset()
+		cl.sm.Unlock()
+	}
+
+	// Hold the app's traffic until the stream is resumed, and
+	// tear down what's left of the old connection.
+	select {
+	case cl.inputControl <- 0:
+	case <-cl.done:
+		return nil
+	}
+	select {
+	case cl.xmlOutCh <- nil:
+	case <-cl.done:
+		return nil
+	}
+	cl.socket.Close()
+	cl.transportSync.Wait()
+
+	tcp, err := cl.redial()
+	if err != nil {
+		cl.reportError(err)
+		return nil
+	}
+	cl.stats.reconnected()
+	cl.negotiated = false
+	cl.restart = restartNone
+	cl.setFeatures(nil)
+	cl.saslExpected = ""
+	cl.scram = nil
+	cl.tlsUnique = nil
+	xmlIn := cl.startConn(tcp)
+	select {
+	case cl.xmlOutCh <- cl.xmlOut:
+	case <-cl.done:
+		close(cl.xmlOut)
+		return nil
+	}
+
+	cl.xmlOut <- cl.streamHeader()
+	cl.startHandshakeTimer()
+	return xmlIn
+}
+
+// How long to wait before each attempt to reconnect.
+var reconnectDelays = []time.Duration{0, time.Second, 10 * time.Second,
+	time.Minute}
+
+// How many see-other-host errors in a row the client follows before
+// deciding the servers are sending it in circles.
+const maxRedirects = 5
+
+// Dial the server, retrying a few times if necessary. When resuming,
+// we try the location the server gave us first.
+func (cl *Client) redial() (net.Conn, error) {
+	dial := cl.dial
+	if host := cl.otherHost; host != "" {
+		dial = func() (net.Conn, error) {
+			return cl.dialOtherHost(host)
+		}
+	} else if loc := cl.sm.resumeLocation(); loc != "" {
+		dial = func() (net.Conn, error) {
+			tcp, err := cl.dialOtherHost(loc)
+			if err == nil {
+				return tcp, nil
+			}
+			Warn.Logf("Can't resume at %s: %s", loc, err)
+			return cl.dial()
+		}
+	}
+	var err error
+	for _, d := range reconnectDelays {
+		select {
+		case <-time.After(d):
+		case <-cl.done:
+			return nil, ErrClosed
+		}
+		var tcp net.Conn
+		tcp, err = dial()
+		if err == nil {
+			return tcp, nil
+		}
+		Warn.Logf("reconnect: %s", err)
+	}
+	return nil, err
+}
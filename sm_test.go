@@ -0,0 +1,216 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"net"
+	"testing"
+)
+
+const smFeatures = `<bind xmlns="` + NsBind + `"/><sm xmlns="` + NsSM + `"/>`
+
+func TestSmMarshal(t *testing.T) {
+	h := uint32(0)
+	a := &smElement{XMLName: xml.Name{Space: NsSM, Local: "a"}, H: &h}
+	assertMarshal(t, `<a xmlns="`+NsSM+`" h="0"></a>`, a)
+
+	en := &smElement{XMLName: xml.Name{Space: NsSM, Local: "enable"}, Resume: "true"}
+	assertMarshal(t, `<enable xmlns="`+NsSM+`" resume="true"></enable>`, en)
+}
+
+func TestSmEnable(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer close(cl.Out)
+
+	srv.open(smFeatures)
+	srv.bind()
+	en := srv.expect("enable")
+	assertEquals(t, NsSM, en.XMLName.Space)
+	assertEquals(t, "true", en.attr("resume"))
+	srv.send(`<enabled xmlns="` + NsSM + `" id="sm1" resume="true"/>`)
+
+	cl.Out <- &Message{Header: Header{To: "a@b.c", Id: "m1"}}
+	srv.expect("message")
+
+	// Nothing has arrived from the server yet.
+	srv.send(`<r xmlns="` + NsSM + `"/>`)
+	a := srv.expect("a")
+	assertEquals(t, "0", a.attr("h"))
+
+	srv.send(`<message from="a@b.c" id="m2"><body>hi</body></message>`)
+	<-cl.In
+	srv.send(`<r xmlns="` + NsSM + `"/>`)
+	a = srv.expect("a")
+	assertEquals(t, "1", a.attr("h"))
+
+	srv.send(`<a xmlns="` + NsSM + `" h="1"/>`)
+	waitFor(t, func() bool { return cl.AckCount() == 1 })
+	if !cl.sm.resumable() {
+		t.Errorf("stream should be resumable")
+	}
+}
+
+func TestSmNotAdvertised(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer close(cl.Out)
+
+	srv.open(`<bind xmlns="` + NsBind + `"/>`)
+	srv.bind()
+
+	// No <enable/> should be sent; the next thing the server sees
+	// is the app's traffic.
+	cl.Out <- &Message{Header: Header{To: "a@b.c", Id: "m1"}}
+	srv.expect("message")
+	if cl.AckCount() != 0 {
+		t.Errorf("AckCount %d", cl.AckCount())
+	}
+	if err := cl.RequestAck(); err != ErrSmNotEnabled {
+		t.Errorf("RequestAck: %v", err)
+	}
+}
+
+// Start a session with stream management enabled and resumable.
+func smSession(t *testing.T, dial func() (net.Conn, error)) (*Client, *fakeServer) {
+	cl, srv := newTestClientDial(t, dial)
+	srv.open(smFeatures)
+	srv.bind()
+	srv.expect("enable")
+	srv.send(`<enabled xmlns="` + NsSM + `" id="sm1" resume="true"/>`)
+	return cl, srv
+}
+
+func TestSmResend(t *testing.T) {
+	servers := make(chan *fakeServer, 1)
+	dial := func() (net.Conn, error) {
+		c, s := net.Pipe()
+		servers <- newFakeServer(t, s)
+		return c, nil
+	}
+	cl, srv := smSession(t, dial)
+	defer close(cl.Out)
+
+	ids := []string{"m1", "m2", "m3", "m4"}
+	for _, id := range ids {
+		cl.Out <- &Message{Header: Header{To: "a@b.c", Id: id}}
+		srv.expect("message")
+	}
+
+	// The server only got the first two before the connection
+	// dropped.
+	srv.conn.Close()
+	srv = <-servers
+	srv.open(smFeatures)
+	res := srv.expect("resume")
+	assertEquals(t, "sm1", res.attr("previd"))
+	assertEquals(t, "0", res.attr("h"))
+	srv.send(`<resumed xmlns="` + NsSM + `" previd="sm1" h="2"/>`)
+
+	for _, id := range ids[2:] {
+		msg := srv.expect("message")
+		assertEquals(t, id, msg.attr("id"))
+	}
+	if cl.AckCount() != 2 {
+		t.Errorf("AckCount %d", cl.AckCount())
+	}
+
+	// The app's traffic flows again.
+	cl.Out <- &Message{Header: Header{To: "a@b.c", Id: "m5"}}
+	msg := srv.expect("message")
+	assertEquals(t, "m5", msg.attr("id"))
+}
+
+// Start a resumable session whose server asks us to resume at loc.
+func smLocationSession(t *testing.T, dial func() (net.Conn, error), loc string) (*Client, *fakeServer) {
+	cl, srv := newTestClientDial(t, dial)
+	srv.open(smFeatures)
+	srv.bind()
+	srv.expect("enable")
+	srv.send(`<enabled xmlns="` + NsSM + `" id="sm1" resume="true" ` +
+		`location="` + loc + `"/>`)
+	return cl, srv
+}
+
+func TestSmResumeLocation(t *testing.T) {
+	l := otherHost(t)
+	defer l.Close()
+	dial := func() (net.Conn, error) {
+		t.Errorf("dialed the original server")
+		return nil, errors.New("no")
+	}
+	cl, srv := smLocationSession(t, dial, l.Addr().String())
+	defer close(cl.Out)
+	cl.Out <- &Message{Header: Header{To: "a@b.c", Id: "m1"}}
+	srv.expect("message")
+
+	srv.conn.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	srv = newFakeServer(t, conn)
+	srv.open(smFeatures)
+	assertEquals(t, "sm1", srv.expect("resume").attr("previd"))
+	srv.send(`<resumed xmlns="` + NsSM + `" previd="sm1" h="1"/>`)
+	cl.Out <- &Message{Header: Header{To: "a@b.c", Id: "m2"}}
+	assertEquals(t, "m2", srv.expect("message").attr("id"))
+}
+
+func TestSmResumeLocationFallback(t *testing.T) {
+	// Nothing's listening at the location any more.
+	l := otherHost(t)
+	loc := l.Addr().String()
+	l.Close()
+	servers := make(chan *fakeServer, 1)
+	dial := func() (net.Conn, error) {
+		c, s := net.Pipe()
+		servers <- newFakeServer(t, s)
+		return c, nil
+	}
+	cl, srv := smLocationSession(t, dial, loc)
+	defer close(cl.Out)
+
+	srv.conn.Close()
+	srv = <-servers
+	srv.open(smFeatures)
+	assertEquals(t, "sm1", srv.expect("resume").attr("previd"))
+}
+
+func TestRequestAck(t *testing.T) {
+	cl, srv := smSession(t, nil)
+	defer close(cl.Out)
+
+	cl.Out <- &Message{Header: Header{To: "a@b.c", Id: "m1"}}
+	srv.expect("message")
+	if err := cl.RequestAck(); err != nil {
+		t.Fatalf("RequestAck: %v", err)
+	}
+	srv.expect("r")
+	srv.send(`<a xmlns="` + NsSM + `" h="1"/>`)
+	waitFor(t, func() bool { return cl.AckCount() == 1 })
+}
+
+func TestSmQueueOverflow(t *testing.T) {
+	cl, srv := smSession(t, nil)
+	defer close(cl.Out)
+	cl.SetSmQueueMax(2)
+
+	for _, id := range []string{"m1", "m2", "m3"} {
+		cl.Out <- &Message{Header: Header{To: "a@b.c", Id: id}}
+		srv.expect("message")
+	}
+	st := <-cl.SmDropped()
+	assertEquals(t, "m1", st.GetHeader().Id)
+
+	srv.send(`<a xmlns="` + NsSM + `" h="3"/>`)
+	waitFor(t, func() bool { return cl.AckCount() == 3 })
+	cl.sm.Lock()
+	n := len(cl.sm.queue)
+	cl.sm.Unlock()
+	if n != 0 {
+		t.Errorf("%d stanzas still queued", n)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains the counters behind Client.Stats().
+
+import (
+	"sync"
+	"time"
+)
+
+// Counters describing a Client's connection to the server, for
+// monitoring. They cover the client's whole life, across
+// reconnections.
+type Stats struct {
+	IqSent, IqReceived             uint64
+	MessagesSent, MessagesReceived uint64
+	PresenceSent, PresenceReceived uint64
+	// Bytes on the socket, including TLS overhead.
+	BytesRead, BytesWritten uint64
+	// How many times the client has connected to the server again
+	// after losing its connection.
+	Reconnects uint64
+	// Incoming stanzas discarded because the app wasn't reading
+	// Client.In. See InOverflow.
+	InDropped uint64
+	// How long the server took to answer the most recent stream
+	// management ack request, or 0 if it hasn't answered one.
+	PingRTT time.Duration
+}
+
+type clientStats struct {
+	sync.Mutex
+	Stats
+	// When we sent the ack request the server hasn't answered.
+	pingSent time.Time
+}
+
+// Stats returns a snapshot of the client's counters.
+func (cl *Client) Stats() Stats {
+	cl.stats.Lock()
+	defer cl.stats.Unlock()
+	return cl.stats.Stats
+}
+
+func (cs *clientStats) stanzaSent(st Stanza) {
+	cs.Lock()
+	defer cs.Unlock()
+	switch st.(type) {
+	case *Iq:
+		cs.IqSent++
+	case *Message:
+		cs.MessagesSent++
+	case *Presence:
+		cs.PresenceSent++
+	}
+}
+
+func (cs *clientStats) stanzaReceived(st Stanza) {
+	cs.Lock()
+	defer cs.Unlock()
+	switch st.(type) {
+	case *Iq:
+		cs.IqReceived++
+	case *Message:
+		cs.MessagesReceived++
+	case *Presence:
+		cs.PresenceReceived++
+	}
+}
+
+func (cs *clientStats) read(n int) {
+	cs.Lock()
+	defer cs.Unlock()
+	cs.BytesRead += uint64(n)
+}
+
+func (cs *clientStats) written(n int) {
+	cs.Lock()
+	defer cs.Unlock()
+	cs.BytesWritten += uint64(n)
+}
+
+func (cs *clientStats) reconnected() {
+	cs.Lock()
+	defer cs.Unlock()
+	cs.Reconnects++
+	// Any ack request went down with the old connection.
+	cs.pingSent = time.Time{}
+}
+
+func (cs *clientStats) inDropped() {
+	cs.Lock()
+	defer cs.Unlock()
+	cs.InDropped++
+}
+
+// Called when we send <r/>. If there's already one outstanding, the
+// answer to that one will do.
+func (cs *clientStats) pinged() {
+	cs.Lock()
+	defer cs.Unlock()
+	if cs.pingSent.IsZero() {
+		cs.pingSent = time.Now()
+	}
+}
+
+// Called when the server sends <a/>.
+func (cs *clientStats) ponged() {
+	cs.Lock()
+	defer cs.Unlock()
+	if !cs.pingSent.IsZero() {
+		cs.PingRTT = time.Since(cs.pingSent)
+		cs.pingSent = time.Time{}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	c, s := net.Pipe()
+	conn := &countingConn{Conn: c}
+	srv := newFakeServer(t, s)
+	jid := &JID{Node: "user", Domain: "example.com", Resource: "res"}
+	cl, err := newClient(conn, nil, jid, "secret", nil)
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	cl.Send(&Message{Header: Header{To: "a@b.c", Id: "m1"}})
+	cl.Send(&Message{Header: Header{To: "a@b.c", Id: "m2"}})
+	cl.Send(&Presence{})
+	srv.expect("message")
+	srv.expect("message")
+	srv.expect("presence")
+
+	srv.send(`<message id="m3" from="a@b.c"/>`)
+	srv.send(`<presence from="a@b.c/d"/>`)
+	srv.send(`<presence from="e@b.c/d"/>`)
+	expectMessage(t, cl, "m3")
+	<-cl.In
+	<-cl.In
+
+	// The bind request and its answer count too.
+	waitFor(t, func() bool { return cl.Stats().IqSent == 1 })
+	st := cl.Stats()
+	if st.IqSent != 1 || st.MessagesSent != 2 || st.PresenceSent != 1 {
+		t.Errorf("sent: %+v", st)
+	}
+	if st.IqReceived != 1 || st.MessagesReceived != 1 ||
+		st.PresenceReceived != 2 {
+		t.Errorf("received: %+v", st)
+	}
+	if st.Reconnects != 0 || st.PingRTT != 0 {
+		t.Errorf("stats: %+v", st)
+	}
+	waitFor(t, func() bool {
+		st := cl.Stats()
+		read, written := conn.bytes()
+		return st.BytesRead == uint64(read) &&
+			st.BytesWritten == uint64(written)
+	})
+	if st := cl.Stats(); st.BytesRead == 0 || st.BytesWritten == 0 {
+		t.Errorf("bytes: %+v", st)
+	}
+}
+
+func TestStatsPingRTT(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	// As if the ticker had asked for an ack.
+	cl.stats.pinged()
+	time.Sleep(10 * time.Millisecond)
+	srv.send(`<a xmlns="` + NsSM + `" h="0"/>`)
+	waitFor(t, func() bool { return cl.Stats().PingRTT != 0 })
+	if rtt := cl.Stats().PingRTT; rtt < 10*time.Millisecond {
+		t.Errorf("rtt %s", rtt)
+	}
+}
@@ -11,17 +11,21 @@
 package xmpp
 
 import (
+	"bytes"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"math/big"
 	"net"
-	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -30,29 +34,38 @@ type stanzaHandler struct {
 	id string
 	// Return true means pass this to the application
 	f func(Stanza) bool
+	// If checkFrom is set, only a stanza from whoever the request
+	// went to is given to f. See replyFrom().
+	from      string
+	checkFrom bool
 }
 
 // BUG(cjyar) Review all these *Client receiver methods. They should
 // probably either all be receivers, or none.
 
-func (cl *Client) readTransport(w io.WriteCloser) {
+// Reads from the socket until it's closed, then closes done. The only
+// read deadline is the one handleTls() sets to interrupt us; see
+// pauseReader().
+func (cl *Client) readTransport(w io.WriteCloser, done chan struct{}) {
+	defer cl.transportSync.Done()
+	defer close(done)
 	defer w.Close()
-	p := make([]byte, 1024)
+	sock := cl.socket
+	p := make([]byte, cl.readBufferSize)
 	for {
-		if cl.socket == nil {
-			cl.waitForSocket()
-		}
-		cl.socket.SetReadDeadline(time.Now().Add(time.Second))
-		nr, err := cl.socket.Read(p)
+		nr, err := sock.Read(p)
 		if nr == 0 {
-			if errno, ok := err.(*net.OpError); ok {
-				if errno.Timeout() {
-					continue
-				}
+			if errno, ok := err.(net.Error); ok && errno.Timeout() {
+				// We've been asked to stop reading
+				// while the socket is replaced.
+				resume := <-cl.readerPause
+				sock = <-resume
+				continue
 			}
 			Warn.Logf("read: %s", err)
 			break
 		}
+		cl.stats.read(nr)
 		nw, err := w.Write(p[:nr])
 		if nw < nr {
 			Warn.Logf("read: %s", err)
@@ -61,8 +74,11 @@ func (cl *Client) readTransport(w io.WriteCloser) {
 	}
 }
 
-func (cl *Client) writeTransport(r io.Reader) {
+func (cl *Client) writeTransport(r io.ReadCloser, fw *flushWriter) {
+	defer cl.transportSync.Done()
+	defer r.Close()
 	defer cl.socket.Close()
+	defer fw.stop()
 	p := make([]byte, 1024)
 	for {
 		nr, err := r.Read(p)
@@ -71,42 +87,250 @@ func (cl *Client) writeTransport(r io.Reader) {
 			break
 		}
 		nw, err := cl.socket.Write(p[:nr])
+		cl.stats.written(nw)
 		if nw < nr {
 			Warn.Logf("write: %s", err)
+			// Closing the socket below ends the stream, but
+			// only this says why. If we closed it
+			// ourselves, the app already knows.
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				cl.reportError(&TransportError{Op: "write",
+					Err: err})
+			}
 			break
 		}
+		fw.sent(nr)
 	}
 }
 
-func readXml(r io.Reader, ch chan<- interface{},
-	extStanza map[string]func(*xml.Name) interface{}) {
-	if _, ok := Debug.(*noLog); !ok {
-		pr, pw := io.Pipe()
-		go tee(r, pw, "S: ")
-		r = pr
+// Implemented by the writers between writeXml() and the transport
+// that can wait for what's been written to them to reach the socket.
+type flusher interface {
+	Flush() error
+}
+
+// Sent down the write pipeline by Flush(), in order with the
+// stanzas, and answered once everything before it is on the socket.
+type flushRequest chan error
+
+// The transport's end of the write pipeline. It counts what goes
+// into the pipe to writeTransport(), and what comes out onto the
+// socket, so Flush() can wait for them to match.
+type flushWriter struct {
+	w    io.WriteCloser
+	mu   sync.Mutex
+	cond *sync.Cond
+	// Bytes written to w, and how many of them have reached the
+	// socket.
+	queued, written int64
+	// Whether writeTransport() has given up.
+	stopped bool
+}
+
+func newFlushWriter(w io.WriteCloser) *flushWriter {
+	fw := &flushWriter{w: w}
+	fw.cond = sync.NewCond(&fw.mu)
+	return fw
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.mu.Lock()
+	fw.queued += int64(n)
+	fw.mu.Unlock()
+	return n, err
+}
+
+func (fw *flushWriter) Close() error {
+	return fw.w.Close()
+}
+
+func (fw *flushWriter) sent(n int) {
+	fw.mu.Lock()
+	fw.written += int64(n)
+	fw.mu.Unlock()
+	fw.cond.Broadcast()
+}
+
+func (fw *flushWriter) stop() {
+	fw.mu.Lock()
+	fw.stopped = true
+	fw.mu.Unlock()
+	fw.cond.Broadcast()
+}
+
+func (fw *flushWriter) Flush() error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	for fw.written < fw.queued && !fw.stopped {
+		fw.cond.Wait()
+	}
+	if fw.written < fw.queued {
+		return errors.New("connection closed before the write finished")
+	}
+	return nil
+}
+
+// Remembers what the XML parser has read, so readXml() can log each
+// element from the server in one piece.
+type logReader struct {
+	r   io.Reader
+	buf []byte
+	// The offset in the stream of buf[0].
+	off int64
+	// Whether to log, and where else each element goes, if
+	// anywhere.
+	debug bool
+	raw   func([]byte)
+}
+
+func (lr *logReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.buf = append(lr.buf, p[:n]...)
+	return n, err
+}
+
+// Everything we've read since the last log(), up to the given stream
+// offset.
+func (lr *logReader) text(end int64) []byte {
+	n := int(end - lr.off)
+	if n > len(lr.buf) {
+		n = len(lr.buf)
+	}
+	return lr.buf[:n]
+}
+
+// Log everything up to the given stream offset, and forget it.
+func (lr *logReader) log(end int64) {
+	text := lr.text(end)
+	var str string
+	if lr.debug || lr.raw != nil {
+		str = strings.TrimSpace(string(text))
+	}
+	lr.forget(end)
+	if str == "" {
+		return
 	}
+	if lr.debug {
+		Debug.Log("S: " + str)
+	}
+	if lr.raw != nil {
+		lr.raw([]byte(str))
+	}
+}
+
+// Forget everything up to the given stream offset, without logging
+// it.
+func (lr *logReader) forget(end int64) {
+	n := len(lr.text(end))
+	lr.buf = append(lr.buf[:0], lr.buf[n:]...)
+	lr.off += int64(n)
+}
+
+// Stops the XML parser from reading more than limit() bytes of one
+// top-level element. readXml() moves start to the beginning of each
+// element. Reads are cut short at the limit, and the rest is held
+// back, so the parser's read-ahead doesn't count against an element
+// that fits.
+type limitReader struct {
+	r     io.Reader
+	limit func() int
+	// The stream offsets of the end of what we've returned, and
+	// the start of the current element.
+	off, start int64
+	// What we've read but not yet returned.
+	held []byte
+}
+
+func (lr *limitReader) Read(p []byte) (int, error) {
+	var n int
+	var err error
+	if len(lr.held) > 0 {
+		n = copy(p, lr.held)
+		lr.held = lr.held[n:]
+	} else {
+		n, err = lr.r.Read(p)
+	}
+	if max := lr.limit(); max > 0 && n > 0 {
+		left := lr.start + int64(max) - lr.off
+		if left <= 0 {
+			lr.held = append(p[:n:n], lr.held...)
+			return 0, ErrStanzaTooLarge
+		}
+		if int64(n) > left {
+			lr.held = append(p[left:n:n], lr.held...)
+			n = int(left)
+		}
+	}
+	lr.off += int64(n)
+	return n, err
+}
+
+// Reads XML from the server and sends it on ch. If limit is non-nil,
+// it returns the largest element we'll accept, or 0 for no limit. An
+// element which is too big is reported by sending ErrStanzaTooLarge
+// on ch. One that's well-formed but doesn't unmarshal is skipped, and
+// reported with a *ParseError. If raw is non-nil, it's given the text
+// of each element before it's parsed. Elements in the namespaces of
+// extStreaming are handed to their handler as they arrive; see
+// streamElement().
+func readXml(r io.Reader, ch chan<- interface{},
+	extStanza map[string][]func(*xml.Name) interface{},
+	extStreaming map[string]func(*xml.Decoder, *xml.StartElement) error,
+	limit func() int, raw func([]byte)) {
 	defer close(ch)
+	// Closing our input lets the transport know nobody is
+	// listening any more.
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
 
 	// This trick loads our namespaces into the parser.
 	nsstr := fmt.Sprintf(`<a xmlns="%s" xmlns:stream="%s">`,
 		NsClient, NsStream)
 	nsrdr := strings.NewReader(nsstr)
-	p := xml.NewDecoder(io.MultiReader(nsrdr, r))
+	var lim *limitReader
+	if limit != nil {
+		lim = &limitReader{r: r, limit: limit, off: int64(len(nsstr))}
+		r = lim
+	}
+	src := io.MultiReader(nsrdr, r)
+	// Even if nothing's logged, we need the text of an element
+	// that fails to unmarshal, to skip the rest of it.
+	_, quiet := Debug.(*noLog)
+	lr := &logReader{r: src, debug: !quiet, raw: raw}
+	p := xml.NewDecoder(lr)
 	p.Token()
+	// Don't log our trick.
+	lr.buf = lr.buf[len(nsstr):]
+	lr.off = int64(len(nsstr))
 
 Loop:
 	for {
+		if lim != nil {
+			lim.start = p.InputOffset()
+		}
 		// Sniff the next token on the stream.
 		t, err := p.Token()
 		if t == nil {
-			if err != io.EOF {
+			lr.log(p.InputOffset())
+			if err == ErrStanzaTooLarge {
+				ch <- err
+			} else if err != io.EOF {
 				Warn.Logf("read: %s", err)
 			}
 			break
 		}
+		if ee, ok := t.(xml.EndElement); ok &&
+			ee.Name.Space == NsStream && ee.Name.Local == "stream" {
+			// The server has closed its side of the stream.
+			lr.log(p.InputOffset())
+			break
+		}
 		var se xml.StartElement
 		var ok bool
 		if se, ok = t.(xml.StartElement); !ok {
+			lr.log(p.InputOffset())
 			continue
 		}
 
@@ -114,6 +338,7 @@ Loop:
 		var obj interface{}
 		switch se.Name.Space + " " + se.Name.Local {
 		case NsStream + " stream":
+			lr.log(p.InputOffset())
 			st, err := parseStream(se)
 			if err != nil {
 				Warn.Logf("unmarshal stream: %s", err)
@@ -130,20 +355,62 @@ Loop:
 		case NsSASL + " challenge", NsSASL + " failure",
 			NsSASL + " success":
 			obj = &auth{}
+		case NsSM + " enabled", NsSM + " resumed", NsSM + " failed",
+			NsSM + " r", NsSM + " a":
+			obj = &smElement{}
+		case NsClient + " handshake":
+			obj = &handshake{}
+		case NsDialback + " result", NsDialback + " verify":
+			obj = &dialback{}
 		case NsClient + " iq":
 			obj = &Iq{}
+			fixLang(&se)
 		case NsClient + " message":
 			obj = &Message{}
+			fixLang(&se)
 		case NsClient + " presence":
 			obj = &Presence{}
+			fixLang(&se)
 		default:
+			if h := extStreaming[se.Name.Space]; h != nil {
+				err = streamElement(p, lr, lim, se, h, ch)
+				if err == ErrStanzaTooLarge {
+					ch <- err
+					break Loop
+				}
+				if err != nil {
+					Warn.Logf("read: %s", err)
+					break Loop
+				}
+				continue
+			}
+			// It's up to the extensions whether it means
+			// anything.
 			obj = &Generic{}
-			Info.Logf("Ignoring unrecognized: %s %s", se.Name.Space,
-				se.Name.Local)
 		}
 
 		// Read the complete XML stanza.
 		err = p.DecodeElement(obj, &se)
+		if _, bad := err.(*xml.SyntaxError); err != nil && !bad &&
+			err != ErrStanzaTooLarge {
+			// The XML's fine, but not what we expected.
+			// Skip the rest of the element and carry on.
+			serr := skipElement(p, lr.text(p.InputOffset()))
+			if serr != nil {
+				err = serr
+			} else {
+				lr.log(p.InputOffset())
+				Warn.Logf("unmarshal: %s", err)
+				ch <- &ParseError{Element: se.Name.Space + " " +
+					se.Name.Local, Err: err}
+				continue
+			}
+		}
+		lr.log(p.InputOffset())
+		if err == ErrStanzaTooLarge {
+			ch <- err
+			break Loop
+		}
 		if err != nil {
 			Warn.Logf("unmarshal: %s", err)
 			break Loop
@@ -156,7 +423,9 @@ Loop:
 			err = parseExtended(st.GetHeader(), extStanza)
 			if err != nil {
 				Warn.Logf("ext unmarshal: %s", err)
-				break Loop
+				ch <- &ParseError{Element: se.Name.Space + " " +
+					se.Name.Local, Err: err}
+				continue
 			}
 		}
 
@@ -165,12 +434,142 @@ Loop:
 	}
 }
 
-func parseExtended(st *Header, extStanza map[string]func(*xml.Name) interface{}) error {
+// Gives h the element se starts, to read as it arrives rather than
+// being unmarshaled whole. Only its start tag is logged or given to
+// the raw inbound hook, and the text behind each token is forgotten
+// once it's been read, so what's held in memory is the largest token
+// rather than the element. For the same reason, the size limit
+// applies to each token. h's error is reported on ch as a
+// *ParseError; the error returned is one that stops us reading the
+// stream.
+func streamElement(p *xml.Decoder, lr *logReader, lim *limitReader,
+	se xml.StartElement,
+	h func(*xml.Decoder, *xml.StartElement) error,
+	ch chan<- interface{}) error {
+	lr.log(p.InputOffset())
+	er := &elementReader{p: p, lr: lr, lim: lim, start: &se}
+	d := xml.NewTokenDecoder(er)
+	t, err := d.Token()
+	if err != nil {
+		return err
+	}
+	start := t.(xml.StartElement)
+	herr := h(d, &start)
+	// Skip whatever h didn't read.
+	for {
+		_, err := er.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if herr != nil {
+		Warn.Logf("stream %s %s: %s", se.Name.Space, se.Name.Local,
+			herr)
+		ch <- &ParseError{Element: se.Name.Space + " " + se.Name.Local,
+			Err: herr}
+	}
+	return nil
+}
+
+// The tokens of one element, starting with its start tag, for
+// streamElement(). It returns io.EOF after the element's end.
+type elementReader struct {
+	p     *xml.Decoder
+	lr    *logReader
+	lim   *limitReader
+	start *xml.StartElement
+	depth int
+}
+
+func (er *elementReader) Token() (xml.Token, error) {
+	if er.start != nil {
+		t := *er.start
+		er.start = nil
+		er.depth = 1
+		return t, nil
+	}
+	if er.depth == 0 {
+		return nil, io.EOF
+	}
+	if er.lim != nil {
+		er.lim.start = er.p.InputOffset()
+	}
+	t, err := er.p.Token()
+	er.lr.forget(er.p.InputOffset())
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch t.(type) {
+	case xml.StartElement:
+		er.depth++
+	case xml.EndElement:
+		er.depth--
+	}
+	return t, nil
+}
+
+// Reads past the end of an element that failed to unmarshal. text is
+// the element's XML as far as p got; it tells how many of the
+// element's descendants p is still inside.
+func skipElement(p *xml.Decoder, text []byte) error {
+	scan := xml.NewDecoder(bytes.NewReader(text))
+	scan.Strict = false
+	depth := 0
+	for {
+		t, err := scan.RawToken()
+		if err != nil {
+			break
+		}
+		switch t.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+	for ; depth > 0; depth-- {
+		if err := p.Skip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Some peers write the stanza's xml:lang without its prefix. Treat
+// that as xml:lang, unless there's a real one too.
+func fixLang(se *xml.StartElement) {
+	bare := -1
+	for i, a := range se.Attr {
+		if a.Name.Local != "lang" {
+			continue
+		}
+		switch a.Name.Space {
+		case xmlURL:
+			return
+		case "":
+			bare = i
+		}
+	}
+	if bare >= 0 {
+		se.Attr[bare].Name.Space = xmlURL
+	}
+}
+
+func parseExtended(st *Header, extStanza map[string][]func(*xml.Name) interface{}) error {
 	// Now parse the stanza's innerxml to find the string that we
 	// can unmarshal this nested element from.
 	reader := strings.NewReader(st.Innerxml)
 	p := xml.NewDecoder(reader)
+	// How deep we are inside the stanza's children.
+	depth := 0
 	for {
+		start := p.InputOffset()
 		t, err := p.Token()
 		if err == io.EOF {
 			break
@@ -178,51 +577,143 @@ func parseExtended(st *Header, extStanza map[string]func(*xml.Name) interface{})
 		if err != nil {
 			return err
 		}
-		if se, ok := t.(xml.StartElement); ok {
-			if con, ok := extStanza[se.Name.Space]; ok {
-				// Call the indicated constructor.
-				nested := con(&se.Name)
-
-				// Unmarshal the nested element and
-				// stuff it back into the stanza.
-				err := p.DecodeElement(nested, &se)
-				if err != nil {
-					return err
+		switch t := t.(type) {
+		case xml.StartElement:
+			cons := extStanza[t.Name.Space]
+			var nested interface{}
+			if len(cons) > 1 {
+				nested, err = parseNested(p, &t,
+					st.Innerxml, start, cons)
+			} else if len(cons) == 1 {
+				// Call the indicated constructor, and
+				// unmarshal the nested element.
+				nested = cons[0](&t.Name)
+				err = p.DecodeElement(nested, &t)
+			} else {
+				if depth == 0 && t.Name.Space != "" &&
+					t.Name.Space != NsClient {
+					// Keep it for UnknownElements(),
+					// but keep looking inside it for
+					// elements we do know, like
+					// result sets.
+					g := &Generic{}
+					d := xml.NewDecoder(strings.NewReader(
+						st.Innerxml[start:]))
+					if err := d.Decode(g); err != nil {
+						return err
+					}
+					st.Nested = append(st.Nested, g)
+					st.nestedRaw = append(st.nestedRaw,
+						st.Innerxml[start:start+d.InputOffset()])
 				}
-				st.Nested = append(st.Nested, nested)
+				depth++
+				continue
+			}
+			if err != nil {
+				return err
 			}
+			// Stuff it back into the stanza.
+			st.Nested = append(st.Nested, nested)
+			st.nestedRaw = append(st.nestedRaw,
+				st.Innerxml[start:p.InputOffset()])
+		case xml.EndElement:
+			depth--
 		}
 	}
 
 	return nil
 }
 
-func writeXml(w io.Writer, ch <-chan interface{}) {
-	if _, ok := Debug.(*noLog); !ok {
-		pr, pw := io.Pipe()
-		go tee(pr, w, "C: ")
-		w = pw
+// Try each of the constructors registered for a namespace in turn,
+// and return the first value that the element unmarshals into. p has
+// just read the element's start tag, which begins at offset start in
+// innerxml.
+func parseNested(p *xml.Decoder, se *xml.StartElement, innerxml string,
+	start int64, cons []func(*xml.Name) interface{}) (interface{}, error) {
+	if err := p.Skip(); err != nil {
+		return nil, err
 	}
+	raw := innerxml[start:p.InputOffset()]
+
+	var errs []string
+	for _, con := range cons {
+		nested := con(&se.Name)
+		err := xml.NewDecoder(strings.NewReader(raw)).Decode(nested)
+		if err == nil {
+			return nested, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("no extension could unmarshal <%s %s>: %s",
+		se.Name.Space, se.Name.Local, strings.Join(errs, "; "))
+}
+
+// Each element is marshaled in full before it's written, so the
+// transport sees large stanzas in large writes, and debug logging
+// sees whole elements.
+// Each stanza written is passed to sent, if it's not nil.
+func writeXml(w io.Writer, ch <-chan interface{}, sent func(Stanza), format xmlFormat) {
 	defer func(w io.Writer) {
 		if c, ok := w.(io.Closer); ok {
 			c.Close()
 		}
 	}(w)
 
-	enc := xml.NewEncoder(w)
+	_, quiet := Debug.(*noLog)
+	var buf bytes.Buffer
+	enc := xml.NewEncoder(&buf)
 
+	var err error
+	// Whether we've closed our side of the stream.
+	var ended bool
 	for obj := range ch {
-		if st, ok := obj.(*stream); ok {
-			_, err := w.Write([]byte(st.String()))
-			if err != nil {
-				Warn.Logf("write: %s", err)
-			}
-		} else {
-			err := enc.Encode(obj)
-			if err != nil {
-				Warn.Logf("marshal: %s", err)
-				break
+		if f, ok := obj.(flushRequest); ok {
+			if err == nil {
+				if fl, ok := w.(flusher); ok {
+					err = fl.Flush()
+				}
 			}
+			f <- err
+			continue
+		}
+		if err != nil || ended {
+			// The connection is broken, or we're done
+			// with it. Keep draining the channel so our
+			// senders don't block.
+			continue
+		}
+		buf.Reset()
+		if format.indent != "" {
+			// An indenting encoder starts each element
+			// after the first on a new line, so each one
+			// needs its own.
+			enc = xml.NewEncoder(&buf)
+			enc.Indent("", format.indent)
+		}
+		if st, ok := obj.(*stream); ok {
+			buf.WriteString(st.String())
+		} else if _, ok := obj.(*streamEnd); ok {
+			buf.WriteString("</stream:stream>")
+			ended = true
+		} else if err := enc.Encode(obj); err != nil {
+			// Nothing's been written, so the stream is
+			// still good.
+			Warn.Logf("marshal: %s", err)
+			continue
+		}
+		if format.newlines {
+			buf.WriteByte('\n')
+		}
+		if !quiet {
+			Debug.Log("C: " + buf.String())
+		}
+		_, err = w.Write(buf.Bytes())
+		if err != nil {
+			Warn.Logf("write: %s", err)
+			continue
+		}
+		if st, ok := obj.(Stanza); ok && sent != nil {
+			sent(st)
 		}
 	}
 }
@@ -230,19 +721,79 @@ func writeXml(w io.Writer, ch <-chan interface{}) {
 func (cl *Client) readStream(srvIn <-chan interface{}, cliOut chan<- Stanza) {
 	defer close(cliOut)
 
-	handlers := make(map[string]func(Stanza) bool)
+	handlers := make(map[string]*stanzaHandler)
+	// A second handler for the same id displaces the first, which
+	// is told, as if it had been canceled.
+	add := func(h *stanzaHandler) {
+		if old := handlers[h.id]; old != nil {
+			Warn.Logf("Two handlers for stanza id %s", h.id)
+			old.f(&CanceledStanza{Header{Id: h.id}})
+		}
+		handlers[h.id] = h
+	}
+	// The select below may pick a stanza or a cancellation ahead
+	// of the registration it's for, so this picks up any pending
+	// registrations first.
+	drain := func() {
+		for {
+			select {
+			case h := <-cl.handlers:
+				add(h)
+			default:
+				return
+			}
+		}
+	}
 Loop:
 	for {
 		select {
 		case h := <-cl.handlers:
-			handlers[h.id] = h.f
+			add(h)
+		case <-cl.handshakeExpired:
+			cl.handshakeTimedOut()
+		case reply := <-cl.handlerQueries:
+			drain()
+			ids := make([]string, 0, len(handlers))
+			for id := range handlers {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			reply <- ids
+		case id := <-cl.cancels:
+			drain()
+			if h := handlers[id]; h != nil {
+				delete(handlers, id)
+				h.f(&CanceledStanza{Header{Id: id}})
+			}
 		case x, ok := <-srvIn:
 			if !ok {
-				break Loop
+				srvIn = cl.reconnect()
+				if srvIn == nil {
+					break Loop
+				}
+				continue
+			}
+			if cl.aborted {
+				// We've closed the stream, so ignore
+				// what the server sent after.
+				continue
+			}
+			if !cl.checkRestart(x) {
+				continue
 			}
 			switch obj := x.(type) {
 			case *stream:
-				handleStream(obj)
+				cl.handleStream(obj)
+				switch cl.ns {
+				case NsComponentAccept:
+					cl.componentHandshake(obj)
+				case NsServer:
+					cl.startDialback(obj)
+				}
+			case *handshake:
+				cl.handleHandshake()
+			case *dialback:
+				cl.handleDialback(obj)
 			case *streamError:
 				cl.handleStreamError(obj)
 			case *Features:
@@ -251,15 +802,52 @@ Loop:
 				cl.handleTls(obj)
 			case *auth:
 				cl.handleSasl(obj)
+			case *smElement:
+				cl.handleSm(obj)
+			case *Generic:
+				cl.handleStreamElement(obj)
+			case error:
+				if obj == ErrStanzaTooLarge {
+					cl.abortStream(StreamPolicyViolation,
+						obj)
+				} else {
+					cl.reportError(obj)
+				}
 			case Stanza:
-				send := true
+				drain()
+				obj.GetHeader().streamLang = cl.streamLang
 				id := obj.GetHeader().Id
-				if handlers[id] != nil {
-					f := handlers[id]
+				if !cl.negotiated && handlers[id] == nil {
+					// Nothing but the answers to our
+					// bind and session requests should
+					// come before the session's ready.
+					Warn.Logf("Dropping %T received during negotiation",
+						obj)
+					continue
+				}
+				cl.sm.stanzaHandled()
+				cl.stats.stanzaReceived(obj)
+				if !cl.validFrom(obj) {
+					Warn.Logf("Dropping stanza with bad from: %s",
+						obj.GetHeader().From)
+					continue
+				}
+				send := true
+				if h := handlers[id]; h != nil {
+					from := obj.GetHeader().From
+					if h.checkFrom && !cl.replyFrom(h.from, from) {
+						// Someone's guessed the id.
+						Warn.Logf("Dropping reply to %s from %s",
+							id, from)
+						continue
+					}
 					delete(handlers, id)
-					send = f(obj)
+					send = h.f(obj)
 				}
 				if send {
+					if iq, ok := obj.(*Iq); ok {
+						cl.awaitIqReply(iq)
+					}
 					cliOut <- obj
 				}
 			default:
@@ -267,38 +855,222 @@ Loop:
 			}
 		}
 	}
+	// There's nobody left to answer the app's requests.
+	cl.Close()
+}
+
+// Gives an element the core doesn't know to the extension that
+// claimed it, if any.
+func (cl *Client) handleStreamElement(g *Generic) {
+	f := cl.extStream[g.XMLName.Space+" "+g.XMLName.Local]
+	if f == nil {
+		Info.Logf("Ignoring unrecognized: %s %s", g.XMLName.Space,
+			g.XMLName.Local)
+		return
+	}
+	f(cl, g)
+}
+
+// Reports whether the stanza's from is one we believe. Some stanzas,
+// such as carbons, roster pushes, and results from our archive, only
+// our own account may send; the rest are up to the app's validator.
+func (cl *Client) validFrom(st Stanza) bool {
+	h := st.GetHeader()
+	jid := cl.jid()
+	if h.From != "" && !strings.EqualFold(h.From, jid.bare()) &&
+		ownOnly(st) {
+		return false
+	}
+	if f := cl.fromValidator(); f != nil {
+		return f(st)
+	}
+	return true
+}
+
+// Reports whether from may answer a request we sent to to. A stanza
+// without a from comes from our server, which nobody else can make it
+// send, and which answers requests to itself, or to our own account,
+// from either.
+func (cl *Client) replyFrom(to, from string) bool {
+	if from == "" || strings.EqualFold(from, to) {
+		return true
+	}
+	jid := cl.jid()
+	self := func(addr string) bool {
+		return addr == "" || strings.EqualFold(addr, jid.Domain) ||
+			strings.EqualFold(addr, jid.bare()) ||
+			strings.EqualFold(addr, jid.String())
+	}
+	return self(to) && self(from)
+}
+
+// Reports whether only our own account may send st.
+func ownOnly(st Stanza) bool {
+	switch st := st.(type) {
+	case *Message:
+		for _, n := range st.Nested {
+			switch n := n.(type) {
+			case *mamResult:
+				return true
+			case *Generic:
+				if n.XMLName.Space == NsCarbons {
+					return true
+				}
+			}
+		}
+	case *Iq:
+		if st.Type != "set" {
+			return false
+		}
+		for _, n := range st.Nested {
+			if _, ok := n.(*RosterQuery); ok {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // This loop is paused until resource binding is complete. Otherwise
 // the app might inject something inappropriate into our negotiations
 // with the server. The control channel controls this loop's
-// activity.
-func writeStream(srvOut chan<- interface{}, cliIn <-chan Stanza,
-	control <-chan int) {
-	defer close(srvOut)
+// activity. When the client reconnects, the new connection's XML
+// writer arrives on xmlOutCh. Stanzas come from the app on cliIn, and
+// from Send() on internalOut. Those on priorityOut go ahead of both.
+// Other elements come from SendElement() on elementOut.
+func (cl *Client) writeStream(srvOut chan<- interface{}, cliIn <-chan Stanza) {
+	defer func() {
+		if srvOut != nil {
+			close(srvOut)
+		}
+	}()
+	defer close(cl.done)
+
+	ticker := time.NewTicker(smAckInterval)
+	defer ticker.Stop()
 
-	var input <-chan Stanza
+	var input, internal, priority <-chan Stanza
+	var elements <-chan interface{}
+	// Whether CloseWrite() has ended our side of the stream.
+	var ended bool
+	// The JIDs we've sent directed presence to, which we tell when
+	// we go away.
+	directed := make(map[string]bool)
+	send := func(x Stanza) {
+		if x == nil {
+			Info.Log("Refusing to send nil stanza")
+			return
+		}
+		if h := x.GetHeader(); h.Lang == "" {
+			h.Lang = cl.lang
+		}
+		if pr, ok := x.(*Presence); ok {
+			switch {
+			case pr.To != "" && pr.Type == "":
+				directed[pr.To] = true
+			case pr.To != "" && pr.Type == "unavailable":
+				delete(directed, pr.To)
+			case pr.To == "" && pr.Type == "":
+				cl.setLastPresence(pr)
+			case pr.To == "" && pr.Type == "unavailable":
+				cl.setLastPresence(nil)
+			}
+			cl.muc.sent(pr)
+		}
+		cl.sm.stanzaSent(x)
+		cl.iqReplied(x)
+		srvOut <- x
+	}
+	requestAck := func() {
+		cl.stats.pinged()
+		srvOut <- &smElement{XMLName: xml.Name{Space: NsSM, Local: "r"}}
+	}
+	goAway := func() {
+		if srvOut == nil || internal == nil {
+			return
+		}
+		for to := range directed {
+			send(&Presence{Header: Header{To: to,
+				Type: "unavailable"}})
+		}
+	}
+	defer goAway()
 Loop:
 	for {
+		// Whatever else is ready, priority stanzas go first.
+		select {
+		case x := <-priority:
+			send(x)
+			continue
+		default:
+		}
 		select {
-		case status := <-control:
+		case status := <-cl.inputControl:
 			switch status {
 			case 0:
 				input = nil
+				internal = nil
+				priority = nil
+				elements = nil
 			case 1:
+				if ended {
+					continue
+				}
 				input = cliIn
+				internal = cl.internalOut
+				priority = cl.priorityOut
+				elements = cl.elementOut
+			case 2:
+				if ended {
+					continue
+				}
+				goAway()
+				if srvOut != nil {
+					srvOut <- &streamEnd{}
+				}
+				ended = true
+				input = nil
+				internal = nil
+				priority = nil
+				elements = nil
+				close(cl.writeClosed)
 			case -1:
 				break Loop
 			}
+		case f := <-cl.flushes:
+			if srvOut == nil {
+				f <- errors.New("not connected")
+				continue
+			}
+			srvOut <- f
+		case newOut := <-cl.xmlOutCh:
+			if srvOut != nil {
+				close(srvOut)
+			}
+			srvOut = newOut
+		case <-ticker.C:
+			if srvOut != nil && !ended && cl.sm.unacked() {
+				requestAck()
+			}
+		case <-cl.ackRequests:
+			if srvOut != nil && !ended {
+				requestAck()
+			}
 		case x, ok := <-input:
 			if !ok {
 				break Loop
 			}
-			if x == nil {
-				Info.Log("Refusing to send nil stanza")
-				continue
+			send(x)
+		case x := <-internal:
+			send(x)
+		case x := <-elements:
+			if st, ok := x.(Stanza); ok {
+				send(st)
+			} else {
+				srvOut <- x
 			}
-			srvOut <- x
+		case x := <-priority:
+			send(x)
 		}
 	}
 }
@@ -306,7 +1078,8 @@ Loop:
 // Stanzas from the remote go up through a stack of filters to the
 // app. This function manages the filters.
 func filterTop(filterOut <-chan <-chan Stanza, filterIn chan<- <-chan Stanza,
-	topFilter <-chan Stanza, app chan<- Stanza) {
+	topFilter <-chan Stanza, app chan Stanza, overflow OverflowPolicy,
+	dropped func()) {
 	defer close(app)
 Loop:
 	for {
@@ -324,7 +1097,39 @@ Loop:
 			if !ok {
 				break Loop
 			}
-			app <- data
+			deliver(app, data, overflow, dropped)
+		}
+	}
+}
+
+// Hands data to the app, following the overflow policy if app is
+// full.
+func deliver(app chan Stanza, data Stanza, overflow OverflowPolicy,
+	dropped func()) {
+	if overflow == OverflowBlock {
+		app <- data
+		return
+	}
+	for {
+		select {
+		case app <- data:
+			return
+		default:
+		}
+		if overflow == OverflowDropNewest {
+			Warn.Logf("App isn't reading, dropped %T %s", data,
+				data.GetHeader().Id)
+			dropped()
+			return
+		}
+		// The app may read the oldest one itself before we do,
+		// in which case there's nothing to drop.
+		select {
+		case old := <-app:
+			Warn.Logf("App isn't reading, dropped %T %s", old,
+				old.GetHeader().Id)
+			dropped()
+		default:
 		}
 	}
 }
@@ -336,17 +1141,230 @@ func filterBottom(from <-chan Stanza, to chan<- Stanza) {
 	}
 }
 
-func handleStream(ss *stream) {
+// Each stream the server opens, after TLS and authentication too,
+// has its own id.
+func (cl *Client) handleStream(ss *stream) {
+	cl.streamLang = ss.Lang
+	if cl.streamLang == "" {
+		cl.streamLang = cl.lang
+	}
+	cl.streamIdMu.Lock()
+	cl.streamId = ss.Id
+	cl.streamFrom = ss.From
+	cl.streamIdMu.Unlock()
+	if !cl.checkStreamFrom(ss.From) {
+		return
+	}
+	if cl.ns == NsClient && !supportedVersion(ss.Version) {
+		if cl.legacyAuth {
+			cl.iqAuth()
+			return
+		}
+		// A pre-1.0 server would never send the features we'd
+		// wait for.
+		got := "no version"
+		if ss.Version != "" {
+			got = "version " + ss.Version
+		}
+		cl.abortStream(StreamUnsupportedVersion, &NegotiationError{
+			Expected: "stream version " + Version, Got: got})
+	}
+}
+
+// Compares the domain the server's stream says it's from with the one
+// we meant to reach. Returns false if it's wrong and we've given up.
+func (cl *Client) checkStreamFrom(from string) bool {
+	var want string
+	switch cl.ns {
+	case NsClient:
+		want = cl.jid().Domain
+	case NsServer:
+		want = cl.peer
+	default:
+		// A component's server needn't say.
+		return true
+	}
+	if from == "" || strings.EqualFold(from, want) {
+		return true
+	}
+	if !cl.strictFrom {
+		Warn.Logf("Server's stream is from %s, not %s", from, want)
+		return true
+	}
+	cl.abortStream(StreamInvalidFrom, &NegotiationError{
+		Expected: "stream from " + want, Got: "from " + from})
+	return false
+}
+
+// Reports whether a stream of the given version has the features,
+// TLS and SASL we need: whether it's at least 1.0. RFC 6120, Section
+// 4.7.5.
+func supportedVersion(v string) bool {
+	major, minor, ok := strings.Cut(v, ".")
+	if !ok {
+		return false
+	}
+	maj, err := strconv.Atoi(major)
+	if err != nil {
+		return false
+	}
+	if _, err := strconv.Atoi(minor); err != nil {
+		return false
+	}
+	return maj >= 1
+}
+
+// IsEncrypted reports whether the connection to the server is
+// currently protected by TLS, whether by STARTTLS or DirectTLS.
+func (cl *Client) IsEncrypted() bool {
+	cl.encryptedMu.Lock()
+	defer cl.encryptedMu.Unlock()
+	return cl.encrypted
+}
+
+func (cl *Client) setEncrypted(encrypted bool) {
+	cl.encryptedMu.Lock()
+	defer cl.encryptedMu.Unlock()
+	cl.encrypted = encrypted
+}
+
+// StreamFrom returns the domain the server's current stream says it's
+// from, or "" if it hasn't opened one or didn't say. See
+// StrictStreamFrom.
+func (cl *Client) StreamFrom() string {
+	cl.streamIdMu.Lock()
+	defer cl.streamIdMu.Unlock()
+	return cl.streamFrom
 }
 
+// StreamID returns the id the server gave the current stream, or ""
+// if it hasn't opened one yet.
+func (cl *Client) StreamID() string {
+	cl.streamIdMu.Lock()
+	defer cl.streamIdMu.Unlock()
+	return cl.streamId
+}
+
+// Where the server is in restarting the stream after SASL success.
+type restartState int
+
+const (
+	restartNone restartState = iota
+	// It must open a new stream,
+	restartStream
+	// and then offer resource binding.
+	restartFeatures
+)
+
+// Makes sure the server restarts the stream after SASL success
+// before anything else, as RFC 6120 says it must. Returns false, and
+// gives up on the stream, if it doesn't.
+func (cl *Client) checkRestart(x interface{}) bool {
+	switch x.(type) {
+	case *streamError, error:
+		// The server's giving up, or we are.
+		return true
+	}
+	switch cl.restart {
+	case restartNone:
+		return true
+	case restartStream:
+		if _, ok := x.(*stream); ok {
+			cl.restart = restartFeatures
+			return true
+		}
+		cl.restart = restartNone
+		cl.abortStream(StreamPolicyViolation, &NegotiationError{
+			Expected: "stream restart", Got: describeElement(x)})
+		return false
+	default:
+		if fe, ok := x.(*Features); ok && fe.Bind != nil {
+			cl.restart = restartNone
+			return true
+		}
+		cl.restart = restartNone
+		cl.abortStream(StreamPolicyViolation, &NegotiationError{
+			Expected: "features offering bind",
+			Got:      describeElement(x)})
+		return false
+	}
+}
+
+// Names what readXml() gave us, for error messages.
+func describeElement(x interface{}) string {
+	switch x := x.(type) {
+	case *Generic:
+		return "<" + x.XMLName.Local + ">"
+	case *Features:
+		return "features without bind"
+	case *stream:
+		return "a second stream"
+	}
+	return fmt.Sprintf("%T", x)
+}
+
+// Tell the server why we're giving up on the stream, and shut down.
+func (cl *Client) abortStream(cond StreamCondition, err error) {
+	Warn.Logf("Aborting stream: %s", err)
+	se := &streamError{Any: Generic{XMLName: xml.Name{Space: NsStreams,
+		Local: string(cond)}}}
+	cl.xmlOut <- se
+	cl.aborted = true
+	cl.reportError(err)
+	cl.Close()
+}
+
+// The server will close the connection after this. Unless we're
+// going to reconnect, shut down.
 func (cl *Client) handleStreamError(se *streamError) {
-	Info.Logf("Received stream error: %v", se)
-	close(cl.Out)
+	err := se.streamError()
+	Info.Logf("Received %v", err)
+	if err.Condition == StreamConflict {
+		cl.reportError(&ConflictError{err})
+	} else {
+		cl.reportError(err)
+	}
+	if err.Condition == StreamSeeOtherHost && err.OtherHost != "" {
+		if !cl.redirect(err.OtherHost) {
+			cl.Close()
+		}
+		return
+	}
+	if !err.Retryable() || !cl.autoReconnecting() {
+		cl.Close()
+	}
+}
+
+// Arranges for reconnect() to dial host rather than the server's
+// usual address. Returns false if we can't, or won't.
+func (cl *Client) redirect(host string) bool {
+	if cl.dial == nil || !cl.autoReconnecting() {
+		return false
+	}
+	if cl.redirects >= maxRedirects {
+		Warn.Logf("Not following redirect to %s: too many redirects",
+			host)
+		return false
+	}
+	Info.Logf("Redirected to %s", host)
+	cl.otherHost = host
+	cl.redirects++
+	return true
 }
 
 func (cl *Client) handleFeatures(fe *Features) {
-	cl.Features = fe
-	if fe.Starttls != nil {
+	cl.setFeatures(fe)
+	if cl.negotiated {
+		// The server changed what it offers after the session
+		// started. There's nothing to negotiate; the app can
+		// see them with CurrentFeatures().
+		Info.Log("Server updated its stream features")
+		return
+	}
+	// We use TLS whenever it's offered, so a server that requires
+	// it never sees SASL on a plain connection, even if it also
+	// advertises mechanisms.
+	if fe.Starttls != nil && !cl.IsEncrypted() {
 		start := &starttls{XMLName: xml.Name{Space: NsTLS,
 			Local: "starttls"}}
 		cl.xmlOut <- start
@@ -359,72 +1377,125 @@ func (cl *Client) handleFeatures(fe *Features) {
 	}
 
 	if fe.Bind != nil {
+		if fe.Sm != nil && cl.sm.resumable() {
+			cl.resumeSm()
+			return
+		}
 		cl.bind(fe.Bind)
 		return
 	}
 }
 
 // readTransport() is running concurrently. We need to stop it,
-// negotiate TLS, then start it again. It calls waitForSocket() in
-// its inner loop; see below.
+// negotiate TLS, then start it again.
 func (cl *Client) handleTls(t *starttls) {
 	tcp := cl.socket
+	resume, err := cl.pauseReader(tcp)
+	if err != nil {
+		cl.abortStream(StreamUndefinedCondition, err)
+		return
+	}
 
-	// Set the socket to nil, and wait for the reader routine to
-	// signal that it's paused.
-	cl.socket = nil
-	cl.socketSync.Add(1)
-	cl.socketSync.Wait()
-
-	// Negotiate TLS with the server.
-	tls := tls.Client(tcp, &TlsConfig)
+	// Negotiate TLS with the server. We do the handshake here,
+	// rather than leaving it to the first read, so we have the
+	// channel binding data in hand before SASL starts.
+	domain := cl.jid().Domain
+	if cl.ns == NsServer {
+		domain = cl.peer
+	}
+	tls := tls.Client(tcp, tlsConfig(domain))
+	if cl.handshakeTimeout > 0 {
+		tcp.SetDeadline(time.Now().Add(cl.handshakeTimeout))
+	}
+	err = tls.Handshake()
+	tcp.SetDeadline(time.Time{})
+	if err != nil {
+		Warn.Logf("TLS handshake: %s", err)
+		cl.reportError(transportError("TLS handshake", err))
+		resume <- tcp
+		cl.Close()
+		return
+	}
+	cl.setEncrypted(true)
+	cl.tlsUnique = tls.ConnectionState().TLSUnique
+	cl.enterPhase(TLSNegotiated)
 
-	// Make the TLS connection available to the reader, and wait
-	// for it to signal that it's working again.
-	cl.socketSync.Add(1)
-	cl.socket = tls
-	cl.socketSync.Wait()
+	// Make the TLS connection available to the reader.
+	cl.setSocket(tls)
+	resume <- tls
 
 	Info.Log("TLS negotiation succeeded.")
-	cl.Features = nil
+	cl.setFeatures(nil)
 
 	// Now re-send the initial handshake message to start the new
 	// session.
-	hsOut := &stream{To: cl.Jid.Domain, Version: Version}
-	cl.xmlOut <- hsOut
+	cl.xmlOut <- cl.streamHeader()
 }
 
-// Synchronize with handleTls(). Called from readTransport() when
-// cl.socket is nil.
-func (cl *Client) waitForSocket() {
-	// Signal that we've stopped reading from the socket.
-	cl.socketSync.Done()
-
-	// Wait until the socket is available again.
-	for cl.socket == nil {
-		time.Sleep(1e8)
+// Interrupt readTransport()'s read from sock, and wait until it's
+// stopped. It won't read again until it's sent the socket to use
+// next on the returned channel. If the connection closed first,
+// there's nothing to pause, and it returns an error.
+func (cl *Client) pauseReader(sock net.Conn) (chan<- net.Conn, error) {
+	resume := make(chan net.Conn)
+	sock.SetReadDeadline(time.Now())
+	defer sock.SetReadDeadline(time.Time{})
+	select {
+	case cl.readerPause <- resume:
+		return resume, nil
+	case <-cl.readerDone:
+		return nil, &TransportError{Op: "starttls",
+			Err: io.ErrUnexpectedEOF}
+	case <-cl.done:
+		return nil, ErrClosed
 	}
-
-	// Signal that we're going back to the read loop.
-	cl.socketSync.Done()
 }
 
+// Pick the strongest mechanism the server offers. SCRAM-SHA-1-PLUS
+// is only possible once TLS has given us channel binding data, and
+// PLAIN is only used over TLS, since it sends the password as is.
 // BUG(cjyar): Doesn't implement TLS/SASL EXTERNAL.
 func (cl *Client) chooseSasl(fe *Features) {
-	var digestMd5 bool
+	var plain, digestMd5, scramSha1, scramSha1Plus bool
 	for _, m := range fe.Mechanisms.Mechanism {
 		switch strings.ToLower(m) {
+		case "plain":
+			plain = true
 		case "digest-md5":
 			digestMd5 = true
+		case "scram-sha-1":
+			scramSha1 = true
+		case "scram-sha-1-plus":
+			scramSha1Plus = true
 		}
 	}
 
-	if digestMd5 {
+	cl.scram = nil
+	if scramSha1Plus && cl.tlsUnique != nil {
+		cl.startScram("SCRAM-SHA-1-PLUS")
+	} else if scramSha1 {
+		cl.startScram("SCRAM-SHA-1")
+	} else if digestMd5 {
 		auth := &auth{XMLName: xml.Name{Space: NsSASL, Local: "auth"}, Mechanism: "DIGEST-MD5"}
 		cl.xmlOut <- auth
+	} else if plain && !cl.IsEncrypted() && !cl.allowPlain {
+		Warn.Log("Refusing to send the password in PLAIN over an unencrypted connection")
+		cl.failAuth(&AuthError{Text: "server only offers PLAIN, " +
+			"and the connection isn't encrypted"})
+	} else if plain {
+		payload := plainPayload(cl.authzid, cl.saslUsername(), cl.password)
+		auth := &auth{XMLName: xml.Name{Space: NsSASL, Local: "auth"}, Mechanism: "PLAIN",
+			Chardata: base64.StdEncoding.EncodeToString([]byte(payload))}
+		cl.xmlOut <- auth
 	}
 }
 
+// The PLAIN message, RFC 4616: authzid, authcid and password,
+// separated by NULs.
+func plainPayload(authzid, username, password string) string {
+	return authzid + "\x00" + username + "\x00" + password
+}
+
 func (cl *Client) handleSasl(srv *auth) {
 	switch strings.ToLower(srv.XMLName.Local) {
 	case "challenge":
@@ -434,24 +1505,54 @@ func (cl *Client) handleSasl(srv *auth) {
 			Warn.Logf("SASL challenge decode: %s", err)
 			return
 		}
-		srvMap := parseSasl(string(str))
+		if cl.scram != nil {
+			cl.scramChallenge(string(str))
+			return
+		}
+		pairs := parseSaslPairs(string(str))
+		srvMap := saslMap(pairs)
 
 		if cl.saslExpected == "" {
-			cl.saslDigest1(srvMap)
+			cl.saslDigest1(srvMap, saslRealms(pairs))
 		} else {
 			cl.saslDigest2(srvMap)
 		}
 	case "failure":
 		Info.Log("SASL authentication failed")
+		err := &AuthError{}
+		if srv.Any != nil {
+			err.Condition = srv.Any.XMLName.Local
+		}
+		if srv.Text != nil {
+			err.Text = srv.Text.Chardata
+		}
+		cl.failAuth(err)
 	case "success":
+		if cl.scram != nil && (srv.Chardata != "" || !cl.scram.verified) {
+			b64 := base64.StdEncoding
+			str, err := b64.DecodeString(srv.Chardata)
+			if err == nil && len(str) == 0 {
+				err = errors.New("SCRAM: server sent no signature")
+			} else if err == nil {
+				err = cl.scram.verify(string(str))
+			}
+			if err != nil {
+				// The server couldn't prove it knows our
+				// password, so don't trust it.
+				Warn.Logf("SASL success: %s", err)
+				cl.failAuth(&AuthError{Text: err.Error()})
+				return
+			}
+		}
 		Info.Log("Sasl authentication succeeded")
-		cl.Features = nil
-		ss := &stream{To: cl.Jid.Domain, Version: Version}
-		cl.xmlOut <- ss
+		cl.enterPhase(Authenticated)
+		cl.setFeatures(nil)
+		cl.restart = restartStream
+		cl.xmlOut <- cl.streamHeader()
 	}
 }
 
-func (cl *Client) saslDigest1(srvMap map[string]string) {
+func (cl *Client) saslDigest1(srvMap map[string]string, realms []string) {
 	// Make sure it supports qop=auth
 	var hasAuth bool
 	for _, qop := range strings.Fields(srvMap["qop"]) {
@@ -466,24 +1567,25 @@ func (cl *Client) saslDigest1(srvMap map[string]string) {
 
 	// Pick a realm.
 	var realm string
-	if srvMap["realm"] != "" {
-		realm = strings.Fields(srvMap["realm"])[0]
+	if len(realms) > 0 {
+		realm = realms[0]
+		if cl.chooseRealm != nil {
+			realm = cl.chooseRealm(realms)
+		}
 	}
 
 	passwd := cl.password
 	nonce := srvMap["nonce"]
-	digestUri := "xmpp/" + cl.Jid.Domain
+	host := cl.saslHost
+	if host == "" {
+		host = cl.jid().Domain
+	}
+	digestUri := "xmpp/" + host
 	nonceCount := int32(1)
 	nonceCountStr := fmt.Sprintf("%08x", nonceCount)
 
-	// Begin building the response. Username is
-	// user@domain or just domain.
-	var username string
-	if cl.Jid.Node == "" {
-		username = cl.Jid.Domain
-	} else {
-		username = cl.Jid.Node
-	}
+	// Begin building the response.
+	username := cl.saslUsername()
 
 	// Generate our own nonce from random data.
 	randSize := big.NewInt(0)
@@ -498,21 +1600,24 @@ func (cl *Client) saslDigest1(srvMap map[string]string) {
 	/* Now encode the actual password response, as well as the
 	 * expected next challenge from the server. */
 	response := saslDigestResponse(username, realm, passwd, nonce,
-		cnonceStr, "AUTHENTICATE", digestUri, nonceCountStr)
+		cnonceStr, "AUTHENTICATE", digestUri, nonceCountStr, cl.authzid)
 	next := saslDigestResponse(username, realm, passwd, nonce,
-		cnonceStr, "", digestUri, nonceCountStr)
+		cnonceStr, "", digestUri, nonceCountStr, cl.authzid)
 	cl.saslExpected = next
 
 	// Build the map which will be encoded.
 	clMap := make(map[string]string)
-	clMap["realm"] = `"` + realm + `"`
-	clMap["username"] = `"` + username + `"`
-	clMap["nonce"] = `"` + nonce + `"`
-	clMap["cnonce"] = `"` + cnonceStr + `"`
+	clMap["realm"] = saslQuote(realm)
+	clMap["username"] = saslQuote(username)
+	clMap["nonce"] = saslQuote(nonce)
+	clMap["cnonce"] = saslQuote(cnonceStr)
 	clMap["nc"] = nonceCountStr
 	clMap["qop"] = "auth"
-	clMap["digest-uri"] = `"` + digestUri + `"`
+	clMap["digest-uri"] = saslQuote(digestUri)
 	clMap["response"] = response
+	if cl.authzid != "" {
+		clMap["authzid"] = saslQuote(cl.authzid)
+	}
 	if srvMap["charset"] == "utf-8" {
 		clMap["charset"] = "utf-8"
 	}
@@ -529,26 +1634,136 @@ func (cl *Client) saslDigest2(srvMap map[string]string) {
 		clObj := &auth{XMLName: xml.Name{Space: NsSASL, Local: "response"}}
 		cl.xmlOut <- clObj
 	} else {
-		clObj := &auth{XMLName: xml.Name{Space: NsSASL, Local: "failure"}, Any: &Generic{XMLName: xml.Name{Space: NsSASL,
-			Local: "abort"}}}
-		cl.xmlOut <- clObj
+		cl.saslAbort()
+	}
+}
+
+// The name we authenticate as: the node part of our JID, or the
+// domain if there's no node.
+func (cl *Client) saslUsername() string {
+	jid := cl.jid()
+	if jid.Node == "" {
+		return jid.Domain
 	}
+	return jid.Node
+}
+
+// Give up on a server that won't let us in, or that we don't trust.
+func (cl *Client) failAuth(err *AuthError) {
+	cl.authErrMu.Lock()
+	cl.authErr = err
+	cl.authErrMu.Unlock()
+	cl.reportError(err)
+	cl.Close()
+}
+
+// Give up on SASL authentication.
+func (cl *Client) saslAbort() {
+	clObj := &auth{XMLName: xml.Name{Space: NsSASL, Local: "failure"}, Any: &Generic{XMLName: xml.Name{Space: NsSASL,
+		Local: "abort"}}}
+	cl.xmlOut <- clObj
 }
 
 // Takes a string like `key1=value1,key2="value2"...` and returns a
-// key/value map.
+// key/value map. If a key appears more than once, as realm may, the
+// first value is kept.
 func parseSasl(in string) map[string]string {
-	re := regexp.MustCompile(`([^=]+)="?([^",]+)"?,?`)
-	strs := re.FindAllStringSubmatch(in, -1)
+	return saslMap(parseSaslPairs(in))
+}
+
+// A key and value from a SASL challenge.
+type saslPair struct {
+	key, value string
+}
+
+func saslMap(pairs []saslPair) map[string]string {
 	m := make(map[string]string)
-	for _, pair := range strs {
-		key := strings.ToLower(string(pair[1]))
-		value := string(pair[2])
-		m[key] = value
+	for _, p := range pairs {
+		if _, ok := m[p.key]; !ok {
+			m[p.key] = p.value
+		}
 	}
 	return m
 }
 
+// The realms a challenge offers, in order. Some servers list several
+// in one value, rather than repeating the key.
+func saslRealms(pairs []saslPair) []string {
+	var realms []string
+	for _, p := range pairs {
+		if p.key != "realm" {
+			continue
+		}
+		realms = append(realms, strings.FieldsFunc(p.value,
+			func(r rune) bool {
+				return r == ',' || r == ' '
+			})...)
+	}
+	return realms
+}
+
+// Splits a string like `key1=value1,key2="value2"...` into its
+// pairs, in order, with the keys in lower case. Quoted values may
+// contain commas and backslash escapes, as in RFC 2831. Empty
+// elements are skipped.
+func parseSaslPairs(in string) []saslPair {
+	var pairs []saslPair
+	for {
+		in = strings.TrimLeft(in, ", \t\r\n")
+		eq := strings.IndexByte(in, '=')
+		if eq < 0 {
+			break
+		}
+		if c := strings.IndexByte(in[:eq], ','); c >= 0 {
+			// An element with no value.
+			in = in[c+1:]
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(in[:eq]))
+		in = strings.TrimLeft(in[eq+1:], " \t\r\n")
+		var value string
+		if strings.HasPrefix(in, `"`) {
+			var buf []byte
+			i := 1
+			for ; i < len(in) && in[i] != '"'; i++ {
+				if in[i] == '\\' && i+1 < len(in) {
+					i++
+				}
+				buf = append(buf, in[i])
+			}
+			value = string(buf)
+			if i < len(in) {
+				i++
+			}
+			in = in[i:]
+		} else {
+			end := strings.IndexByte(in, ',')
+			if end < 0 {
+				end = len(in)
+			}
+			value = strings.TrimSpace(in[:end])
+			in = in[end:]
+		}
+		// Skip anything else before the next element.
+		if c := strings.IndexByte(in, ','); c >= 0 {
+			in = in[c+1:]
+		} else {
+			in = ""
+		}
+		if key != "" {
+			pairs = append(pairs, saslPair{key, value})
+		}
+	}
+	return pairs
+}
+
+// Quotes s for packSasl(), escaping what RFC 2831 says must be.
+func saslQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
+
 // Inverse of parseSasl().
 func packSasl(m map[string]string) string {
 	var terms []string
@@ -563,7 +1778,7 @@ func packSasl(m map[string]string) string {
 
 // Computes the response string for digest authentication.
 func saslDigestResponse(username, realm, passwd, nonce, cnonceStr,
-	authenticate, digestUri, nonceCountStr string) string {
+	authenticate, digestUri, nonceCountStr, authzid string) string {
 	h := func(text string) []byte {
 		h := md5.New()
 		h.Write([]byte(text))
@@ -578,6 +1793,9 @@ func saslDigestResponse(username, realm, passwd, nonce, cnonceStr,
 
 	a1 := string(h(username+":"+realm+":"+passwd)) + ":" +
 		nonce + ":" + cnonceStr
+	if authzid != "" {
+		a1 += ":" + authzid
+	}
 	a2 := authenticate + ":" + digestUri
 	response := hex(kd(hex(h(a1)), nonce+":"+
 		nonceCountStr+":"+cnonceStr+":auth:"+
@@ -587,20 +1805,23 @@ func saslDigestResponse(username, realm, passwd, nonce, cnonceStr,
 
 // Send a request to bind a resource. RFC 3920, section 7.
 func (cl *Client) bind(bindAdv *bindIq) {
-	res := cl.Jid.Resource
+	res := cl.jid().Resource
 	bindReq := &bindIq{}
 	if res != "" {
 		bindReq.Resource = &res
 	}
-	msg := &Iq{Header: Header{Type: "set", Id: <-Id,
+	msg := &Iq{Header: Header{Type: "set", Id: cl.NextId(),
 		Nested: []interface{}{bindReq}}}
 	f := func(st Stanza) bool {
 		iq, ok := st.(*Iq)
 		if !ok {
 			Warn.Log("non-iq response")
+			cl.Close()
+			return false
 		}
 		if iq.Type == "error" {
 			Warn.Log("Resource binding failed")
+			cl.Close()
 			return false
 		}
 		var bindRepl *bindIq
@@ -612,24 +1833,35 @@ func (cl *Client) bind(bindAdv *bindIq) {
 		}
 		if bindRepl == nil {
 			Warn.Logf("Bad bind reply: %#v", iq)
+			cl.Close()
 			return false
 		}
 		jidStr := bindRepl.Jid
 		if jidStr == nil || *jidStr == "" {
 			Warn.Log("Can't bind empty resource")
+			cl.Close()
 			return false
 		}
 		jid := new(JID)
 		if err := jid.Set(*jidStr); err != nil {
 			Warn.Logf("Can't parse JID %s: %s", *jidStr, err)
+			cl.Close()
+			return false
+		}
+		cl.setJid(*jid)
+		Info.Logf("Bound resource: %s", jid)
+		cl.enterPhase(Bound)
+		cl.newSession = true
+		if cl.Features != nil && cl.Features.Sm != nil {
+			// bindDone() will be called when the server
+			// answers.
+			cl.enableSm()
 			return false
 		}
-		cl.Jid = *jid
-		Info.Logf("Bound resource: %s", cl.Jid.String())
 		cl.bindDone()
 		return false
 	}
-	cl.HandleStanza(msg.Id, f)
+	cl.HandleStanzaFrom(msg.Id, msg.To, f)
 	cl.xmlOut <- msg
 }
 
@@ -638,8 +1870,60 @@ func (cl *Client) bind(bindAdv *bindIq) {
 // more than once. If it returns false, the stanza will not be made
 // available on the normal Client.In channel. The stanza handler
 // must not read from that channel, as deliveries on it cannot proceed
-// until the handler returns true or false.
+// until the handler returns true or false. If another handler is
+// already waiting for the same id, it's called with a
+// *CanceledStanza and forgotten. Since anyone may send a stanza with
+// the id, HandleStanzaFrom() is safer for replies.
 func (cl *Client) HandleStanza(id string, f func(Stanza) bool) {
 	h := &stanzaHandler{id: id, f: f}
 	cl.handlers <- h
 }
+
+// HandleStanzaFrom is like HandleStanza, for the reply to a request
+// sent to the given JID. A stanza with the id from anyone else is
+// dropped, and f waits on. Our server may answer for to without a
+// from, and if to is our server or our own account, from its domain
+// or our JID.
+func (cl *Client) HandleStanzaFrom(id, to string, f func(Stanza) bool) {
+	h := &stanzaHandler{id: id, f: f, from: to, checkFrom: true}
+	cl.handlers <- h
+}
+
+// Given to a handler registered with HandleStanza() in place of a
+// stanza, when CancelStanza() removes it, or another handler for the
+// same id replaces it.
+type CanceledStanza struct {
+	Header
+}
+
+var _ Stanza = &CanceledStanza{}
+
+func (c *CanceledStanza) GetHeader() *Header {
+	return &c.Header
+}
+
+// PendingHandlers returns the ids of the handlers registered with
+// HandleStanza() that are still waiting for their stanzas, in order,
+// which may help find a request whose reply never came. It returns
+// nil once the client has shut down. Like the handlers themselves, it
+// waits while the app isn't reading Client.In.
+func (cl *Client) PendingHandlers() []string {
+	reply := make(chan []string, 1)
+	select {
+	case cl.handlerQueries <- reply:
+		return <-reply
+	case <-cl.done:
+		return nil
+	}
+}
+
+// CancelStanza removes the handler registered for the given id, if it
+// hasn't been called yet, and calls it once more with a
+// *CanceledStanza so it can clean up. Handlers which don't need to
+// can ignore that, as its return value is ignored.
+func (cl *Client) CancelStanza(id string) {
+	select {
+	case cl.cancels <- id:
+	case <-cl.done:
+	}
+}
@@ -5,7 +5,17 @@
 package xmpp
 
 import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestSaslDigest(t *testing.T) {
@@ -13,7 +23,1582 @@ func TestSaslDigest(t *testing.T) {
 	obs := saslDigestResponse("chris", "elwood.innosoft.com",
 		"secret", "OA6MG9tEQGm2hh", "OA6MHXh6VqTrRk",
 		"AUTHENTICATE", "imap/elwood.innosoft.com",
-		"00000001")
+		"00000001", "")
 	exp := "d388dad90d4bbd760a152321f2143af7"
 	assertEquals(t, exp, obs)
 }
+
+func TestParseSasl(t *testing.T) {
+	m := parseSasl(`realm="elwood.innosoft.com,innosoft.com",` +
+		`nonce="OA6MG9tEQGm2hh",, qop="auth",` +
+		`note="say \"hi\", then \\ go",empty="",` +
+		`charset=utf-8,algorithm=md5-sess,realm="other.com"`)
+	assertEquals(t, "elwood.innosoft.com,innosoft.com", m["realm"])
+	assertEquals(t, "OA6MG9tEQGm2hh", m["nonce"])
+	assertEquals(t, "auth", m["qop"])
+	assertEquals(t, `say "hi", then \ go`, m["note"])
+	if v, ok := m["empty"]; !ok || v != "" {
+		t.Errorf("empty: %q %v", v, ok)
+	}
+	assertEquals(t, "utf-8", m["charset"])
+	assertEquals(t, "md5-sess", m["algorithm"])
+	if len(m) != 7 {
+		t.Errorf("parsed %v", m)
+	}
+
+	// Garbage doesn't confuse it.
+	m = parseSasl(`junk,nonce="unterminated`)
+	assertEquals(t, "unterminated", m["nonce"])
+	if len(m) != 1 {
+		t.Errorf("parsed %v", m)
+	}
+}
+
+func TestSaslQuote(t *testing.T) {
+	q := saslQuote(`a "b" \ c`)
+	assertEquals(t, `"a \"b\" \\ c"`, q)
+	assertEquals(t, `a "b" \ c`, parseSasl("x=" + q)["x"])
+}
+
+func TestSaslHost(t *testing.T) {
+	SaslHost = "gateway.example.net"
+	defer func() { SaslHost = "" }()
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<mechanisms xmlns="` + NsSASL + `">` +
+		`<mechanism>DIGEST-MD5</mechanism></mechanisms>`)
+	auth := srv.expect("auth")
+	assertEquals(t, "DIGEST-MD5", auth.attr("mechanism"))
+
+	b64 := base64.StdEncoding
+	srv.send(`<challenge xmlns="` + NsSASL + `">` +
+		b64.EncodeToString([]byte(`realm="example.com",`+
+			`nonce="OA6MG9tEQGm2hh",qop="auth",charset=utf-8,`+
+			`algorithm=md5-sess`)) + `</challenge>`)
+	resp := srv.expect("response")
+	got, err := b64.DecodeString(resp.Innerxml)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	fields := parseSasl(string(got))
+	assertEquals(t, "xmpp/gateway.example.net", fields["digest-uri"])
+}
+
+func TestChooseRealm(t *testing.T) {
+	var offered []string
+	ChooseRealm = func(realms []string) string {
+		offered = realms
+		return realms[len(realms)-1]
+	}
+	defer func() { ChooseRealm = nil }()
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<mechanisms xmlns="` + NsSASL + `">` +
+		`<mechanism>DIGEST-MD5</mechanism></mechanisms>`)
+	srv.expect("auth")
+
+	b64 := base64.StdEncoding
+	srv.send(`<challenge xmlns="` + NsSASL + `">` +
+		b64.EncodeToString([]byte(`realm="staff.example.com",`+
+			`realm="students.example.com,guests.example.com",`+
+			`nonce="OA6MG9tEQGm2hh",qop="auth",charset=utf-8,`+
+			`algorithm=md5-sess`)) + `</challenge>`)
+	resp := srv.expect("response")
+	got, err := b64.DecodeString(resp.Innerxml)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	assertEquals(t, "staff.example.com students.example.com "+
+		"guests.example.com", strings.Join(offered, " "))
+	assertEquals(t, "guests.example.com", parseSasl(string(got))["realm"])
+}
+
+// Answer a DIGEST-MD5 challenge, and return the fields of the
+// client's response.
+func digestFields(t *testing.T) map[string]string {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<mechanisms xmlns="` + NsSASL + `">` +
+		`<mechanism>DIGEST-MD5</mechanism></mechanisms>`)
+	srv.expect("auth")
+
+	b64 := base64.StdEncoding
+	srv.send(`<challenge xmlns="` + NsSASL + `">` +
+		b64.EncodeToString([]byte(`realm="example.com",`+
+			`nonce="OA6MG9tEQGm2hh",qop="auth",charset=utf-8,`+
+			`algorithm=md5-sess`)) + `</challenge>`)
+	resp := srv.expect("response")
+	got, err := b64.DecodeString(resp.Innerxml)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return parseSasl(string(got))
+}
+
+func TestSaslDigestAuthzid(t *testing.T) {
+	// Without an authzid, the directive is left out, so the
+	// server doesn't put one in A1.
+	fields := digestFields(t)
+	if _, ok := fields["authzid"]; ok {
+		t.Errorf("sent authzid %q", fields["authzid"])
+	}
+	assertEquals(t, saslDigestResponse("user", "example.com", "secret",
+		"OA6MG9tEQGm2hh", fields["cnonce"], "AUTHENTICATE",
+		"xmpp/example.com", "00000001", ""), fields["response"])
+
+	AuthzID = "admin@example.com"
+	defer func() { AuthzID = "" }()
+	fields = digestFields(t)
+	assertEquals(t, "admin@example.com", fields["authzid"])
+	assertEquals(t, saslDigestResponse("user", "example.com", "secret",
+		"OA6MG9tEQGm2hh", fields["cnonce"], "AUTHENTICATE",
+		"xmpp/example.com", "00000001", "admin@example.com"),
+		fields["response"])
+}
+
+func TestNestedRaw(t *testing.T) {
+	replace := `<replace id='1'  xmlns='` + NsCorrect + `'/>`
+	signed := `<signcrypt xmlns="urn:xmpp:openpgp:0">` +
+		`<to jid="a@b.c"/><payload>AAAA</payload></signcrypt>`
+	str := `<message xmlns="` + NsClient + `" to="a@b.c" id="2">` +
+		`<body>fixed</body>` + replace + signed + `</message>`
+	msg := &Message{}
+	if err := xml.Unmarshal([]byte(str), msg); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	m := map[string][]func(*xml.Name) interface{}{
+		NsCorrect: {newReplace}}
+	if err := parseExtended(&msg.Header, m); err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	raw := msg.NestedRaw()
+	if len(raw) != 2 {
+		t.Fatalf("raw: %v", raw)
+	}
+	assertEquals(t, replace, raw[0])
+	assertEquals(t, signed, raw[1])
+
+	// Nothing was received for what the app adds.
+	msg.Nested = append(msg.Nested, &StanzaId{Id: "x"})
+	raw = msg.NestedRaw()
+	if len(raw) != 3 || raw[2] != "" {
+		t.Errorf("raw: %v", raw)
+	}
+}
+
+const bindFeatures = `<bind xmlns="` + NsBind + `"/>`
+
+// As an RFC 3921 server offers them, asking for a session too.
+const sessionFeatures = bindFeatures + `<session xmlns="` + NsSession + `"/>`
+
+func TestConcurrentSend(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	const senders = 20
+	const each = 25
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				msg := &Message{Header: Header{To: "a@b.c",
+					Id: fmt.Sprintf("%d-%d", i, j)}}
+				if j%2 == 0 {
+					cl.Out <- msg
+				} else if err := cl.Send(msg); err != nil {
+					t.Errorf("Send: %v", err)
+				}
+			}
+		}(i)
+	}
+
+	seen := make(map[string]bool)
+	for len(seen) < senders*each {
+		msg := srv.expect("message")
+		id := msg.attr("id")
+		if seen[id] {
+			t.Fatalf("duplicate %s", id)
+		}
+		seen[id] = true
+	}
+	wg.Wait()
+}
+
+func TestSendAfterClose(t *testing.T) {
+	cl, srv := newTestClient(t)
+	srv.open(bindFeatures)
+	srv.bind()
+
+	cl.Close()
+	err := cl.Send(&Message{Header: Header{To: "a@b.c"}})
+	if err != ErrClosed {
+		t.Errorf("Send after Close: %v", err)
+	}
+	// Closing twice is harmless.
+	cl.Close()
+	for _ = range cl.In {
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	cl.SendDirectedPresence("room@conference.example.com/me", &Presence{})
+	srv.expect("presence")
+	if err := cl.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	// We leave the room before closing our side.
+	pr := srv.expect("presence")
+	assertEquals(t, "unavailable", pr.attr("type"))
+	srv.expect("/stream")
+	err := cl.Send(&Message{Header: Header{To: "a@b.c"}})
+	if err != ErrClosed {
+		t.Errorf("Send after CloseWrite: %v", err)
+	}
+
+	// The server can still send.
+	srv.send(`<message id="m1"/>`)
+	expectMessage(t, cl, "m1")
+	srv.send(`</stream:stream>`)
+	for _ = range cl.In {
+	}
+	if el, ok := <-srv.in; ok {
+		t.Errorf("client sent <%s> after closing", el.XMLName.Local)
+	}
+}
+
+func TestSendElement(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	type ping struct {
+		XMLName xml.Name `xml:"urn:example:custom ping"`
+		Seq     int      `xml:"seq,attr"`
+	}
+	if err := cl.SendElement(&ping{Seq: 7}); err != nil {
+		t.Fatalf("SendElement: %v", err)
+	}
+	el := srv.expect("ping")
+	assertEquals(t, "urn:example:custom", el.XMLName.Space)
+	assertEquals(t, "7", el.attr("seq"))
+
+	cl.Close()
+	if err := cl.SendElement(&ping{Seq: 8}); err != ErrClosed {
+		t.Errorf("SendElement after Close: %v", err)
+	}
+	for _ = range cl.In {
+	}
+}
+
+func TestBindFailure(t *testing.T) {
+	cl, srv := newTestClient(t)
+	srv.open(bindFeatures)
+	iq := srv.expect("iq")
+	srv.send(`<iq type="error" id="` + iq.attr("id") + `"><error type="cancel">` +
+		`<not-allowed xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/>` +
+		`</error></iq>`)
+
+	// Nothing will ever be sent, but the sender mustn't hang.
+	done := make(chan error)
+	go func() {
+		done <- cl.Send(&Message{Header: Header{To: "a@b.c"}})
+	}()
+	select {
+	case err := <-done:
+		if err != ErrClosed {
+			t.Errorf("Send: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Send blocked after failed bind")
+	}
+}
+
+// Wait for the client to report an error.
+func nextError(t *testing.T, cl *Client) error {
+	select {
+	case err := <-cl.Errors():
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no error reported")
+	}
+	return nil
+}
+
+// Authenticate with PLAIN, and leave the fake server to restart the
+// stream, or not.
+func authenticated(t *testing.T) (*Client, *fakeServer) {
+	AllowPlainWithoutTLS = true
+	defer func() { AllowPlainWithoutTLS = false }()
+	cl, srv := newTestClient(t)
+	srv.open(`<mechanisms xmlns="` + NsSASL + `">` +
+		`<mechanism>PLAIN</mechanism></mechanisms>`)
+	srv.expect("auth")
+	srv.send(`<success xmlns="` + NsSASL + `"/>`)
+	srv.expect("stream")
+	return cl, srv
+}
+
+func TestStreamRestart(t *testing.T) {
+	// The server carries on without restarting the stream.
+	cl, srv := authenticated(t)
+	defer cl.Close()
+	srv.send(`<stream:features>` + bindFeatures + `</stream:features>`)
+	err := nextError(t, cl)
+	ne, ok := err.(*NegotiationError)
+	if !ok {
+		t.Fatalf("not a NegotiationError: %v", err)
+	}
+	assertEquals(t, "stream restart", ne.Expected)
+	se := srv.expect("error")
+	assertEquals(t, `<policy-violation xmlns="`+NsStreams+
+		`"></policy-violation>`, se.Innerxml)
+
+	// It restarts, but doesn't offer to bind.
+	cl, srv = authenticated(t)
+	defer cl.Close()
+	srv.send(`<stream:stream xmlns="` + NsClient + `" xmlns:stream="` +
+		NsStream + `" from="example.com" id="stream2" version="1.0">` +
+		`<stream:features><sm xmlns="` + NsSM + `"/></stream:features>`)
+	err = nextError(t, cl)
+	ne, ok = err.(*NegotiationError)
+	if !ok {
+		t.Fatalf("not a NegotiationError: %v", err)
+	}
+	assertEquals(t, "features offering bind", ne.Expected)
+
+	// A proper restart carries on to binding.
+	cl, srv = authenticated(t)
+	defer cl.Close()
+	srv.send(`<stream:stream xmlns="` + NsClient + `" xmlns:stream="` +
+		NsStream + `" from="example.com" id="stream3" version="1.0">` +
+		`<stream:features>` + bindFeatures + `</stream:features>`)
+	srv.bind()
+}
+
+func TestStreamErrorConflictNoReconnect(t *testing.T) {
+	dial := func() (net.Conn, error) {
+		t.Errorf("reconnected after conflict")
+		return nil, errors.New("no")
+	}
+	cl, srv := newTestClientDial(t, dial)
+	cl.EnableAutoReconnect(true)
+	srv.open(bindFeatures)
+	srv.bind()
+
+	srv.send(`<stream:error><conflict xmlns="` + NsStreams +
+		`"/></stream:error>`)
+	srv.conn.Close()
+	err := nextError(t, cl)
+	var ce *ConflictError
+	if !errors.As(err, &ce) {
+		t.Fatalf("not a conflict: %#v", err)
+	}
+	var se *StreamError
+	if !errors.As(err, &se) || se.Condition != StreamConflict {
+		t.Fatalf("error: %v", err)
+	}
+	for _ = range cl.In {
+	}
+}
+
+func TestStreamErrorReconnect(t *testing.T) {
+	servers := make(chan *fakeServer, 1)
+	dial := func() (net.Conn, error) {
+		c, s := net.Pipe()
+		servers <- newFakeServer(t, s)
+		return c, nil
+	}
+	cl, srv := newTestClientDial(t, dial)
+	defer cl.Close()
+	cl.EnableAutoReconnect(true)
+	srv.open(bindFeatures)
+	srv.bind()
+
+	srv.send(`<stream:error><system-shutdown xmlns="` + NsStreams +
+		`"/></stream:error>`)
+	srv.conn.Close()
+	err, ok := nextError(t, cl).(*StreamError)
+	if !ok || err.Condition != StreamSystemShutdown {
+		t.Fatalf("error: %v", err)
+	}
+
+	// The client starts over with a new session.
+	srv = <-servers
+	srv.open(bindFeatures)
+	srv.bind()
+	if err := cl.Send(&Message{Header: Header{To: "a@b.c", Id: "m1"}}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	msg := srv.expect("message")
+	assertEquals(t, "m1", msg.attr("id"))
+	if n := cl.Stats().Reconnects; n != 1 {
+		t.Errorf("%d reconnects", n)
+	}
+}
+
+// Connect a client with auto-reconnect, broadcast a presence, and
+// have the server shut down. Returns the server the client reconnects
+// to, with a new session bound.
+func reconnectWithPresence(t *testing.T) (*Client, *fakeServer) {
+	servers := make(chan *fakeServer, 1)
+	dial := func() (net.Conn, error) {
+		c, s := net.Pipe()
+		servers <- newFakeServer(t, s)
+		return c, nil
+	}
+	cl, srv := newTestClientDial(t, dial)
+	cl.EnableAutoReconnect(true)
+	srv.open(bindFeatures)
+	srv.bind()
+	err := cl.Send(&Presence{Header: Header{Id: "p1"},
+		Status: &Generic{Chardata: "Gone fishing"}})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	srv.expect("presence")
+
+	srv.send(`<stream:error><system-shutdown xmlns="` + NsStreams +
+		`"/></stream:error>`)
+	srv.conn.Close()
+	nextError(t, cl)
+	srv = <-servers
+	srv.open(bindFeatures)
+	srv.bind()
+	return cl, srv
+}
+
+func TestResendPresence(t *testing.T) {
+	cl, srv := reconnectWithPresence(t)
+	defer cl.Close()
+	pr := srv.expect("presence")
+	assertEquals(t, "", pr.attr("type"))
+	assertEquals(t, "", pr.attr("id"))
+	assertEquals(t, `<status xmlns="`+NsClient+`">Gone fishing</status>`,
+		pr.Innerxml)
+}
+
+func TestResendPresenceDisabled(t *testing.T) {
+	ResendPresence = false
+	defer func() { ResendPresence = true }()
+	cl, srv := reconnectWithPresence(t)
+	defer cl.Close()
+	cl.Send(&Message{Header: Header{To: "a@b.c", Id: "m1"}})
+	srv.expect("message")
+}
+
+// A listener for the host a see-other-host error sends the client to.
+func otherHost(t *testing.T) *net.TCPListener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	tl := l.(*net.TCPListener)
+	tl.SetDeadline(time.Now().Add(5 * time.Second))
+	return tl
+}
+
+func seeOtherHost(srv *fakeServer, host string) {
+	srv.send(`<stream:error><see-other-host xmlns="` + NsStreams +
+		`">` + host + `</see-other-host></stream:error>`)
+	srv.conn.Close()
+}
+
+func TestSeeOtherHost(t *testing.T) {
+	l := otherHost(t)
+	defer l.Close()
+	dial := func() (net.Conn, error) {
+		t.Errorf("dialed the original server")
+		return nil, errors.New("no")
+	}
+	cl, srv := newTestClientDial(t, dial)
+	defer cl.Close()
+	cl.EnableAutoReconnect(true)
+	srv.open(bindFeatures)
+	srv.bind()
+
+	seeOtherHost(srv, l.Addr().String())
+	var se *StreamError
+	if err := nextError(t, cl); !errors.As(err, &se) ||
+		se.Condition != StreamSeeOtherHost {
+		t.Fatalf("error: %v", err)
+	}
+	assertEquals(t, l.Addr().String(), se.OtherHost)
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	srv = newFakeServer(t, conn)
+	srv.open(bindFeatures)
+	srv.bind()
+	if err := cl.Send(&Message{Header: Header{To: "a@b.c", Id: "m1"}}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assertEquals(t, "m1", srv.expect("message").attr("id"))
+}
+
+func TestSeeOtherHostLoop(t *testing.T) {
+	l := otherHost(t)
+	defer l.Close()
+	cl, srv := newTestClientDial(t, func() (net.Conn, error) {
+		return nil, errors.New("no")
+	})
+	defer cl.Close()
+	cl.EnableAutoReconnect(true)
+	srv.expect("stream")
+	for i := 0; i < maxRedirects; i++ {
+		seeOtherHost(srv, l.Addr().String())
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		srv = newFakeServer(t, conn)
+		srv.expect("stream")
+	}
+	// One more is too many.
+	seeOtherHost(srv, l.Addr().String())
+	select {
+	case <-cl.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("still following redirects")
+	}
+}
+
+func TestStreamVersion(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.expect("stream")
+	srv.send(`<stream:stream xmlns="` + NsClient + `" xmlns:stream="` +
+		NsStream + `" from="example.com" id="stream1">`)
+	var ne *NegotiationError
+	if err := nextError(t, cl); !errors.As(err, &ne) {
+		t.Fatalf("error: %v", err)
+	}
+	assertEquals(t, "no version", ne.Got)
+	se := srv.expect("error")
+	assertEquals(t, `<unsupported-version xmlns="`+NsStreams+`">`+
+		`</unsupported-version>`, se.Innerxml)
+
+	for _, v := range []string{"1.0", "1.1", "2.0", "1.10"} {
+		if !supportedVersion(v) {
+			t.Errorf("%s unsupported", v)
+		}
+	}
+	for _, v := range []string{"", "0.9", "1", "x.y"} {
+		if supportedVersion(v) {
+			t.Errorf("%s supported", v)
+		}
+	}
+}
+
+// Open the stream as a server for the given domain.
+func (srv *fakeServer) openFrom(from, features string) {
+	srv.expect("stream")
+	srv.send(`<stream:stream xmlns="` + NsClient + `" xmlns:stream="` +
+		NsStream + `" from="` + from + `" id="stream1" version="1.0">` +
+		`<stream:features>` + features + `</stream:features>`)
+}
+
+func TestStreamFrom(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	// By default, a stream from the wrong domain is only a
+	// warning.
+	srv.openFrom("evil.example.net", bindFeatures)
+	srv.bind()
+	<-cl.Bound()
+	assertEquals(t, "evil.example.net", cl.StreamFrom())
+}
+
+func TestStrictStreamFrom(t *testing.T) {
+	StrictStreamFrom = true
+	defer func() { StrictStreamFrom = false }()
+
+	// Case doesn't matter.
+	cl, srv := newTestClient(t)
+	srv.openFrom("EXAMPLE.com", bindFeatures)
+	srv.bind()
+	<-cl.Bound()
+	cl.Close()
+
+	cl, srv = newTestClient(t)
+	defer cl.Close()
+	srv.openFrom("evil.example.net", bindFeatures)
+	var ne *NegotiationError
+	if err := nextError(t, cl); !errors.As(err, &ne) {
+		t.Fatalf("error: %v", err)
+	}
+	assertEquals(t, "stream from example.com", ne.Expected)
+	assertEquals(t, "from evil.example.net", ne.Got)
+	se := srv.expect("error")
+	assertEquals(t, `<invalid-from xmlns="`+NsStreams+`">`+
+		`</invalid-from>`, se.Innerxml)
+	for _ = range cl.In {
+	}
+}
+
+func TestLargeStanza(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	body := strings.Repeat("0123456789abcdef", 1<<16)
+	srv.send(`<message from="a@b.c" id="big"><body>` + body +
+		`</body></message>`)
+	select {
+	case st := <-cl.In:
+		msg, ok := st.(*Message)
+		if !ok || len(msg.Body) != 1 {
+			t.Fatalf("received %T", st)
+		}
+		if msg.GetBody() != body {
+			t.Errorf("body of %d bytes garbled", len(body))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no message")
+	}
+
+	cl.Send(&Message{Header: Header{To: "a@b.c", Id: "big2"},
+		Body: []*Generic{{Chardata: body}}})
+	msg := srv.expect("message")
+	if !strings.Contains(msg.Innerxml, body) {
+		t.Errorf("sent body garbled")
+	}
+}
+
+type discardLog struct{}
+
+func (l discardLog) Log(v ...interface{}) {
+	_ = fmt.Sprint(v...)
+}
+
+func (l discardLog) Logf(f string, v ...interface{}) {
+	_ = fmt.Sprintf(f, v...)
+}
+
+// Parse a 1MB stanza with debug logging turned on.
+func BenchmarkReadLargeStanza(b *testing.B) {
+	old := Debug
+	Debug = discardLog{}
+	defer func() { Debug = old }()
+
+	body := strings.Repeat("0123456789abcdef", 1<<16)
+	str := `<stream:stream xmlns="` + NsClient + `" xmlns:stream="` +
+		NsStream + `" id="1" version="1.0"><message><body>` + body +
+		`</body></message>`
+	b.SetBytes(int64(len(str)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ch := make(chan interface{})
+		go readXml(strings.NewReader(str), ch,
+			make(map[string][]func(*xml.Name) interface{}), nil, nil, nil)
+		for _ = range ch {
+		}
+	}
+}
+
+// Counts the reads on a connection, and the bytes through it.
+type countingConn struct {
+	net.Conn
+	sync.Mutex
+	reads                   int
+	bytesRead, bytesWritten int
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	c.Lock()
+	c.reads++
+	c.Unlock()
+	n, err := c.Conn.Read(p)
+	c.Lock()
+	c.bytesRead += n
+	c.Unlock()
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.Lock()
+	c.bytesWritten += n
+	c.Unlock()
+	return n, err
+}
+
+func (c *countingConn) bytes() (read, written int) {
+	c.Lock()
+	defer c.Unlock()
+	return c.bytesRead, c.bytesWritten
+}
+
+func (c *countingConn) count() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.reads
+}
+
+// An idle client shouldn't wake up to poll the socket.
+func TestIdleNoPolling(t *testing.T) {
+	c, s := net.Pipe()
+	conn := &countingConn{Conn: c}
+	srv := newFakeServer(t, s)
+	jid := &JID{Node: "user", Domain: "example.com", Resource: "res"}
+	cl, err := newClient(conn, nil, jid, "secret", nil)
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	// Wait for the reader to block on the socket.
+	time.Sleep(100 * time.Millisecond)
+	before := conn.count()
+	time.Sleep(1500 * time.Millisecond)
+	if n := conn.count() - before; n != 0 {
+		t.Errorf("%d reads while idle", n)
+	}
+}
+
+func TestStartTls(t *testing.T) {
+	cert := testCertificate(t)
+	TlsConfig.InsecureSkipVerify = true
+	defer func() { TlsConfig.InsecureSkipVerify = false }()
+
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<starttls xmlns="` + NsTLS + `"><required/></starttls>`)
+	srv.expect("starttls")
+	srv = srv.startTls(cert)
+	srv.open(bindFeatures)
+	srv.bind()
+
+	cl.Send(&Message{Header: Header{To: "a@b.c", Id: "m1"}})
+	msg := srv.expect("message")
+	assertEquals(t, "m1", msg.attr("id"))
+	if len(cl.tlsUnique) == 0 {
+		t.Errorf("no channel binding data")
+	}
+}
+
+func TestMaxStanzaSize(t *testing.T) {
+	MaxStanzaSize = 1000
+	defer func() { MaxStanzaSize = 0 }()
+	cl, srv := newTestClient(t)
+	srv.open(bindFeatures)
+	srv.bind()
+
+	// Small stanzas get through, however many there are.
+	small := `<message from="a@b.c" id="small"><body>` +
+		strings.Repeat("x", 500) + `</body></message>`
+	srv.send(small + small + small)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-cl.In:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no message")
+		}
+	}
+
+	// The client won't read all of this one.
+	go srv.conn.Write([]byte(`<message from="a@b.c" id="big"><body>` +
+		strings.Repeat("x", 5000) + `</body></message>`))
+	se := srv.expect("error")
+	if !strings.Contains(se.Innerxml, "policy-violation") {
+		t.Errorf("stream error: %s", se.Innerxml)
+	}
+	if err := nextError(t, cl); err != ErrStanzaTooLarge {
+		t.Errorf("error: %v", err)
+	}
+	for st := range cl.In {
+		t.Errorf("received %v", st)
+	}
+}
+
+type multiFoo struct {
+	XMLName xml.Name `xml:"urn:example:multi foo"`
+	A       string   `xml:"a,attr"`
+}
+
+type multiBar struct {
+	XMLName xml.Name `xml:"urn:example:multi bar"`
+	B       string   `xml:"b"`
+}
+
+func TestParseExtendedShared(t *testing.T) {
+	exts := map[string][]func(*xml.Name) interface{}{
+		"urn:example:multi": {
+			func(*xml.Name) interface{} { return &multiFoo{} },
+			func(*xml.Name) interface{} { return &multiBar{} },
+		},
+	}
+	h := Header{Innerxml: `<body>hi</body>` +
+		`<bar xmlns="urn:example:multi"><b>two</b></bar>` +
+		`<foo xmlns="urn:example:multi" a="one"/>`}
+	if err := parseExtended(&h, exts); err != nil {
+		t.Fatalf("parseExtended: %v", err)
+	}
+	if len(h.Nested) != 2 {
+		t.Fatalf("nested: %#v", h.Nested)
+	}
+	bar, ok := h.Nested[0].(*multiBar)
+	if !ok {
+		t.Fatalf("not bar: %#v", h.Nested[0])
+	}
+	assertEquals(t, "two", bar.B)
+	foo, ok := h.Nested[1].(*multiFoo)
+	if !ok {
+		t.Fatalf("not foo: %#v", h.Nested[1])
+	}
+	assertEquals(t, "one", foo.A)
+
+	h = Header{Innerxml: `<baz xmlns="urn:example:multi"/>`}
+	err := parseExtended(&h, exts)
+	if err == nil || !strings.Contains(err.Error(), "urn:example:multi baz") {
+		t.Errorf("unmatched element: %v", err)
+	}
+}
+
+func TestStreamLang(t *testing.T) {
+	StreamLang = "de"
+	defer func() { StreamLang = "" }()
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+
+	assertEquals(t, "de", srv.expect("stream").attr("lang"))
+	srv.send(`<stream:stream xmlns="` + NsClient + `" xmlns:stream="` +
+		NsStream + `" from="example.com" id="stream1" ` +
+		`xml:lang="de" version="1.0"><stream:features>` +
+		bindFeatures + `</stream:features>`)
+	srv.bind()
+
+	// Stanzas default to the stream's language.
+	if err := cl.Send(&Message{Header: Header{To: "a@b.c"}}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	msg := srv.expect("message")
+	assertEquals(t, "de", msg.attr("lang"))
+	for _, a := range msg.Attr {
+		if a.Name.Local == "lang" && a.Name.Space != xmlURL {
+			t.Errorf("lang not in the xml namespace: %v", a.Name)
+		}
+	}
+	if err := cl.Send(&Message{Header: Header{To: "a@b.c", Lang: "en"}}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assertEquals(t, "en", srv.expect("message").attr("lang"))
+}
+
+func TestInheritedLang(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.expect("stream")
+	srv.send(`<stream:stream xmlns="` + NsClient + `" xmlns:stream="` +
+		NsStream + `" from="example.com" id="stream1" ` +
+		`xml:lang="en" version="1.0"><stream:features>` +
+		bindFeatures + `</stream:features>`)
+	srv.bind()
+
+	srv.send(`<message id="m1"><body>hi</body>` +
+		`<body xml:lang="fr">salut</body></message>`)
+	msg := expectMessage(t, cl, "m1")
+	assertEquals(t, "en", msg.GetLang())
+	assertEquals(t, "hi", msg.BodyFor("en"))
+	// It's not written back out, though.
+	assertEquals(t, "", msg.Lang)
+
+	srv.send(`<message id="m2" xml:lang="fr"><body>salut</body></message>`)
+	assertEquals(t, "fr", expectMessage(t, cl, "m2").GetLang())
+}
+
+func carbon(from, body string) string {
+	return `<message from="` + from + `" to="user@example.com/res" ` +
+		`type="chat"><received xmlns="` + NsCarbons + `">` +
+		`<forwarded xmlns="` + NsForward + `"><message xmlns="` +
+		NsClient + `" from="juliet@example.com/balcony" ` +
+		`to="user@example.com/other" type="chat"><body>` + body +
+		`</body></message></forwarded></received></message>`
+}
+
+// The next message from the client, which must be the one with the
+// given id.
+func expectMessage(t *testing.T, cl *Client, id string) *Message {
+	select {
+	case st := <-cl.In:
+		msg, ok := st.(*Message)
+		if !ok || msg.Id != id {
+			t.Fatalf("expected message %s, got %#v", id, st)
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no message %s", id)
+	}
+	return nil
+}
+
+func TestStanzaBeforeBind(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.send(`<message from="mallory@example.com" id="early">` +
+		`<body>hi</body></message>`)
+	srv.bind()
+	srv.send(`<message from="alice@example.com" id="late">` +
+		`<body>hi</body></message>`)
+	expectMessage(t, cl, "late")
+}
+
+func TestCurrentFeatures(t *testing.T) {
+	cert := testCertificate(t)
+	TlsConfig.InsecureSkipVerify = true
+	defer func() { TlsConfig.InsecureSkipVerify = false }()
+
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if fe := cl.CurrentFeatures(); fe != nil {
+				_ = len(fe.Mechanisms.Mechanism)
+			}
+		}
+	}()
+	srv.open(`<starttls xmlns="` + NsTLS + `"/>`)
+	srv.expect("starttls")
+	srv = srv.startTls(cert)
+	srv.open(`<mechanisms xmlns="` + NsSASL + `">` +
+		`<mechanism>SCRAM-SHA-1</mechanism></mechanisms>`)
+	srv.expect("auth")
+	// Failing makes the client shut itself down.
+	srv.send(`<failure xmlns="` + NsSASL + `"><not-authorized/></failure>`)
+	close(stop)
+	wg.Wait()
+
+	fe := cl.CurrentFeatures()
+	if fe == nil || len(fe.Mechanisms.Mechanism) != 1 {
+		t.Fatalf("features: %#v", fe)
+	}
+	// It's a copy.
+	fe.Mechanisms.Mechanism[0] = "PLAIN"
+	assertEquals(t, "SCRAM-SHA-1",
+		cl.CurrentFeatures().Mechanisms.Mechanism[0])
+}
+
+func TestMechanisms(t *testing.T) {
+	cert := testCertificate(t)
+	TlsConfig.InsecureSkipVerify = true
+	defer func() { TlsConfig.InsecureSkipVerify = false }()
+
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<starttls xmlns="` + NsTLS + `"/>`)
+	srv.expect("starttls")
+	if mechs := cl.Mechanisms(); mechs != nil {
+		t.Errorf("mechanisms before they're offered: %v", mechs)
+	}
+	srv = srv.startTls(cert)
+	srv.open(`<mechanisms xmlns="` + NsSASL + `">` +
+		`<mechanism>SCRAM-SHA-1-PLUS</mechanism>` +
+		`<mechanism>SCRAM-SHA-1</mechanism>` +
+		`<mechanism>PLAIN</mechanism></mechanisms>`)
+	srv.expect("auth")
+	mechs := cl.Mechanisms()
+	assertEquals(t, "SCRAM-SHA-1-PLUS SCRAM-SHA-1 PLAIN",
+		strings.Join(mechs, " "))
+	// It's a copy.
+	mechs[0] = "ANONYMOUS"
+	assertEquals(t, "SCRAM-SHA-1-PLUS", cl.Mechanisms()[0])
+	srv.send(`<failure xmlns="` + NsSASL + `"><not-authorized/></failure>`)
+}
+
+func TestRequiredTlsBeforeSasl(t *testing.T) {
+	cert := testCertificate(t)
+	TlsConfig.InsecureSkipVerify = true
+	defer func() { TlsConfig.InsecureSkipVerify = false }()
+
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<starttls xmlns="` + NsTLS + `"><required/></starttls>` +
+		`<mechanisms xmlns="` + NsSASL + `">` +
+		`<mechanism>SCRAM-SHA-1</mechanism></mechanisms>`)
+	srv.expect("starttls")
+	srv = srv.startTls(cert)
+	srv.open(`<mechanisms xmlns="` + NsSASL + `">` +
+		`<mechanism>SCRAM-SHA-1</mechanism></mechanisms>`)
+	srv.expect("auth")
+	srv.send(`<failure xmlns="` + NsSASL + `"><not-authorized/></failure>`)
+}
+
+func TestFeaturesAfterBind(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	srv.send(`<stream:features>` + bindFeatures +
+		`<sm xmlns="` + NsSM + `"/></stream:features>`)
+	waitFor(t, func() bool {
+		fe := cl.CurrentFeatures()
+		return fe != nil && fe.Sm != nil
+	})
+	// The next thing the client sends is the app's, not a bind
+	// request.
+	cl.Out <- &Message{Header: Header{To: "alice@example.com", Id: "m1"}}
+	assertEquals(t, "m1", srv.expect("message").attr("id"))
+}
+
+func TestStreamID(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	assertEquals(t, "", cl.StreamID())
+	srv.open(bindFeatures)
+	srv.bind()
+	assertEquals(t, "stream1", cl.StreamID())
+}
+
+func TestRawInboundHook(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	raw := make(chan string, 10)
+	cl.SetRawInboundHook(func(b []byte) {
+		raw <- string(b)
+	})
+	srv.open(bindFeatures)
+	srv.bind()
+
+	msg := `<message from='alice@example.com' id="m1">` +
+		`<body>hi</body></message>`
+	srv.send(msg)
+	expectMessage(t, cl, "m1")
+	for {
+		select {
+		case str := <-raw:
+			if strings.HasPrefix(str, "<message") {
+				assertEquals(t, msg, str)
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("hook didn't see the message")
+		}
+	}
+}
+
+func TestStreamHandlers(t *testing.T) {
+	got := make(chan *Generic, 1)
+	ext := Extension{StreamHandlers: map[string]func(*Client, *Generic){
+		"urn:example:ext ping": func(cl *Client, g *Generic) {
+			got <- g
+		}}}
+	jid := &JID{Node: "user", Domain: "example.com", Resource: "res"}
+	c, s := net.Pipe()
+	srv := newFakeServer(t, s)
+	cl, err := newClient(c, nil, jid, "secret", []Extension{ext})
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	// Nobody claims this one.
+	srv.send(`<other xmlns="urn:example:ext"/>`)
+	srv.send(`<ping xmlns="urn:example:ext" seq="1"/>`)
+	select {
+	case g := <-got:
+		assertEquals(t, "ping", g.XMLName.Local)
+		seq := ""
+		for _, a := range g.Attr {
+			if a.Name.Local == "seq" {
+				seq = a.Value
+			}
+		}
+		assertEquals(t, "1", seq)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler wasn't called")
+	}
+}
+
+// Counts the base64 data in the chunks of a streamed element, as a
+// StreamingHandler for a file transfer might.
+func countChunks(d *xml.Decoder, se *xml.StartElement) (int, error) {
+	buf := make([]byte, 4096)
+	total := 0
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+		cd, ok := t.(xml.CharData)
+		if !ok {
+			continue
+		}
+		n, err := base64.StdEncoding.Decode(buf, cd)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+}
+
+func TestStreamingHandlers(t *testing.T) {
+	got := make(chan int, 1)
+	ext := Extension{StreamingHandlers: map[string]func(*Client, *xml.Decoder, *xml.StartElement) error{
+		"urn:example:file": func(cl *Client, d *xml.Decoder, se *xml.StartElement) error {
+			if se.Name.Local == "refuse" {
+				// Leaves the rest for readXml() to skip.
+				return errors.New("refused")
+			}
+			n, err := countChunks(d, se)
+			got <- n
+			return err
+		}}}
+	jid := &JID{Node: "user", Domain: "example.com", Resource: "res"}
+	c, s := net.Pipe()
+	srv := newFakeServer(t, s)
+	cl, err := newClient(c, nil, jid, "secret", []Extension{ext})
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	chunk := `<chunk>` + base64.StdEncoding.EncodeToString(
+		make([]byte, 3000)) + `</chunk>`
+	srv.send(`<data xmlns="urn:example:file">` +
+		strings.Repeat(chunk, 10) + `</data>`)
+	srv.send(`<refuse xmlns="urn:example:file">` + chunk + `</refuse>`)
+	srv.send(`<message id="m1"/>`)
+	select {
+	case n := <-got:
+		if n != 30000 {
+			t.Errorf("handler read %d bytes", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler wasn't called")
+	}
+	expectMessage(t, cl, "m1")
+	var pe *ParseError
+	if err := nextError(t, cl); !errors.As(err, &pe) {
+		t.Fatalf("expected a parse error, got %v", err)
+	}
+	assertEquals(t, "urn:example:file refuse", pe.Element)
+}
+
+// Gives the head, then n copies of chunk, then the tail, without
+// building the whole thing.
+type repeatReader struct {
+	head, chunk, tail string
+	n                 int
+	cur               string
+}
+
+func (rr *repeatReader) Read(p []byte) (int, error) {
+	for rr.cur == "" {
+		switch {
+		case rr.head != "":
+			rr.cur, rr.head = rr.head, ""
+		case rr.n > 0:
+			rr.cur = rr.chunk
+			rr.n--
+		case rr.tail != "":
+			rr.cur, rr.tail = rr.tail, ""
+		default:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, rr.cur)
+	rr.cur = rr.cur[n:]
+	return n, nil
+}
+
+func TestStreamingMemory(t *testing.T) {
+	const chunks = 4096
+	chunk := `<chunk>` + base64.StdEncoding.EncodeToString(
+		make([]byte, 3072)) + `</chunk>`
+	r := &repeatReader{head: `<data xmlns="urn:example:file">`,
+		chunk: chunk, n: chunks,
+		tail: `</data><message id="m1"/>`}
+	got := 0
+	streaming := map[string]func(*xml.Decoder, *xml.StartElement) error{
+		"urn:example:file": func(d *xml.Decoder, se *xml.StartElement) error {
+			var err error
+			got, err = countChunks(d, se)
+			return err
+		}}
+	// Far smaller than the element.
+	limit := func() int { return 64 << 10 }
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	ch := make(chan interface{})
+	go readXml(r, ch, nil, streaming, limit, nil)
+	x := <-ch
+	runtime.ReadMemStats(&after)
+	if msg, ok := x.(*Message); !ok || msg.Id != "m1" {
+		t.Fatalf("expected message m1, got %#v", x)
+	}
+	if got != chunks*3072 {
+		t.Errorf("handler read %d bytes", got)
+	}
+	size := len(chunk) * chunks
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > uint64(size/8) {
+		t.Errorf("allocated %d bytes reading %d", alloc, size)
+	}
+	for _ = range ch {
+	}
+}
+
+func TestSpoofedCarbon(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	srv.send(carbon("mallory@evil.example.com", "forged"))
+	srv.send(`<message id="m1" from="juliet@example.com/balcony"/>`)
+	srv.send(carbon("user@example.com", "real"))
+	expectMessage(t, cl, "m1")
+	msg := expectMessage(t, cl, "")
+	if len(msg.UnknownElements()) != 1 ||
+		!strings.Contains(msg.Innerxml, "real") {
+		t.Errorf("expected the real carbon: %s", msg.Innerxml)
+	}
+
+	// A spoofed roster push is dropped too, without an answer.
+	srv.send(`<iq type="set" id="push1" from="mallory@evil.example.com">` +
+		`<query xmlns="` + NsRoster + `"><item jid="mallory@evil.example.com" ` +
+		`subscription="both"/></query></iq>`)
+	srv.send(`<message id="m2" from="juliet@example.com/balcony"/>`)
+	expectMessage(t, cl, "m2")
+}
+
+func TestFromValidator(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	cl.SetFromValidator(func(st Stanza) bool {
+		return !strings.HasSuffix(st.GetHeader().From, "@evil.example.com")
+	})
+	srv.send(`<message id="m1" from="mallory@evil.example.com"/>`)
+	srv.send(`<message id="m2" from="juliet@example.com/balcony"/>`)
+	expectMessage(t, cl, "m2")
+}
+
+func TestInDropOldest(t *testing.T) {
+	InBufferSize, InOverflow = 2, OverflowDropOldest
+	defer func() { InBufferSize, InOverflow = 0, OverflowBlock }()
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	// Nobody reads these.
+	for i := 1; i <= 5; i++ {
+		srv.send(fmt.Sprintf(`<message from="a@b.c" id="m%d"/>`, i))
+	}
+	waitFor(t, func() bool { return cl.Stats().InDropped == 3 })
+
+	// The client still answers the server.
+	errs := make(chan error)
+	go func() {
+		_, err := cl.DiscoInfo("example.com", "")
+		errs <- err
+	}()
+	iq := srv.expect("iq")
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `" from="example.com">` +
+		`<query xmlns="` + NsDiscoInfo + `"/></iq>`)
+	if err := <-errs; err != nil {
+		t.Fatalf("DiscoInfo: %v", err)
+	}
+
+	// The newest ones are waiting.
+	expectMessage(t, cl, "m4")
+	expectMessage(t, cl, "m5")
+	if n := cl.Stats().InDropped; n != 3 {
+		t.Errorf("dropped %d", n)
+	}
+}
+
+func TestAddFilterFunc(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	cl.AddFilterFunc(func(st Stanza) (Stanza, bool) {
+		msg, ok := st.(*Message)
+		if !ok {
+			return st, true
+		}
+		if strings.HasPrefix(msg.Id, "drop") {
+			return st, false
+		}
+		// Stanzas can be changed on the way too.
+		cp := *msg
+		cp.AddSubject("", "filtered")
+		return &cp, true
+	})
+	for _, id := range []string{"drop1", "m1", "drop2", "m2"} {
+		srv.send(`<message from="juliet@example.com" id="` + id + `"/>`)
+	}
+	for _, id := range []string{"m1", "m2"} {
+		msg := expectMessage(t, cl, id)
+		assertEquals(t, "filtered", msg.GetSubject())
+	}
+}
+
+func TestOutPriority(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+
+	// Queue both kinds before binding lets any of them out.
+	go func() {
+		cl.Out <- &Message{Header: Header{Id: "normal1"}}
+		cl.Out <- &Message{Header: Header{Id: "normal2"}}
+	}()
+	cl.OutPriority() <- &Iq{Header: Header{Id: "urgent1", Type: "result"}}
+	cl.OutPriority() <- &Iq{Header: Header{Id: "urgent2", Type: "result"}}
+	srv.bind()
+
+	for _, id := range []string{"urgent1", "urgent2", "normal1", "normal2"} {
+		assertEquals(t, id, srv.next().attr("id"))
+	}
+}
+
+func TestDuplicateHandler(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	first := make(chan Stanza, 10)
+	second := make(chan Stanza, 10)
+	cl.HandleStanza("q1", func(st Stanza) bool {
+		first <- st
+		return false
+	})
+	cl.HandleStanza("q1", func(st Stanza) bool {
+		second <- st
+		return false
+	})
+	select {
+	case st := <-first:
+		if _, ok := st.(*CanceledStanza); !ok {
+			t.Fatalf("first handler got %#v", st)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("collision not reported")
+	}
+
+	// The reply goes to the second.
+	srv.send(`<message id="q1" from="a@b.c"/>`)
+	select {
+	case st := <-second:
+		if _, ok := st.(*Message); !ok {
+			t.Fatalf("second handler got %#v", st)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second handler not called")
+	}
+	select {
+	case st := <-first:
+		t.Errorf("first handler called again with %#v", st)
+	default:
+	}
+}
+
+func TestPendingHandlers(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	answered := make(chan string, 2)
+	f := func(st Stanza) bool {
+		answered <- st.GetHeader().Id
+		return false
+	}
+	// Ours, leaving out any the client registered itself.
+	pending := func() string {
+		var ids []string
+		for _, id := range cl.PendingHandlers() {
+			if strings.HasPrefix(id, "h") {
+				ids = append(ids, id)
+			}
+		}
+		return fmt.Sprint(ids)
+	}
+	cl.HandleStanza("h2", f)
+	cl.HandleStanza("h1", f)
+	assertEquals(t, "[h1 h2]", pending())
+
+	srv.send(`<iq type="result" id="h1"/>`)
+	assertEquals(t, "h1", <-answered)
+	assertEquals(t, "[h2]", pending())
+}
+
+func TestSpoofedReply(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- cl.Query("pubsub.example.com", "get", &pubsub{}, nil)
+	}()
+	iq := srv.expect("iq")
+	// Someone else guesses the id.
+	srv.send(`<iq type="error" id="` + iq.attr("id") + `" ` +
+		`from="mallory@evil.example.com"><error type="cancel">` +
+		`<item-not-found xmlns="` + NsStanzas + `"/></error></iq>`)
+	srv.send(`<message from="a@b.c" id="m1"/>`)
+	expectMessage(t, cl, "m1")
+	pending := false
+	for _, id := range cl.PendingHandlers() {
+		pending = pending || id == iq.attr("id")
+	}
+	if !pending {
+		t.Fatal("Query answered by the spoofed reply")
+	}
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `" ` +
+		`from="pubsub.example.com"/>`)
+	if err := <-errs; err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+}
+
+func TestReplyFrom(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	for _, c := range []struct {
+		to, from string
+		ok       bool
+	}{
+		{"pubsub.example.com", "pubsub.example.com", true},
+		{"pubsub.example.com", "PubSub.Example.com", true},
+		{"pubsub.example.com", "", true},
+		{"pubsub.example.com", "example.com", false},
+		{"juliet@example.com", "juliet@example.com/balcony", false},
+		{"", "example.com", true},
+		{"", "user@example.com", true},
+		{"example.com", "user@example.com/res", true},
+		{"", "mallory@example.com", false},
+		{"user@example.com", "pubsub.example.com", false},
+	} {
+		if ok := cl.replyFrom(c.to, c.from); ok != c.ok {
+			t.Errorf("reply to %q from %q: %v", c.to, c.from, ok)
+		}
+	}
+}
+
+func TestCancelStanza(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	calls := make(chan Stanza, 10)
+	cl.HandleStanza("q1", func(st Stanza) bool {
+		calls <- st
+		return false
+	})
+	cl.CancelStanza("q1")
+	select {
+	case st := <-calls:
+		if _, ok := st.(*CanceledStanza); !ok {
+			t.Fatalf("handler got %#v", st)
+		}
+		assertEquals(t, "q1", st.GetHeader().Id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not called")
+	}
+
+	// The answer goes to the app instead.
+	srv.send(`<message id="q1" from="a@b.c"/>`)
+	expectMessage(t, cl, "q1")
+	select {
+	case st := <-calls:
+		t.Errorf("handler called again with %#v", st)
+	default:
+	}
+
+	// Cancelling something that isn't registered does nothing.
+	cl.CancelStanza("q2")
+	srv.send(`<message id="q2" from="a@b.c"/>`)
+	expectMessage(t, cl, "q2")
+}
+
+func TestParseErrorSkipped(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	// Neither of these unmarshals, but both are well-formed.
+	srv.send(`<a xmlns="` + NsSM + `" h="lots"><x><y/></x></a>`)
+	srv.send(`<message id="m1"><delay xmlns="` + NsDelay + `" ` +
+		`stamp="yesterday"/><body>hi</body></message>`)
+	srv.send(`<message id="m2"><body>hi</body></message>`)
+	expectMessage(t, cl, "m2")
+	for _, exp := range []string{NsSM + " a", NsClient + " message"} {
+		var pe *ParseError
+		if err := nextError(t, cl); !errors.As(err, &pe) {
+			t.Fatalf("expected a parse error, got %v", err)
+		}
+		assertEquals(t, exp, pe.Element)
+	}
+}
+
+func TestSkipElement(t *testing.T) {
+	var v struct {
+		A struct {
+			B int `xml:"b"`
+		} `xml:"a"`
+	}
+	text := `<x><a><b>many</b><c><d/></c></a><e/></x><next/>`
+	p := xml.NewDecoder(strings.NewReader(text))
+	off := p.InputOffset()
+	t0, _ := p.Token()
+	se := t0.(xml.StartElement)
+	if err := p.DecodeElement(&v, &se); err == nil {
+		t.Fatal("decoded")
+	}
+	if err := skipElement(p, []byte(text[off:p.InputOffset()])); err != nil {
+		t.Fatalf("skipElement: %v", err)
+	}
+	t1, err := p.Token()
+	if next, ok := t1.(xml.StartElement); !ok || next.Name.Local != "next" {
+		t.Fatalf("after skipping: %#v %v", t1, err)
+	}
+}
@@ -14,6 +14,8 @@ import (
 	// BUG(cjyar): We should use stringprep
 	// "code.google.com/p/go-idn/src/stringprep"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -29,6 +31,9 @@ type JID struct {
 var _ fmt.Stringer = &JID{}
 var _ flag.Value = &JID{}
 
+// The </stream:stream> that ends our side of the stream.
+type streamEnd struct{}
+
 // XMPP's <stream:stream> XML element
 type stream struct {
 	XMLName xml.Name `xml:"stream=http://etherx.jabber.org/streams stream"`
@@ -37,6 +42,9 @@ type stream struct {
 	Id      string   `xml:"id,attr"`
 	Lang    string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
 	Version string   `xml:"version,attr"`
+	// The namespace of the stanzas in the stream, if it's not
+	// jabber:client.
+	Ns string `xml:"-"`
 }
 
 var _ fmt.Stringer = &stream{}
@@ -54,28 +62,212 @@ type errText struct {
 	Text    string   `xml:",chardata"`
 }
 
+// StreamError describes the error the server gave when it closed the
+// stream. See RFC 6120, Section 4.9.
+type StreamError struct {
+	// The defined condition, such as StreamConflict.
+	Condition StreamCondition
+	// The human-readable description, if the server sent one.
+	Text string
+	// For StreamSeeOtherHost, where the server told us to go
+	// instead: a host, perhaps with a port.
+	OtherHost string
+}
+
+var _ error = &StreamError{}
+
+// ConflictError is reported on Errors() instead of a plain
+// *StreamError when the server closes the stream because another
+// session logged in with our resource. The client doesn't reconnect
+// after it; an app that does should pick a different resource, or
+// it will knock the other session offline.
+type ConflictError struct {
+	*StreamError
+}
+
+var _ error = &ConflictError{}
+
+// StanzaError is returned by requests the other end answered with an
+// error stanza. See RFC 6120, Section 8.3.
+type StanzaError struct {
+	// The error type, such as "cancel" or "auth".
+	Type string
+	// The defined condition, such as "item-not-found".
+	Condition string
+	// The human-readable description, if there was one.
+	Text string
+	// The error as it arrived, or nil if the reply didn't have one.
+	Err *Error
+}
+
+var _ error = &StanzaError{}
+
+// TransportError is returned when the client can't reach the server,
+// or loses the connection to it.
+type TransportError struct {
+	// What the client was doing, such as "dial example.com:5222".
+	Op  string
+	Err error
+}
+
+var _ error = &TransportError{}
+
+// TimeoutError is returned when the client gives up waiting, whether
+// for the network or for an answer.
+type TimeoutError struct {
+	// What the client was waiting for.
+	Op string
+	// The underlying error, if any.
+	Err error
+}
+
+var _ error = &TimeoutError{}
+
+// AuthError is reported on Errors() when the server rejects our
+// credentials, or can't prove it knows them. StartSession() returns
+// it too.
+type AuthError struct {
+	// The SASL condition, such as "not-authorized". It's empty if
+	// the server was the one that failed.
+	Condition string
+	// The human-readable description, if there was one.
+	Text string
+}
+
+var _ error = &AuthError{}
+
+// NegotiationError is reported on Errors() when the server doesn't
+// follow the steps of stream negotiation, such as by not restarting
+// the stream after authentication.
+type NegotiationError struct {
+	// What the client was waiting for, and what it got instead.
+	Expected string
+	Got      string
+}
+
+var _ error = &NegotiationError{}
+
+// ParseError is reported on Errors() when the server sends an element
+// the client can't make sense of. The element is skipped, and the
+// stream carries on.
+type ParseError struct {
+	// The element's namespace and name, such as "jabber:client iq".
+	Element string
+	Err     error
+}
+
+var _ error = &ParseError{}
+
+// A stream error condition, named after its element. See RFC 6120,
+// Section 4.9.3.
+type StreamCondition string
+
+const (
+	StreamBadFormat           StreamCondition = "bad-format"
+	StreamConflict            StreamCondition = "conflict"
+	StreamConnectionTimeout   StreamCondition = "connection-timeout"
+	StreamHostGone            StreamCondition = "host-gone"
+	StreamHostUnknown         StreamCondition = "host-unknown"
+	StreamInternalServerError StreamCondition = "internal-server-error"
+	StreamInvalidFrom         StreamCondition = "invalid-from"
+	StreamInvalidId           StreamCondition = "invalid-id"
+	StreamNotAuthorized       StreamCondition = "not-authorized"
+	StreamPolicyViolation     StreamCondition = "policy-violation"
+	StreamRemoteConnectFailed StreamCondition = "remote-connection-failed"
+	StreamReset               StreamCondition = "reset"
+	StreamResourceConstraint  StreamCondition = "resource-constraint"
+	StreamSeeOtherHost        StreamCondition = "see-other-host"
+	StreamSystemShutdown      StreamCondition = "system-shutdown"
+	StreamUndefinedCondition  StreamCondition = "undefined-condition"
+	StreamUnsupportedVersion  StreamCondition = "unsupported-version"
+)
+
+// A stanza error condition, named after its element. See RFC 6120,
+// Section 8.3.3. Each is an error, so errors.Is can tell whether a
+// *StanzaError or an *Error has that condition.
+type StanzaCondition string
+
+const (
+	ErrBadRequest            StanzaCondition = "bad-request"
+	ErrConflict              StanzaCondition = "conflict"
+	ErrFeatureNotImplemented StanzaCondition = "feature-not-implemented"
+	ErrForbidden             StanzaCondition = "forbidden"
+	ErrGone                  StanzaCondition = "gone"
+	ErrInternalServerError   StanzaCondition = "internal-server-error"
+	ErrItemNotFound          StanzaCondition = "item-not-found"
+	ErrJidMalformed          StanzaCondition = "jid-malformed"
+	ErrNotAcceptable         StanzaCondition = "not-acceptable"
+	ErrNotAllowed            StanzaCondition = "not-allowed"
+	ErrNotAuthorized         StanzaCondition = "not-authorized"
+	ErrPolicyViolation       StanzaCondition = "policy-violation"
+	ErrRecipientUnavailable  StanzaCondition = "recipient-unavailable"
+	ErrRedirect              StanzaCondition = "redirect"
+	ErrRegistrationRequired  StanzaCondition = "registration-required"
+	ErrRemoteServerNotFound  StanzaCondition = "remote-server-not-found"
+	ErrRemoteServerTimeout   StanzaCondition = "remote-server-timeout"
+	ErrResourceConstraint    StanzaCondition = "resource-constraint"
+	ErrServiceUnavailable    StanzaCondition = "service-unavailable"
+	ErrSubscriptionRequired  StanzaCondition = "subscription-required"
+	ErrUndefinedCondition    StanzaCondition = "undefined-condition"
+	ErrUnexpectedRequest     StanzaCondition = "unexpected-request"
+)
+
+var _ error = ErrItemNotFound
+
 type Features struct {
 	Starttls   *starttls `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
 	Mechanisms mechs     `xml:"urn:ietf:params:xml:ns:xmpp-sasl mechanisms"`
 	Bind       *bindIq
-	Session    *Generic
+	Session    *Generic `xml:"urn:ietf:params:xml:ns:xmpp-session session"`
+	Sm         *Generic `xml:"urn:xmpp:sm:3 sm"`
+	RosterVer  *Generic `xml:"urn:xmpp:features:rosterver ver"`
 	Any        *Generic
 }
 
+// TLSRequired reports whether the server insists on STARTTLS before
+// anything else.
+func (f *Features) TLSRequired() bool {
+	return f.Starttls != nil && f.Starttls.Required != nil
+}
+
+// SASLRequired reports whether we have to authenticate before going
+// further. Mechanisms are only offered when we may, and the server
+// can mark them <optional/>, when it will let us carry on
+// unauthenticated, or <required/>, as it's taken to be if it doesn't
+// say.
+func (f *Features) SASLRequired() bool {
+	return len(f.Mechanisms.Mechanism) > 0 && f.Mechanisms.Optional == nil
+}
+
+// SASLOptional reports whether the server offers mechanisms but will
+// let us carry on without authenticating.
+func (f *Features) SASLOptional() bool {
+	return len(f.Mechanisms.Mechanism) > 0 && f.Mechanisms.Optional != nil
+}
+
+// BindRequired reports whether we have to bind a resource. RFC 6120
+// makes binding mandatory whenever it's offered.
+func (f *Features) BindRequired() bool {
+	return f.Bind != nil
+}
+
 type starttls struct {
 	XMLName  xml.Name
-	Required *string
+	Required *string `xml:"required"`
 }
 
 type mechs struct {
 	Mechanism []string `xml:"urn:ietf:params:xml:ns:xmpp-sasl mechanism"`
+	Required  *string  `xml:"required"`
+	Optional  *string  `xml:"optional"`
 }
 
 type auth struct {
 	XMLName   xml.Name
-	Chardata  string `xml:",chardata"`
-	Mechanism string `xml:"mechanism,attr,omitempty"`
-	Any       *Generic
+	Chardata  string   `xml:",chardata"`
+	Mechanism string   `xml:"mechanism,attr,omitempty"`
+	Text      *Generic `xml:"urn:ietf:params:xml:ns:xmpp-sasl text"`
+	Any       *Generic `xml:",any"`
 }
 
 type Stanza interface {
@@ -85,27 +277,161 @@ type Stanza interface {
 // One of the three core XMPP stanza types: iq, message, presence. See
 // RFC3920, section 9.
 type Header struct {
-	To       string `xml:"to,attr,omitempty"`
-	From     string `xml:"from,attr,omitempty"`
-	Id       string `xml:"id,attr,omitempty"`
-	Type     string `xml:"type,attr,omitempty"`
-	Lang     string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
-	Innerxml string `xml:",innerxml"`
+	To   string `xml:"to,attr,omitempty"`
+	From string `xml:"from,attr,omitempty"`
+	Id   string `xml:"id,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Lang string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	// Attributes of the stanza's element that it has no field
+	// for, such as those some extensions add. See SetAttr().
+	Attrs    map[xml.Name]string `xml:"-"`
+	Innerxml string              `xml:",innerxml"`
 	Error    *Error
 	Nested   []interface{}
+	// The received XML of each of Nested. See NestedRaw().
+	nestedRaw []string
+	// The default language of the stream it came in on. See
+	// GetLang().
+	streamLang string
+}
+
+// NestedRaw returns the XML of each element of Nested exactly as it
+// was received, for checking signatures over it. Namespaces declared
+// on the stanza itself aren't included. Elements that weren't parsed
+// from the stanza's own XML, such as those added by the app, have an
+// empty string.
+func (h *Header) NestedRaw() []string {
+	raw := make([]string, len(h.Nested))
+	copy(raw, h.nestedRaw)
+	return raw
+}
+
+// SetAttr gives the stanza's element an attribute it has no field
+// for. A name in a namespace other than the stanza's gets a prefix
+// declared for it.
+func (h *Header) SetAttr(name xml.Name, value string) {
+	if h.Attrs == nil {
+		h.Attrs = make(map[xml.Name]string)
+	}
+	h.Attrs[name] = value
+}
+
+// Collects the attributes of a stanza's element that Header has no
+// field for. Namespace declarations aren't attributes.
+func extraAttrs(attrs []xml.Attr) map[xml.Name]string {
+	var extra map[xml.Name]string
+	for _, a := range attrs {
+		switch {
+		case a.Name.Space == "xmlns",
+			a.Name.Space == "" && a.Name.Local == "xmlns":
+			continue
+		case a.Name.Space == "":
+			switch a.Name.Local {
+			case "to", "from", "id", "type":
+				continue
+			}
+		case a.Name.Space == xmlURL && a.Name.Local == "lang":
+			continue
+		}
+		if extra == nil {
+			extra = make(map[xml.Name]string)
+		}
+		extra[a.Name] = a.Value
+	}
+	return extra
+}
+
+// Adds h.Attrs to the attributes of the stanza's element, in a stable
+// order.
+func (h *Header) addAttrs(start *xml.StartElement) {
+	names := make([]xml.Name, 0, len(h.Attrs))
+	for name := range h.Attrs {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i].Space != names[j].Space {
+			return names[i].Space < names[j].Space
+		}
+		return names[i].Local < names[j].Local
+	})
+	for _, name := range names {
+		start.Attr = append(start.Attr, xml.Attr{Name: name,
+			Value: h.Attrs[name]})
+	}
+}
+
+// UnknownElements returns the stanza's child elements in namespaces
+// that no extension claimed, in the order they appeared. Only the
+// element names, first child, and character data are kept.
+func (h *Header) UnknownElements() []*Generic {
+	var unknown []*Generic
+	for _, n := range h.Nested {
+		if g, ok := n.(*Generic); ok {
+			unknown = append(unknown, g)
+		}
+	}
+	return unknown
 }
 
 // message stanza
 type Message struct {
 	XMLName xml.Name `xml:"jabber:client message"`
 	Header
-	Subject *Generic `xml:"jabber:client subject"`
-	Body    *Generic `xml:"jabber:client body"`
-	Thread  *Generic `xml:"jabber:client thread"`
+	// There may be a subject and a body in each of several
+	// languages. See BodyFor() and AddBody().
+	Subject []*Generic `xml:"jabber:client subject"`
+	Body    []*Generic `xml:"jabber:client body"`
+	Thread  *Generic   `xml:"jabber:client thread"`
 }
 
 var _ Stanza = &Message{}
 
+func (m *Message) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type plain Message
+	if err := d.DecodeElement((*plain)(m), &start); err != nil {
+		return err
+	}
+	m.Attrs = extraAttrs(start.Attr)
+	return nil
+}
+
+func (m *Message) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type plain Message
+	switch {
+	case m.XMLName.Local != "":
+		start.Name = m.XMLName
+	case start.Name.Local == "Message":
+		// Not a field with a name of its own.
+		start.Name = xml.Name{Space: NsClient, Local: "message"}
+	}
+	m.addAttrs(&start)
+	return e.EncodeElement((*plain)(m), start)
+}
+
+// The values of Message.Type. RFC 6121, Section 5.2.2.
+const (
+	MessageChat      = "chat"
+	MessageError     = "error"
+	MessageGroupchat = "groupchat"
+	MessageHeadline  = "headline"
+	MessageNormal    = "normal"
+)
+
+// NewMessage makes a message of the given type, with a body. It
+// returns an error if typ isn't one of the Message types, or empty,
+// which means normal.
+func NewMessage(typ, to, body string) (*Message, error) {
+	switch typ {
+	case "", MessageChat, MessageError, MessageGroupchat,
+		MessageHeadline, MessageNormal:
+	default:
+		return nil, fmt.Errorf("invalid message type %q", typ)
+	}
+	msg := &Message{Header: Header{To: to, Type: typ}}
+	msg.AddBody("", body)
+	return msg, nil
+}
+
 // presence stanza
 type Presence struct {
 	XMLName xml.Name `xml:"presence"`
@@ -117,6 +443,62 @@ type Presence struct {
 
 var _ Stanza = &Presence{}
 
+func (pr *Presence) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type plain Presence
+	if err := d.DecodeElement((*plain)(pr), &start); err != nil {
+		return err
+	}
+	pr.Attrs = extraAttrs(start.Attr)
+	return nil
+}
+
+func (pr *Presence) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type plain Presence
+	switch {
+	case pr.XMLName.Local != "":
+		start.Name = pr.XMLName
+	case start.Name.Local == "Presence":
+		// Not a field with a name of its own.
+		start.Name = xml.Name{Local: "presence"}
+	}
+	pr.addAttrs(&start)
+	return e.EncodeElement((*plain)(pr), start)
+}
+
+// The values of Presence.Type. Available presence has none. RFC 6121,
+// Section 4.7.1.
+const (
+	PresenceError        = "error"
+	PresenceProbe        = "probe"
+	PresenceSubscribe    = "subscribe"
+	PresenceSubscribed   = "subscribed"
+	PresenceUnavailable  = "unavailable"
+	PresenceUnsubscribe  = "unsubscribe"
+	PresenceUnsubscribed = "unsubscribed"
+)
+
+// DefaultPresence makes an available presence, such as an app might
+// give StartSession(), with the given show ("away", "chat", "dnd",
+// "xa", or "" for none), status text, and priority, and DefaultCaps
+// if it's set.
+func DefaultPresence(show, status string, priority int) *Presence {
+	pr := &Presence{Priority: &Generic{XMLName: xml.Name{Space: NsClient,
+		Local: "priority"}, Chardata: strconv.Itoa(priority)}}
+	if show != "" {
+		pr.Show = &Generic{XMLName: xml.Name{Space: NsClient,
+			Local: "show"}, Chardata: show}
+	}
+	if status != "" {
+		pr.Status = &Generic{XMLName: xml.Name{Space: NsClient,
+			Local: "status"}, Chardata: status}
+	}
+	if DefaultCaps != nil {
+		caps := *DefaultCaps
+		pr.Nested = append(pr.Nested, &caps)
+	}
+	return pr
+}
+
 // iq stanza
 type Iq struct {
 	XMLName xml.Name `xml:"iq"`
@@ -125,13 +507,51 @@ type Iq struct {
 
 var _ Stanza = &Iq{}
 
+func (iq *Iq) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type plain Iq
+	if err := d.DecodeElement((*plain)(iq), &start); err != nil {
+		return err
+	}
+	iq.Attrs = extraAttrs(start.Attr)
+	return nil
+}
+
+func (iq *Iq) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type plain Iq
+	switch {
+	case iq.XMLName.Local != "":
+		start.Name = iq.XMLName
+	case start.Name.Local == "Iq":
+		// Not a field with a name of its own.
+		start.Name = xml.Name{Local: "iq"}
+	}
+	iq.addAttrs(&start)
+	return e.EncodeElement((*plain)(iq), start)
+}
+
+// The values of Iq.Type. RFC 6120, Section 8.2.3.
+const (
+	IqGet    = "get"
+	IqSet    = "set"
+	IqResult = "result"
+	IqError  = "error"
+)
+
 // Describes an XMPP stanza error. See RFC 3920, Section 9.3.
 type Error struct {
 	XMLName xml.Name `xml:"error"`
 	// The error type attribute.
 	Type string `xml:"type,attr"`
-	// Any nested element, if present.
-	Any *Generic
+	// The human-readable descriptions, if any, perhaps in several
+	// languages. See TextFor().
+	Text []*Generic `xml:"urn:ietf:params:xml:ns:xmpp-stanzas text"`
+	// The defined condition, such as <item-not-found/>. See
+	// Condition().
+	Any *Generic `xml:",any"`
+	// An optional application-specific condition, in the
+	// application's own namespace, which says more than the
+	// defined one. See AppCondition().
+	App *Generic `xml:",any"`
 }
 
 var _ error = &Error{}
@@ -144,10 +564,15 @@ type bindIq struct {
 }
 
 // Holds an XML element not described by the more specific types.
+// Any only holds the first child element, but an element with
+// children that was unmarshaled keeps all its content in Innerxml,
+// which is what's marshaled if it's set.
 type Generic struct {
 	XMLName  xml.Name
-	Any      *Generic `xml:",any"`
-	Chardata string   `xml:",chardata"`
+	Attr     []xml.Attr `xml:",any,attr"`
+	Any      *Generic   `xml:",any"`
+	Chardata string     `xml:",chardata"`
+	Innerxml string     `xml:",innerxml"`
 }
 
 var _ fmt.Stringer = &Generic{}
@@ -163,8 +588,36 @@ func (jid *JID) String() string {
 	return result
 }
 
-// Set implements flag.Value. It returns true if it successfully
-// parses the string.
+// The JID without its resource.
+func (jid *JID) bare() string {
+	if jid.Node == "" {
+		return jid.Domain
+	}
+	return jid.Node + "@" + jid.Domain
+}
+
+// Bare returns the JID without its resource.
+func (jid JID) Bare() JID {
+	jid.Resource = ""
+	return jid
+}
+
+// Equal reports whether the two JIDs address the same entity. The
+// node and domain are compared without regard to case, as nodeprep
+// and nameprep would fold it; the resource is compared exactly.
+func (jid JID) Equal(other JID) bool {
+	return jid.BareEqual(other) && jid.Resource == other.Resource
+}
+
+// BareEqual is like Equal, but ignores the resources, so a full JID
+// matches its bare JID.
+func (jid JID) BareEqual(other JID) bool {
+	return strings.EqualFold(jid.Node, other.Node) &&
+		strings.EqualFold(jid.Domain, other.Domain)
+}
+
+// Set implements flag.Value. It returns an error if it can't parse
+// the string.
 func (jid *JID) Set(val string) error {
 	r := regexp.MustCompile("^(([^@/]+)@)?([^@/]+)(/([^@/]+))?$")
 	parts := r.FindStringSubmatch(val)
@@ -183,7 +636,15 @@ func (jid *JID) Set(val string) error {
 func (s *stream) String() string {
 	var buf bytes.Buffer
 	buf.WriteString(`<stream:stream xmlns="`)
-	buf.WriteString(NsClient)
+	if s.Ns != "" {
+		buf.WriteString(s.Ns)
+	} else {
+		buf.WriteString(NsClient)
+	}
+	if s.Ns == NsServer {
+		buf.WriteString(`" xmlns:db="`)
+		buf.WriteString(NsDialback)
+	}
 	buf.WriteString(`" xmlns:stream="`)
 	buf.WriteString(NsStream)
 	buf.WriteString(`"`)
@@ -235,6 +696,79 @@ func parseStream(se xml.StartElement) (*stream, error) {
 	return s, nil
 }
 
+// GetLang returns the language of the stanza's human-readable
+// content, from its xml:lang attribute. A received stanza without one
+// inherits the stream's default language.
+func (h *Header) GetLang() string {
+	if h.Lang == "" {
+		return h.streamLang
+	}
+	return h.Lang
+}
+
+// GetBody returns the body in the message's own language, or the
+// first body if there isn't one in that language.
+func (m *Message) GetBody() string {
+	return textFor(m.Body, m.GetLang(), m.GetLang(), true)
+}
+
+// BodyFor returns the body in the given language, or "" if there
+// isn't one.
+func (m *Message) BodyFor(lang string) string {
+	return textFor(m.Body, m.GetLang(), lang, false)
+}
+
+// AddBody adds a body in the given language. An empty lang means the
+// message's own language.
+func (m *Message) AddBody(lang, text string) {
+	m.Body = append(m.Body, newText("body", m.Lang, lang, text))
+}
+
+// GetSubject is like GetBody, for the subject.
+func (m *Message) GetSubject() string {
+	return textFor(m.Subject, m.GetLang(), m.GetLang(), true)
+}
+
+// SubjectFor is like BodyFor, for the subject.
+func (m *Message) SubjectFor(lang string) string {
+	return textFor(m.Subject, m.GetLang(), lang, false)
+}
+
+// AddSubject is like AddBody, for the subject.
+func (m *Message) AddSubject(lang, text string) {
+	m.Subject = append(m.Subject, newText("subject", m.Lang, lang, text))
+}
+
+// Find the text in lang among texts, which are in msgLang unless
+// they say otherwise.
+func textFor(texts []*Generic, msgLang, lang string, orFirst bool) string {
+	for _, t := range texts {
+		tl := msgLang
+		for _, a := range t.Attr {
+			if a.Name.Space == xmlURL && a.Name.Local == "lang" {
+				tl = a.Value
+			}
+		}
+		if strings.EqualFold(tl, lang) {
+			return t.Chardata
+		}
+	}
+	if orFirst && len(texts) > 0 {
+		return texts[0].Chardata
+	}
+	return ""
+}
+
+func newText(local, msgLang, lang, text string) *Generic {
+	g := &Generic{XMLName: xml.Name{Space: NsClient, Local: local},
+		Chardata: text}
+	if lang != "" && !strings.EqualFold(lang, msgLang) {
+		g.Attr = []xml.Attr{{Name: xml.Name{Space: xmlURL,
+			Local: "lang"}, Value: lang}}
+	}
+	return g
+}
+
 func (iq *Iq) GetHeader() *Header {
 	return &iq.Header
 }
@@ -260,7 +794,244 @@ func (u *Generic) String() string {
 		u.XMLName.Local)
 }
 
+func (u *Generic) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type plain Generic
+	if err := d.DecodeElement((*plain)(u), &start); err != nil {
+		return err
+	}
+	if u.Any == nil {
+		// Chardata says it all.
+		u.Innerxml = ""
+	}
+	return nil
+}
+
+func (u *Generic) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if u.XMLName.Local != "" {
+		start.Name = u.XMLName
+	}
+	if u.Innerxml == "" {
+		type plain Generic
+		return e.EncodeElement((*plain)(u), start)
+	}
+	// The namespace declarations we received would clash with the
+	// ones the encoder makes.
+	start.Attr = nil
+	for _, a := range u.Attr {
+		if a.Name.Space != "xmlns" && a.Name.Local != "xmlns" {
+			start.Attr = append(start.Attr, a)
+		}
+	}
+	raw := struct {
+		Innerxml string `xml:",innerxml"`
+	}{u.Innerxml}
+	return e.EncodeElement(raw, start)
+}
+
+// Convert what the server sent into the type we give to the app.
+func (se *streamError) streamError() *StreamError {
+	err := &StreamError{Condition: StreamCondition(se.Any.XMLName.Local)}
+	if err.Condition == "" {
+		err.Condition = StreamUndefinedCondition
+	}
+	if se.Text != nil {
+		err.Text = se.Text.Text
+	}
+	if err.Condition == StreamSeeOtherHost {
+		err.OtherHost = strings.TrimSpace(se.Any.Chardata)
+	}
+	return err
+}
+
+func (er *StreamError) Error() string {
+	if er.Text == "" {
+		return "stream error: " + string(er.Condition)
+	}
+	return fmt.Sprintf("stream error: %s: %s", er.Condition, er.Text)
+}
+
+// Unwrap returns the stream error, so errors.As finds it too.
+func (er *ConflictError) Unwrap() error {
+	return er.StreamError
+}
+
+// Retryable returns false if connecting again is certain to end the
+// same way, or would knock another session offline: the server
+// rejected our credentials, or another client logged in with our
+// resource.
+func (er *StreamError) Retryable() bool {
+	switch er.Condition {
+	case StreamConflict, StreamNotAuthorized, StreamHostUnknown,
+		StreamPolicyViolation, StreamUnsupportedVersion:
+		return false
+	}
+	return true
+}
+
+func (er *StanzaError) Error() string {
+	if er.Text == "" {
+		return "stanza error: " + er.Condition
+	}
+	return fmt.Sprintf("stanza error: %s: %s", er.Condition, er.Text)
+}
+
+func (c StanzaCondition) Error() string {
+	return "stanza error: " + string(c)
+}
+
+// Is reports whether target is the StanzaCondition er has.
+func (er *StanzaError) Is(target error) bool {
+	c, ok := target.(StanzaCondition)
+	return ok && string(c) == er.Condition
+}
+
+// Unwrap returns the error element, so errors.As can find it.
+func (er *StanzaError) Unwrap() error {
+	if er.Err == nil {
+		return nil
+	}
+	return er.Err
+}
+
+func (er *TransportError) Error() string {
+	return er.Op + ": " + er.Err.Error()
+}
+
+func (er *TransportError) Unwrap() error {
+	return er.Err
+}
+
+func (er *TimeoutError) Error() string {
+	if er.Err == nil {
+		return er.Op + ": timed out"
+	}
+	return er.Op + ": " + er.Err.Error()
+}
+
+func (er *TimeoutError) Unwrap() error {
+	return er.Err
+}
+
+// Timeout always returns true. It's there so code written for
+// net.Error recognizes a TimeoutError.
+func (er *TimeoutError) Timeout() bool {
+	return true
+}
+
+func (er *NegotiationError) Error() string {
+	return fmt.Sprintf("negotiation: expected %s, got %s", er.Expected,
+		er.Got)
+}
+
+func (er *ParseError) Error() string {
+	return fmt.Sprintf("parse %s: %s", er.Element, er.Err)
+}
+
+func (er *ParseError) Unwrap() error {
+	return er.Err
+}
+
+func (er *AuthError) Error() string {
+	if er.Condition == "" {
+		return "authentication failed: " + er.Text
+	}
+	if er.Text == "" {
+		return "authentication failed: " + er.Condition
+	}
+	return fmt.Sprintf("authentication failed: %s: %s", er.Condition,
+		er.Text)
+}
+
+// TextFor returns the error's description in the given language. If
+// there isn't one, it returns the description with no language, or
+// else the first.
+func (er *Error) TextFor(lang string) string {
+	if lang != "" {
+		if text := textFor(er.Text, "", lang, false); text != "" {
+			return text
+		}
+	}
+	return textFor(er.Text, "", "", true)
+}
+
+// Condition returns the name of the error's defined condition, such
+// as "item-not-found", or "" if it doesn't have one.
+func (er *Error) Condition() string {
+	if er.Any == nil || er.Any.XMLName.Space != NsStanzas {
+		return ""
+	}
+	return er.Any.XMLName.Local
+}
+
+// AppCondition returns the application-specific condition, or nil if
+// there isn't one.
+func (er *Error) AppCondition() *Generic {
+	return er.App
+}
+
+// The defined condition is the child in the stanzas namespace, and
+// the application condition is the one that isn't.
+func (er *Error) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var raw struct {
+		Type string     `xml:"type,attr"`
+		Text []*Generic `xml:"urn:ietf:params:xml:ns:xmpp-stanzas text"`
+		Any  []*Generic `xml:",any"`
+	}
+	if err := d.DecodeElement(&raw, &start); err != nil {
+		return err
+	}
+	er.XMLName = start.Name
+	er.Type = raw.Type
+	er.Text = raw.Text
+	er.Any = nil
+	er.App = nil
+	for _, g := range raw.Any {
+		if g.XMLName.Space == NsStanzas {
+			er.Any = g
+			break
+		}
+	}
+	if er.Any == nil && len(raw.Any) > 0 {
+		// Some old servers leave the namespace out.
+		er.Any = raw.Any[0]
+	}
+	for _, g := range raw.Any {
+		if g != er.Any && g.XMLName.Space != NsStanzas {
+			er.App = g
+			break
+		}
+	}
+	return nil
+}
+
+// Converts an error element, which may be nil, into what a request
+// returns, with its text in lang if possible.
+func (er *Error) stanzaError(lang string) *StanzaError {
+	err := &StanzaError{Condition: "undefined-condition", Err: er}
+	if er == nil {
+		return err
+	}
+	err.Type = er.Type
+	if cond := er.Condition(); cond != "" {
+		err.Condition = cond
+	}
+	err.Text = er.TextFor(lang)
+	return err
+}
+
+// Error returns the error's type and condition, and its text if it
+// has any, such as "cancel/item-not-found: no such node". See XML()
+// for all of it.
 func (er *Error) Error() string {
+	s := er.Type + "/" + er.condition()
+	if text := er.TextFor(""); text != "" {
+		s += ": " + text
+	}
+	return s
+}
+
+// XML returns the error element as it would be sent.
+func (er *Error) XML() string {
 	buf, err := xml.Marshal(er)
 	if err != nil {
 		Warn.Log("double bad error: couldn't marshal error")
@@ -269,6 +1040,21 @@ func (er *Error) Error() string {
 	return string(buf)
 }
 
+// Is reports whether target is the StanzaCondition er has. An error
+// without one has undefined-condition.
+func (er *Error) Is(target error) bool {
+	c, ok := target.(StanzaCondition)
+	return ok && string(c) == er.condition()
+}
+
+// Like Condition(), but undefined-condition if there isn't one.
+func (er *Error) condition() string {
+	if cond := er.Condition(); cond != "" {
+		return cond
+	}
+	return string(ErrUndefinedCondition)
+}
+
 var bindExt Extension = Extension{StanzaHandlers: map[string]func(*xml.Name) interface{}{NsBind: newBind},
 	Start: func(cl *Client) {}}
 
@@ -7,6 +7,7 @@ package xmpp
 import (
 	"bytes"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"os"
 	"reflect"
@@ -51,6 +52,31 @@ func TestJid(t *testing.T) {
 	assertEquals(t, str, jid.String())
 }
 
+func TestJidEqual(t *testing.T) {
+	full := JID{Node: "User", Domain: "Example.COM", Resource: "Res"}
+	same := JID{Node: "user", Domain: "example.com", Resource: "Res"}
+	if !full.Equal(same) {
+		t.Errorf("%v != %v", &full, &same)
+	}
+	other := JID{Node: "user", Domain: "example.com", Resource: "res"}
+	if full.Equal(other) {
+		t.Errorf("resources compared without case: %v", &other)
+	}
+
+	bare := full.Bare()
+	assertEquals(t, "User@Example.COM", bare.String())
+	assertEquals(t, "Res", full.Resource)
+	if full.Equal(bare) {
+		t.Errorf("%v == %v", &full, &bare)
+	}
+	if !full.BareEqual(bare) || !bare.BareEqual(other) {
+		t.Errorf("%v isn't %v's bare JID", &bare, &full)
+	}
+	if full.BareEqual(JID{Node: "juliet", Domain: "example.com"}) {
+		t.Error("different nodes matched")
+	}
+}
+
 func assertMarshal(t *testing.T, expected string, marshal interface{}) {
 	var buf bytes.Buffer
 	enc := xml.NewEncoder(&buf)
@@ -102,6 +128,39 @@ func TestStreamErrorMarshal(t *testing.T) {
 	assertMarshal(t, exp, e)
 }
 
+// Parse a stream error the way readXml() does.
+func parseStreamError(t *testing.T, str string) *StreamError {
+	var se streamError
+	if err := xml.Unmarshal([]byte(str), &se); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	return se.streamError()
+}
+
+func TestStreamErrorConflict(t *testing.T) {
+	err := parseStreamError(t, `<stream:error xmlns:stream="`+NsStream+
+		`"><conflict xmlns="`+NsStreams+`"/><text xmlns="`+NsStreams+
+		`" xml:lang="en">Replaced by new connection</text></stream:error>`)
+	assertEquals(t, string(StreamConflict), string(err.Condition))
+	assertEquals(t, "Replaced by new connection", err.Text)
+	assertEquals(t, "stream error: conflict: Replaced by new connection",
+		err.Error())
+	if err.Retryable() {
+		t.Errorf("conflict is retryable")
+	}
+}
+
+func TestStreamErrorSystemShutdown(t *testing.T) {
+	err := parseStreamError(t, `<stream:error xmlns:stream="`+NsStream+
+		`"><system-shutdown xmlns="`+NsStreams+`"/></stream:error>`)
+	assertEquals(t, string(StreamSystemShutdown), string(err.Condition))
+	assertEquals(t, "", err.Text)
+	assertEquals(t, "stream error: system-shutdown", err.Error())
+	if !err.Retryable() {
+		t.Errorf("system-shutdown isn't retryable")
+	}
+}
+
 func TestIqMarshal(t *testing.T) {
 	iq := &Iq{Header: Header{Type: "set", Id: "3",
 		Nested: []interface{}{Generic{XMLName: xml.Name{Space: NsBind,
@@ -112,8 +171,8 @@ func TestIqMarshal(t *testing.T) {
 }
 
 func TestMarshalEscaping(t *testing.T) {
-	msg := &Message{Body: &Generic{XMLName: xml.Name{Local: "body"},
-		Chardata: `&<!-- "`}}
+	msg := &Message{Body: []*Generic{{XMLName: xml.Name{Local: "body"},
+		Chardata: `&<!-- "`}}}
 	exp := `<message xmlns="jabber:client"><body>&amp;&lt;!-- &#34;</body></message>`
 	assertMarshal(t, exp, msg)
 }
@@ -122,12 +181,12 @@ func TestUnmarshalMessage(t *testing.T) {
 	str := `<message to="a@b.c"><body>foo!</body></message>`
 	r := strings.NewReader(str)
 	ch := make(chan interface{})
-	go readXml(r, ch, make(map[string]func(*xml.Name) interface{}))
+	go readXml(r, ch, make(map[string][]func(*xml.Name) interface{}), nil, nil, nil)
 	obs := <-ch
 	exp := &Message{XMLName: xml.Name{Local: "message", Space: "jabber:client"},
 		Header: Header{To: "a@b.c", Innerxml: "<body>foo!</body>"},
-		Body: &Generic{XMLName: xml.Name{Local: "body", Space: "jabber:client"},
-			Chardata: "foo!"}}
+		Body: []*Generic{{XMLName: xml.Name{Local: "body", Space: "jabber:client"},
+			Chardata: "foo!"}}}
 	if !reflect.DeepEqual(obs, exp) {
 		t.Errorf("read %s\ngot:  %#v\nwant: %#v\n", str, obs, exp)
 	}
@@ -141,3 +200,325 @@ func TestUnmarshalMessage(t *testing.T) {
 		t.Errorf("body\ngot:  %#v\nwant: %#v\n", obsBody, expBody)
 	}
 }
+
+func TestStanzaLang(t *testing.T) {
+	h := Header{Id: "1", Lang: "fr"}
+	assertMarshal(t, `<iq id="1" xml:lang="fr"></iq>`, &Iq{Header: h})
+	assertMarshal(t, `<message xmlns="jabber:client" id="1" xml:lang="fr">`+
+		`</message>`, &Message{Header: h})
+	assertMarshal(t, `<presence id="1" xml:lang="fr"></presence>`,
+		&Presence{Header: h})
+
+	for _, str := range []string{
+		`<iq xmlns="jabber:client" id="1" xml:lang="fr"/>`,
+		`<message xmlns="jabber:client" id="1" xml:lang="fr"/>`,
+		`<presence xmlns="jabber:client" id="1" xml:lang="fr"/>`,
+		// Without the prefix.
+		`<iq xmlns="jabber:client" id="1" lang="fr"/>`,
+		`<message xmlns="jabber:client" id="1" lang="fr"/>`,
+		`<presence xmlns="jabber:client" id="1" lang="fr"/>`,
+		// The real one wins.
+		`<message xmlns="jabber:client" id="1" lang="de" xml:lang="fr"/>`,
+	} {
+		ch := make(chan interface{})
+		go readXml(strings.NewReader(str), ch,
+			make(map[string][]func(*xml.Name) interface{}), nil, nil, nil)
+		st, ok := (<-ch).(Stanza)
+		if !ok {
+			t.Errorf("%s: not a stanza", str)
+			continue
+		}
+		if lang := st.GetHeader().GetLang(); lang != "fr" {
+			t.Errorf("%s: lang %q", str, lang)
+		}
+	}
+}
+
+func TestMultilingualBody(t *testing.T) {
+	msg := &Message{Header: Header{Id: "1", Lang: "en"}}
+	msg.AddSubject("", "Greetings")
+	msg.AddBody("", "Wherefore art thou, Romeo?")
+	msg.AddBody("de", "Wo bist du, Romeo?")
+	exp := `<message xmlns="jabber:client" id="1" xml:lang="en">` +
+		`<subject xmlns="jabber:client">Greetings</subject>` +
+		`<body xmlns="jabber:client">Wherefore art thou, Romeo?</body>` +
+		`<body xmlns="jabber:client" xml:lang="de">Wo bist du, Romeo?</body>` +
+		`</message>`
+	assertMarshal(t, exp, msg)
+
+	str := `<message xmlns="jabber:client" id="1" xml:lang="en">` +
+		`<body xml:lang="de">Wo bist du, Romeo?</body>` +
+		`<body>Wherefore art thou, Romeo?</body></message>`
+	msg = &Message{}
+	if err := xml.Unmarshal([]byte(str), msg); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(msg.Body) != 2 {
+		t.Fatalf("bodies: %v", msg.Body)
+	}
+	assertEquals(t, "Wo bist du, Romeo?", msg.BodyFor("de"))
+	assertEquals(t, "Wherefore art thou, Romeo?", msg.BodyFor("en"))
+	assertEquals(t, "", msg.BodyFor("fr"))
+	// The default is the one in the message's language, not the
+	// first.
+	assertEquals(t, "Wherefore art thou, Romeo?", msg.GetBody())
+	assertEquals(t, "", msg.GetSubject())
+
+	// Without a match, the first will do.
+	msg = &Message{Header: Header{Lang: "fr"}}
+	msg.AddBody("de", "Wo bist du, Romeo?")
+	msg.AddBody("en", "Wherefore art thou, Romeo?")
+	assertEquals(t, "Wo bist du, Romeo?", msg.GetBody())
+}
+
+func TestFeaturesRequired(t *testing.T) {
+	str := `<stream:features xmlns:stream="` + NsStream + `">` +
+		`<starttls xmlns="` + NsTLS + `"><required/></starttls>` +
+		`<mechanisms xmlns="` + NsSASL + `">` +
+		`<mechanism>SCRAM-SHA-1</mechanism></mechanisms>` +
+		`</stream:features>`
+	fe := &Features{}
+	if err := xml.Unmarshal([]byte(str), fe); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !fe.TLSRequired() || !fe.SASLRequired() || fe.BindRequired() {
+		t.Errorf("required: tls %v, sasl %v, bind %v", fe.TLSRequired(),
+			fe.SASLRequired(), fe.BindRequired())
+	}
+
+	str = `<stream:features xmlns:stream="` + NsStream + `">` +
+		`<starttls xmlns="` + NsTLS + `"/>` +
+		`<bind xmlns="` + NsBind + `"/></stream:features>`
+	fe = &Features{}
+	if err := xml.Unmarshal([]byte(str), fe); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if fe.TLSRequired() || fe.SASLRequired() || !fe.BindRequired() {
+		t.Errorf("required: tls %v, sasl %v, bind %v", fe.TLSRequired(),
+			fe.SASLRequired(), fe.BindRequired())
+	}
+}
+
+func TestMechanismsRequired(t *testing.T) {
+	str := `<stream:features xmlns:stream="` + NsStream + `">` +
+		`<mechanisms xmlns="` + NsSASL + `"><required/>` +
+		`<mechanism>SCRAM-SHA-1</mechanism></mechanisms>` +
+		`</stream:features>`
+	fe := &Features{}
+	if err := xml.Unmarshal([]byte(str), fe); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if fe.Mechanisms.Required == nil || fe.Mechanisms.Optional != nil {
+		t.Errorf("mechanisms: %#v", fe.Mechanisms)
+	}
+	if !fe.SASLRequired() || fe.SASLOptional() {
+		t.Errorf("sasl required %v, optional %v", fe.SASLRequired(),
+			fe.SASLOptional())
+	}
+
+	str = `<stream:features xmlns:stream="` + NsStream + `">` +
+		`<mechanisms xmlns="` + NsSASL + `"><optional/>` +
+		`<mechanism>ANONYMOUS</mechanism>` +
+		`<mechanism>SCRAM-SHA-1</mechanism></mechanisms>` +
+		`</stream:features>`
+	fe = &Features{}
+	if err := xml.Unmarshal([]byte(str), fe); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if fe.Mechanisms.Required != nil || fe.Mechanisms.Optional == nil {
+		t.Errorf("mechanisms: %#v", fe.Mechanisms)
+	}
+	if fe.SASLRequired() || !fe.SASLOptional() {
+		t.Errorf("sasl required %v, optional %v", fe.SASLRequired(),
+			fe.SASLOptional())
+	}
+	assertEquals(t, "ANONYMOUS SCRAM-SHA-1",
+		strings.Join(fe.Mechanisms.Mechanism, " "))
+}
+
+func TestErrorTextFor(t *testing.T) {
+	str := `<iq xmlns="` + NsClient + `" type="error" id="1">` +
+		`<error type="cancel"><item-not-found xmlns="` + NsStanzas + `"/>` +
+		`<text xmlns="` + NsStanzas + `" xml:lang="en">No such user</text>` +
+		`<text xmlns="` + NsStanzas + `" xml:lang="de">Unbekannter ` +
+		`Benutzer</text></error></iq>`
+	iq := &Iq{}
+	if err := xml.Unmarshal([]byte(str), iq); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if iq.Error == nil || len(iq.Error.Text) != 2 {
+		t.Fatalf("error: %#v", iq.Error)
+	}
+	assertEquals(t, "No such user", iq.Error.TextFor("en"))
+	assertEquals(t, "Unbekannter Benutzer", iq.Error.TextFor("DE"))
+	// With neither the language nor one without a language, it's
+	// the first.
+	assertEquals(t, "No such user", iq.Error.TextFor("fr"))
+	assertEquals(t, "Unbekannter Benutzer", iq.Error.stanzaError("de").Text)
+
+	iq.Error.Text = append(iq.Error.Text, &Generic{
+		XMLName:  xml.Name{Space: NsStanzas, Local: "text"},
+		Chardata: "Unknown user"})
+	assertEquals(t, "Unknown user", iq.Error.TextFor("fr"))
+	assertEquals(t, "Unknown user", iq.Error.TextFor(""))
+}
+
+func TestErrorAppCondition(t *testing.T) {
+	str := `<iq xmlns="` + NsClient + `" type="error" id="1">` +
+		`<error type="cancel"><service-unavailable xmlns="` +
+		NsStanzas + `"/><text xmlns="` + NsStanzas + `">Down for ` +
+		`maintenance</text><quota-exceeded xmlns="urn:example:errors" ` +
+		`code="429"/></error></iq>`
+	iq := &Iq{}
+	if err := xml.Unmarshal([]byte(str), iq); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	er := iq.Error
+	assertEquals(t, "cancel", er.Type)
+	assertEquals(t, "service-unavailable", er.Condition())
+	assertEquals(t, "Down for maintenance", er.TextFor(""))
+	app := er.AppCondition()
+	if app == nil {
+		t.Fatal("no app condition")
+	}
+	assertEquals(t, "urn:example:errors", app.XMLName.Space)
+	assertEquals(t, "quota-exceeded", app.XMLName.Local)
+	assertEquals(t, "service-unavailable", er.stanzaError("").Condition)
+
+	// Both are marshaled.
+	er = &Error{Type: "cancel",
+		Any: &Generic{XMLName: xml.Name{Space: NsStanzas,
+			Local: "service-unavailable"}},
+		App: &Generic{XMLName: xml.Name{Space: "urn:example:errors",
+			Local: "quota-exceeded"}}}
+	assertMarshal(t, `<error type="cancel"><service-unavailable xmlns="`+
+		NsStanzas+`"></service-unavailable><quota-exceeded `+
+		`xmlns="urn:example:errors"></quota-exceeded></error>`, er)
+
+	// Without one, there's just the defined condition.
+	str = `<error type="cancel"><item-not-found xmlns="` + NsStanzas +
+		`"/></error>`
+	er = &Error{}
+	if err := xml.Unmarshal([]byte(str), er); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	assertEquals(t, "item-not-found", er.Condition())
+	if er.AppCondition() != nil {
+		t.Errorf("app condition: %v", er.AppCondition())
+	}
+}
+
+func TestErrorIs(t *testing.T) {
+	str := `<error type="cancel"><item-not-found xmlns="` + NsStanzas +
+		`"/><text xmlns="` + NsStanzas + `">No such node</text></error>`
+	er := &Error{}
+	if err := xml.Unmarshal([]byte(str), er); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	assertEquals(t, "cancel/item-not-found: No such node", er.Error())
+	if !strings.HasPrefix(er.XML(), `<error type="cancel">`) ||
+		!strings.Contains(er.XML(), `<item-not-found`) {
+		t.Errorf("XML: %s", er.XML())
+	}
+	if !errors.Is(er, ErrItemNotFound) || errors.Is(er, ErrForbidden) {
+		t.Errorf("Is: %v", er)
+	}
+
+	// As a Query() or sendIq() caller sees it.
+	var err error = er.stanzaError("")
+	if !errors.Is(err, ErrItemNotFound) || errors.Is(err, ErrGone) {
+		t.Errorf("Is: %v", err)
+	}
+	wrapped := fmt.Errorf("fetching: %w", err)
+	if !errors.Is(wrapped, ErrItemNotFound) {
+		t.Errorf("Is through a wrapper: %v", wrapped)
+	}
+
+	er = &Error{Type: "wait"}
+	assertEquals(t, "wait/undefined-condition", er.Error())
+	if !errors.Is(er.stanzaError(""), ErrUndefinedCondition) {
+		t.Errorf("not undefined-condition")
+	}
+}
+
+func TestNewMessage(t *testing.T) {
+	for _, typ := range []string{"", MessageChat, MessageError,
+		MessageGroupchat, MessageHeadline, MessageNormal} {
+		msg, err := NewMessage(typ, "a@b.c", "hi")
+		if err != nil {
+			t.Errorf("NewMessage(%q): %v", typ, err)
+			continue
+		}
+		assertEquals(t, typ, msg.Type)
+		assertEquals(t, "a@b.c", msg.To)
+		assertEquals(t, "hi", msg.GetBody())
+	}
+	for _, typ := range []string{"Chat", "normal ", "whisper"} {
+		if msg, err := NewMessage(typ, "a@b.c", "hi"); err == nil {
+			t.Errorf("NewMessage(%q): %v", typ, msg)
+		}
+	}
+}
+
+func TestUnknownElements(t *testing.T) {
+	str := `<message to="a@b.c"><body>foo!</body>` +
+		`<x xmlns="urn:example:unregistered"><y>bar</y></x>` +
+		`<query xmlns="` + NsRoster + `"/></message>`
+	r := strings.NewReader(str)
+	ch := make(chan interface{})
+	exts := map[string][]func(*xml.Name) interface{}{
+		NsRoster: {newRosterQuery}}
+	go readXml(r, ch, exts, nil, nil, nil)
+	obs := <-ch
+	msg, ok := obs.(*Message)
+	if !ok {
+		t.Fatalf("Not a Message: %T", obs)
+	}
+	unknown := msg.UnknownElements()
+	if len(unknown) != 1 {
+		t.Fatalf("unknown elements: %v", unknown)
+	}
+	assertEquals(t, "urn:example:unregistered", unknown[0].XMLName.Space)
+	assertEquals(t, "x", unknown[0].XMLName.Local)
+	if unknown[0].Any == nil {
+		t.Fatalf("no child: %v", unknown[0])
+	}
+	assertEquals(t, "bar", unknown[0].Any.Chardata)
+	if len(msg.Nested) != 2 {
+		t.Errorf("nested: %v", msg.Nested)
+	}
+}
+
+func TestStanzaAttrs(t *testing.T) {
+	str := `<message xmlns:foo="urn:example:foo" to="a@b.c" ` +
+		`foo:bar="baz" xml:lang="en"><body>hi</body></message>`
+	r := strings.NewReader(str)
+	ch := make(chan interface{})
+	go readXml(r, ch, nil, nil, nil, nil)
+	obs := <-ch
+	msg, ok := obs.(*Message)
+	if !ok {
+		t.Fatalf("Not a Message: %T", obs)
+	}
+	foo := xml.Name{Space: "urn:example:foo", Local: "bar"}
+	if len(msg.Attrs) != 1 {
+		t.Fatalf("attrs: %v", msg.Attrs)
+	}
+	assertEquals(t, "baz", msg.Attrs[foo])
+	assertEquals(t, "a@b.c", msg.To)
+
+	buf, err := xml.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var back Message
+	if err := xml.Unmarshal(buf, &back); err != nil {
+		t.Fatalf("Unmarshal %s: %v", buf, err)
+	}
+	assertEquals(t, "baz", back.Attrs[foo])
+	assertEquals(t, "en", back.Lang)
+
+	iq := &Iq{Header: Header{Type: "get", Id: "1"}}
+	iq.SetAttr(xml.Name{Local: "extra"}, "yes")
+	assertMarshal(t, `<iq extra="yes" id="1" type="get"></iq>`, iq)
+}
@@ -0,0 +1,122 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains a fake server for testing apps without a real
+// one.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// The JID of the Client NewTestPair() returns.
+const TestPairJid = "user@example.com/res"
+
+// A scripted XMPP server at the other end of an in-memory connection
+// from a Client. The test sends it what the server should say, and
+// reads what the client sent.
+type FakeServer struct {
+	// How long Next() waits for the client to send something.
+	Timeout time.Duration
+	conn    net.Conn
+	in      <-chan interface{}
+}
+
+// NewTestPair returns a Client connected to a FakeServer, with the
+// stream negotiated and a resource bound, ready for the app's
+// traffic. Nothing goes over the network. It panics if the client
+// can't negotiate, which only happens if something's badly broken.
+func NewTestPair() (*Client, *FakeServer) {
+	jid := &JID{}
+	jid.Set(TestPairJid)
+	c, s := net.Pipe()
+	srv := &FakeServer{Timeout: 5 * time.Second, conn: s}
+	cl, err := newClient(c, nil, jid, "secret", nil)
+	if err != nil {
+		panic(fmt.Sprintf("NewTestPair: %s", err))
+	}
+	srv.in = startXmlReader(s, cl.extStanza, nil, nil, nil)
+	if err := srv.negotiate(cl); err != nil {
+		cl.Close()
+		srv.Close()
+		panic(fmt.Sprintf("NewTestPair: %s", err))
+	}
+	return cl, srv
+}
+
+// Play the server's part in opening the stream and binding a
+// resource.
+func (srv *FakeServer) negotiate(cl *Client) error {
+	if _, err := srv.next(); err != nil {
+		return err
+	}
+	err := srv.Send(`<stream:stream xmlns="` + NsClient +
+		`" xmlns:stream="` + NsStream + `" from="example.com"` +
+		` id="fake" version="1.0"><stream:features><bind xmlns="` +
+		NsBind + `"/></stream:features>`)
+	if err != nil {
+		return err
+	}
+	st, err := srv.Next()
+	if err != nil {
+		return err
+	}
+	err = srv.Send(`<iq type="result" id="` + st.GetHeader().Id +
+		`"><bind xmlns="` + NsBind + `"><jid>` + TestPairJid +
+		`</jid></bind></iq>`)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-cl.Bound():
+		return nil
+	case <-time.After(srv.Timeout):
+		return errors.New("timed out waiting for the client to bind")
+	}
+}
+
+// Send gives the client the XML, which needn't be a complete element,
+// as if the server had sent it.
+func (srv *FakeServer) Send(xml string) error {
+	srv.conn.SetWriteDeadline(time.Now().Add(srv.Timeout))
+	_, err := srv.conn.Write([]byte(xml))
+	return err
+}
+
+// Next returns the next stanza the client sends. Anything else it
+// sends, such as stream management requests, is skipped. It returns
+// an error if the client closes the stream, or sends nothing for
+// Timeout.
+func (srv *FakeServer) Next() (Stanza, error) {
+	for {
+		obj, err := srv.next()
+		if err != nil {
+			return nil, err
+		}
+		if st, ok := obj.(Stanza); ok {
+			return st, nil
+		}
+	}
+}
+
+func (srv *FakeServer) next() (interface{}, error) {
+	select {
+	case obj, ok := <-srv.in:
+		if !ok {
+			return nil, errors.New("client closed the stream")
+		}
+		return obj, nil
+	case <-time.After(srv.Timeout):
+		return nil, errors.New("timed out waiting for the client")
+	}
+}
+
+// Close drops the connection, as if the server had gone away.
+func (srv *FakeServer) Close() error {
+	return srv.conn.Close()
+}
@@ -0,0 +1,34 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"fmt"
+)
+
+// An app answering a ping (XEP-0199) from the server.
+func ExampleNewTestPair() {
+	cl, srv := NewTestPair()
+	defer cl.Close()
+
+	srv.Send(`<iq from="example.com" to="` + TestPairJid + `" id="ping1" ` +
+		`type="get"><ping xmlns="urn:xmpp:ping"/></iq>`)
+
+	// The app's side.
+	st := <-cl.In
+	iq := st.(*Iq)
+	fmt.Println(iq.Type, iq.UnknownElements()[0].XMLName.Local)
+	cl.Out <- &Iq{Header: Header{To: iq.From, Id: iq.Id, Type: "result"}}
+
+	reply, err := srv.Next()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(reply.GetHeader().Id, reply.GetHeader().Type)
+	// Output:
+	// get ping
+	// ping1 result
+}
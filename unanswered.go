@@ -0,0 +1,82 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file answers the get and set iqs that nobody else does. RFC
+// 6120 requires an answer to every one.
+
+import (
+	"encoding/xml"
+	"sync"
+	"time"
+)
+
+// The get and set iqs we've given to the app, and the timers that
+// will answer them if it doesn't.
+type iqTracker struct {
+	sync.Mutex
+	timeout time.Duration
+	pending map[string]*time.Timer
+}
+
+// Replies go back to whoever sent the request, with the same id.
+func iqKey(peer, id string) string {
+	return peer + " " + id
+}
+
+// Called as iq goes to the app, which has until the timeout to
+// answer it.
+func (cl *Client) awaitIqReply(iq *Iq) {
+	t := &cl.unanswered
+	if t.timeout <= 0 || (iq.Type != "get" && iq.Type != "set") {
+		return
+	}
+	key := iqKey(iq.From, iq.Id)
+	t.Lock()
+	defer t.Unlock()
+	if t.pending == nil {
+		t.pending = make(map[string]*time.Timer)
+	}
+	if old := t.pending[key]; old != nil {
+		old.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(t.timeout, func() {
+		t.Lock()
+		if t.pending[key] != timer {
+			t.Unlock()
+			return
+		}
+		delete(t.pending, key)
+		t.Unlock()
+		Info.Logf("Nobody answered iq %s from %s", iq.Id, iq.From)
+		cl.Send(serviceUnavailable(iq))
+	})
+	t.pending[key] = timer
+}
+
+// Called for each stanza we send, in case it answers one of the
+// pending iqs.
+func (cl *Client) iqReplied(st Stanza) {
+	iq, ok := st.(*Iq)
+	if !ok || (iq.Type != "result" && iq.Type != "error") {
+		return
+	}
+	t := &cl.unanswered
+	key := iqKey(iq.To, iq.Id)
+	t.Lock()
+	defer t.Unlock()
+	if timer := t.pending[key]; timer != nil {
+		timer.Stop()
+		delete(t.pending, key)
+	}
+}
+
+// The error reply to a request we don't support.
+func serviceUnavailable(iq *Iq) *Iq {
+	return &Iq{Header: Header{To: iq.From, Id: iq.Id, Type: "error",
+		Error: &Error{Type: "cancel", Any: &Generic{XMLName: xml.Name{
+			Space: NsStanzas, Local: "service-unavailable"}}}}}
+}
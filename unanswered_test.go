@@ -0,0 +1,68 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"testing"
+	"time"
+)
+
+const versionQuery = `<iq type="get" id="v1" from="romeo@example.net/orchard">` +
+	`<query xmlns="jabber:iq:version"/></iq>`
+
+func TestUnhandledIq(t *testing.T) {
+	UnhandledIqTimeout = 10 * time.Millisecond
+	defer func() { UnhandledIqTimeout = 30 * time.Second }()
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	srv.send(versionQuery)
+	// The app sees it, but doesn't answer.
+	if _, ok := (<-cl.In).(*Iq); !ok {
+		t.Fatal("no iq")
+	}
+	iq := srv.expect("iq")
+	assertEquals(t, "error", iq.attr("type"))
+	assertEquals(t, "v1", iq.attr("id"))
+	assertEquals(t, "romeo@example.net/orchard", iq.attr("to"))
+	assertEquals(t, `<error type="cancel"><service-unavailable xmlns="`+
+		NsStanzas+`"></service-unavailable></error>`, iq.Innerxml)
+}
+
+func TestAnsweredIq(t *testing.T) {
+	UnhandledIqTimeout = 10 * time.Millisecond
+	defer func() { UnhandledIqTimeout = 30 * time.Second }()
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	srv.send(versionQuery)
+	req := (<-cl.In).(*Iq)
+	cl.Send(&Iq{Header: Header{To: req.From, Id: req.Id, Type: "result"}})
+	assertEquals(t, "result", srv.expect("iq").attr("type"))
+	time.Sleep(50 * time.Millisecond)
+
+	// Nothing else was sent.
+	cl.Send(&Message{Header: Header{To: "a@b.c", Id: "after"}})
+	assertEquals(t, "after", srv.expect("message").attr("id"))
+}
+
+func TestUnhandledIqDisabled(t *testing.T) {
+	UnhandledIqTimeout = 0
+	defer func() { UnhandledIqTimeout = 30 * time.Second }()
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	srv.send(versionQuery)
+	<-cl.In
+	time.Sleep(50 * time.Millisecond)
+	cl.Send(&Message{Header: Header{To: "a@b.c", Id: "after"}})
+	assertEquals(t, "after", srv.expect("message").attr("id"))
+}
@@ -0,0 +1,109 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+// This file contains support for HTTP file upload, XEP-0363.
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+const NsUpload = "urn:xmpp:http:upload:0"
+
+var uploadExt Extension = Extension{StanzaHandlers: map[string]func(*xml.Name) interface{}{NsUpload: newUploadSlot},
+	Start: func(cl *Client) {}}
+
+type uploadRequest struct {
+	XMLName     xml.Name `xml:"urn:xmpp:http:upload:0 request"`
+	Filename    string   `xml:"filename,attr"`
+	Size        int64    `xml:"size,attr"`
+	ContentType string   `xml:"content-type,attr,omitempty"`
+}
+
+type uploadSlot struct {
+	XMLName xml.Name `xml:"urn:xmpp:http:upload:0 slot"`
+	Put     struct {
+		URL    string `xml:"url,attr"`
+		Header []struct {
+			Name  string `xml:"name,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"header"`
+	} `xml:"put"`
+	Get struct {
+		URL string `xml:"url,attr"`
+	} `xml:"get"`
+}
+
+func newUploadSlot(name *xml.Name) interface{} {
+	return &uploadSlot{}
+}
+
+// The only headers the upload service may ask us to send with the
+// PUT.
+var uploadHeaders = map[string]bool{"authorization": true,
+	"cookie": true, "expires": true}
+
+// RequestUploadSlot asks the upload service for a place to put a
+// file. The caller should PUT the file to putURL, with the given
+// headers, and then share getURL, perhaps with NewOOBMessage. If
+// service is empty, the upload service is found through disco.
+func (cl *Client) RequestUploadSlot(service, filename string, size int64, contentType string) (putURL, getURL string, headers map[string]string, err error) {
+	if service == "" {
+		if service, err = cl.findUploadService(); err != nil {
+			return "", "", nil, err
+		}
+	}
+	iq := &Iq{Header: Header{To: service, Type: "get", Id: cl.NextId(),
+		Nested: []interface{}{&uploadRequest{Filename: filename,
+			Size: size, ContentType: contentType}}}}
+	reply, err := cl.sendIq(iq)
+	if err != nil {
+		return "", "", nil, err
+	}
+	for _, n := range reply.Nested {
+		slot, ok := n.(*uploadSlot)
+		if !ok {
+			continue
+		}
+		headers = make(map[string]string)
+		for _, h := range slot.Put.Header {
+			if !uploadHeaders[strings.ToLower(h.Name)] {
+				Warn.Logf("Ignoring upload header %s", h.Name)
+				continue
+			}
+			// Don't let the service inject more headers.
+			v := strings.NewReplacer("\r", "", "\n", "").
+				Replace(h.Value)
+			headers[h.Name] = v
+		}
+		return slot.Put.URL, slot.Get.URL, headers, nil
+	}
+	return "", "", nil, fmt.Errorf("upload reply has no slot: %v", reply)
+}
+
+// Look through our server's items for one that takes uploads.
+func (cl *Client) findUploadService() (string, error) {
+	domain := cl.jid().Domain
+	items, err := cl.DiscoItems(domain, "")
+	if err != nil {
+		return "", err
+	}
+	for _, it := range items {
+		if it.Node != "" {
+			continue
+		}
+		info, err := cl.DiscoInfo(it.Jid, "")
+		if err != nil {
+			Warn.Logf("disco#info %s: %s", it.Jid, err)
+			continue
+		}
+		if info.HasFeature(NsUpload) {
+			return it.Jid, nil
+		}
+	}
+	return "", fmt.Errorf("%s has no upload service", domain)
+}
@@ -0,0 +1,80 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRequestUploadSlot(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	type result struct {
+		put, get string
+		headers  map[string]string
+		err      error
+	}
+	results := make(chan result)
+	go func() {
+		put, get, headers, err := cl.RequestUploadSlot("",
+			"très cool.jpg", 23456, "image/jpeg")
+		results <- result{put, get, headers, err}
+	}()
+
+	// Find the upload service.
+	iq := srv.expect("iq")
+	assertEquals(t, "example.com", iq.attr("to"))
+	if !strings.Contains(iq.Innerxml, NsDiscoItems) {
+		t.Fatalf("not disco#items: %s", iq.Innerxml)
+	}
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `">` +
+		`<query xmlns="` + NsDiscoItems + `">` +
+		`<item jid="conference.example.com"/>` +
+		`<item jid="upload.example.com"/></query></iq>`)
+	for _, to := range []string{"conference.example.com",
+		"upload.example.com"} {
+		iq = srv.expect("iq")
+		assertEquals(t, to, iq.attr("to"))
+		feature := "http://jabber.org/protocol/muc"
+		if to == "upload.example.com" {
+			feature = NsUpload
+		}
+		srv.send(`<iq type="result" id="` + iq.attr("id") + `">` +
+			`<query xmlns="` + NsDiscoInfo + `">` +
+			`<identity category="store" type="file"/>` +
+			`<feature var="` + feature + `"/></query></iq>`)
+	}
+
+	iq = srv.expect("iq")
+	assertEquals(t, "upload.example.com", iq.attr("to"))
+	assertEquals(t, "get", iq.attr("type"))
+	assertEquals(t, `<request xmlns="`+NsUpload+`" filename="tr`+
+		"è"+`s cool.jpg" size="23456" content-type="image/jpeg">`+
+		`</request>`, iq.Innerxml)
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `">` +
+		`<slot xmlns="` + NsUpload + `">` +
+		`<put url="https://upload.example.com/4a77/tr%C3%A8s%20cool.jpg">` +
+		`<header name="Authorization">Basic Base64String==</header>` +
+		`<header name="Cookie">foo=bar; user=romeo</header>` +
+		`<header name="X-Evil">1</header></put>` +
+		`<get url="https://download.example.com/4a77/tr%C3%A8s%20cool.jpg"/>` +
+		`</slot></iq>`)
+
+	r := <-results
+	if r.err != nil {
+		t.Fatalf("RequestUploadSlot: %v", r.err)
+	}
+	assertEquals(t, "https://upload.example.com/4a77/tr%C3%A8s%20cool.jpg", r.put)
+	assertEquals(t, "https://download.example.com/4a77/tr%C3%A8s%20cool.jpg", r.get)
+	if len(r.headers) != 2 {
+		t.Errorf("headers: %v", r.headers)
+	}
+	assertEquals(t, "Basic Base64String==", r.headers["Authorization"])
+	assertEquals(t, "foo=bar; user=romeo", r.headers["Cookie"])
+}
@@ -7,14 +7,20 @@
 package xmpp
 
 import (
-	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -30,39 +36,307 @@ const (
 	NsBind    = "urn:ietf:params:xml:ns:xmpp-bind"
 	NsSession = "urn:ietf:params:xml:ns:xmpp-session"
 	NsRoster  = "jabber:iq:roster"
+	NsSM      = "urn:xmpp:sm:3"
+	NsCarbons = "urn:xmpp:carbons:2"
+	NsStanzas = "urn:ietf:params:xml:ns:xmpp-stanzas"
+
+	// The namespace of xml:lang.
+	xmlURL = "http://www.w3.org/XML/1998/namespace"
 
 	// DNS SRV names
 	serverSrv = "xmpp-server"
 	clientSrv = "xmpp-client"
+	// Client connections that start with TLS. XEP-0368.
+	directTlsSrv = "xmpps-client"
+)
+
+// Returned by Send() once the client has shut down.
+var ErrClosed = errors.New("client is closed")
+
+// Returned by requests whose answer was cancelled with
+// CancelStanza().
+var ErrCanceled = errors.New("request canceled")
+
+// Reported on Errors() when the server sends an element larger than
+// MaxStanzaSize.
+var ErrStanzaTooLarge = errors.New("stanza too large")
+
+// How long Close() waits for what's been sent to be written.
+var closeFlushTimeout = 5 * time.Second
+
+// How many stanzas OutPriority() holds before sending on it blocks.
+const priorityOutBuffer = 100
+
+// How many errors Errors() will hold for an app that isn't reading
+// them.
+const errorsBuffer = 10
+
+// How many transitions Phase() will hold for an app that isn't
+// reading them.
+const phasesBuffer = 10
+
+// A step in connecting to the server. See Client.Phase().
+type Phase int
+
+const (
+	// The connection to the server is open, but nothing has
+	// been negotiated over it yet.
+	TCPConnected Phase = iota + 1
+	// The connection is encrypted, by STARTTLS or DirectTLS.
+	TLSNegotiated
+	// The server accepted our credentials.
+	Authenticated
+	// We have a resource, whether the server bound a new one or
+	// let us resume the stream that had it. For a component, the
+	// handshake is enough.
+	Bound
+	// StartSession() succeeded.
+	SessionStarted
 )
 
+var phaseNames = []string{"", "TCPConnected", "TLSNegotiated",
+	"Authenticated", "Bound", "SessionStarted"}
+
+func (p Phase) String() string {
+	if p <= 0 || int(p) >= len(phaseNames) {
+		return fmt.Sprintf("Phase(%d)", int(p))
+	}
+	return phaseNames[p]
+}
+
 // This channel may be used as a convenient way to generate a unique
-// id for an iq, message, or presence stanza.
+// id for an iq, message, or presence stanza. It predates NextId(),
+// which is cheaper, and draws from the same sequence.
 var Id <-chan string
 
+// The sequence behind NextId() and Id.
+var (
+	idMutex sync.Mutex
+	nextId  int64
+)
+
 func init() {
-	// Start the unique id generator.
 	idCh := make(chan string)
 	Id = idCh
 	go func(ch chan<- string) {
-		id := int64(1)
 		for {
-			str := fmt.Sprintf("id_%d", id)
-			ch <- str
-			id++
+			ch <- newId()
 		}
 	}(idCh)
 }
 
+// Returns an id that's unique within this process.
+func newId() string {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	nextId++
+	return fmt.Sprintf("id_%d", nextId)
+}
+
+// NextId returns a new id for a stanza. Ids are unique within this
+// process, not just this client.
+func (cl *Client) NextId() string {
+	return newId()
+}
+
 // Extensions can add stanza filters and/or new XML element types.
+// StanzaHandlers maps a namespace to a constructor for the elements in
+// it. If several extensions claim the same namespace, each element is
+// given to the first of their constructors whose value it unmarshals
+// into, so the types should use XMLName to say which elements they're
+// for. StreamHandlers claims elements the server sends at the top
+// level of the stream that aren't stanzas; it's keyed by namespace
+// and local name separated by a space, as in "urn:example:ext ping".
+// Its handlers are called from the goroutine that reads the stream,
+// so they mustn't block.
+//
+// StreamingHandlers also claims top-level elements, by namespace, but
+// reads them as they arrive rather than once they're complete, for
+// ones too big to hold in memory. Like an xml.Unmarshaler, the handler
+// is given a decoder that has just returned the element's start, and
+// should read the rest of it. Whatever it leaves is skipped. An error
+// is reported as a *ParseError. It's called from the goroutine that
+// reads the stream, so nothing else is read meanwhile. Since the
+// element is never held whole, only its start tag reaches the debug
+// log and the raw inbound hook.
 type Extension struct {
-	StanzaHandlers map[string]func(*xml.Name) interface{}
-	Start          func(*Client)
+	StanzaHandlers    map[string]func(*xml.Name) interface{}
+	StreamHandlers    map[string]func(*Client, *Generic)
+	StreamingHandlers map[string]func(*Client, *xml.Decoder, *xml.StartElement) error
+	Start             func(*Client)
 }
 
-// Allows the user to override the TLS configuration.
+// Allows the user to override the TLS configuration. The server's
+// certificate chain is verified, against ServerName or else the JID's
+// domain, unless InsecureSkipVerify is set, which is only safe for
+// testing.
 var TlsConfig tls.Config
 
+// The oldest version of TLS that Clients accept, unless TlsConfig
+// sets a MinVersion of its own. The handshake fails if the server
+// can't do better.
+var TLSMinVersion uint16 = tls.VersionTLS12
+
+// The cipher suites Clients offer for TLS 1.2, in order of
+// preference, unless TlsConfig sets CipherSuites of its own. Nil means
+// Go's defaults. TLS 1.3's suites can't be configured.
+var TLSCipherSuites []uint16
+
+// The configuration for a TLS connection to domain's server.
+func tlsConfig(domain string) *tls.Config {
+	config := TlsConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName = domain
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = TLSMinVersion
+	}
+	if config.CipherSuites == nil {
+		config.CipherSuites = TLSCipherSuites
+	}
+	return config
+}
+
+// The size of the buffer each Client uses to read from the server.
+// Clients that expect large stanzas, such as vCards with photos, may
+// want to make it bigger. It takes effect for Clients created after
+// it's changed.
+var ReadBufferSize = defaultReadBufferSize
+
+const defaultReadBufferSize = 4096
+
+// The largest element, in bytes, a Client will accept from the
+// server. If the server sends anything bigger, the client reports
+// ErrStanzaTooLarge on Errors() and closes the stream with a
+// policy-violation error. Zero, the default, means no limit. It takes
+// effect for Clients created after it's changed.
+var MaxStanzaSize int
+
+// The language, such as "en" or "de", that Clients ask the server to
+// use for human-readable text such as error descriptions. It's also
+// the default xml:lang of the stanzas they send. Empty means the
+// server's default. It takes effect for Clients created after it's
+// changed.
+var StreamLang string
+
+// How Clients lay out the XML they send. By default it's as compact
+// as possible. WriteNewlines puts a newline after each element, which
+// some servers and log readers need; WriteIndent, if not empty,
+// indents elements' children with it, for debugging. They take effect
+// for Clients created after they're changed.
+var (
+	WriteNewlines bool
+	WriteIndent   string
+)
+
+// The layout writeXml() gives the XML it writes.
+type xmlFormat struct {
+	newlines bool
+	indent   string
+}
+
+// What a Client does with an incoming stanza when the app isn't
+// keeping up with Client.In.
+type OverflowPolicy int
+
+const (
+	// Wait for the app. Until it reads, nothing more is read from
+	// the server, including stream management acks.
+	OverflowBlock OverflowPolicy = iota
+	// Discard the oldest stanza waiting in Client.In to make room.
+	OverflowDropOldest
+	// Discard the incoming stanza.
+	OverflowDropNewest
+)
+
+// How many stanzas Client.In holds for an app that isn't reading
+// them, and what happens when it's full. Dropped stanzas are counted
+// in Stats().InDropped. With no buffer, the drop policies drop any
+// stanza the app isn't already waiting for. They take effect for
+// Clients created after they're changed.
+var (
+	InBufferSize int
+	InOverflow   OverflowPolicy
+)
+
+// How long the app has to answer a get or set iq it reads from
+// Client.In. If it hasn't by then, the client answers with a
+// service-unavailable error, so the sender isn't left waiting. Zero
+// leaves answering entirely to the app. It takes effect for Clients
+// created after it's changed.
+var UnhandledIqTimeout = 30 * time.Second
+
+// How long to spend connecting to a server host, across all its
+// addresses. If NewClient() gives up on one of the domain's SRV
+// targets, it tries the next.
+// Zero leaves it to the operating system.
+var DialTimeout = 30 * time.Second
+
+// How long a Client may take to negotiate the stream, from connecting
+// through TLS and authentication to resource binding. If it runs out,
+// the client reports a *TimeoutError on Errors() and shuts down. Zero
+// means no limit. It takes effect for Clients created after it's
+// changed.
+var HandshakeTimeout = 30 * time.Second
+
+// How long StartSession() waits for the server to answer each of its
+// requests, to start the session and to fetch the roster. If it runs
+// out, StartSession() gives up with a *TimeoutError. Zero means no
+// limit. It takes effect for Clients created after it's changed.
+var SessionTimeout = 30 * time.Second
+
+// Whether Clients whose JID has no resource make one up from the
+// host name and a random suffix, such as "laptop.3f9a2c1e", rather
+// than letting the server assign one. It takes effect for Clients
+// created after it's changed.
+var GenerateResource bool
+
+// Whether NewClient and NewClientFromHost connect with TLS straight
+// away, as servers listening for xmpps connections, usually on port
+// 5223, expect. NewClient looks up the domain's xmpps-client SRV
+// records rather than xmpp-client. Otherwise TLS is negotiated with
+// STARTTLS. It takes effect for Clients created after it's changed.
+var DirectTLS bool
+
+// The identity, such as "admin@example.com", that Clients ask the
+// server to authorize them as once they've authenticated with their
+// own JID and password. Admin tools and gateways use it to act for
+// other users. Empty means the identity we authenticate as. It takes
+// effect for Clients created after it's changed.
+var AuthzID string
+
+// The host that Clients name in DIGEST-MD5's digest-uri, for servers
+// reached through a host other than their JID's domain, such as an
+// SRV target or a gateway, which expect the name they're reached by.
+// Empty means the JID's domain. It takes effect for Clients created
+// after it's changed.
+var SaslHost string
+
+// Chooses which of the realms a server offers for DIGEST-MD5 Clients
+// authenticate in, for deployments where it depends on the user. If
+// it's nil, they use the first. It takes effect for Clients created
+// after it's changed.
+var ChooseRealm func(realms []string) string
+
+// Whether Clients may authenticate with SASL PLAIN, which sends the
+// password as is, over a connection that isn't encrypted. Only set
+// it for servers reached over a trusted network. It takes effect for
+// Clients created after it's changed.
+var AllowPlainWithoutTLS bool
+
+// Whether Clients give up on a server whose stream says it's from a
+// domain other than the one they meant to reach, RFC 6120 Section
+// 4.7.1, rather than just warning. That can mean a misconfigured
+// server, or someone in the middle. It takes effect for Clients
+// created after it's changed.
+var StrictStreamFrom bool
+
+// Whether a Client that reconnects with a new session, rather than
+// resuming its stream, broadcasts the last presence the app did
+// again, so contacts see it online. See EnableAutoReconnect(). It
+// takes effect for Clients created after it's changed.
+var ResendPresence = true
+
 // The client in a client-server XMPP connection.
 type Client struct {
 	// This client's unique ID. It's unique within the context of
@@ -70,30 +344,171 @@ type Client struct {
 	// will be distinguishable by its Uid.
 	Uid string
 	// This client's JID. This will be updated asynchronously by
-	// the time StartSession() returns.
-	Jid          JID
-	password     string
-	socket       net.Conn
-	socketSync   sync.WaitGroup
+	// the time StartSession() returns. Until then, use BoundJID()
+	// or Bound() rather than reading it.
+	Jid   JID
+	jidMu sync.Mutex
+	// Closed once resource binding has set Jid.
+	bound    chan struct{}
+	isBound  bool
+	password string
+	// The namespace of our stanzas, which is NsClient unless we're
+	// a component or a server. A server's stream goes to peer.
+	ns   string
+	peer string
+	dial func() (net.Conn, error)
+	// The connection to the server. Changing it, or closing it from
+	// outside the transport, takes socketMu.
+	socket   net.Conn
+	socketMu sync.Mutex
+	// Where a see-other-host error sent us, and how many times in
+	// a row one has. Only readStream() touches them.
+	otherHost string
+	redirects int
+	// Whether abortStream() has given up on the stream. Only
+	// readStream() touches it.
+	aborted bool
+	// A snapshot of DirectTLS, for dialing otherHost.
+	directTls bool
+	// Used to pause readTransport() while handleTls() replaces
+	// the socket, and closed when readTransport() exits.
+	readerPause   chan chan net.Conn
+	readerDone    chan struct{}
+	transportSync sync.WaitGroup
+	// Snapshots of ReadBufferSize, MaxStanzaSize, StreamLang,
+	// InBufferSize, InOverflow, WriteNewlines and WriteIndent.
+	readBufferSize int
+	maxStanza      int
+	lang           string
+	inBufferSize   int
+	inOverflow     OverflowPolicy
+	format         xmlFormat
+	// A snapshot of closeFlushTimeout.
+	closeTimeout time.Duration
+	// A snapshot of HandshakeTimeout, and the timer enforcing it
+	// on the current connection. The timer tells readStream() on
+	// handshakeExpired.
+	handshakeTimeout time.Duration
+	handshakeTimer   *time.Timer
+	handshakeMu      sync.Mutex
+	handshakeExpired chan struct{}
+	// A snapshot of SessionTimeout.
+	sessionTimeout time.Duration
+	// The id of the server's current stream, and the domain it
+	// says it's from. See StreamID() and StreamFrom().
+	streamId   string
+	streamFrom string
+	streamIdMu sync.Mutex
+	// The default language of the stanzas the server sends on the
+	// current stream: the stream's xml:lang, or else ours. Only
+	// readStream() touches it.
+	streamLang string
+	// Whether the current connection has finished negotiating.
+	// Until it has, readStream() only accepts replies to our own
+	// requests. Only readStream() touches it.
+	negotiated bool
+	// How far the server has got restarting the stream after
+	// SASL success. Only readStream() touches it.
+	restart restartState
+	// The get and set iqs given to the app and not yet answered.
+	unanswered   iqTracker
 	saslExpected string
 	authDone     bool
+	// A snapshot of AuthzID.
+	authzid string
+	// A snapshot of SaslHost.
+	saslHost string
+	// A snapshot of ChooseRealm.
+	chooseRealm func([]string) string
+	// A snapshot of AllowPlainWithoutTLS.
+	allowPlain bool
+	// A snapshot of LegacyAuth.
+	legacyAuth bool
+	// A snapshot of DialbackSecret.
+	dialbackSecret string
+	// A snapshot of StrictStreamFrom.
+	strictFrom bool
+	// A snapshot of ResendPresence, and the last presence the app
+	// broadcast, which writeStream() keeps.
+	resendPresence bool
+	lastPresence   *Presence
+	presenceMu     sync.Mutex
+	// Whether bindDone() finishes binding a new session. Only
+	// readStream() touches it.
+	newSession bool
+	// Whether the connection is encrypted, the tls-unique channel
+	// binding data from the TLS handshake, and the state of SCRAM
+	// authentication if we're using it.
+	encrypted    bool
+	encryptedMu  sync.Mutex
+	tlsUnique    []byte
+	scram        *scram
 	handlers     chan *stanzaHandler
+	cancels      chan string
 	inputControl chan int
+	xmlOutCh     chan chan<- interface{}
+	flushes      chan flushRequest
+	ackRequests  chan struct{}
+	// Where PendingHandlers() asks readStream() for its ids.
+	handlerQueries chan chan<- []string
+	// The stanza constructors from the extensions this client
+	// was created with.
+	extStanza map[string][]func(*xml.Name) interface{}
+	// And their handlers for stream-level elements.
+	extStream map[string]func(*Client, *Generic)
+	// And for those they read as they arrive.
+	extStreaming map[string]func(*xml.Decoder, *xml.StartElement) error
+	roster       rosterClient
+	mam          mamClient
+	disco        discoClient
+	pubsub       pubsubClient
+	muc          mucClient
+	sm           smState
+	stats        clientStats
+	// Errors for the app; see Errors().
+	errors chan error
+	// Negotiation progress for the app; see Phase().
+	phases chan Phase
+	// See EnableAutoReconnect().
+	autoReconnect   bool
+	autoReconnectMu sync.Mutex
+	// Why authentication failed, if it did.
+	authErr   error
+	authErrMu sync.Mutex
+	// See SetRawInboundHook().
+	rawHook func([]byte)
+	rawCh   chan []byte
+	rawMu   sync.Mutex
+	// See SetFromValidator().
+	validator   func(Stanza) bool
+	validatorMu sync.Mutex
+	// Closed when the client shuts down.
+	done chan struct{}
+	// Closed when CloseWrite() has ended our side of the stream.
+	writeClosed chan struct{}
 	// Incoming XMPP stanzas from the server will be published on
 	// this channel. Information which is only used by this
 	// library to set up the XMPP stream will not appear here.
 	In <-chan Stanza
 	// Outgoing XMPP stanzas to the server should be sent to this
-	// channel.
-	Out    chan<- Stanza
-	xmlOut chan<- interface{}
+	// channel. Any number of goroutines may send on it at once.
+	// Closing it shuts the client down, just like Close(); once
+	// that's happened, only Send() may be used, as it returns an
+	// error rather than panicking.
+	Out         chan<- Stanza
+	internalOut chan Stanza
+	priorityOut chan Stanza
+	xmlOut      chan<- interface{}
+	// Where SendElement() queues what isn't a stanza.
+	elementOut chan interface{}
 	// Features advertised by the remote. This will be updated
 	// asynchronously as new features are received throughout the
-	// connection process. It should not be updated once
-	// StartSession() returns.
-	Features  *Features
-	filterOut chan<- <-chan Stanza
-	filterIn  <-chan <-chan Stanza
+	// connection process, so apps shouldn't read it; use
+	// CurrentFeatures() instead.
+	Features   *Features
+	featuresMu sync.Mutex
+	filterOut  chan<- <-chan Stanza
+	filterIn   <-chan <-chan Stanza
 }
 
 // Connect to the appropriate server and authenticate as the given JID
@@ -103,78 +518,274 @@ type Client struct {
 // send operation to Client.Out will block until negotiation (resource
 // binding) is complete.
 func NewClient(jid *JID, password string, exts []Extension) (*Client, error) {
-	// Resolve the domain in the JID.
-	_, srvs, err := net.LookupSRV(clientSrv, "tcp", jid.Domain)
+	domain := jid.Domain
+	direct := DirectTLS
+	dial := func() (net.Conn, error) {
+		return dialServer(context.Background(), domain, "", direct)
+	}
+	tcp, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	return newClient(tcp, dial, jid, password, exts)
+}
+
+// DialOptions says where Dial() connects.
+type DialOptions struct {
+	// The host to connect to, rather than the one the JID's
+	// domain's SRV records name, and its port. Zero means the
+	// standard port, 5222, or 5223 with DirectTLS.
+	Host string
+	Port int
+}
+
+// Dial connects to the server for jid's domain, as NewClient does,
+// but doesn't start the stream, so the app can set socket options or
+// otherwise inspect the connection before handing it to
+// NewClientConn(). The server is found through the domain's SRV
+// records unless opts, which may be nil, names a host. If DirectTLS is
+// set, TLS is negotiated straight away.
+func Dial(ctx context.Context, jid *JID, opts *DialOptions) (net.Conn, error) {
+	var addrStr string
+	if opts != nil && opts.Host != "" {
+		port := opts.Port
+		if port == 0 {
+			port = 5222
+			if DirectTLS {
+				port = 5223
+			}
+		}
+		addrStr = net.JoinHostPort(opts.Host, strconv.Itoa(port))
+	}
+	return dialServer(ctx, jid.Domain, addrStr, DirectTLS)
+}
+
+// Connects to addrStr, or if it's empty, to the target of domain's
+// SRV records, and negotiates TLS straight away if direct is set.
+func dialServer(ctx context.Context, domain, addrStr string, direct bool) (net.Conn, error) {
+	var tcp net.Conn
+	var err error
+	switch {
+	case addrStr != "":
+		tcp, err = dialTcp(ctx, addrStr)
+	case direct:
+		tcp, err = dialSrv(ctx, directTlsSrv, domain)
+	default:
+		tcp, err = dialSrv(ctx, clientSrv, domain)
+	}
+	if err != nil || !direct {
+		return tcp, err
+	}
+	return startDirectTls(ctx, tcp, domain)
+}
+
+// NewClientConn is like NewClient, but uses conn, which is already
+// connected to the server, perhaps by Dial() or through a proxy,
+// rather than dialing. Unless Dial() negotiated DirectTLS, TLS is
+// still negotiated over it. Since the client can't connect again by
+// itself, it doesn't reconnect or resume the stream if conn fails.
+func NewClientConn(conn net.Conn, jid *JID, password string, exts []Extension) (*Client, error) {
+	return newClient(conn, nil, jid, password, exts)
+}
+
+// Negotiate TLS on a new connection to a server that expects it
+// straight away, before the stream starts.
+func startDirectTls(ctx context.Context, tcp net.Conn, domain string) (net.Conn, error) {
+	conn := tls.Client(tcp, tlsConfig(domain))
+	if HandshakeTimeout > 0 {
+		tcp.SetDeadline(time.Now().Add(HandshakeTimeout))
+	}
+	err := conn.HandshakeContext(ctx)
+	tcp.SetDeadline(time.Time{})
+	if err != nil {
+		tcp.Close()
+		return nil, transportError("TLS handshake", err)
+	}
+	return conn, nil
+}
+
+// Connect to the host a see-other-host error named, the way NewClient
+// connected to the original one. Without a port, it's the standard
+// one for the kind of connection.
+func (cl *Client) dialOtherHost(host string) (net.Conn, error) {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		port := "5222"
+		if cl.directTls {
+			port = "5223"
+		}
+		host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+	}
+	return dialServer(context.Background(), cl.jid().Domain, host,
+		cl.directTls)
+}
+
+// Resolve the domain's SRV records for service, clientSrv or
+// serverSrv, and connect to the first target that answers.
+func dialSrv(ctx context.Context, service, domain string) (net.Conn, error) {
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, service, "tcp",
+		domain)
 	if err != nil {
-		return nil, errors.New("LookupSrv " + jid.Domain +
-			": " + err.Error())
+		return nil, transportError("LookupSrv "+domain, err)
 	}
 
-	var tcp *net.TCPConn
 	for _, srv := range srvs {
 		addrStr := fmt.Sprintf("%s:%d", srv.Target, srv.Port)
-		addr, err := net.ResolveTCPAddr("tcp", addrStr)
-		if err != nil {
-			err = fmt.Errorf("ResolveTCPAddr(%s): %s",
-				addrStr, err.Error())
-			continue
-		}
-		tcp, err = net.DialTCP("tcp", nil, addr)
+		var tcp net.Conn
+		tcp, err = dialTcp(ctx, addrStr)
 		if err != nil {
-			err = fmt.Errorf("DialTCP(%s): %s",
-				addr, err)
 			continue
 		}
+		return tcp, nil
 	}
-	if tcp == nil {
-		return nil, err
+	if err == nil {
+		err = &TransportError{Op: "LookupSrv " + domain,
+			Err: errors.New("no SRV targets")}
 	}
+	return nil, err
+}
 
-	return newClient(tcp, jid, password, exts)
+// Wraps a network error as a *TimeoutError if it's a timeout, or a
+// *TransportError otherwise.
+func transportError(op string, err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return &TimeoutError{Op: op, Err: err}
+	}
+	return &TransportError{Op: op, Err: err}
 }
 
 // Connect to the specified host and port. This is otherwise identical
 // to NewClient.
 func NewClientFromHost(jid *JID, password string, exts []Extension, host string, port int) (*Client, error) {
 	addrStr := fmt.Sprintf("%s:%d", host, port)
-	addr, err := net.ResolveTCPAddr("tcp", addrStr)
-	if err != nil {
-		return nil, err
+	domain := jid.Domain
+	direct := DirectTLS
+	dial := func() (net.Conn, error) {
+		return dialServer(context.Background(), domain, addrStr,
+			direct)
 	}
-	tcp, err := net.DialTCP("tcp", nil, addr)
+	tcp, err := dial()
 	if err != nil {
 		return nil, err
 	}
 
-	return newClient(tcp, jid, password, exts)
+	return newClient(tcp, dial, jid, password, exts)
+}
+
+// The dial function is used to reconnect to the server if the
+// connection is lost; it may be nil.
+func newClient(tcp net.Conn, dial func() (net.Conn, error), jid *JID, password string, exts []Extension) (*Client, error) {
+	return newClientNs(tcp, dial, jid, password, exts, NsClient)
+}
+
+// Like newClient, but the stream's stanzas are in namespace ns, which
+// decides how the stream is negotiated.
+func newClientNs(tcp net.Conn, dial func() (net.Conn, error), jid *JID, password string, exts []Extension, ns string) (*Client, error) {
+	return newClientPeer(tcp, dial, jid, password, exts, ns, "")
 }
 
-func newClient(tcp *net.TCPConn, jid *JID, password string, exts []Extension) (*Client, error) {
+// Like newClientNs, for a server-to-server stream to peer.
+func newClientPeer(tcp net.Conn, dial func() (net.Conn, error), jid *JID, password string, exts []Extension, ns, peer string) (*Client, error) {
 	// Include the mandatory extensions.
 	exts = append(exts, rosterExt)
 	exts = append(exts, bindExt)
+	exts = append(exts, correctExt)
+	exts = append(exts, hintsExt)
+	exts = append(exts, iqAuthExt)
+	exts = append(exts, nickExt)
+	exts = append(exts, rsmExt)
+	exts = append(exts, delayExt)
+	exts = append(exts, mamExt)
+	exts = append(exts, discoExt)
+	exts = append(exts, commandsExt)
+	exts = append(exts, pubsubExt)
+	exts = append(exts, oobExt)
+	exts = append(exts, uploadExt)
+	exts = append(exts, mucExt)
 
 	cl := new(Client)
-	cl.Uid = <-Id
+	cl.Uid = newId()
 	cl.password = password
+	cl.authzid = AuthzID
+	cl.saslHost = SaslHost
+	cl.chooseRealm = ChooseRealm
+	cl.allowPlain = AllowPlainWithoutTLS
+	cl.legacyAuth = LegacyAuth
+	cl.dialbackSecret = DialbackSecret
+	cl.strictFrom = StrictStreamFrom
+	cl.resendPresence = ResendPresence
 	cl.Jid = *jid
-	cl.socket = tcp
+	if GenerateResource && ns == NsClient && cl.Jid.Resource == "" {
+		cl.Jid.Resource = generateResource()
+	}
+	cl.dial = dial
+	cl.directTls = DirectTLS
+	cl.ns = ns
+	cl.peer = peer
+	cl.readBufferSize = ReadBufferSize
+	cl.maxStanza = MaxStanzaSize
+	cl.lang = StreamLang
+	cl.inBufferSize = InBufferSize
+	cl.inOverflow = InOverflow
+	cl.format = xmlFormat{newlines: WriteNewlines, indent: WriteIndent}
+	cl.handshakeTimeout = HandshakeTimeout
+	cl.closeTimeout = closeFlushTimeout
+	cl.sessionTimeout = SessionTimeout
+	cl.unanswered.timeout = UnhandledIqTimeout
+	if cl.readBufferSize <= 0 {
+		cl.readBufferSize = defaultReadBufferSize
+	}
 	cl.handlers = make(chan *stanzaHandler, 100)
+	cl.cancels = make(chan string, 100)
+	cl.handlerQueries = make(chan chan<- []string)
+	cl.handshakeExpired = make(chan struct{}, 1)
+	cl.readerPause = make(chan chan net.Conn)
 	cl.inputControl = make(chan int)
+	cl.xmlOutCh = make(chan chan<- interface{})
+	cl.flushes = make(chan flushRequest)
+	cl.ackRequests = make(chan struct{})
+	cl.internalOut = make(chan Stanza)
+	cl.elementOut = make(chan interface{})
+	cl.priorityOut = make(chan Stanza, priorityOutBuffer)
+	cl.done = make(chan struct{})
+	cl.writeClosed = make(chan struct{})
+	cl.bound = make(chan struct{})
+	cl.sm.queueMax = defaultSmQueueMax
+	cl.sm.dropped = make(chan Stanza, 100)
+	cl.errors = make(chan error, errorsBuffer)
+	cl.phases = make(chan Phase, phasesBuffer)
 
-	extStanza := make(map[string]func(*xml.Name) interface{})
+	cl.extStanza = make(map[string][]func(*xml.Name) interface{})
 	for _, ext := range exts {
 		for k, v := range ext.StanzaHandlers {
-			extStanza[k] = v
+			cl.extStanza[k] = append(cl.extStanza[k], v)
+		}
+	}
+	cl.extStream = make(map[string]func(*Client, *Generic))
+	for _, ext := range exts {
+		for k, v := range ext.StreamHandlers {
+			if _, ok := cl.extStream[k]; ok {
+				Warn.Logf("Stream element %s claimed twice", k)
+				continue
+			}
+			cl.extStream[k] = v
+		}
+	}
+	cl.extStreaming = make(map[string]func(*xml.Decoder, *xml.StartElement) error)
+	for _, ext := range exts {
+		for k, v := range ext.StreamingHandlers {
+			if _, ok := cl.extStreaming[k]; ok {
+				Warn.Logf("Streaming namespace %s claimed twice", k)
+				continue
+			}
+			v := v
+			cl.extStreaming[k] = func(p *xml.Decoder, se *xml.StartElement) error {
+				return v(cl, p, se)
+			}
 		}
 	}
 
-	// Start the transport handler, initially unencrypted.
-	tlsr, tlsw := cl.startTransport()
-
-	// Start the reader and writers that convert to and from XML.
-	xmlIn := startXmlReader(tlsr, extStanza)
-	cl.xmlOut = startXmlWriter(tlsw)
+	xmlIn := cl.startConn(tcp)
 
 	// Start the XMPP stream handler which filters stream-level
 	// events and responds to them.
@@ -189,34 +800,86 @@ func newClient(tcp *net.TCPConn, jid *JID, password string, exts []Extension) (*
 
 	// Add filters for our extensions.
 	for _, ext := range exts {
-		ext.Start(cl)
+		if ext.Start != nil {
+			ext.Start(cl)
+		}
 	}
 
 	// Initial handshake.
-	hsOut := &stream{To: jid.Domain, Version: Version}
-	cl.xmlOut <- hsOut
+	cl.xmlOut <- cl.streamHeader()
+	cl.startHandshakeTimer()
 
 	return cl, nil
 }
 
+// The header we open each stream with.
+func (cl *Client) streamHeader() *stream {
+	st := &stream{To: cl.jid().Domain, Lang: cl.lang, Version: Version}
+	if cl.ns != NsClient {
+		// XEP-0114 and plain dialback streams predate stream
+		// versions.
+		st.Ns = cl.ns
+		st.Version = ""
+	}
+	if cl.ns == NsServer {
+		st.To = cl.peer
+		st.From = cl.jid().Domain
+	}
+	return st
+}
+
+// Start the transport and XML layers on top of a new connection to
+// the server. This is done once when the client is created, and
+// again each time it reconnects.
+func (cl *Client) startConn(tcp net.Conn) <-chan interface{} {
+	cl.setSocket(tcp)
+	cl.setEncrypted(false)
+	cl.enterPhase(TCPConnected)
+	if conn, ok := tcp.(*tls.Conn); ok {
+		// It was dialed with DirectTLS.
+		cl.setEncrypted(true)
+		cl.tlsUnique = conn.ConnectionState().TLSUnique
+		cl.enterPhase(TLSNegotiated)
+	}
+
+	// Start the transport handler, unencrypted unless it's a
+	// DirectTLS connection.
+	tlsr, tlsw := cl.startTransport()
+	if cl.ns != NsClient {
+		tlsr = newNsReader(tlsr, cl.ns, NsClient)
+		tlsw = newNsWriter(tlsw, NsClient, cl.ns)
+	}
+
+	// Start the reader and writers that convert to and from XML.
+	xmlIn := startXmlReader(tlsr, cl.extStanza, cl.extStreaming,
+		cl.maxStanzaSize, cl.rawInbound)
+	cl.xmlOut = startXmlWriter(tlsw, cl.stats.stanzaSent, cl.format)
+	return xmlIn
+}
+
 func (cl *Client) startTransport() (io.Reader, io.WriteCloser) {
 	inr, inw := io.Pipe()
 	outr, outw := io.Pipe()
-	go cl.readTransport(inw)
-	go cl.writeTransport(outr)
-	return inr, outw
+	fw := newFlushWriter(outw)
+	cl.transportSync.Add(2)
+	cl.readerDone = make(chan struct{})
+	go cl.readTransport(inw, cl.readerDone)
+	go cl.writeTransport(outr, fw)
+	return inr, fw
 }
 
 func startXmlReader(r io.Reader,
-	extStanza map[string]func(*xml.Name) interface{}) <-chan interface{} {
+	extStanza map[string][]func(*xml.Name) interface{},
+	extStreaming map[string]func(*xml.Decoder, *xml.StartElement) error,
+	limit func() int, raw func([]byte)) <-chan interface{} {
 	ch := make(chan interface{})
-	go readXml(r, ch, extStanza)
+	go readXml(r, ch, extStanza, extStreaming, limit, raw)
 	return ch
 }
 
-func startXmlWriter(w io.WriteCloser) chan<- interface{} {
+func startXmlWriter(w io.WriteCloser, sent func(Stanza), format xmlFormat) chan<- interface{} {
 	ch := make(chan interface{})
-	go writeXml(w, ch)
+	go writeXml(w, ch, sent, format)
 	return ch
 }
 
@@ -228,49 +891,72 @@ func (cl *Client) startStreamReader(xmlIn <-chan interface{}, srvOut chan<- inte
 
 func (cl *Client) startStreamWriter(xmlOut chan<- interface{}) chan<- Stanza {
 	ch := make(chan Stanza)
-	go writeStream(xmlOut, ch, cl.inputControl)
+	go cl.writeStream(xmlOut, ch)
 	return ch
 }
 
 func (cl *Client) startFilter(srvIn <-chan Stanza) <-chan Stanza {
-	cliIn := make(chan Stanza)
+	size := cl.inBufferSize
+	if size < 0 {
+		size = 0
+	}
+	cliIn := make(chan Stanza, size)
 	filterOut := make(chan (<-chan Stanza))
 	filterIn := make(chan (<-chan Stanza))
 	nullFilter := make(chan Stanza)
 	go filterBottom(srvIn, nullFilter)
-	go filterTop(filterOut, filterIn, nullFilter, cliIn)
+	go filterTop(filterOut, filterIn, nullFilter, cliIn, cl.inOverflow,
+		cl.stats.inDropped)
 	cl.filterOut = filterOut
 	cl.filterIn = filterIn
 	return cliIn
 }
 
-func tee(r io.Reader, w io.Writer, prefix string) {
-	defer func(w io.Writer) {
-		if c, ok := w.(io.Closer); ok {
-			c.Close()
-		}
-	}(w)
+// BoundJID returns the full JID the server bound for this client, and
+// whether resource binding has happened yet.
+func (cl *Client) BoundJID() (JID, bool) {
+	cl.jidMu.Lock()
+	defer cl.jidMu.Unlock()
+	return cl.Jid, cl.isBound
+}
 
-	buf := bytes.NewBuffer([]uint8(prefix))
-	for {
-		var c [1]byte
-		n, _ := r.Read(c[:])
-		if n == 0 {
-			break
-		}
-		n, _ = w.Write(c[:n])
-		if n == 0 {
-			break
-		}
-		buf.Write(c[:n])
-		if c[0] == '\n' || c[0] == '>' {
-			Debug.Log(buf)
-			buf = bytes.NewBuffer([]uint8(prefix))
-		}
+// Bound returns a channel which is closed once resource binding has
+// set the client's JID. BoundJID() returns the JID from then on.
+func (cl *Client) Bound() <-chan struct{} {
+	return cl.bound
+}
+
+// Make up a resource which is recognizably ours, but won't collide
+// with another of our clients on the same host.
+func generateResource() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "xmpp"
+	}
+	// A resource can't have a '/', and a short one is friendlier.
+	if i := strings.IndexAny(host, "./"); i > 0 {
+		host = host[:i]
 	}
-	leftover := buf.String()
-	if leftover != "" {
-		Debug.Log(buf)
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return host + "." + newId()
+	}
+	return fmt.Sprintf("%s.%x", host, b)
+}
+
+// A copy of cl.Jid, safe to read while binding may be changing it.
+func (cl *Client) jid() JID {
+	jid, _ := cl.BoundJID()
+	return jid
+}
+
+func (cl *Client) setJid(jid JID) {
+	cl.jidMu.Lock()
+	defer cl.jidMu.Unlock()
+	cl.Jid = jid
+	if !cl.isBound {
+		cl.isBound = true
+		close(cl.bound)
 	}
 }
 
@@ -278,20 +964,171 @@ func tee(r io.Reader, w io.Writer, prefix string) {
 // the negotiations that precede it). Now we can start accepting
 // traffic from the app.
 func (cl *Client) bindDone() {
-	cl.inputControl <- 1
+	cl.stopHandshakeTimer()
+	cl.negotiated = true
+	cl.otherHost = ""
+	cl.redirects = 0
+	select {
+	case cl.inputControl <- 1:
+	case <-cl.done:
+	}
+	if cl.newSession {
+		cl.newSession = false
+		cl.sendLastPresence()
+	}
+}
+
+// Broadcasts the app's last presence again, if it sent one, on a new
+// session after reconnecting.
+func (cl *Client) sendLastPresence() {
+	if !cl.resendPresence {
+		return
+	}
+	cl.presenceMu.Lock()
+	last := cl.lastPresence
+	cl.presenceMu.Unlock()
+	if last == nil {
+		return
+	}
+	pr := *last
+	pr.Id = ""
+	Info.Log("Sending our presence again")
+	select {
+	case cl.priorityOut <- &pr:
+	default:
+		Warn.Log("Presence not sent again: queue full")
+	}
+}
+
+func (cl *Client) setLastPresence(pr *Presence) {
+	cl.presenceMu.Lock()
+	defer cl.presenceMu.Unlock()
+	cl.lastPresence = pr
+}
+
+// Gives up on the connection if negotiation takes longer than
+// HandshakeTimeout.
+func (cl *Client) startHandshakeTimer() {
+	if cl.handshakeTimeout <= 0 {
+		return
+	}
+	cl.handshakeMu.Lock()
+	defer cl.handshakeMu.Unlock()
+	if cl.handshakeTimer != nil {
+		cl.handshakeTimer.Stop()
+	}
+	// Forget the old connection's timer if it already went off.
+	select {
+	case <-cl.handshakeExpired:
+	default:
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(cl.handshakeTimeout, func() {
+		cl.handshakeMu.Lock()
+		defer cl.handshakeMu.Unlock()
+		if cl.handshakeTimer != timer {
+			return
+		}
+		select {
+		case cl.handshakeExpired <- struct{}{}:
+		default:
+		}
+	})
+	cl.handshakeTimer = timer
+}
+
+// Called by readStream(), which does the negotiating, when the timer
+// goes off.
+func (cl *Client) handshakeTimedOut() {
+	cl.handshakeMu.Lock()
+	running := cl.handshakeTimer != nil
+	cl.handshakeMu.Unlock()
+	if !running {
+		// Negotiation finished while we were being told.
+		return
+	}
+	cl.abortStream(StreamConnectionTimeout, &TimeoutError{
+		Op: fmt.Sprintf("stream negotiation (%s)", cl.handshakeTimeout)})
+}
+
+func (cl *Client) stopHandshakeTimer() {
+	cl.handshakeMu.Lock()
+	defer cl.handshakeMu.Unlock()
+	if cl.handshakeTimer != nil {
+		cl.handshakeTimer.Stop()
+		cl.handshakeTimer = nil
+	}
 }
 
 // Start an XMPP session. A typical XMPP client should call this
 // immediately after creating the Client in order to start the
 // session, retrieve the roster, and broadcast an initial
 // presence. The presence can be as simple as a newly-initialized
-// Presence struct.  See RFC 3921, Section 3.
+// Presence struct, or one from DefaultPresence(). It's only sent
+// once the session is established, and the roster fetched if it was
+// asked for, so contacts never see us before we can see them. The
+// session itself is only requested if the server's features ask for
+// one, as RFC 3921, Section 3 has it; RFC 6121 servers don't.
+//
+// Bots and components which have no use for the roster should pass
+// false for getRoster. No roster request is sent at all, so the
+// server won't push roster changes to this client either, and
+// Roster() will return an empty roster unless the app calls
+// FetchRosterAsync() itself.
+//
+// If the server refuses the session or the roster, the error is a
+// *StanzaError. If it rejects our credentials, it's an *AuthError. If
+// it doesn't answer within SessionTimeout, it's a *TimeoutError.
 func (cl *Client) StartSession(getRoster bool, pr *Presence) error {
-	id := <-Id
-	iq := &Iq{Header: Header{To: cl.Jid.Domain, Id: id, Type: "set",
+	// Only once we're bound do we have the features that say
+	// whether the server wants a session.
+	select {
+	case <-cl.bound:
+	case <-cl.done:
+		return cl.closedErr()
+	}
+	if cl.sessionRequired() {
+		if err := cl.startSession(); err != nil {
+			return err
+		}
+	} else {
+		Info.Log("Server doesn't need a session")
+		cl.enterPhase(SessionStarted)
+	}
+	if getRoster {
+		err := fetchRoster(cl)
+		if err != nil {
+			return err
+		}
+	}
+	if pr != nil {
+		return cl.Send(pr)
+	}
+	return nil
+}
+
+// Whether the server offered session establishment, and didn't say
+// it was optional. RFC 6121 dropped it, so modern servers don't, and
+// some refuse the request.
+func (cl *Client) sessionRequired() bool {
+	fe := cl.CurrentFeatures()
+	if fe == nil || fe.Session == nil {
+		return false
+	}
+	return fe.Session.Any == nil || fe.Session.Any.XMLName.Local != "optional"
+}
+
+// Sends the session request of RFC 3921, and waits for the answer.
+func (cl *Client) startSession() error {
+	id := cl.NextId()
+	iq := &Iq{Header: Header{To: cl.jid().Domain, Id: id, Type: "set",
 		Nested: []interface{}{Generic{XMLName: xml.Name{Space: NsSession, Local: "session"}}}}}
-	ch := make(chan error)
+	ch := make(chan error, 1)
 	f := func(st Stanza) bool {
+		if _, ok := st.(*CanceledStanza); ok {
+			ch <- ErrCanceled
+			return false
+		}
 		iq, ok := st.(*Iq)
 		if !ok {
 			Warn.Log("iq reply not iq; can't start session")
@@ -300,31 +1137,438 @@ func (cl *Client) StartSession(getRoster bool, pr *Presence) error {
 		}
 		if iq.Type == "error" {
 			Warn.Logf("Can't start session: %v", iq)
-			ch <- iq.Error
+			ch <- iq.Error.stanzaError(cl.lang)
 			return false
 		}
+		cl.enterPhase(SessionStarted)
 		ch <- nil
 		return false
 	}
-	cl.HandleStanza(id, f)
-	cl.Out <- iq
+	cl.HandleStanzaFrom(id, iq.To, f)
+	if err := cl.Send(iq); err != nil {
+		return cl.closedErr()
+	}
 
 	// Now wait until the callback is called.
-	if err := <-ch; err != nil {
-		return err
-	}
-	if getRoster {
-		err := fetchRoster(cl)
+	expired, stop := cl.sessionTimer()
+	defer stop()
+	select {
+	case err := <-ch:
 		if err != nil {
 			return err
 		}
-	}
-	if pr != nil {
-		cl.Out <- pr
+	case <-expired:
+		cl.CancelStanza(id)
+		return &TimeoutError{Op: "session start"}
+	case <-cl.done:
+		return cl.closedErr()
 	}
 	return nil
 }
 
+// Returns a channel that's sent on once StartSession() has waited
+// sessionTimeout for an answer, or never if there's no limit, and a
+// function to stop it.
+func (cl *Client) sessionTimer() (<-chan time.Time, func()) {
+	if cl.sessionTimeout <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTimer(cl.sessionTimeout)
+	return t.C, func() { t.Stop() }
+}
+
+// Why the client shut down before the session started: an
+// *AuthError if the server wouldn't let us in, or ErrClosed.
+func (cl *Client) closedErr() error {
+	cl.authErrMu.Lock()
+	defer cl.authErrMu.Unlock()
+	if cl.authErr != nil {
+		return cl.authErr
+	}
+	return ErrClosed
+}
+
+// Send queues a stanza for delivery to the server. Unlike sending on
+// Client.Out, it's safe to call after the client has shut down, or
+// CloseWrite() has ended our side of the stream: it returns
+// ErrClosed. Like Client.Out, it blocks until resource
+// binding is complete.
+func (cl *Client) Send(st Stanza) error {
+	select {
+	case <-cl.writeClosed:
+		return ErrClosed
+	default:
+	}
+	select {
+	case cl.internalOut <- st:
+		return nil
+	case <-cl.writeClosed:
+		return ErrClosed
+	case <-cl.done:
+		return ErrClosed
+	}
+}
+
+// SendElement queues v, which may be anything that marshals to XML,
+// for delivery to the server, in order with what Send() queues. It's
+// for elements that aren't stanzas, which Client.Out can't carry, such
+// as those of an extension the library doesn't know. Like Send(), it
+// blocks until resource binding is complete, and returns ErrClosed
+// once the client has shut down.
+func (cl *Client) SendElement(v interface{}) error {
+	select {
+	case <-cl.writeClosed:
+		return ErrClosed
+	default:
+	}
+	select {
+	case cl.elementOut <- v:
+		return nil
+	case <-cl.writeClosed:
+		return ErrClosed
+	case <-cl.done:
+		return ErrClosed
+	}
+}
+
+// sendIq sends an iq and waits for the reply. A reply of type error
+// is returned as a *StanzaError.
+func (cl *Client) sendIq(iq *Iq) (*Iq, error) {
+	replies := make(chan Stanza, 1)
+	cl.HandleStanzaFrom(iq.Id, iq.To, func(st Stanza) bool {
+		replies <- st
+		return false
+	})
+	if err := cl.Send(iq); err != nil {
+		return nil, err
+	}
+	var st Stanza
+	select {
+	case st = <-replies:
+	case <-cl.done:
+		return nil, ErrClosed
+	}
+	if _, ok := st.(*CanceledStanza); ok {
+		return nil, ErrCanceled
+	}
+	reply, ok := st.(*Iq)
+	if !ok {
+		return nil, fmt.Errorf("response to iq wasn't iq: %s", st)
+	}
+	if reply.Type == "error" {
+		return nil, reply.Error.stanzaError(cl.lang)
+	}
+	return reply, nil
+}
+
+// Query sends an iq of the given type, "get" or "set", with payload
+// as its child, and waits for the reply. If result isn't nil, the
+// reply's child element that unmarshals into it is decoded into it,
+// as xml.Unmarshal would. A reply of type error is returned as a
+// *StanzaError.
+func (cl *Client) Query(to, typ string, payload, result interface{}) error {
+	iq := &Iq{Header: Header{To: to, Type: typ, Id: cl.NextId()}}
+	if payload != nil {
+		iq.Nested = []interface{}{payload}
+	}
+	reply, err := cl.sendIq(iq)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	// An extension may already have parsed it.
+	rv := reflect.ValueOf(result)
+	for _, n := range reply.Nested {
+		if nv := reflect.ValueOf(n); nv.Type() == rv.Type() &&
+			rv.Kind() == reflect.Ptr {
+			rv.Elem().Set(nv.Elem())
+			return nil
+		}
+	}
+	for _, raw := range reply.NestedRaw() {
+		if raw == "" {
+			continue
+		}
+		if err := xml.Unmarshal([]byte(raw), result); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("reply from %s has no %T", reply.From, result)
+}
+
+// OutPriority returns a channel for stanzas which should go ahead of
+// those sent on Client.Out or with Send(), such as answers to pings.
+// Stanzas on it are sent in the order they were queued. Like
+// Client.Out, it's not read until resource binding is complete.
+// Stanzas queued once the client has shut down are never sent.
+func (cl *Client) OutPriority() chan<- Stanza {
+	return cl.priorityOut
+}
+
+func (cl *Client) maxStanzaSize() int {
+	return cl.maxStanza
+}
+
+// Errors returns a channel on which the client reports why it lost
+// its connection to the server: a *StreamError if the server closed
+// the stream, or a *ConflictError if another session took over our
+// resource; an *AuthError if the server wouldn't let us in; a
+// *NegotiationError if the server broke the rules of negotiation; a
+// *TransportError if writing to the server failed; or the error from
+// dialing, usually a *TransportError, if the client couldn't
+// reconnect. It also reports a *ParseError for each element from the
+// server that had to be skipped, which doesn't cost the connection.
+// The channel is buffered; if the app doesn't read from it, some
+// reports will be lost.
+func (cl *Client) Errors() <-chan error {
+	return cl.errors
+}
+
+func (cl *Client) reportError(err error) {
+	select {
+	case cl.errors <- err:
+	default:
+		Warn.Logf("Error report dropped: %v", err)
+	}
+}
+
+// Phase returns a channel which carries each step of negotiating the
+// connection as it's reached, in order, for showing the app's user
+// how far along it is. It starts again from TCPConnected each time
+// the client reconnects. The channel is buffered; if the app doesn't
+// read from it, some steps will be lost.
+func (cl *Client) Phase() <-chan Phase {
+	return cl.phases
+}
+
+func (cl *Client) enterPhase(p Phase) {
+	Debug.Logf("Phase: %s", p)
+	select {
+	case cl.phases <- p:
+	default:
+		Warn.Logf("Phase report dropped: %s", p)
+	}
+}
+
+// EnableAutoReconnect controls whether the client dials the server
+// again when it loses the connection. Without it, the client only
+// reconnects to resume a stream under stream management. With it,
+// the client also reconnects when the stream can't be resumed, in
+// which case it binds a new session and, unless ResendPresence is
+// false, broadcasts the app's last presence again; the app must
+// re-establish anything else, such as directed presence. The client
+// never reconnects after a stream error that isn't Retryable(), such
+// as a resource conflict. It also follows see-other-host errors to
+// the host they name, a few times in a row at most.
+func (cl *Client) EnableAutoReconnect(enable bool) {
+	cl.autoReconnectMu.Lock()
+	defer cl.autoReconnectMu.Unlock()
+	cl.autoReconnect = enable
+}
+
+func (cl *Client) autoReconnecting() bool {
+	cl.autoReconnectMu.Lock()
+	defer cl.autoReconnectMu.Unlock()
+	return cl.autoReconnect
+}
+
+// CurrentFeatures returns a copy of the features the server most
+// recently advertised, or nil if we're between feature
+// advertisements, as during TLS and SASL negotiation. Features the
+// server sends once the session is established replace the old ones
+// here, without starting negotiation over.
+func (cl *Client) CurrentFeatures() *Features {
+	cl.featuresMu.Lock()
+	defer cl.featuresMu.Unlock()
+	if cl.Features == nil {
+		return nil
+	}
+	fe := *cl.Features
+	fe.Mechanisms.Mechanism = append([]string(nil),
+		fe.Mechanisms.Mechanism...)
+	return &fe
+}
+
+// Mechanisms returns the SASL mechanisms the server is offering, in
+// its order of preference, or nil if its current features don't
+// offer any. They're available once the features arrive, before the
+// client picks one, until authentication succeeds.
+func (cl *Client) Mechanisms() []string {
+	cl.featuresMu.Lock()
+	defer cl.featuresMu.Unlock()
+	if cl.Features == nil {
+		return nil
+	}
+	return append([]string(nil), cl.Features.Mechanisms.Mechanism...)
+}
+
+// Only readStream() changes cl.Features, so it can read it without
+// the lock.
+func (cl *Client) setFeatures(fe *Features) {
+	cl.featuresMu.Lock()
+	defer cl.featuresMu.Unlock()
+	cl.Features = fe
+}
+
+// SetRawInboundHook installs a function which is given the XML text
+// of each element the server sends, before it's parsed, for debugging
+// or for checking signatures. It's called from its own goroutine, so
+// it doesn't hold up the client; if it can't keep up, elements are
+// dropped, with a warning. f may be nil. Elements claimed by an
+// Extension's StreamingHandlers are never held whole, so f is only
+// given their start tags.
+func (cl *Client) SetRawInboundHook(f func([]byte)) {
+	cl.rawMu.Lock()
+	defer cl.rawMu.Unlock()
+	cl.rawHook = f
+	if cl.rawCh == nil {
+		cl.rawCh = make(chan []byte, rawInboundBuffer)
+		go cl.dispatchRaw(cl.rawCh)
+	}
+}
+
+// How many elements the raw inbound hook may fall behind by.
+const rawInboundBuffer = 100
+
+// Called by readXml() with each element's text.
+func (cl *Client) rawInbound(b []byte) {
+	cl.rawMu.Lock()
+	ch := cl.rawCh
+	cl.rawMu.Unlock()
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- b:
+	default:
+		Warn.Log("Raw inbound hook isn't keeping up; dropping XML")
+	}
+}
+
+func (cl *Client) dispatchRaw(ch <-chan []byte) {
+	for {
+		select {
+		case b := <-ch:
+			cl.rawMu.Lock()
+			f := cl.rawHook
+			cl.rawMu.Unlock()
+			if f != nil {
+				f(b)
+			}
+		case <-cl.done:
+			return
+		}
+	}
+}
+
+// SetFromValidator installs a function which decides whether to
+// believe the from address of each incoming stanza. Stanzas it
+// returns false for are dropped, with a warning. The client already
+// drops carbons, roster pushes, and archived messages which aren't
+// from the user's own account. f may be nil, and must not block.
+func (cl *Client) SetFromValidator(f func(Stanza) bool) {
+	cl.validatorMu.Lock()
+	defer cl.validatorMu.Unlock()
+	cl.validator = f
+}
+
+func (cl *Client) fromValidator() func(Stanza) bool {
+	cl.validatorMu.Lock()
+	defer cl.validatorMu.Unlock()
+	return cl.validator
+}
+
+// SendDirectedPresence sends pr to the given JID only, as when joining
+// a chat room. When the client shuts down, it sends unavailable
+// presence to each JID it sent available presence to this way, or
+// through Client.Out.
+func (cl *Client) SendDirectedPresence(to string, pr *Presence) {
+	pr.To = to
+	if err := cl.Send(pr); err != nil {
+		Warn.Logf("directed presence to %s: %s", to, err)
+	}
+}
+
+// Close shuts down the client's connection to the server, once
+// what's already been sent has been written; it returns Flush()'s
+// error, if any. Incoming stanzas which have already arrived may
+// still be delivered on Client.In, which will be closed once the
+// connection is gone. The client's goroutines all exit once the app
+// has drained Client.In. If the server isn't reading, Close() waits
+// only so long for the writes to finish before it closes the
+// connection anyway, and returns a *TimeoutError.
+func (cl *Client) Close() error {
+	timeout := time.NewTimer(cl.closeTimeout)
+	defer timeout.Stop()
+	err := cl.flush(timeout.C)
+	if _, ok := err.(*TimeoutError); ok {
+		cl.closeSocket()
+	}
+	select {
+	case cl.inputControl <- -1:
+	case <-cl.done:
+		return nil
+	}
+	return err
+}
+
+// CloseWrite ends our side of the stream, once what's already been
+// sent has been written, but leaves the connection open so the server
+// can finish sending. Client.In keeps delivering until the server
+// closes its side, and then the client shuts down as Close() would.
+// Afterwards, Send() returns ErrClosed, and nothing more is taken
+// from Client.Out.
+func (cl *Client) CloseWrite() error {
+	err := cl.Flush()
+	select {
+	case cl.inputControl <- 2:
+	case <-cl.done:
+		return nil
+	}
+	return err
+}
+
+// Flush blocks until the stanzas already sent on Client.Out, and
+// everything queued ahead of them, have been written to the socket.
+// It returns an error if the connection broke first, and ErrClosed if
+// the client has shut down.
+func (cl *Client) Flush() error {
+	return cl.flush(nil)
+}
+
+// Like Flush(), but gives up when timeout fires.
+func (cl *Client) flush(timeout <-chan time.Time) error {
+	f := make(flushRequest, 1)
+	select {
+	case cl.flushes <- f:
+	case <-cl.done:
+		return ErrClosed
+	case <-timeout:
+		return &TimeoutError{Op: "flush"}
+	}
+	select {
+	case err := <-f:
+		return err
+	case <-timeout:
+		return &TimeoutError{Op: "flush"}
+	}
+}
+
+// Close the connection to the server out from under the transport.
+func (cl *Client) closeSocket() {
+	cl.socketMu.Lock()
+	defer cl.socketMu.Unlock()
+	cl.socket.Close()
+}
+
+func (cl *Client) setSocket(sock net.Conn) {
+	cl.socketMu.Lock()
+	defer cl.socketMu.Unlock()
+	cl.socket = sock
+}
+
 // AddFilter adds a new filter to the top of the stack through which
 // incoming stanzas travel on their way up to the client. The new
 // filter's output channel is given to this function, and it returns a
@@ -334,3 +1578,20 @@ func (cl *Client) AddFilter(out <-chan Stanza) <-chan Stanza {
 	cl.filterOut <- out
 	return <-cl.filterIn
 }
+
+// AddFilterFunc adds a filter to the top of the stack, as AddFilter
+// does, that calls f with each incoming stanza in turn. f returns what
+// to pass on up, which may be st, a modified copy or another stanza
+// altogether, and false if nothing should be.
+func (cl *Client) AddFilterFunc(f func(st Stanza) (Stanza, bool)) {
+	out := make(chan Stanza)
+	in := cl.AddFilter(out)
+	go func(in <-chan Stanza, out chan<- Stanza) {
+		defer close(out)
+		for st := range in {
+			if st, ok := f(st); ok && st != nil {
+				out <- st
+			}
+		}
+	}(in, out)
+}
@@ -6,18 +6,31 @@ package xmpp
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/xml"
+	"errors"
+	"math/big"
+	"net"
+	"os"
 	"reflect"
+	"runtime"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestReadError(t *testing.T) {
 	r := strings.NewReader(`<stream:error><bad-foo xmlns="blah"/>` +
 		`</stream:error>`)
 	ch := make(chan interface{})
-	go readXml(r, ch, make(map[string]func(*xml.Name) interface{}))
+	go readXml(r, ch, make(map[string][]func(*xml.Name) interface{}), nil, nil, nil)
 	x := <-ch
 	se, ok := x.(*streamError)
 	if !ok {
@@ -33,7 +46,7 @@ func TestReadError(t *testing.T) {
 		`<text xml:lang="en" xmlns="` + NsStreams +
 		`">Error text</text></stream:error>`)
 	ch = make(chan interface{})
-	go readXml(r, ch, make(map[string]func(*xml.Name) interface{}))
+	go readXml(r, ch, make(map[string][]func(*xml.Name) interface{}), nil, nil, nil)
 	x = <-ch
 	se, ok = x.(*streamError)
 	if !ok {
@@ -51,7 +64,7 @@ func TestReadStream(t *testing.T) {
 		`xmlns="` + NsClient + `" xmlns:stream="` + NsStream +
 		`" version="1.0">`)
 	ch := make(chan interface{})
-	go readXml(r, ch, make(map[string]func(*xml.Name) interface{}))
+	go readXml(r, ch, make(map[string][]func(*xml.Name) interface{}), nil, nil, nil)
 	x := <-ch
 	ss, ok := x.(*stream)
 	if !ok {
@@ -64,20 +77,45 @@ func TestReadStream(t *testing.T) {
 }
 
 func testWrite(obj interface{}) string {
+	return testWriteFormat(xmlFormat{}, obj)
+}
+
+func testWriteFormat(format xmlFormat, objs ...interface{}) string {
 	w := bytes.NewBuffer(nil)
 	ch := make(chan interface{})
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		writeXml(w, ch)
+		writeXml(w, ch, nil, format)
 	}()
-	ch <- obj
+	for _, obj := range objs {
+		ch <- obj
+	}
 	close(ch)
 	wg.Wait()
 	return w.String()
 }
 
+func TestWriteNewlines(t *testing.T) {
+	m1 := &Message{Header: Header{To: "a@b.c", Id: "1"}}
+	m2 := &Message{Header: Header{To: "a@b.c", Id: "2"}}
+	exp := `<message xmlns="` + NsClient + `" to="a@b.c" id="1"></message>` +
+		`<message xmlns="` + NsClient + `" to="a@b.c" id="2"></message>`
+	assertEquals(t, exp, testWriteFormat(xmlFormat{}, m1, m2))
+
+	exp = `<message xmlns="` + NsClient + `" to="a@b.c" id="1"></message>` + "\n" +
+		`<message xmlns="` + NsClient + `" to="a@b.c" id="2"></message>` + "\n"
+	assertEquals(t, exp, testWriteFormat(xmlFormat{newlines: true}, m1, m2))
+
+	m1.Body = []*Generic{{XMLName: xml.Name{Local: "body"}, Chardata: "hi"}}
+	exp = `<message xmlns="` + NsClient + `" to="a@b.c" id="1">` + "\n" +
+		`  <body>hi</body>` + "\n" + `</message>` + "\n" +
+		`<message xmlns="` + NsClient + `" to="a@b.c" id="2"></message>` + "\n"
+	assertEquals(t, exp, testWriteFormat(xmlFormat{newlines: true,
+		indent: "  "}, m1, m2))
+}
+
 func TestWriteError(t *testing.T) {
 	se := &streamError{Any: Generic{XMLName: xml.Name{Local: "blah"}}}
 	str := testWrite(se)
@@ -100,3 +138,930 @@ func TestWriteStream(t *testing.T) {
 		` from="bar.com" id="42" xml:lang="en" version="1.0">`
 	assertEquals(t, exp, str)
 }
+
+// A fake XMPP server, connected to a Client through an in-memory
+// pipe. Tests script what the server says and inspect what the client
+// sends.
+type fakeServer struct {
+	t    *testing.T
+	conn net.Conn
+	in   chan *fakeElement
+}
+
+// A top-level element the client sent to the fake server. For
+// <stream:stream>, only the name and attributes are filled in.
+type fakeElement struct {
+	XMLName  xml.Name
+	Attr     []xml.Attr `xml:",any,attr"`
+	Innerxml string     `xml:",innerxml"`
+}
+
+// Create a Client connected to a fake server. The client's JID is
+// user@example.com/res.
+func newTestClient(t *testing.T) (*Client, *fakeServer) {
+	return newTestClientDial(t, nil)
+}
+
+// Like newTestClient, but the client will use dial if it needs to
+// reconnect.
+func newTestClientDial(t *testing.T, dial func() (net.Conn, error)) (*Client, *fakeServer) {
+	jid := &JID{Node: "user", Domain: "example.com", Resource: "res"}
+	c, s := net.Pipe()
+	srv := newFakeServer(t, s)
+	cl, err := newClient(c, dial, jid, "secret", nil)
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	return cl, srv
+}
+
+func newFakeServer(t *testing.T, conn net.Conn) *fakeServer {
+	srv := &fakeServer{t: t, conn: conn, in: make(chan *fakeElement, 100)}
+	go srv.read()
+	return srv
+}
+
+func (srv *fakeServer) read() {
+	defer close(srv.in)
+	dec := xml.NewDecoder(srv.conn)
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return
+		}
+		if ee, ok := t.(xml.EndElement); ok && ee.Name.Local == "stream" {
+			// Reported as an element named "/stream".
+			srv.in <- &fakeElement{XMLName: xml.Name{
+				Space: ee.Name.Space, Local: "/stream"}}
+			continue
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		el := &fakeElement{}
+		if se.Name.Local == "stream" {
+			el.XMLName = se.Name
+			el.Attr = se.Attr
+		} else if err := dec.DecodeElement(el, &se); err != nil {
+			return
+		}
+		srv.in <- el
+	}
+}
+
+// Return the next element the client sends.
+func (srv *fakeServer) next() *fakeElement {
+	select {
+	case el, ok := <-srv.in:
+		if !ok {
+			srv.t.Fatalf("client closed the connection")
+		}
+		return el
+	case <-time.After(5 * time.Second):
+		srv.t.Fatalf("timed out waiting for the client")
+	}
+	return nil
+}
+
+// Return the next element the client sends, which must have the
+// given local name.
+func (srv *fakeServer) expect(local string) *fakeElement {
+	el := srv.next()
+	if el.XMLName.Local != local {
+		srv.t.Fatalf("expected <%s>, got <%s>%s", local,
+			el.XMLName.Local, el.Innerxml)
+	}
+	return el
+}
+
+func (srv *fakeServer) send(str string) {
+	srv.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := srv.conn.Write([]byte(str)); err != nil {
+		srv.t.Fatalf("fake server write: %v", err)
+	}
+}
+
+// Wait for the client's stream header, and answer it with our own
+// and the given features.
+func (srv *fakeServer) open(features string) {
+	srv.expect("stream")
+	srv.send(`<stream:stream xmlns="` + NsClient + `" xmlns:stream="` +
+		NsStream + `" from="example.com" id="stream1" version="1.0">` +
+		`<stream:features>` + features + `</stream:features>`)
+}
+
+// Answer the client's resource binding request.
+func (srv *fakeServer) bind() {
+	iq := srv.expect("iq")
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `"><bind xmlns="` +
+		NsBind + `"><jid>user@example.com/res</jid></bind></iq>`)
+}
+
+func (el *fakeElement) attr(local string) string {
+	for _, a := range el.Attr {
+		if a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// Poll until f returns true, or fail after a few seconds.
+func waitFor(t *testing.T, f func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGenerateResource(t *testing.T) {
+	GenerateResource = true
+	defer func() { GenerateResource = false }()
+
+	jid := &JID{Node: "user", Domain: "example.com"}
+	c, s := net.Pipe()
+	srv := newFakeServer(t, s)
+	cl, err := newClient(c, nil, jid, "secret", nil)
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	defer cl.Close()
+	srv.open(bindFeatures)
+	iq := srv.expect("iq")
+	var b bindIq
+	if err := xml.Unmarshal([]byte(iq.Innerxml), &b); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	if b.Resource == nil {
+		t.Fatalf("no resource: %s", iq.Innerxml)
+	}
+	host, _ := os.Hostname()
+	host = strings.SplitN(host, ".", 2)[0]
+	if !strings.HasPrefix(*b.Resource, host+".") ||
+		len(*b.Resource) != len(host)+9 {
+		t.Errorf("resource: %s", *b.Resource)
+	}
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `"><bind xmlns="` +
+		NsBind + `"><jid>user@example.com/` + *b.Resource +
+		`</jid></bind></iq>`)
+	<-cl.Bound()
+
+	// Without it, the server picks.
+	GenerateResource = false
+	jid = &JID{Node: "user", Domain: "example.com"}
+	c, s = net.Pipe()
+	srv = newFakeServer(t, s)
+	cl2, err := newClient(c, nil, jid, "secret", nil)
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	defer cl2.Close()
+	srv.open(bindFeatures)
+	iq = srv.expect("iq")
+	assertEquals(t, `<bind xmlns="`+NsBind+`"></bind>`, iq.Innerxml)
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `"><bind xmlns="` +
+		NsBind + `"><jid>user@example.com/server</jid></bind></iq>`)
+	<-cl2.Bound()
+}
+
+func TestNewClientConn(t *testing.T) {
+	jid := &JID{Node: "user", Domain: "example.com", Resource: "res"}
+	c, s := net.Pipe()
+	srv := newFakeServer(t, s)
+	cl, err := NewClientConn(c, jid, "secret", nil)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+	<-cl.Bound()
+	assertEquals(t, "user@example.com/res", cl.Jid.String())
+}
+
+func TestDirectTls(t *testing.T) {
+	cert := testCertificate(t)
+	TlsConfig.InsecureSkipVerify = true
+	defer func() { TlsConfig.InsecureSkipVerify = false }()
+
+	c, s := net.Pipe()
+	// The server handshakes before anything else is said.
+	srvConn := tls.Server(s, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MaxVersion:   tls.VersionTLS12})
+	handshake := make(chan error, 1)
+	go func() { handshake <- srvConn.Handshake() }()
+	conn, err := startDirectTls(context.Background(), c, "example.com")
+	if err != nil {
+		t.Fatalf("startDirectTls: %v", err)
+	}
+	if err := <-handshake; err != nil {
+		t.Fatalf("server handshake: %v", err)
+	}
+
+	srv := newFakeServer(t, srvConn)
+	jid := &JID{Node: "user", Domain: "example.com", Resource: "res"}
+	cl, err := newClient(conn, nil, jid, "secret", nil)
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	defer cl.Close()
+	// It doesn't ask for TLS again, and has channel binding.
+	srv.open(`<starttls xmlns="` + NsTLS + `"/>` +
+		`<mechanisms xmlns="` + NsSASL + `">` +
+		`<mechanism>SCRAM-SHA-1-PLUS</mechanism></mechanisms>`)
+	auth := srv.expect("auth")
+	assertEquals(t, "SCRAM-SHA-1-PLUS", auth.attr("mechanism"))
+	srv.send(`<failure xmlns="` + NsSASL + `"><not-authorized/></failure>`)
+}
+
+func TestIsEncrypted(t *testing.T) {
+	cert := testCertificate(t)
+	TlsConfig.InsecureSkipVerify = true
+	defer func() { TlsConfig.InsecureSkipVerify = false }()
+
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<starttls xmlns="` + NsTLS + `"/>`)
+	srv.expect("starttls")
+	if cl.IsEncrypted() {
+		t.Error("encrypted before TLS")
+	}
+	srv = srv.startTls(cert)
+	srv.open(`<mechanisms xmlns="` + NsSASL + `">` +
+		`<mechanism>SCRAM-SHA-1</mechanism></mechanisms>`)
+	if !cl.IsEncrypted() {
+		t.Error("not encrypted after TLS")
+	}
+	srv.expect("auth")
+	srv.send(`<failure xmlns="` + NsSASL + `"><not-authorized/></failure>`)
+}
+
+func TestPhase(t *testing.T) {
+	cert := testCertificate(t)
+	TlsConfig.InsecureSkipVerify = true
+	defer func() { TlsConfig.InsecureSkipVerify = false }()
+
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<starttls xmlns="` + NsTLS + `"/>`)
+	srv.expect("starttls")
+	srv = srv.startTls(cert)
+	srv.open(`<mechanisms xmlns="` + NsSASL + `">` +
+		`<mechanism>PLAIN</mechanism></mechanisms>`)
+	srv.expect("auth")
+	srv.send(`<success xmlns="` + NsSASL + `"/>`)
+	srv.open(sessionFeatures)
+	srv.bind()
+	errs := make(chan error)
+	go func() {
+		errs <- cl.StartSession(false, nil)
+	}()
+	srv.session()
+	if err := <-errs; err != nil {
+		t.Fatalf("StartSession: %v", err)
+	}
+
+	for _, exp := range []Phase{TCPConnected, TLSNegotiated,
+		Authenticated, Bound, SessionStarted} {
+		select {
+		case p := <-cl.Phase():
+			assertEquals(t, exp.String(), p.String())
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s", exp)
+		}
+	}
+}
+
+// A jabber:iq:version reply, XEP-0092.
+type testVersion struct {
+	XMLName xml.Name `xml:"jabber:iq:version query"`
+	Name    string   `xml:"name,omitempty"`
+	Version string   `xml:"version,omitempty"`
+}
+
+func TestQuery(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	var v testVersion
+	errs := make(chan error)
+	go func() {
+		errs <- cl.Query("example.com", "get", &testVersion{}, &v)
+	}()
+	iq := srv.expect("iq")
+	assertEquals(t, "get", iq.attr("type"))
+	assertEquals(t, "example.com", iq.attr("to"))
+	assertEquals(t, `<query xmlns="jabber:iq:version"></query>`, iq.Innerxml)
+	srv.send(`<iq type="result" from="example.com" id="` + iq.attr("id") +
+		`"><query xmlns="jabber:iq:version"><name>Server</name>` +
+		`<version>1.2</version></query></iq>`)
+	if err := <-errs; err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	assertEquals(t, "Server", v.Name)
+	assertEquals(t, "1.2", v.Version)
+
+	// Errors are stanza errors.
+	go func() {
+		errs <- cl.Query("example.com", "get", &testVersion{}, &v)
+	}()
+	iq = srv.expect("iq")
+	srv.send(`<iq type="error" from="example.com" id="` + iq.attr("id") +
+		`"><error type="cancel"><service-unavailable xmlns="` +
+		NsStanzas + `"/></error></iq>`)
+	var se *StanzaError
+	if err := <-errs; !errors.As(err, &se) {
+		t.Fatalf("not a stanza error: %v", err)
+	}
+	assertEquals(t, "service-unavailable", se.Condition)
+
+	// So is a reply without what we asked for.
+	go func() {
+		errs <- cl.Query("example.com", "get", &testVersion{}, &v)
+	}()
+	iq = srv.expect("iq")
+	srv.send(`<iq type="result" from="example.com" id="` +
+		iq.attr("id") + `"/>`)
+	if err := <-errs; err == nil {
+		t.Error("no error for an empty reply")
+	}
+}
+
+// Answer the client's session establishment request.
+func (srv *fakeServer) session() {
+	iq := srv.expect("iq")
+	if !strings.Contains(iq.Innerxml, NsSession) {
+		srv.t.Fatalf("not a session request: %s", iq.Innerxml)
+	}
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `"/>`)
+}
+
+func TestStartSessionNoRoster(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(sessionFeatures)
+	srv.bind()
+
+	errs := make(chan error)
+	go func() {
+		errs <- cl.StartSession(false, &Presence{})
+	}()
+	srv.session()
+
+	// The next thing sent is the initial presence, not a roster
+	// request.
+	srv.expect("presence")
+	if err := <-errs; err != nil {
+		t.Fatalf("StartSession: %v", err)
+	}
+	if r := Roster(cl); len(r) != 0 {
+		t.Errorf("roster: %v", r)
+	}
+}
+
+func TestStartSessionNotRequired(t *testing.T) {
+	for _, features := range []string{bindFeatures,
+		bindFeatures + `<session xmlns="` + NsSession + `">` +
+			`<optional/></session>`} {
+		cl, srv := newTestClient(t)
+		srv.open(features)
+		srv.bind()
+
+		errs := make(chan error)
+		go func() {
+			errs <- cl.StartSession(false, &Presence{})
+		}()
+		// Straight to the initial presence, with no session
+		// request.
+		srv.expect("presence")
+		if err := <-errs; err != nil {
+			t.Fatalf("StartSession: %v", err)
+		}
+		started := false
+		for !started {
+			select {
+			case p := <-cl.Phase():
+				started = p == SessionStarted
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no %s", SessionStarted)
+			}
+		}
+		cl.Close()
+	}
+}
+
+func TestSessionTimeout(t *testing.T) {
+	SessionTimeout = 50 * time.Millisecond
+	defer func() { SessionTimeout = 30 * time.Second }()
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(sessionFeatures)
+	srv.bind()
+
+	errs := make(chan error)
+	go func() {
+		errs <- cl.StartSession(true, &Presence{})
+	}()
+	// The server never answers.
+	iq := srv.expect("iq")
+	var to *TimeoutError
+	if err := <-errs; !errors.As(err, &to) {
+		t.Fatalf("not a timeout: %#v", err)
+	}
+	// The handler's gone, so a late answer goes to the app.
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `"/>`)
+	st := <-cl.In
+	if st.GetHeader().Id != iq.attr("id") {
+		t.Errorf("expected the late answer, got %v", st)
+	}
+}
+
+func TestRosterTimeout(t *testing.T) {
+	SessionTimeout = 50 * time.Millisecond
+	defer func() { SessionTimeout = 30 * time.Second }()
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(sessionFeatures)
+	srv.bind()
+
+	errs := make(chan error)
+	go func() {
+		errs <- cl.StartSession(true, &Presence{})
+	}()
+	srv.session()
+	// The server never sends the roster.
+	iq := srv.expect("iq")
+	if !strings.Contains(iq.Innerxml, NsRoster) {
+		t.Fatalf("not a roster request: %s", iq.Innerxml)
+	}
+	var to *TimeoutError
+	if err := <-errs; !errors.As(err, &to) {
+		t.Fatalf("not a timeout: %#v", err)
+	}
+	assertEquals(t, "roster fetch", to.Op)
+}
+
+// Answer the client's <starttls/> and negotiate TLS. Returns the fake
+// server for the encrypted stream.
+func (srv *fakeServer) startTls(cert tls.Certificate) *fakeServer {
+	srv.proceed()
+	conn := tls.Server(srv.conn, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MaxVersion:   tls.VersionTLS12})
+	if err := conn.Handshake(); err != nil {
+		srv.t.Fatalf("TLS handshake: %v", err)
+	}
+	return newFakeServer(srv.t, conn)
+}
+
+// Tell the client to go ahead with STARTTLS.
+func (srv *fakeServer) proceed() {
+	// Stop our reader before it consumes the TLS handshake.
+	srv.conn.SetReadDeadline(time.Now())
+	for _ = range srv.in {
+	}
+	srv.conn.SetReadDeadline(time.Time{})
+	srv.send(`<proceed xmlns="` + NsTLS + `"/>`)
+}
+
+func TestTlsMinVersion(t *testing.T) {
+	cert := testCertificate(t)
+	TlsConfig.InsecureSkipVerify = true
+	defer func() { TlsConfig.InsecureSkipVerify = false }()
+
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<starttls xmlns="` + NsTLS + `"/>`)
+	srv.expect("starttls")
+	srv.proceed()
+	conn := tls.Server(srv.conn, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS10,
+		MaxVersion:   tls.VersionTLS10})
+	if err := conn.Handshake(); err == nil {
+		t.Fatal("client accepted TLS 1.0")
+	}
+	var te *TransportError
+	if err := nextError(t, cl); !errors.As(err, &te) {
+		t.Fatalf("error: %v", err)
+	}
+	if cl.IsEncrypted() {
+		t.Error("encrypted")
+	}
+	select {
+	case <-cl.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client carried on")
+	}
+}
+
+// A server that hangs up after <proceed/> mustn't leave the client
+// waiting for a reader that's already gone.
+func TestTlsProceedHangUp(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(`<starttls xmlns="` + NsTLS + `"/>`)
+	srv.expect("starttls")
+	srv.proceed()
+	srv.conn.Close()
+	closed := make(chan bool)
+	go func() {
+		for _ = range cl.In {
+		}
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client.In still open")
+	}
+}
+
+func TestTlsConfig(t *testing.T) {
+	config := tlsConfig("example.com")
+	assertEquals(t, "example.com", config.ServerName)
+	if config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("MinVersion %x", config.MinVersion)
+	}
+
+	TlsConfig.ServerName = "xmpp.example.com"
+	TlsConfig.MinVersion = tls.VersionTLS13
+	TLSCipherSuites = []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	defer func() {
+		TlsConfig = tls.Config{}
+		TLSCipherSuites = nil
+	}()
+	config = tlsConfig("example.com")
+	assertEquals(t, "xmpp.example.com", config.ServerName)
+	if config.MinVersion != tls.VersionTLS13 {
+		t.Errorf("MinVersion %x", config.MinVersion)
+	}
+	if len(config.CipherSuites) != 1 {
+		t.Errorf("CipherSuites %v", config.CipherSuites)
+	}
+}
+
+// Make a self-signed certificate for the fake server.
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("key: %v", err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1),
+		Subject:   pkix.Name{CommonName: "example.com"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+		DNSNames:  []string{"example.com"}}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestBound(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+
+	iq := srv.expect("iq")
+	select {
+	case <-cl.Bound():
+		t.Fatal("bound before the server answered")
+	default:
+	}
+	if _, ok := cl.BoundJID(); ok {
+		t.Fatal("BoundJID ok before the server answered")
+	}
+	srv.send(`<iq type="result" id="` + iq.attr("id") + `"><bind xmlns="` +
+		NsBind + `"><jid>user@example.com/assigned</jid></bind></iq>`)
+	select {
+	case <-cl.Bound():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not bound")
+	}
+	jid, ok := cl.BoundJID()
+	if !ok {
+		t.Fatal("BoundJID not ok")
+	}
+	assertEquals(t, "user@example.com/assigned", jid.String())
+}
+
+func TestDirectedPresence(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	cl.SendDirectedPresence("room@muc.example.com/nick", &Presence{})
+	pr := srv.expect("presence")
+	assertEquals(t, "room@muc.example.com/nick", pr.attr("to"))
+	assertEquals(t, "", pr.attr("type"))
+	cl.SendDirectedPresence("other@example.com/res", &Presence{})
+	srv.expect("presence")
+	cl.SendDirectedPresence("other@example.com/res",
+		&Presence{Header: Header{Type: "unavailable"}})
+	srv.expect("presence")
+
+	// Only the room is still owed an unavailable.
+	cl.Close()
+	pr = srv.expect("presence")
+	assertEquals(t, "room@muc.example.com/nick", pr.attr("to"))
+	assertEquals(t, "unavailable", pr.attr("type"))
+	select {
+	case el, ok := <-srv.in:
+		if ok {
+			t.Errorf("unexpected <%s>", el.XMLName.Local)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("connection not closed")
+	}
+}
+
+func TestStanzaError(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	errs := make(chan error)
+	go func() {
+		_, err := cl.DiscoInfo("nobody@example.com", "")
+		errs <- err
+	}()
+	iq := srv.expect("iq")
+	srv.send(`<iq type="error" id="` + iq.attr("id") + `">` +
+		`<error type="cancel"><item-not-found xmlns="` + NsStanzas +
+		`"/><text xmlns="` + NsStanzas + `">No such user</text>` +
+		`</error></iq>`)
+	err := <-errs
+	var se *StanzaError
+	if !errors.As(err, &se) {
+		t.Fatalf("not a stanza error: %#v", err)
+	}
+	assertEquals(t, "cancel", se.Type)
+	assertEquals(t, "item-not-found", se.Condition)
+	assertEquals(t, "No such user", se.Text)
+	var e *Error
+	if !errors.As(err, &e) || e != se.Err {
+		t.Errorf("no error element: %#v", err)
+	}
+	var te *TransportError
+	if errors.As(err, &te) {
+		t.Errorf("stanza error is a transport error")
+	}
+}
+
+func TestDialError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	l.Close()
+
+	jid := &JID{Node: "user", Domain: "example.com"}
+	_, err = NewClientFromHost(jid, "secret", nil, "127.0.0.1", addr.Port)
+	var te *TransportError
+	if !errors.As(err, &te) {
+		t.Fatalf("not a transport error: %#v", err)
+	}
+	var se *StanzaError
+	if errors.As(err, &se) {
+		t.Errorf("transport error is a stanza error")
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	DialTimeout = 200 * time.Millisecond
+	defer func() { DialTimeout = 30 * time.Second }()
+
+	// Nothing answers at this address, from TEST-NET-1.
+	jid := &JID{Node: "user", Domain: "example.com"}
+	start := time.Now()
+	_, err := NewClientFromHost(jid, "secret", nil, "192.0.2.1", 5222)
+	if err == nil {
+		t.Fatal("connected to an unroutable address")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("took %s", d)
+	}
+	var te *TransportError
+	var to *TimeoutError
+	if !errors.As(err, &te) && !errors.As(err, &to) {
+		t.Errorf("not a network error: %#v", err)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	HandshakeTimeout = 50 * time.Millisecond
+	defer func() { HandshakeTimeout = 30 * time.Second }()
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	// The server never finishes negotiating.
+	srv.open(bindFeatures)
+	srv.expect("iq")
+
+	var to *TimeoutError
+	if err := nextError(t, cl); !errors.As(err, &to) {
+		t.Fatalf("not a timeout: %#v", err)
+	}
+	for _ = range cl.In {
+	}
+}
+
+func TestHandshakeTimeoutStopped(t *testing.T) {
+	HandshakeTimeout = 50 * time.Millisecond
+	defer func() { HandshakeTimeout = 30 * time.Second }()
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	time.Sleep(100 * time.Millisecond)
+	if err := cl.Send(&Message{Header: Header{To: "a@b.c", Id: "later"}}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assertEquals(t, "later", srv.expect("message").attr("id"))
+}
+
+func TestFlush(t *testing.T) {
+	cl, srv := newTestClient(t)
+	srv.open(bindFeatures)
+	srv.bind()
+
+	cl.Out <- &Message{Header: Header{To: "alice@example.com",
+		Id: "last"}}
+	if err := cl.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	cl.Close()
+	msg := srv.expect("message")
+	assertEquals(t, "last", msg.attr("id"))
+	if err := cl.Flush(); err != ErrClosed {
+		t.Errorf("Flush after Close: %v", err)
+	}
+}
+
+// A server that stops reading can't hold up Close().
+func TestCloseStalled(t *testing.T) {
+	old := closeFlushTimeout
+	closeFlushTimeout = 100 * time.Millisecond
+	defer func() { closeFlushTimeout = old }()
+	jid := &JID{Node: "user", Domain: "example.com", Resource: "res"}
+	c, s := net.Pipe()
+	defer s.Close()
+	cl, err := newClient(c, nil, jid, "secret", nil)
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+
+	// Nobody reads the stream header.
+	errs := make(chan error)
+	go func() {
+		errs <- cl.Close()
+	}()
+	select {
+	case err := <-errs:
+		var te *TimeoutError
+		if !errors.As(err, &te) {
+			t.Errorf("Close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close hung")
+	}
+	for _ = range cl.In {
+	}
+}
+
+// A connection whose writes fail once it's broken.
+type failingConn struct {
+	net.Conn
+	mu     sync.Mutex
+	broken bool
+}
+
+func (fc *failingConn) Write(p []byte) (int, error) {
+	fc.mu.Lock()
+	broken := fc.broken
+	fc.mu.Unlock()
+	if broken {
+		return 0, errors.New("broken pipe")
+	}
+	return fc.Conn.Write(p)
+}
+
+func TestWriteFailure(t *testing.T) {
+	jid := &JID{Node: "user", Domain: "example.com", Resource: "res"}
+	c, s := net.Pipe()
+	conn := &failingConn{Conn: c}
+	srv := newFakeServer(t, s)
+	cl, err := newClient(conn, nil, jid, "secret", nil)
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	conn.mu.Lock()
+	conn.broken = true
+	conn.mu.Unlock()
+	cl.Out <- &Message{Header: Header{To: "alice@example.com"}}
+	select {
+	case err := <-cl.Errors():
+		te, ok := err.(*TransportError)
+		if !ok {
+			t.Fatalf("not a TransportError: %v", err)
+		}
+		assertEquals(t, "write", te.Op)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write error not reported")
+	}
+
+	// The client shuts down, so sends soon fail rather than
+	// hanging.
+	errs := make(chan error)
+	go func() {
+		for {
+			err := cl.Send(&Message{Header: Header{To: "alice@example.com"}})
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-errs:
+		if err != ErrClosed {
+			t.Errorf("Send: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send blocked")
+	}
+}
+
+func TestCloseGoroutines(t *testing.T) {
+	base := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		cl, srv := newTestClient(t)
+		srv.open(bindFeatures)
+		srv.bind()
+		cl.Close()
+		for _ = range cl.In {
+		}
+		if r := Roster(cl); r != nil {
+			t.Errorf("roster after Close: %v", r)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > base {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("%d goroutines, was %d:\n%s",
+				runtime.NumGoroutine(), base, buf)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNextId(t *testing.T) {
+	cl, srv := newTestClient(t)
+	defer cl.Close()
+	srv.open(bindFeatures)
+	srv.bind()
+
+	const callers, each = 10, 1000
+	ids := make(chan string, callers*each)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				ids <- cl.NextId()
+			}
+		}()
+	}
+	// The old channel draws from the same sequence.
+	old := <-Id
+	wg.Wait()
+	close(ids)
+
+	seen := map[string]bool{old: true}
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("duplicate %s", id)
+		}
+		seen[id] = true
+	}
+}